@@ -1,6 +1,7 @@
 import React, { Component } from 'react';
 import Errors from '../../../Errors/Errors';
 import api from '../../../../Constants/APIEndpoints/APIEndpoints';
+import errorMessage from '../../../../Constants/Errors/Errors';
 import PageTypes from '../../../../Constants/PageTypes/PageTypes';
 
 class ForgotPassword extends Component {
@@ -28,7 +29,7 @@ class ForgotPassword extends Component {
             })
         });
         if (response.status >= 300) {
-            const error = await response.text();
+            const error = await errorMessage(response);
             this.setError(error);
             return;
         }
@@ -49,7 +50,7 @@ class ForgotPassword extends Component {
             })
         });
         if (response.status >= 300) {
-            const error = await response.text();
+            const error = await errorMessage(response);
             this.setError(error);
             return;
         }
@@ -2,6 +2,7 @@ import React, { Component } from 'react';
 import PropTypes from 'prop-types';
 import SignForm from '../SignForm/SignForm';
 import api from '../../../../Constants/APIEndpoints/APIEndpoints';
+import errorMessage from '../../../../Constants/Errors/Errors';
 import Errors from '../../../Errors/Errors';
 import PageTypes from '../../../../Constants/PageTypes/PageTypes';
 import { Button, Layout, Menu, Breadcrumb, Modal, Input } from 'antd';
@@ -114,7 +115,7 @@ class SignInNew extends Component {
             })
         });
         if (response.status >= 300) {
-            const error = await response.text();
+            const error = await errorMessage(response);
             this.setError(error);
             return;
         }
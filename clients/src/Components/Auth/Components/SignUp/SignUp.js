@@ -8,6 +8,14 @@ import { Button, Layout, Menu, Breadcrumb, Modal, Input } from 'antd';
 
 const { Header, Content, Footer } = Layout;
 
+// newIdempotencyKey returns a random key for a request, sent again when the request
+// is retried so the gateway replays the first response instead of repeating it
+const newIdempotencyKey = () => {
+    const bytes = new Uint8Array(16);
+    window.crypto.getRandomValues(bytes);
+    return Array.from(bytes, (b) => b.toString(16).padStart(2, "0")).join("");
+};
+
 /**
  * @class
  * @classdesc SignUp handles the sign up component
@@ -56,12 +64,16 @@ class SignUp extends Component {
                 name: "Password Confirmation",
                 key: "passwordConf"
             }];
+
+        // submitting the same form again retries its requests with the same keys
+        this.idempotencyKeys = null;
     }
 
     /**
      * @description setField will set the field for the provided argument
      */
     setField = (e) => {
+        this.idempotencyKeys = null;
         this.setState({ [e.target.name]: e.target.value });
     }
 
@@ -92,13 +104,18 @@ class SignUp extends Component {
             passwordConf
         };
 
+        if (!this.idempotencyKeys) {
+            this.idempotencyKeys = { user: newIdempotencyKey(), dashboard: newIdempotencyKey() };
+        }
+
         let token;
 
         const f1 = await fetch(api.base + api.handlers.users, {
             method: "POST",
             body: JSON.stringify(sendData),
             headers: new Headers({
-                "Content-Type": "application/json"
+                "Content-Type": "application/json",
+                "Idempotency-Key": this.idempotencyKeys.user
             })
         }).then((response) => {
             const authToken = response.headers.get("Authorization")
@@ -121,7 +138,7 @@ class SignUp extends Component {
                 state1: "Ohio",
                 filter: "Tested"
             },
-            private:"false"
+            private: false
         }
 
         const f2 = await fetch(api.base + api.handlers.dashboard, {
@@ -129,7 +146,8 @@ class SignUp extends Component {
             body: JSON.stringify(postBody),
             headers: new Headers({
                 "Content-Type": "application/json",
-                "Authorization": token
+                "Authorization": token,
+                "Idempotency-Key": this.idempotencyKeys.dashboard
             })
         }).then((response) => {
             const authToken = localStorage.getItem("Authorization");
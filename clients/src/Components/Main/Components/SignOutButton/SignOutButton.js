@@ -1,6 +1,7 @@
 import React, { useState } from 'react';
 import PropTypes from 'prop-types';
 import api from '../../../../Constants/APIEndpoints/APIEndpoints';
+import errorMessage from '../../../../Constants/Errors/Errors';
 import Errors from '../../../Errors/Errors';
 import { Button } from 'antd';
 
@@ -16,7 +17,7 @@ const SignOutButton = ({ setAuthToken, setUser }) => {
             })
         });
         if (response.status >= 300) {
-            const error = await response.text();
+            const error = await errorMessage(response);
             setError(error);
             return;
         }
@@ -1,5 +1,6 @@
 import React, { Component } from 'react';
 import api from '../../../../Constants/APIEndpoints/APIEndpoints';
+import errorMessage from '../../../../Constants/Errors/Errors';
 import Errors from '../../../Errors/Errors';
 
 class UpdateAvatar extends Component {
@@ -24,7 +25,7 @@ class UpdateAvatar extends Component {
             })
         });
         if (response.status >= 300) {
-            const error = await response.text();
+            const error = await errorMessage(response);
             this.setError(error);
             return;
         }
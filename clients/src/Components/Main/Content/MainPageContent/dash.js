@@ -3,6 +3,7 @@ import * as d3 from 'd3';
 import { Input, Switch, Menu, Dropdown } from 'antd';
 import * as topojson from "topojson-client";
 import api from '../../../../Constants/APIEndpoints/APIEndpoints';
+import errorMessage from '../../../../Constants/Errors/Errors';
 
 /* Component */
 const MyD3Component = ({ dashInfo, stateParam, state1Param, filterParam, privateParam, owner }) => {
@@ -216,7 +217,7 @@ const MyD3Component = ({ dashInfo, stateParam, state1Param, filterParam, private
             })
         });
         if (response.status >= 300) {
-            const error = await response.text();
+            const error = await errorMessage(response);
             return;
         }
     }
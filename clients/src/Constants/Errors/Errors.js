@@ -0,0 +1,17 @@
+/**
+ * @description errorMessage returns the message of an error response to show the user:
+ * the detail of the problem the gateway describes in application/problem+json,
+ * or the body as it is for other responses
+ */
+export default async function errorMessage(response) {
+    const body = await response.text();
+    const contentType = response.headers.get("Content-Type") || "";
+    if (!contentType.startsWith("application/problem+json")) {
+        return body;
+    }
+    try {
+        return JSON.parse(body).detail || body;
+    } catch (e) {
+        return body;
+    }
+}
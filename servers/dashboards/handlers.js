@@ -1,3 +1,5 @@
+const { publish } = require('./live')
+
 const allDashHandler = async (req, res, { Dashboard }) => {
     try {
         const allDashboards = await Dashboard.find({"private":false})
@@ -122,6 +124,8 @@ const specificDashPatchHandler = async (req, res, { Dashboard }, user) => {
             },
             {new: true}
         )
+        // tell the dashboard's viewers to fetch it again
+        publish(`dashboard:${updatedDash._id}`, { action: "updated", editedAt: updatedDash.editedAt })
         res.set('Content-Type', 'application/json')
         res.status(201).json(updatedDash)
 
@@ -146,6 +150,7 @@ const dataDelHandler = async (req, res, { CountriesCovid }) => {
     try {
         const query = CountriesCovid.where({})
         data = await query.remove()
+        publish("data", { action: "removed" })
         res.send("successfully removed")
     } catch(e) {
         res.status(500).send('internal server error')
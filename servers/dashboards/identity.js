@@ -0,0 +1,69 @@
+const crypto = require('crypto');
+const fs = require('fs');
+
+// header the gateway sends signed identity assertions in
+const IDENTITY_HEADER = "X-User-Assertion"
+// DER prefix turning a raw 32 byte Ed25519 public key into an SPKI key
+const ED25519_SPKI_PREFIX = Buffer.from("302a300506032b6570032100", "hex")
+// allowance for clocks differing between the gateway and this service, in seconds
+const LEEWAY = 30
+
+// loadIdentityKeys reads the gateway's key file, in the format of the gateway's
+// identity.ParseKeys, keeping the keys assertions can be verified with by key ID
+const loadIdentityKeys = (path) => {
+    const file = JSON.parse(fs.readFileSync(path))
+    const keys = {}
+    for (const key of file.keys) {
+        if (key.alg === "HS256") {
+            keys[key.kid] = { alg: key.alg, secret: Buffer.from(key.secret, "base64") }
+        } else if (key.alg === "EdDSA") {
+            const publicKey = crypto.createPublicKey({
+                key: Buffer.concat([ED25519_SPKI_PREFIX, Buffer.from(key.publicKey, "base64")]),
+                format: "der",
+                type: "spki"
+            })
+            keys[key.kid] = { alg: key.alg, publicKey }
+        } else {
+            throw new Error(`key ${key.kid}: unknown algorithm ${key.alg}`)
+        }
+    }
+    return keys
+}
+
+// verifyAssertion checks the signature and expiry of an identity assertion,
+// returning its claims, or null if it is not valid
+const verifyAssertion = (keys, assertion) => {
+    try {
+        const parts = (assertion || "").split(".")
+        if (parts.length !== 3) {
+            return null
+        }
+        const header = JSON.parse(Buffer.from(parts[0], "base64"))
+        const key = keys[header.kid]
+        // the algorithm is the key's, whatever the header says
+        if (!key || header.alg !== key.alg) {
+            return null
+        }
+        const signed = Buffer.from(parts[0] + "." + parts[1])
+        const sig = Buffer.from(parts[2], "base64")
+        let valid
+        if (key.alg === "HS256") {
+            const expected = crypto.createHmac("sha256", key.secret).update(signed).digest()
+            valid = expected.length === sig.length && crypto.timingSafeEqual(expected, sig)
+        } else {
+            valid = crypto.verify(null, signed, key.publicKey, sig)
+        }
+        if (!valid) {
+            return null
+        }
+        const claims = JSON.parse(Buffer.from(parts[1], "base64"))
+        if (Date.now() / 1000 >= claims.exp + LEEWAY) {
+            return null
+        }
+        return claims
+    } catch (err) {
+        return null
+    }
+}
+
+module.exports = { IDENTITY_HEADER, loadIdentityKeys, verifyAssertion }
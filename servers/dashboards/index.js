@@ -1,5 +1,6 @@
 const mongoose = require('mongoose');
 const express = require('express');
+const morgan = require('morgan');
 const axios = require('axios').default;
 // global.fetch = require("node-fetch");
 
@@ -15,9 +16,12 @@ const {
     dataGetHandler,
     dataDelHandler
 } = require('./handlers')
+const { IDENTITY_HEADER, loadIdentityKeys, verifyAssertion } = require('./identity')
 const mongoEndpoint = process.env.MONGO_ENDPOINT
 // TODO: port and endpoint in mongo
 const port = process.env.DASHBOARDPORT;
+// keys of the gateway's identity assertions
+const identityKeys = loadIdentityKeys(process.env.IDENTITYKEYS);
 
 const CountriesCovid = mongoose.model("CountriesCovid", countriesCovidSchema)
 const Dashboard = mongoose.model("Dashboard", dashboardSchema)
@@ -25,6 +29,16 @@ const Dashboard = mongoose.model("Dashboard", dashboardSchema)
 
 const app = express();
 app.use(express.json());
+// one JSON line per request, carrying the gateway's request ID so the
+// line can be matched with the gateway's access log line
+app.use(morgan((tokens, req, res) => JSON.stringify({
+    time: tokens.date(req, res, 'iso'),
+    requestId: req.get('X-Request-ID'),
+    method: tokens.method(req, res),
+    path: req.path,
+    status: Number(tokens.status(req, res)),
+    latencyMs: Number(tokens['response-time'](req, res)),
+})));
 
 const connect = () => {
     mongoose.connect(mongoEndpoint, { useFindAndModify: false });
@@ -38,18 +52,15 @@ mongoose.connection.on('error', console.error)
     .once('open', main);
 
 
-// wrapper for handlers, ensures X-User is valid
+// wrapper for handlers, ensures the gateway signed the identity assertion
 const RequestWrapper = (handler, SchemeAndDBForwarder) => {
     return (req, res) => {
-        let user;
-
-        try {
-            user = JSON.parse(req.get("X-User"))
-        } catch (err) {
+        const claims = verifyAssertion(identityKeys, req.get(IDENTITY_HEADER))
+        if (!claims || !claims.user) {
             res.status(401).send("Unauthorized")
             return
-        }   
-        handler(req, res, SchemeAndDBForwarder, user);
+        }
+        handler(req, res, SchemeAndDBForwarder, claims.user);
     }
 };
 
@@ -63,6 +74,17 @@ const methodNotAllowedHandler = (req, res) => {
     res.status(405).send("method not allowed")
 }
 
+// /health - the gateway's health checks, answered while mongo is connected
+app.route("/health")
+    .get((req, res) => {
+        if (mongoose.connection.readyState !== 1) {
+            res.status(503).send("mongo is not connected")
+            return
+        }
+        res.send("ok")
+    })
+    .all(methodNotAllowedHandler)
+
 // /v1/dashboards
 app.route("/v1/dashboards")
     // get - get all dashboards that are not private and respond to user with dashboard info as JSON array
@@ -0,0 +1,33 @@
+const axios = require('axios').default;
+
+// the gateway's endpoint for publishing live events, and this service's
+// credentials for it, as name:secret
+const LIVE_PUBLISH_URL = process.env.LIVEPUBLISHURL
+const LIVE_PUBLISH_CREDENTIALS = process.env.LIVEPUBLISHCREDENTIALS || ""
+// how long to wait for the gateway, in milliseconds
+const PUBLISH_TIMEOUT = 2000
+
+// publish tells the gateway's live subscribers of the topic, such as
+// "dashboard:<id>", what happened to it. Events only say what changed, never
+// what it changed to, as anyone may subscribe to a topic; subscribers fetch
+// the change through the API, which checks they may see it. Publishing is
+// best effort, so a failure is logged rather than failing the request.
+const publish = async (topic, data) => {
+    if (!LIVE_PUBLISH_URL) {
+        return
+    }
+    const separator = LIVE_PUBLISH_CREDENTIALS.indexOf(":")
+    try {
+        await axios.post(LIVE_PUBLISH_URL, { topic, data }, {
+            auth: {
+                username: LIVE_PUBLISH_CREDENTIALS.slice(0, separator),
+                password: LIVE_PUBLISH_CREDENTIALS.slice(separator + 1)
+            },
+            timeout: PUBLISH_TIMEOUT
+        })
+    } catch (e) {
+        console.error(`error publishing live event to ${topic}: ${e.message}`)
+    }
+}
+
+module.exports = { publish }
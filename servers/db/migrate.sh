@@ -0,0 +1,9 @@
+# applies the migrations to the database of a running container, such as
+# mysqlContainer, for databases created from an older schema.sql
+export MYSQL_ROOT_PASSWORD="qazwsx"
+container=${1:-mysqlContainer}
+
+for migration in migrations/*.sql; do
+    echo "applying $migration"
+    docker exec -i $container mysql -uroot -p$MYSQL_ROOT_PASSWORD demo < $migration || exit 1
+done
@@ -0,0 +1,20 @@
+-- adds the device column to userLog and widens clientIP to fit IPv6 addresses,
+-- for databases created before schema.sql had them; safe to run more than once
+drop procedure if exists migrate_userlog_device;
+
+delimiter //
+create procedure migrate_userlog_device()
+begin
+    if not exists (
+        select * from information_schema.columns
+        where table_schema = database() and table_name = 'userLog' and column_name = 'device'
+    ) then
+        alter table userLog add column device varchar(64) not null default '';
+    end if;
+end //
+delimiter ;
+
+call migrate_userlog_device();
+drop procedure migrate_userlog_device;
+
+alter table userLog modify clientIP varchar(45) not null;
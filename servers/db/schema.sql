@@ -12,6 +12,7 @@ create table if not exists userLog (
     id int not null auto_increment primary key,
     userID int not null,
     inTime datetime not null,
-    clientIP varchar(15) not null,
+    clientIP varchar(45) not null,
+    device varchar(64) not null default '',
     foreign key (userID) references users(id)
 )
\ No newline at end of file
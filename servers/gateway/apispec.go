@@ -0,0 +1,340 @@
+package main
+
+import (
+	"github.com/my/repo/servers/gateway/openapi"
+)
+
+// newAPISpec parses the OpenAPI document describing the gateway's API, which is
+// served at /v1/openapi.json and which requests are validated against
+func newAPISpec() (*openapi.Document, error) {
+	return openapi.Parse([]byte(apiSpec))
+}
+
+// apiSpec describes every route of the gateway, both its own handlers and those of
+// the dashboards upstream. Requests to a documented path with a method, parameters,
+// content type or body the document does not allow are refused before they reach
+// a handler, so it must be kept up to date as routes change. Requests that change
+// data may be sent with an Idempotency-Key; retries with the same key are answered
+// with the first response, 409 while it is in progress, or 422 for another request.
+const apiSpec = `{
+  "openapi": "3.0.3",
+  "info": {"title": "COVID-19 dashboards API", "version": "1.0.0"},
+  "paths": {
+    "/v1/users": {
+      "post": {
+        "operationId": "createUser",
+        "summary": "Sign up, beginning a session for the new user",
+        "parameters": [{"name": "Idempotency-Key", "in": "header", "schema": {"$ref": "#/components/schemas/IdempotencyKey"}}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/NewUser"}}}},
+        "responses": {
+          "201": {"description": "The new user; the Authorization header holds the session token",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+          "409": {"$ref": "#/components/responses/Problem"},
+          "415": {"$ref": "#/components/responses/Problem"},
+          "422": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/v1/users/{userID}": {
+      "parameters": [
+        {"name": "userID", "in": "path", "required": true, "description": "The ID of the user, or me for the signed-in user",
+          "schema": {"type": "string", "pattern": "^(me|[0-9]+)$"}}
+      ],
+      "get": {
+        "operationId": "getUser",
+        "summary": "Get a user's profile",
+        "responses": {
+          "200": {"description": "The user", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+          "401": {"$ref": "#/components/responses/Problem"},
+          "404": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "patch": {
+        "operationId": "updateUser",
+        "summary": "Update the signed-in user's name",
+        "parameters": [{"name": "Idempotency-Key", "in": "header", "schema": {"$ref": "#/components/schemas/IdempotencyKey"}}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Updates"}}}},
+        "responses": {
+          "200": {"description": "The updated user", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+          "401": {"$ref": "#/components/responses/Problem"},
+          "403": {"$ref": "#/components/responses/Problem"},
+          "415": {"$ref": "#/components/responses/Problem"},
+          "422": {"$ref": "#/components/responses/Problem"}
+        }
+      },
+      "delete": {
+        "operationId": "deleteUser",
+        "summary": "Delete the signed-in user, ending every session of the user",
+        "responses": {
+          "200": {"description": "Deleted", "content": {"text/plain": {}}},
+          "401": {"$ref": "#/components/responses/Problem"},
+          "403": {"$ref": "#/components/responses/Problem"},
+          "404": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/v1/sessions": {
+      "post": {
+        "operationId": "createSession",
+        "summary": "Sign in",
+        "parameters": [{"name": "Idempotency-Key", "in": "header", "schema": {"$ref": "#/components/schemas/IdempotencyKey"}}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Credentials"}}}},
+        "responses": {
+          "201": {"description": "The signed-in user; the Authorization header holds the session token",
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/User"}}}},
+          "401": {"$ref": "#/components/responses/Problem"},
+          "415": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/v1/sessions/{sessionID}": {
+      "parameters": [
+        {"name": "sessionID", "in": "path", "required": true, "description": "mine, the only session that may be ended",
+          "schema": {"type": "string"}}
+      ],
+      "delete": {
+        "operationId": "deleteSession",
+        "summary": "Sign out",
+        "responses": {
+          "200": {"description": "Signed out", "content": {"text/plain": {}}},
+          "401": {"$ref": "#/components/responses/Problem"},
+          "403": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/v1/dashboards": {
+      "get": {
+        "operationId": "listDashboards",
+        "summary": "List the public dashboards",
+        "responses": {
+          "200": {"description": "The public dashboards",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/Dashboard"}}}}}
+        }
+      },
+      "post": {
+        "operationId": "createDashboard",
+        "summary": "Create the signed-in user's dashboard",
+        "parameters": [{"name": "Idempotency-Key", "in": "header", "schema": {"$ref": "#/components/schemas/IdempotencyKey"}}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DashboardInput"}}}},
+        "responses": {
+          "201": {"description": "The new dashboard", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Dashboard"}}}},
+          "400": {"description": "The user already has a dashboard"},
+          "401": {"description": "Not signed in"}
+        }
+      }
+    },
+    "/v1/dashboards/{dashID}": {
+      "parameters": [
+        {"name": "dashID", "in": "path", "required": true, "description": "The ID of the dashboard, or me for the signed-in user's",
+          "schema": {"type": "string", "pattern": "^(me|[0-9a-f]{24})$"}}
+      ],
+      "get": {
+        "operationId": "getDashboard",
+        "summary": "Get a dashboard, or the signed-in user's dashboards",
+        "responses": {
+          "200": {"description": "The dashboard, or a list of the user's for me"},
+          "400": {"description": "No such dashboard"},
+          "401": {"description": "Not signed in"}
+        }
+      },
+      "patch": {
+        "operationId": "updateDashboard",
+        "summary": "Update the signed-in user's dashboard",
+        "parameters": [{"name": "Idempotency-Key", "in": "header", "schema": {"$ref": "#/components/schemas/IdempotencyKey"}}],
+        "requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/DashboardUpdates"}}}},
+        "responses": {
+          "201": {"description": "The updated dashboard", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Dashboard"}}}},
+          "400": {"description": "The user has no dashboard, or the ID is not me"},
+          "401": {"description": "Not signed in"}
+        }
+      }
+    },
+    "/v1/data": {
+      "get": {
+        "operationId": "getData",
+        "summary": "Get the data of every state, for the dashboards' charts",
+        "responses": {
+          "200": {"description": "The data of every state",
+            "content": {"application/json": {"schema": {"type": "array", "items": {"$ref": "#/components/schemas/StateData"}}}}}
+        }
+      },
+      "delete": {
+        "operationId": "deleteData",
+        "summary": "Remove the data of every state",
+        "responses": {
+          "200": {"description": "Removed", "content": {"text/plain": {}}}
+        }
+      }
+    },
+    "/v1/csp-reports": {
+      "post": {
+        "operationId": "reportCSPViolations",
+        "summary": "Report violations of the Content-Security-Policy, as browsers do",
+        "requestBody": {"required": true, "content": {
+          "application/csp-report": {"schema": {"type": "object"}},
+          "application/json": {"schema": {"type": "object"}},
+          "application/reports+json": {"schema": {"type": "array", "items": {"type": "object"}}}
+        }},
+        "responses": {
+          "204": {"description": "The reports were collected"}
+        }
+      }
+    },
+    "/v1/live": {
+      "get": {
+        "operationId": "subscribeLive",
+        "summary": "Receive live updates over a WebSocket",
+        "parameters": [
+          {"name": "auth", "in": "query", "description": "The session token, for browsers that cannot set the Authorization header",
+            "schema": {"type": "string", "minLength": 1}}
+        ],
+        "responses": {
+          "101": {"description": "Switching to the WebSocket protocol"},
+          "401": {"$ref": "#/components/responses/Problem"},
+          "403": {"$ref": "#/components/responses/Problem"},
+          "429": {"$ref": "#/components/responses/Problem"}
+        }
+      }
+    },
+    "/v1/openapi.json": {
+      "get": {
+        "operationId": "getOpenAPI",
+        "summary": "Get this document",
+        "responses": {
+          "200": {"description": "This document", "content": {"application/json": {}}}
+        }
+      }
+    }
+  },
+  "components": {
+    "schemas": {
+      "IdempotencyKey": {"type": "string", "minLength": 1, "maxLength": 255,
+        "description": "Identifies the request, so that retrying it with the same key replays the first response instead of carrying it out again"},
+      "NewUser": {
+        "type": "object",
+        "required": ["email", "password", "passwordConf", "userName"],
+        "properties": {
+          "email": {"type": "string", "format": "email"},
+          "password": {"type": "string", "minLength": 1},
+          "passwordConf": {"type": "string"},
+          "userName": {"type": "string", "pattern": "^\\S+$"},
+          "firstName": {"type": "string"},
+          "lastName": {"type": "string"}
+        }
+      },
+      "Credentials": {
+        "type": "object",
+        "required": ["email", "password"],
+        "properties": {
+          "email": {"type": "string"},
+          "password": {"type": "string"}
+        }
+      },
+      "Updates": {
+        "type": "object",
+        "properties": {
+          "firstName": {"type": "string"},
+          "lastName": {"type": "string"}
+        }
+      },
+      "User": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "integer"},
+          "userName": {"type": "string"},
+          "firstName": {"type": "string"},
+          "lastName": {"type": "string"},
+          "photoURL": {"type": "string"}
+        }
+      },
+      "DashboardInput": {
+        "type": "object",
+        "required": ["title", "params"],
+        "properties": {
+          "title": {"type": "string", "minLength": 1},
+          "description": {"type": "string"},
+          "params": {"type": "object"},
+          "private": {"type": "boolean"}
+        }
+      },
+      "DashboardUpdates": {
+        "type": "object",
+        "properties": {
+          "title": {"type": "string"},
+          "description": {"type": "string"},
+          "params": {"type": "object"},
+          "private": {"type": "boolean"}
+        }
+      },
+      "Dashboard": {
+        "type": "object",
+        "properties": {
+          "_id": {"type": "string"},
+          "creator": {"$ref": "#/components/schemas/User"},
+          "title": {"type": "string"},
+          "description": {"type": "string"},
+          "params": {"type": "object"},
+          "private": {"type": "boolean"},
+          "createdAt": {"type": "string", "format": "date-time"},
+          "editedAt": {"type": "string", "format": "date-time"}
+        }
+      },
+      "StateData": {
+        "type": "object",
+        "properties": {
+          "state": {"type": "string"},
+          "tested": {"type": "number"},
+          "infected": {"type": "number"},
+          "deaths": {"type": "number"},
+          "population": {"type": "number"},
+          "popDensity": {"type": "number"},
+          "gini": {"type": "number"},
+          "icuBeds": {"type": "number"},
+          "income": {"type": "number"},
+          "gdp": {"type": "number"},
+          "unemployment": {"type": "number"},
+          "sexRatio": {"type": "number"},
+          "smokingRate": {"type": "number"},
+          "fluDeaths": {"type": "number"},
+          "respDeaths": {"type": "number"},
+          "physicians": {"type": "number"},
+          "hospitals": {"type": "number"},
+          "healthSpending": {"type": "number"},
+          "pollution": {"type": "number"},
+          "medLargeAirports": {"type": "number"},
+          "temperature": {"type": "number"},
+          "urban": {"type": "number"},
+          "schoolClosureDate": {"type": "string", "format": "date-time"}
+        }
+      },
+      "Problem": {
+        "type": "object",
+        "required": ["type", "title", "status", "code"],
+        "properties": {
+          "type": {"type": "string"},
+          "title": {"type": "string"},
+          "status": {"type": "integer"},
+          "detail": {"type": "string"},
+          "instance": {"type": "string"},
+          "code": {"type": "string"},
+          "requestId": {"type": "string"},
+          "errors": {"type": "array", "items": {"$ref": "#/components/schemas/FieldError"}},
+          "upstream": {"type": "string", "description": "The upstream that failed, for upstream problems"},
+          "attempts": {"type": "integer", "description": "How many times the upstream was tried, for upstream problems"}
+        }
+      },
+      "FieldError": {
+        "type": "object",
+        "properties": {
+          "field": {"type": "string"},
+          "code": {"type": "string"},
+          "message": {"type": "string"}
+        }
+      }
+    },
+    "responses": {
+      "Problem": {"description": "The problem, as described by RFC 7807",
+        "content": {"application/problem+json": {"schema": {"$ref": "#/components/schemas/Problem"}}}}
+    }
+  }
+}`
@@ -0,0 +1,182 @@
+//Package cache keeps the responses of routes so they can be served again
+//without asking the upstream, in memory or in redis so that every gateway
+//instance shares them, and coalesces concurrent fetches of the same response.
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Entry is a cached response
+type Entry struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+	//ETag is the strong entity tag of the body
+	ETag string `json:"etag"`
+	//Stored is when the response was received from the upstream
+	Stored time.Time `json:"stored"`
+	//FreshFor is how long after it was stored the response may be served
+	//without asking the upstream
+	FreshFor time.Duration `json:"freshFor"`
+	//StaleIfError is how long after it stops being fresh the response may
+	//still be served while the upstream is failing
+	StaleIfError time.Duration `json:"staleIfError"`
+}
+
+//Fresh reports whether the response may be served without asking the upstream
+func (e *Entry) Fresh(now time.Time) bool {
+	return now.Before(e.Stored.Add(e.FreshFor))
+}
+
+//UsableOnError reports whether the response may be served while the upstream is failing
+func (e *Entry) UsableOnError(now time.Time) bool {
+	return now.Before(e.expires())
+}
+
+//Age is how long ago the response was received from the upstream
+func (e *Entry) Age(now time.Time) time.Duration {
+	if age := now.Sub(e.Stored); age > 0 {
+		return age
+	}
+	return 0
+}
+
+//expires is when the response can no longer be served at all
+func (e *Entry) expires() time.Time {
+	return e.Stored.Add(e.FreshFor + e.StaleIfError)
+}
+
+//size is roughly how many bytes the entry takes up
+func (e *Entry) size(key string) int {
+	size := len(key) + len(e.Body) + len(e.ETag)
+	for name, values := range e.Header {
+		for _, value := range values {
+			size += len(name) + len(value)
+		}
+	}
+	return size
+}
+
+//NewETag returns the strong entity tag of a response body
+func NewETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:]) + `"`
+}
+
+//Backend keeps cached responses until they can no longer be served
+type Backend interface {
+	//Get returns the entry with the key, or nil if there is none
+	Get(key string) (*Entry, error)
+	//Set stores the entry under the key, replacing any already there
+	Set(key string, entry *Entry) error
+	//Purge removes the entries whose keys start with the prefix,
+	//returning how many were removed
+	Purge(prefix string) (int, error)
+}
+
+//call is a fetch in progress
+type call struct {
+	done      chan struct{}
+	entry     *Entry
+	shareable bool
+}
+
+//Cache keeps responses in a Backend, coalescing the concurrent fetches of each
+type Cache struct {
+	Backend Backend
+
+	mu    sync.Mutex
+	calls map[string]*call
+	//purges counts the purges, so a response fetched before one is not stored after it
+	purges uint64
+}
+
+//New constructs a new Cache keeping responses in `backend`
+func New(backend Backend) *Cache {
+	return &Cache{Backend: backend, calls: map[string]*call{}}
+}
+
+//Get returns the entry with the key, or nil if there is none
+func (c *Cache) Get(key string) (*Entry, error) {
+	return c.Backend.Get(key)
+}
+
+//Generation returns the number of purges so far, to be passed to Set
+//once the response fetched after calling it is ready to be stored
+func (c *Cache) Generation() uint64 {
+	return atomic.LoadUint64(&c.purges)
+}
+
+//Set stores the entry under the key, unless a purge happened since `generation`,
+//in which case the entry may hold data the purge was meant to remove
+func (c *Cache) Set(key string, entry *Entry, generation uint64) error {
+	if c.Generation() != generation {
+		return nil
+	}
+	return c.Backend.Set(key, entry)
+}
+
+//Purge removes the entries whose keys start with the prefix. Only fetches
+//in progress on this instance are kept from storing what they fetched.
+func (c *Cache) Purge(prefix string) (int, error) {
+	atomic.AddUint64(&c.purges, 1)
+	return c.Backend.Purge(prefix)
+}
+
+//Fetch calls `fetch` to get the response with the key, unless another
+//request is already fetching it, in which case it waits for that response.
+//`fetch` reports whether the response it got may be given to the other
+//requests; if it may not, or it returned nil as its request was canceled,
+//Fetch returns false and the waiting requests should fetch their own.
+func (c *Cache) Fetch(key string, fetch func() (*Entry, bool)) (*Entry, bool) {
+	c.mu.Lock()
+	if existing, found := c.calls[key]; found {
+		c.mu.Unlock()
+		<-existing.done
+		return existing.entry, existing.shareable && existing.entry != nil
+	}
+	current := &call{done: make(chan struct{})}
+	c.calls[key] = current
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(current.done)
+	}()
+	current.entry, current.shareable = fetch()
+	return current.entry, true
+}
+
+//ServeHTTP purges the entries whose keys start with the prefix
+//in the query, responding with how many were purged as JSON
+func (c *Cache) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "purges must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if !strings.HasPrefix(prefix, "/") {
+		http.Error(w, "prefix must start with /", http.StatusBadRequest)
+		return
+	}
+	purged, err := c.Purge(prefix)
+	if err != nil {
+		http.Error(w, "error purging cache: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Purged int `json:"purged"`
+	}{purged})
+}
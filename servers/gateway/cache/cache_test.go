@@ -0,0 +1,194 @@
+package cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/my/repo/servers/gateway/redistest"
+)
+
+//newEntry returns an entry fresh for a minute with the body
+func newEntry(body string) *Entry {
+	return &Entry{Status: http.StatusOK, Header: http.Header{"Content-Type": {"application/json"}},
+		Body: []byte(body), ETag: NewETag([]byte(body)), Stored: time.Now(), FreshFor: time.Minute}
+}
+
+//testBackend checks the behaviour every backend shares
+func testBackend(t *testing.T, backend Backend) {
+	if entry, err := backend.Get("/v1/data"); entry != nil || err != nil {
+		t.Fatalf("expected no entry but got %v, %v", entry, err)
+	}
+	for _, key := range []string{"/v1/data", "/v1/data?state=Alabama", "/v1/data/*", "/v1/dashboards"} {
+		if err := backend.Set(key, newEntry(key)); err != nil {
+			t.Fatalf("error setting %s: %v", key, err)
+		}
+	}
+	entry, err := backend.Get("/v1/data?state=Alabama")
+	if err != nil || entry == nil {
+		t.Fatalf("expected an entry but got %v, %v", entry, err)
+	}
+	if string(entry.Body) != "/v1/data?state=Alabama" || entry.ETag != NewETag(entry.Body) ||
+		entry.Header.Get("Content-Type") != "application/json" || !entry.Fresh(time.Now()) {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+
+	// entries that can no longer be served are gone
+	expired := newEntry("old")
+	expired.Stored = time.Now().Add(-2 * time.Minute)
+	expired.StaleIfError = 30 * time.Second
+	backend.Set("/v1/old", expired)
+	if entry, _ := backend.Get("/v1/old"); entry != nil {
+		t.Errorf("expected the expired entry to be gone but got %+v", entry)
+	}
+
+	purged, err := backend.Purge("/v1/data")
+	if err != nil || purged != 3 {
+		t.Errorf("expected 3 entries purged but got %d, %v", purged, err)
+	}
+	if entry, _ := backend.Get("/v1/data/*"); entry != nil {
+		t.Errorf("expected the entry to be purged")
+	}
+	if entry, _ := backend.Get("/v1/dashboards"); entry == nil {
+		t.Errorf("expected entries under other prefixes to be kept")
+	}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	testBackend(t, NewMemoryBackend(DefaultMaxBytes))
+
+	// the least recently used entries are evicted to stay within the budget
+	one := newEntry(strings.Repeat("a", 400))
+	backend := NewMemoryBackend(3 * one.size("/a"))
+	backend.Set("/a", one)
+	backend.Set("/b", newEntry(strings.Repeat("b", 400)))
+	backend.Get("/a")
+	backend.Set("/c", newEntry(strings.Repeat("c", 400)))
+	backend.Set("/d", newEntry(strings.Repeat("d", 400)))
+	if backend.Len() != 3 || backend.Bytes() > backend.MaxBytes {
+		t.Errorf("expected 3 entries within %d bytes but got %d in %d", backend.MaxBytes, backend.Len(), backend.Bytes())
+	}
+	if entry, _ := backend.Get("/b"); entry != nil {
+		t.Errorf("expected the least recently used entry to be evicted")
+	}
+	if entry, _ := backend.Get("/a"); entry == nil {
+		t.Errorf("expected the entry used since to be kept")
+	}
+	// entries over the budget are never stored
+	backend.Set("/huge", newEntry(strings.Repeat("h", 4000)))
+	if entry, _ := backend.Get("/huge"); entry != nil || backend.Len() != 3 {
+		t.Errorf("expected the entry over the budget not to be stored")
+	}
+}
+
+func TestRedisBackend(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	testBackend(t, NewRedisBackend(client, "cache:"))
+
+	// entries expire once they can no longer be served
+	entry := newEntry("data")
+	entry.StaleIfError = time.Hour
+	NewRedisBackend(client, "cache:").Set("/v1/expiring", entry)
+	if ttl := client.TTL("cache:%2Fv1%2Fexpiring").Val(); ttl < 60*time.Minute || ttl > 61*time.Minute {
+		t.Errorf("expected the entry to expire in an hour and a minute but got %v", ttl)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	c := New(NewMemoryBackend(DefaultMaxBytes))
+	var fetches int32
+	release := make(chan struct{})
+	fetch := func() (*Entry, bool) {
+		atomic.AddInt32(&fetches, 1)
+		<-release
+		return newEntry("data"), true
+	}
+	results := make(chan *Entry, 10)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entry, shared := c.Fetch("/v1/data", fetch)
+			if !shared {
+				t.Errorf("expected the response to be shared")
+			}
+			results <- entry
+		}()
+	}
+	// let the requests pile up behind the first
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(results)
+	if fetches != 1 {
+		t.Errorf("expected one fetch but got %d", fetches)
+	}
+	for entry := range results {
+		if entry == nil || string(entry.Body) != "data" {
+			t.Errorf("unexpected response %+v", entry)
+		}
+	}
+
+	// responses that may not be shared are fetched by each request
+	release = make(chan struct{})
+	done := make(chan bool)
+	go func() {
+		_, shared := c.Fetch("/v1/private", func() (*Entry, bool) {
+			<-release
+			return newEntry("mine"), false
+		})
+		done <- shared
+	}()
+	time.Sleep(20 * time.Millisecond)
+	go func() {
+		_, shared := c.Fetch("/v1/private", fetch)
+		done <- shared
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	if first, second := <-done, <-done; !first || second {
+		t.Errorf("expected only the fetching request to use the response but got %v, %v", first, second)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	c := New(NewMemoryBackend(DefaultMaxBytes))
+	generation := c.Generation()
+	c.Set("/v1/data", newEntry("data"), generation)
+
+	rr := httptest.NewRecorder()
+	c.ServeHTTP(rr, httptest.NewRequest("POST", "/cache/purge?prefix=/v1/data", nil))
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"purged":1}` {
+		t.Errorf("unexpected purge response %d %q", rr.Code, rr.Body.String())
+	}
+	// responses fetched before a purge are not stored after it
+	c.Set("/v1/data", newEntry("data"), generation)
+	if entry, _ := c.Get("/v1/data"); entry != nil {
+		t.Errorf("expected the response fetched before the purge not to be stored")
+	}
+
+	for _, target := range []string{"/cache/purge", "/cache/purge?prefix=v1"} {
+		rr = httptest.NewRecorder()
+		c.ServeHTTP(rr, httptest.NewRequest("POST", target, nil))
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected purging %s to be refused but got %d", target, rr.Code)
+		}
+	}
+	rr = httptest.NewRecorder()
+	c.ServeHTTP(rr, httptest.NewRequest("GET", "/cache/purge?prefix=/", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected purges to be posted but got %d", rr.Code)
+	}
+}
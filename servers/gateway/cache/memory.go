@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+//DefaultMaxBytes is the byte budget of a MemoryBackend unless configured otherwise
+const DefaultMaxBytes = 64 << 20
+
+//memoryEntry is an entry held by a MemoryBackend
+type memoryEntry struct {
+	key   string
+	entry *Entry
+	size  int
+}
+
+//MemoryBackend keeps responses in memory, so each gateway instance
+//has its own cache. Once the entries take up more than MaxBytes the
+//least recently used are evicted; entries larger than MaxBytes are
+//never stored.
+type MemoryBackend struct {
+	MaxBytes int
+	//Now returns the current time; time.Now if nil
+	Now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int
+}
+
+//NewMemoryBackend constructs a new MemoryBackend holding up to `maxBytes` of responses
+func NewMemoryBackend(maxBytes int) *MemoryBackend {
+	return &MemoryBackend{MaxBytes: maxBytes, entries: map[string]*list.Element{}, lru: list.New()}
+}
+
+func (mb *MemoryBackend) now() time.Time {
+	if mb.Now != nil {
+		return mb.Now()
+	}
+	return time.Now()
+}
+
+//Get returns the entry with the key, or nil if there is none
+func (mb *MemoryBackend) Get(key string) (*Entry, error) {
+	now := mb.now()
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	elem, found := mb.entries[key]
+	if !found {
+		return nil, nil
+	}
+	held := elem.Value.(*memoryEntry)
+	if !held.entry.UsableOnError(now) {
+		mb.remove(elem)
+		return nil, nil
+	}
+	mb.lru.MoveToFront(elem)
+	return held.entry, nil
+}
+
+//Set stores the entry under the key, evicting the least recently used entries to make room
+func (mb *MemoryBackend) Set(key string, entry *Entry) error {
+	size := entry.size(key)
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if elem, found := mb.entries[key]; found {
+		mb.remove(elem)
+	}
+	if size > mb.MaxBytes {
+		return nil
+	}
+	for mb.bytes+size > mb.MaxBytes {
+		mb.remove(mb.lru.Back())
+	}
+	mb.entries[key] = mb.lru.PushFront(&memoryEntry{key, entry, size})
+	mb.bytes += size
+	return nil
+}
+
+//Purge removes the entries whose keys start with the prefix
+func (mb *MemoryBackend) Purge(prefix string) (int, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	purged := 0
+	for key, elem := range mb.entries {
+		if strings.HasPrefix(key, prefix) {
+			mb.remove(elem)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+//Bytes returns roughly how many bytes the entries held take up
+func (mb *MemoryBackend) Bytes() int {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.bytes
+}
+
+//Len returns the number of entries held
+func (mb *MemoryBackend) Len() int {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return len(mb.entries)
+}
+
+//remove drops the entry; the caller holds mb.mu
+func (mb *MemoryBackend) remove(elem *list.Element) {
+	held := mb.lru.Remove(elem).(*memoryEntry)
+	delete(mb.entries, held.key)
+	mb.bytes -= held.size
+}
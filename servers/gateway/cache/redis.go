@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+//purgeBatch is how many keys each SCAN of a purge asks for
+const purgeBatch = 100
+
+//RedisBackend keeps responses in redis, so every gateway instance serves
+//the responses any of them fetched. Entries are stored as JSON, expiring
+//once they can no longer be served.
+type RedisBackend struct {
+	Client *redis.Client
+	//Prefix is added to the key of each entry
+	Prefix string
+}
+
+//NewRedisBackend constructs a new RedisBackend, keeping entries under the prefix
+func NewRedisBackend(client *redis.Client, prefix string) *RedisBackend {
+	return &RedisBackend{Client: client, Prefix: prefix}
+}
+
+//redisKey returns the redis key of the entry with the key, which is escaped
+//so it holds no characters SCAN patterns treat specially
+func (rb *RedisBackend) redisKey(key string) string {
+	return rb.Prefix + url.QueryEscape(key)
+}
+
+//Get returns the entry with the key, or nil if there is none
+func (rb *RedisBackend) Get(key string) (*Entry, error) {
+	data, err := rb.Client.Get(rb.redisKey(key)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entry := &Entry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+//Set stores the entry under the key until it can no longer be served
+func (rb *RedisBackend) Set(key string, entry *Entry) error {
+	ttl := time.Until(entry.expires())
+	if ttl < time.Millisecond {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return rb.Client.Set(rb.redisKey(key), data, ttl).Err()
+}
+
+//Purge removes the entries whose keys start with the prefix
+func (rb *RedisBackend) Purge(prefix string) (int, error) {
+	purged := 0
+	var cursor uint64
+	for {
+		keys, next, err := rb.Client.Scan(cursor, rb.redisKey(prefix)+"*", purgeBatch).Result()
+		if err != nil {
+			return purged, err
+		}
+		if len(keys) != 0 {
+			n, err := rb.Client.Del(keys...).Result()
+			if err != nil {
+				return purged, err
+			}
+			purged += int(n)
+		}
+		if next == 0 {
+			return purged, nil
+		}
+		cursor = next
+	}
+}
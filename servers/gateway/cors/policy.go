@@ -0,0 +1,261 @@
+//Package cors decides which cross-origin requests browsers may make to the
+//gateway, following the CORS protocol of the Fetch standard:
+//https://fetch.spec.whatwg.org/#http-cors-protocol
+package cors
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//CORS headers
+const (
+	AllowOriginHeader      = "Access-Control-Allow-Origin"
+	AllowCredentialsHeader = "Access-Control-Allow-Credentials"
+	AllowMethodsHeader     = "Access-Control-Allow-Methods"
+	AllowHeadersHeader     = "Access-Control-Allow-Headers"
+	ExposeHeadersHeader    = "Access-Control-Expose-Headers"
+	MaxAgeHeader           = "Access-Control-Max-Age"
+	RequestMethodHeader    = "Access-Control-Request-Method"
+	RequestHeadersHeader   = "Access-Control-Request-Headers"
+)
+
+//Defaults of the parts of a policy left unset
+var (
+	//DefaultMethods are the methods allowed from other origins
+	DefaultMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE"}
+	//DefaultHeaders are the request headers pages may send
+	DefaultHeaders = []string{"Content-Type", "Authorization", "Idempotency-Key"}
+	//DefaultExposeHeaders are the response headers pages may read
+	DefaultExposeHeaders = []string{"Authorization", "Idempotent-Replayed"}
+	//DefaultMaxAge is how long browsers may cache the answer to a preflight request
+	DefaultMaxAge = 10 * time.Minute
+)
+
+//Options describe a Policy
+type Options struct {
+	//Origins allowed to make requests: exact origins such as "https://example.com",
+	//wildcards such as "https://*.example.com" matching any subdomain but not the
+	//domain itself, or "*" for any origin
+	Origins []string
+	//Credentials lets pages send cookies and read the responses to requests made with them
+	Credentials bool
+	//Methods allowed; DefaultMethods if empty
+	Methods []string
+	//Headers pages may send; DefaultHeaders if nil
+	Headers []string
+	//ExposeHeaders pages may read besides the CORS-safelisted ones; DefaultExposeHeaders if nil
+	ExposeHeaders []string
+	//MaxAge is how long the answer to a preflight request may be cached; DefaultMaxAge if zero
+	MaxAge time.Duration
+}
+
+//Policy decides which cross-origin requests are allowed
+type Policy struct {
+	anyOrigin   bool
+	origins     map[string]bool
+	wildcards   []wildcard
+	credentials bool
+	methods     map[string]bool
+	headers     map[string]bool
+
+	allowMethods  string
+	allowHeaders  string
+	exposeHeaders string
+	maxAge        string
+}
+
+//wildcard is an origin pattern matching the subdomains of a domain
+type wildcard struct {
+	scheme string
+	//suffix is the domain the host must be beneath, with its leading dot
+	suffix string
+	port   string
+}
+
+//NewPolicy constructs a new Policy, checking the options are valid
+func NewPolicy(opts Options) (*Policy, error) {
+	p := &Policy{
+		origins:     map[string]bool{},
+		credentials: opts.Credentials,
+		methods:     map[string]bool{},
+		headers:     map[string]bool{},
+	}
+	for _, origin := range opts.Origins {
+		if origin == "*" {
+			//the standard does not let credentialed requests be allowed from any origin
+			if opts.Credentials {
+				return nil, fmt.Errorf("origin \"*\" cannot be allowed with credentials")
+			}
+			p.anyOrigin = true
+			continue
+		}
+		scheme, host, port, err := parseOrigin(origin)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(host, "*.") {
+			if len(host) < 3 || strings.Contains(host[2:], "*") {
+				return nil, fmt.Errorf("origin %q: wildcards must be a whole leading label such as *.example.com", origin)
+			}
+			p.wildcards = append(p.wildcards, wildcard{scheme, host[1:], port})
+			continue
+		}
+		if strings.Contains(host, "*") {
+			return nil, fmt.Errorf("origin %q: wildcards must be a whole leading label such as *.example.com", origin)
+		}
+		p.origins[serializeOrigin(scheme, host, port)] = true
+	}
+
+	methods := opts.Methods
+	if len(methods) == 0 {
+		methods = DefaultMethods
+	}
+	for _, method := range methods {
+		p.methods[method] = true
+	}
+	p.allowMethods = strings.Join(methods, ", ")
+
+	headers := opts.Headers
+	if headers == nil {
+		headers = DefaultHeaders
+	}
+	for _, header := range headers {
+		if header == "*" {
+			return nil, fmt.Errorf("allowed headers must be listed by name")
+		}
+		p.headers[strings.ToLower(header)] = true
+	}
+	p.allowHeaders = strings.Join(headers, ", ")
+
+	expose := opts.ExposeHeaders
+	if expose == nil {
+		expose = DefaultExposeHeaders
+	}
+	p.exposeHeaders = strings.Join(expose, ", ")
+
+	maxAge := opts.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultMaxAge
+	}
+	if maxAge < 0 {
+		return nil, fmt.Errorf("max age may not be negative")
+	}
+	p.maxAge = strconv.Itoa(int(maxAge / time.Second))
+	return p, nil
+}
+
+//parseOrigin splits an origin into its scheme, lowercase host and port,
+//leaving the port empty if it is the scheme's default
+func parseOrigin(origin string) (string, string, string, error) {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 ||
+		len(u.Path) != 0 || len(u.RawQuery) != 0 || len(u.Fragment) != 0 || u.User != nil {
+		return "", "", "", fmt.Errorf("origin %q must be a scheme and host such as https://example.com", origin)
+	}
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	return u.Scheme, strings.ToLower(u.Hostname()), port, nil
+}
+
+//serializeOrigin puts the parts of an origin back together
+func serializeOrigin(scheme string, host string, port string) string {
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if len(port) != 0 {
+		host += ":" + port
+	}
+	return scheme + "://" + host
+}
+
+//AllowsOrigin reports whether requests from the origin, as sent in the Origin header, are allowed
+func (p *Policy) AllowsOrigin(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	//pages in sandboxes and on file: URLs send an opaque "null" origin, which is never trusted
+	scheme, host, port, err := parseOrigin(origin)
+	if err != nil {
+		return false
+	}
+	if p.origins[serializeOrigin(scheme, host, port)] {
+		return true
+	}
+	for _, w := range p.wildcards {
+		if scheme == w.scheme && port == w.port && len(host) > len(w.suffix) && strings.HasSuffix(host, w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+//AllowsMethod reports whether requests with the method are allowed
+func (p *Policy) AllowsMethod(method string) bool {
+	return p.methods[method]
+}
+
+//AllowsHeaders reports whether requests may send the headers listed,
+//comma-separated, in an Access-Control-Request-Headers header
+func (p *Policy) AllowsHeaders(list string) bool {
+	for _, header := range strings.Split(list, ",") {
+		header = strings.ToLower(strings.TrimSpace(header))
+		if len(header) != 0 && !p.headers[header] {
+			return false
+		}
+	}
+	return true
+}
+
+//VariesByOrigin reports whether responses differ by the origin of the request,
+//and so must be cached separately for each
+func (p *Policy) VariesByOrigin() bool {
+	return !p.anyOrigin || p.credentials
+}
+
+//allowOrigin sets the headers allowing the origin to read the response
+func (p *Policy) allowOrigin(header http.Header, origin string) {
+	if p.anyOrigin && !p.credentials {
+		header.Set(AllowOriginHeader, "*")
+	} else {
+		header.Set(AllowOriginHeader, origin)
+	}
+	if p.credentials {
+		header.Set(AllowCredentialsHeader, "true")
+	}
+}
+
+//Allow sets the headers allowing a page at the origin to read the
+//response to its request, if the origin is allowed, reporting whether it was
+func (p *Policy) Allow(header http.Header, origin string) bool {
+	if !p.AllowsOrigin(origin) {
+		return false
+	}
+	p.allowOrigin(header, origin)
+	if len(p.exposeHeaders) != 0 {
+		header.Set(ExposeHeadersHeader, p.exposeHeaders)
+	}
+	return true
+}
+
+//Preflight sets the headers answering a preflight request from the origin
+//for a request with the method and headers, if it is allowed, reporting
+//whether it was
+func (p *Policy) Preflight(header http.Header, origin string, method string, headers string) bool {
+	if !p.AllowsOrigin(origin) || !p.AllowsMethod(method) || !p.AllowsHeaders(headers) {
+		return false
+	}
+	p.allowOrigin(header, origin)
+	header.Set(AllowMethodsHeader, p.allowMethods)
+	if len(p.allowHeaders) != 0 {
+		header.Set(AllowHeadersHeader, p.allowHeaders)
+	}
+	header.Set(MaxAgeHeader, p.maxAge)
+	return true
+}
@@ -0,0 +1,187 @@
+package cors
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNewPolicy(t *testing.T) {
+	cases := []struct {
+		name  string
+		opts  Options
+		valid bool
+	}{
+		{"exact and wildcard origins", Options{Origins: []string{"https://example.com", "http://localhost:3000", "https://*.example.com"}}, true},
+		{"any origin", Options{Origins: []string{"*"}}, true},
+		{"no origins", Options{}, true},
+		{"any origin with credentials", Options{Origins: []string{"*"}, Credentials: true}, false},
+		{"origin with path", Options{Origins: []string{"https://example.com/"}}, false},
+		{"origin without scheme", Options{Origins: []string{"example.com"}}, false},
+		{"origin with other scheme", Options{Origins: []string{"ftp://example.com"}}, false},
+		{"origin with user", Options{Origins: []string{"https://me@example.com"}}, false},
+		{"null origin", Options{Origins: []string{"null"}}, false},
+		{"wildcard within label", Options{Origins: []string{"https://api-*.example.com"}}, false},
+		{"wildcard not leading", Options{Origins: []string{"https://api.*.com"}}, false},
+		{"wildcard alone", Options{Origins: []string{"https://*"}}, false},
+		{"wildcard headers", Options{Origins: []string{"https://example.com"}, Headers: []string{"*"}}, false},
+		{"negative max age", Options{Origins: []string{"https://example.com"}, MaxAge: -time.Second}, false},
+	}
+	for _, c := range cases {
+		_, err := NewPolicy(c.opts)
+		if (err == nil) != c.valid {
+			t.Errorf("case %s: expected valid %v but got error %v", c.name, c.valid, err)
+		}
+	}
+}
+
+func TestAllowsOrigin(t *testing.T) {
+	policy, err := NewPolicy(Options{Origins: []string{
+		"https://example.com", "http://localhost:3000", "https://*.apps.example.org", "https://*.example.net:8443",
+	}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cases := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://example.com", true},
+		{"https://EXAMPLE.com", true},
+		{"https://example.com:443", true},
+		{"http://example.com", false},
+		{"https://example.com:8443", false},
+		{"https://www.example.com", false},
+		{"https://example.com.evil.com", false},
+		{"https://evilexample.com", false},
+		{"http://localhost:3000", true},
+		{"http://localhost", false},
+		{"https://one.apps.example.org", true},
+		{"https://two.levels.apps.example.org", true},
+		{"https://apps.example.org", false},
+		{"https://evilapps.example.org", false},
+		{"http://one.apps.example.org", false},
+		{"https://one.apps.example.org:8443", false},
+		{"https://one.example.net:8443", true},
+		{"https://one.example.net", false},
+		{"null", false},
+		{"", false},
+		{"https://example.com/path", false},
+	}
+	for _, c := range cases {
+		if allowed := policy.AllowsOrigin(c.origin); allowed != c.allowed {
+			t.Errorf("origin %q: expected allowed %v but got %v", c.origin, c.allowed, allowed)
+		}
+	}
+
+	anyOrigin, _ := NewPolicy(Options{Origins: []string{"*"}})
+	if !anyOrigin.AllowsOrigin("https://anywhere.test") || anyOrigin.VariesByOrigin() {
+		t.Error("expected any origin to be allowed, with the same response for each")
+	}
+	if !policy.VariesByOrigin() {
+		t.Error("expected responses to vary by origin with an allow-list")
+	}
+	none, _ := NewPolicy(Options{})
+	if none.AllowsOrigin("https://example.com") {
+		t.Error("expected no origin to be allowed by an empty allow-list")
+	}
+}
+
+func TestAllow(t *testing.T) {
+	cases := []struct {
+		name        string
+		opts        Options
+		origin      string
+		allowed     bool
+		allowOrigin string
+		credentials string
+		expose      string
+	}{
+		{"listed origin", Options{Origins: []string{"https://example.com"}}, "https://example.com", true, "https://example.com", "", "Authorization, Idempotent-Replayed"},
+		{"credentials", Options{Origins: []string{"https://example.com"}, Credentials: true, ExposeHeaders: []string{"X-Total", "ETag"}},
+			"https://example.com", true, "https://example.com", "true", "X-Total, ETag"},
+		{"any origin", Options{Origins: []string{"*"}, ExposeHeaders: []string{}}, "https://example.com", true, "*", "", ""},
+		{"other origin", Options{Origins: []string{"https://example.com"}}, "https://evil.com", false, "", "", ""},
+	}
+	for _, c := range cases {
+		policy, err := NewPolicy(c.opts)
+		if err != nil {
+			t.Fatalf("case %s: unexpected error: %v", c.name, err)
+		}
+		header := http.Header{}
+		if allowed := policy.Allow(header, c.origin); allowed != c.allowed {
+			t.Errorf("case %s: expected allowed %v but got %v", c.name, c.allowed, allowed)
+		}
+		if header.Get(AllowOriginHeader) != c.allowOrigin || header.Get(AllowCredentialsHeader) != c.credentials ||
+			header.Get(ExposeHeadersHeader) != c.expose {
+			t.Errorf("case %s: unexpected headers %v", c.name, header)
+		}
+		// preflight headers are only sent in answer to preflight requests
+		if len(header.Get(AllowMethodsHeader)) != 0 || len(header.Get(MaxAgeHeader)) != 0 {
+			t.Errorf("case %s: unexpected preflight headers %v", c.name, header)
+		}
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	policy, err := NewPolicy(Options{
+		Origins:     []string{"https://example.com"},
+		Credentials: true,
+		Methods:     []string{"GET", "POST"},
+		Headers:     []string{"Content-Type", "Authorization", "X-Request-ID"},
+		MaxAge:      time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cases := []struct {
+		name    string
+		origin  string
+		method  string
+		headers string
+		allowed bool
+	}{
+		{"allowed", "https://example.com", "POST", "content-type,authorization", true},
+		{"headers in any case and spacing", "https://example.com", "POST", " Content-Type , X-REQUEST-ID ", true},
+		{"no headers", "https://example.com", "GET", "", true},
+		{"other origin", "https://evil.com", "POST", "", false},
+		{"method not allowed", "https://example.com", "DELETE", "", false},
+		{"methods are case-sensitive", "https://example.com", "post", "", false},
+		{"header not allowed", "https://example.com", "POST", "content-type,x-secret", false},
+	}
+	for _, c := range cases {
+		header := http.Header{}
+		if allowed := policy.Preflight(header, c.origin, c.method, c.headers); allowed != c.allowed {
+			t.Errorf("case %s: expected allowed %v but got %v", c.name, c.allowed, allowed)
+			continue
+		}
+		if !c.allowed {
+			if len(header) != 0 {
+				t.Errorf("case %s: expected no headers but got %v", c.name, header)
+			}
+			continue
+		}
+		expected := map[string]string{
+			AllowOriginHeader:      "https://example.com",
+			AllowCredentialsHeader: "true",
+			AllowMethodsHeader:     "GET, POST",
+			AllowHeadersHeader:     "Content-Type, Authorization, X-Request-ID",
+			MaxAgeHeader:           "3600",
+		}
+		for name, value := range expected {
+			if header.Get(name) != value {
+				t.Errorf("case %s: expected %s %q but got %q", c.name, name, value, header.Get(name))
+			}
+		}
+	}
+
+	// the defaults allow the methods and headers the web client uses
+	defaults, _ := NewPolicy(Options{Origins: []string{"https://example.com"}})
+	header := http.Header{}
+	if !defaults.Preflight(header, "https://example.com", "PATCH", "authorization, content-type") {
+		t.Fatal("expected the defaults to allow the request")
+	}
+	if header.Get(AllowMethodsHeader) != "GET, HEAD, POST, PUT, PATCH, DELETE" || header.Get(MaxAgeHeader) != "600" {
+		t.Errorf("unexpected headers %v", header)
+	}
+}
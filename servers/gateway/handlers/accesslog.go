@@ -0,0 +1,177 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/my/repo/servers/gateway/identity"
+	"github.com/my/repo/servers/gateway/logging"
+	"github.com/my/repo/servers/gateway/sessions"
+)
+
+// RequestIDHeader is the header carrying the ID of each request, which is
+// passed on to upstreams and sent back to the client
+const RequestIDHeader = "X-Request-ID"
+
+// validRequestID matches the request IDs accepted from clients and load balancers
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// redacted replaces the values of credentials in the access log
+const redacted = "[REDACTED]"
+
+// redactedHeaders are the request headers carrying credentials
+var redactedHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	identity.Header:       true,
+}
+
+// redactedParams are the query string parameters carrying credentials
+var redactedParams = map[string]bool{
+	"auth":     true,
+	"token":    true,
+	"password": true,
+}
+
+// AccessLogHandler is a middleware handler that gives each request an ID and a
+// request-scoped logger, and writes an access log line for it once it is served
+type AccessLogHandler struct {
+	Handler http.Handler
+	Logger  *logging.Logger
+	ctx     *HandlerContext
+}
+
+// NewAccessLogger makes a new access logging wrapper writing to `logger`
+func NewAccessLogger(handlerToWrap http.Handler, ctx *HandlerContext, logger *logging.Logger) *AccessLogHandler {
+	return &AccessLogHandler{Handler: handlerToWrap, Logger: logger, ctx: ctx}
+}
+
+func (al *AccessLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	// keep the ID the request arrived with, so it can be traced from the load balancer
+	requestID := r.Header.Get(RequestIDHeader)
+	if !validRequestID.MatchString(requestID) {
+		requestID = newRequestID()
+	}
+	r.Header.Set(RequestIDHeader, requestID)
+	w.Header().Set(RequestIDHeader, requestID)
+
+	fields := logging.Fields{
+		"method":    r.Method,
+		"path":      redactURL(r),
+		"remoteIp":  clientIP(r),
+		"userAgent": r.UserAgent(),
+		"headers":   redactHeaders(r.Header),
+	}
+	if sid, err := sessions.GetSessionID(r, al.ctx.SigningKey); err == nil {
+		fields["sessionHash"] = sid.Fingerprint()
+	}
+	logger := al.Logger.With(logging.Fields{"requestId": requestID})
+	ctx, annotations := logging.WithAnnotations(logging.NewContext(r.Context(), logger))
+	rec := &statusRecorder{ResponseWriter: w}
+	// the line is written even if the handler panics, as the proxy does when a response is cut off
+	defer func() {
+		for k, v := range annotations() {
+			fields[k] = v
+		}
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		fields["status"] = rec.status
+		fields["bytes"] = rec.bytes
+		fields["latencyMs"] = float64(time.Since(start).Microseconds()) / 1000
+		logger.Log("info", "request", fields)
+	}()
+	al.Handler.ServeHTTP(rec, r.WithContext(ctx))
+}
+
+// newRequestID returns a new random request ID
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// clientIP returns the client IP address, without the port
+func clientIP(r *http.Request) string {
+	ip := GetIP(r)
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		return host
+	}
+	return ip
+}
+
+// redactURL returns the path and query string of the request with credentials redacted
+func redactURL(r *http.Request) string {
+	if len(r.URL.RawQuery) == 0 {
+		return r.URL.Path
+	}
+	query := r.URL.Query()
+	for param := range query {
+		if redactedParams[strings.ToLower(param)] {
+			query.Set(param, redacted)
+		}
+	}
+	return r.URL.Path + "?" + query.Encode()
+}
+
+// redactHeaders returns the request headers with credentials redacted
+func redactHeaders(header http.Header) map[string]string {
+	headers := make(map[string]string, len(header))
+	for name, values := range header {
+		if redactedHeaders[name] {
+			headers[name] = redacted
+		} else {
+			headers[name] = strings.Join(values, ", ")
+		}
+	}
+	return headers
+}
+
+// statusRecorder records the status and size of a response
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(p)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+// Flush sends any buffered data to the client, for streamed responses
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the handler take over the connection, for WebSockets
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	rec.status = http.StatusSwitchingProtocols
+	return hijacker.Hijack()
+}
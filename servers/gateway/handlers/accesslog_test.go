@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/my/repo/servers/gateway/logging"
+	"github.com/my/repo/servers/gateway/models/users"
+	"github.com/my/repo/servers/gateway/routing"
+	"github.com/my/repo/servers/gateway/sessions"
+)
+
+// logLines decodes the JSON log lines written to buf
+func logLines(t *testing.T, buf *bytes.Buffer) []logging.Fields {
+	lines := []logging.Fields{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		fields := logging.Fields{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("log line is not JSON: %q", line)
+		}
+		lines = append(lines, fields)
+	}
+	buf.Reset()
+	return lines
+}
+
+func TestAccessLogHandler(t *testing.T) {
+	signingKey := "the key"
+	store := sessions.NewMemStore(time.Hour, time.Minute)
+	ctx := &HandlerContext{SigningKey: signingKey, SessionStore: store}
+	sid, err := sessions.BeginSession(signingKey, store, &SessionState{time.Now(), &users.User{ID: 7}}, httptest.NewRecorder())
+	if err != nil {
+		t.Fatalf("error beginning session: %v", err)
+	}
+
+	// the handler logs through the request logger and sees the request ID
+	var seenID string
+	target := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seenID = r.Header.Get(RequestIDHeader)
+		logging.FromContext(r.Context()).Printf("handling")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	})
+	router := routing.NewRouter(map[string]http.Handler{"test": target}, nil, ctx.RequireSession)
+	cfg, err := routing.ParseConfig([]byte(`{"routes": [{"prefix": "/v1/things", "target": "test", "auth": true}]}`))
+	if err != nil {
+		t.Fatalf("error parsing routes: %v", err)
+	}
+	if err := router.Apply(cfg); err != nil {
+		t.Fatalf("error applying routes: %v", err)
+	}
+	buf := &bytes.Buffer{}
+	handler := NewAccessLogger(router, ctx, logging.New(buf))
+
+	r := httptest.NewRequest("POST", "/v1/things/1?auth=secret&page=2", nil)
+	r.Header.Set("Authorization", "Bearer "+sid.String())
+	r.Header.Set("Cookie", "session=secret")
+	r.Header.Set("User-Agent", "test agent")
+	r.RemoteAddr = "1.2.3.4:1000"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+
+	requestID := rr.Header().Get(RequestIDHeader)
+	if len(requestID) != 32 || seenID != requestID {
+		t.Errorf("expected a generated request ID passed on and sent back, but the handler saw %q and the client got %q", seenID, requestID)
+	}
+	lines := logLines(t, buf)
+	if len(lines) != 2 {
+		t.Fatalf("expected the handler's line and the access log line but got %v", lines)
+	}
+	if lines[0]["msg"] != "handling" || lines[0]["requestId"] != requestID {
+		t.Errorf("unexpected handler line %v", lines[0])
+	}
+	access := lines[1]
+	expected := logging.Fields{
+		"requestId":   requestID,
+		"method":      "POST",
+		"path":        "/v1/things/1?auth=%5BREDACTED%5D&page=2",
+		"route":       "/v1/things",
+		"status":      201.0,
+		"bytes":       7.0,
+		"userId":      7.0,
+		"sessionHash": sid.Fingerprint(),
+		"remoteIp":    "1.2.3.4",
+		"userAgent":   "test agent",
+	}
+	for k, v := range expected {
+		if access[k] != v {
+			t.Errorf("expected %s %v but got %v", k, v, access[k])
+		}
+	}
+	if _, ok := access["latencyMs"].(float64); !ok {
+		t.Errorf("expected latencyMs but got %v", access["latencyMs"])
+	}
+	headers, _ := access["headers"].(map[string]interface{})
+	if headers["Authorization"] != redacted || headers["Cookie"] != redacted || headers["User-Agent"] != "test agent" {
+		t.Errorf("unexpected headers %v", headers)
+	}
+	if strings.Contains(buf.String(), sid.String()) {
+		t.Error("the session ID was logged")
+	}
+
+	// request IDs from the client are kept, unless they are not valid
+	for id, keep := range map[string]bool{"lb-1234.abc:5": true, "has spaces": false, strings.Repeat("a", 129): false} {
+		r := httptest.NewRequest("GET", "/nowhere", nil)
+		r.Header.Set(RequestIDHeader, id)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		if kept := rr.Header().Get(RequestIDHeader) == id; kept != keep {
+			t.Errorf("request ID %q kept -> expected: %v received: %v", id, keep, kept)
+		}
+		line := logLines(t, buf)[0]
+		if line["status"] != 404.0 || line["requestId"] != rr.Header().Get(RequestIDHeader) {
+			t.Errorf("unexpected access log line %v", line)
+		}
+	}
+}
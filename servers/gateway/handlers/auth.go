@@ -6,15 +6,79 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
-	"time"
 
+	"github.com/my/repo/servers/gateway/logging"
 	"github.com/my/repo/servers/gateway/models/users"
+	"github.com/my/repo/servers/gateway/problem"
 	"github.com/my/repo/servers/gateway/sessions"
 	"golang.org/x/crypto/bcrypt"
 )
 
 var contentTypeJSON = "application/json"
 
+// errSessionsUnavailable is the detail sent when sessions cannot be checked because the session store is down
+var errSessionsUnavailable = "sessions are temporarily unavailable, please try again later"
+
+// sessionProblem responds to a request whose session could not be found, telling clients to
+// retry later instead of signing in again when the session store is unavailable
+func sessionProblem(w http.ResponseWriter, r *http.Request, err error) {
+	if sessions.IsUnavailable(err) {
+		problem.Error(w, r, http.StatusServiceUnavailable, problem.CodeSessionsUnavailable, errSessionsUnavailable)
+		return
+	}
+	problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthenticated, "session unauthorized please log in")
+}
+
+// beginSessionProblem responds to a request whose new session could not be begun
+func beginSessionProblem(w http.ResponseWriter, r *http.Request, err error) {
+	if sessions.IsUnavailable(err) {
+		problem.Error(w, r, http.StatusServiceUnavailable, problem.CodeSessionsUnavailable, errSessionsUnavailable)
+		return
+	}
+	problem.Internal(w, r, err)
+}
+
+// validationProblem responds with the invalid fields of the request body if `err` is a
+// *users.ValidationError, and with a 500 problem otherwise
+func validationProblem(w http.ResponseWriter, r *http.Request, err error) {
+	invalid, ok := err.(*users.ValidationError)
+	if !ok {
+		problem.Internal(w, r, err)
+		return
+	}
+	p := problem.New(http.StatusUnprocessableEntity, problem.CodeValidationFailed, invalid.Error())
+	for _, field := range invalid.Fields {
+		p.Errors = append(p.Errors, problem.FieldError{Field: field.Field, Code: field.Code, Message: field.Message})
+	}
+	problem.Write(w, r, p)
+}
+
+// methodNotAllowed responds to a request with a method the handler does not serve
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allow string) {
+	w.Header().Set("Allow", allow)
+	problem.Error(w, r, http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, r.Method+" is not allowed")
+}
+
+// notJSON responds to a request whose body is not JSON
+func notJSON(w http.ResponseWriter, r *http.Request) {
+	problem.Error(w, r, http.StatusUnsupportedMediaType, problem.CodeUnsupportedMediaType, "request body must be in JSON")
+}
+
+// invalidJSON responds to a request whose JSON body could not be decoded
+func invalidJSON(w http.ResponseWriter, r *http.Request) {
+	problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidJSON, "request body is not valid JSON")
+}
+
+// writeJSON responds with the value encoded as JSON, logging errors
+// writing it, as the status has been sent by then
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, value interface{}) {
+	w.Header().Add("Content-Type", contentTypeJSON)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		logging.FromContext(r.Context()).Errorf("error writing response: %v", err)
+	}
+}
+
 //TODO: define HTTP handler functions as described in the
 //assignment description. Remember to use your handler context
 //struct as the receiver on these functions so that you have
@@ -24,13 +88,13 @@ var contentTypeJSON = "application/json"
 func (ctx *HandlerContext) UsersHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
 		if !strings.HasPrefix(r.Header.Get("Content-Type"), contentTypeJSON) {
-			http.Error(w, "request body must be in JSON", http.StatusUnsupportedMediaType)
+			notJSON(w, r)
 			return
 		}
 		incomingUser := &users.NewUser{}
 		dec := json.NewDecoder(r.Body)
 		if err := dec.Decode(incomingUser); err != nil {
-			http.Error(w, "error decoding json", http.StatusBadRequest)
+			invalidJSON(w, r)
 			return
 		}
 		defer r.Body.Close()
@@ -38,47 +102,40 @@ func (ctx *HandlerContext) UsersHandler(w http.ResponseWriter, r *http.Request)
 		// ensure new user is valid and convert newUser into User
 		user, err := incomingUser.ToUser()
 		if err != nil {
-			http.Error(w, fmt.Sprintf("%s", err), http.StatusBadRequest)
+			validationProblem(w, r, err)
 			return
 		}
 		// check for duplicate email and id
-		checkEmailUser, err := ctx.UserStore.GetByEmail(user.Email)
+		checkEmailUser, err := ctx.userStore(r).GetByEmail(user.Email)
 		if err == nil && len(checkEmailUser.Email) != 0 {
-			http.Error(w, "user already exists", http.StatusBadRequest)
+			problem.Error(w, r, http.StatusConflict, problem.CodeUserExists, "user already exists")
 			return
 		}
 
-		checkUserNameUser, err := ctx.UserStore.GetByUserName(user.UserName)
+		checkUserNameUser, err := ctx.userStore(r).GetByUserName(user.UserName)
 		if err == nil && len(checkUserNameUser.UserName) != 0 {
-			http.Error(w, "user already exists", http.StatusBadRequest)
+			problem.Error(w, r, http.StatusConflict, problem.CodeUserExists, "user already exists")
 			return
 		}
 
 		// creating new user in database
-		savedUser, err := ctx.UserStore.Insert(user)
+		savedUser, err := ctx.userStore(r).Insert(user)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("%s", err), http.StatusBadRequest)
+			problem.Internal(w, r, err)
 			return
 		}
-		newSessionState := SessionState{time.Now(), savedUser}
-
 		// begin new session
-		_, err = sessions.BeginSession(ctx.SigningKey, ctx.SessionStore, newSessionState, w)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("%s", err), http.StatusBadRequest)
+		if err := ctx.beginUserSession(r, savedUser, w); err != nil {
+			beginSessionProblem(w, r, err)
 			return
 		}
+		// the device the account was created from is known from now on
+		ctx.logSignIn(savedUser, r, true)
 
 		// respond to client
-		w.Header().Add("Content-Type", contentTypeJSON)
-		w.WriteHeader(http.StatusCreated)
-		enc := json.NewEncoder(w)
-		if err := enc.Encode(savedUser); err != nil {
-			http.Error(w, fmt.Sprintf("%s", err), http.StatusBadRequest)
-			return
-		}
+		writeJSON(w, r, http.StatusCreated, savedUser)
 	} else {
-		http.Error(w, "request error", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r, "POST")
 		return
 	}
 }
@@ -91,9 +148,10 @@ func (ctx *HandlerContext) SpecificUserHandler(w http.ResponseWriter, r *http.Re
 	sessionState := &SessionState{}
 	_, err := sessions.GetState(r, ctx.SigningKey, ctx.SessionStore, sessionState)
 	if err != nil {
-		http.Error(w, "sesssion unauthorized please log in", http.StatusUnauthorized)
+		sessionProblem(w, r, err)
 		return
 	}
+	logging.Annotate(r.Context(), "userId", sessionState.User.ID)
 
 	method := r.Method
 	if method == "GET" {
@@ -106,24 +164,22 @@ func (ctx *HandlerContext) SpecificUserHandler(w http.ResponseWriter, r *http.Re
 		} else {
 			userID, err = strconv.ParseInt(userIDString, 10, 64)
 			if err != nil {
-				http.Error(w, "user does not exist", http.StatusNotFound)
+				problem.Error(w, r, http.StatusNotFound, problem.CodeUserNotFound, "user does not exist")
 				return
 			}
 		}
 
 		// return user if found and StatusOK, if not found return StatusNotFound
-		user, err := ctx.UserStore.GetByID(userID)
-		if err != nil || len(user.UserName) == 0 {
-			http.Error(w, "user does not exist", http.StatusNotFound)
+		user, err := ctx.userStore(r).GetByID(userID)
+		if err != nil && err != users.ErrUserNotFound {
+			problem.Internal(w, r, err)
 			return
 		}
-		w.Header().Add("Content-Type", contentTypeJSON)
-		w.WriteHeader(http.StatusOK)
-		enc := json.NewEncoder(w)
-		if err := enc.Encode(user); err != nil {
-			http.Error(w, fmt.Sprintf("%s", err), http.StatusBadRequest)
+		if err != nil || len(user.UserName) == 0 {
+			problem.Error(w, r, http.StatusNotFound, problem.CodeUserNotFound, "user does not exist")
 			return
 		}
+		writeJSON(w, r, http.StatusOK, user)
 	} else if method == "PATCH" {
 		// If the user ID in the request URL is not "me" or does not match the currently-authenticated user,
 		// immediately respond with an http.StatusForbidden (403) error status code and appropriate error message.
@@ -135,19 +191,19 @@ func (ctx *HandlerContext) SpecificUserHandler(w http.ResponseWriter, r *http.Re
 		} else {
 			userID, err = strconv.ParseInt(userIDString, 10, 64)
 			if err != nil {
-				http.Error(w, "user does not exist", http.StatusNotFound)
+				problem.Error(w, r, http.StatusNotFound, problem.CodeUserNotFound, "user does not exist")
 				return
 			}
 			// check if it matches with current user
 			if userID != sessionState.User.ID {
-				http.Error(w, "request not authorized", http.StatusForbidden)
+				problem.Error(w, r, http.StatusForbidden, problem.CodeForbidden, "only your own profile may be updated")
 				return
 			}
 		}
 		// If the request's Content-Type header does not start with application/json, respond with status code
 		// http.StatusUnsupportedMediaType (415), and a message indicating that the request body must be in JSON.
 		if !strings.HasPrefix(r.Header.Get("Content-Type"), contentTypeJSON) {
-			http.Error(w, "request body must be in JSON", http.StatusUnsupportedMediaType)
+			notJSON(w, r)
 			return
 		}
 		// The request body should contain JSON that can be decoded into the users.Updates struct.
@@ -155,28 +211,65 @@ func (ctx *HandlerContext) SpecificUserHandler(w http.ResponseWriter, r *http.Re
 		userUpdates := &users.Updates{}
 		dec := json.NewDecoder(r.Body)
 		if err := dec.Decode(userUpdates); err != nil {
-			http.Error(w, fmt.Sprintf("%s", err), http.StatusBadRequest)
+			invalidJSON(w, r)
 			return
 		}
 
 		// close response body
 		defer r.Body.Close()
 
-		user, err := ctx.UserStore.Update(userID, userUpdates)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("%s", err), http.StatusBadRequest)
+		if err := userUpdates.Validate(); err != nil {
+			validationProblem(w, r, err)
 			return
 		}
-		w.Header().Add("Content-Type", contentTypeJSON)
-		w.WriteHeader(http.StatusOK)
-		enc := json.NewEncoder(w)
-		if err := enc.Encode(user); err != nil {
-			http.Error(w, fmt.Sprintf("%s", err), http.StatusBadRequest)
+		user, err := ctx.userStore(r).Update(userID, userUpdates)
+		if err == users.ErrUserNotFound {
+			problem.Error(w, r, http.StatusNotFound, problem.CodeUserNotFound, "user does not exist")
+			return
+		} else if err != nil {
+			problem.Internal(w, r, err)
 			return
 		}
+		// rewrite the user's live sessions so they stop carrying the old profile
+		if err := ctx.SyncUserSessions(r.Context(), userID); err != nil {
+			logging.FromContext(r.Context()).Errorf("error updating sessions of user %d: %v", userID, err)
+		}
+		// token sessions carry the profile in the token, so the caller is given a new one
+		sessionState.User = user
+		if _, err := sessions.ReissueSession(r, ctx.SigningKey, ctx.SessionStore, sessionState, w); err != nil {
+			logging.FromContext(r.Context()).Errorf("error reissuing session of user %d: %v", userID, err)
+		}
+		writeJSON(w, r, http.StatusOK, user)
 
+	} else if method == "DELETE" {
+		// only the currently-authenticated user may be deleted
+		urlSlice := strings.Split(r.URL.Path, "/")
+		userIDString := urlSlice[len(urlSlice)-1]
+		if userIDString != "me" && userIDString != strconv.FormatInt(sessionState.User.ID, 10) {
+			problem.Error(w, r, http.StatusForbidden, problem.CodeForbidden, "only your own account may be deleted")
+			return
+		}
+		userID := sessionState.User.ID
+		if err := ctx.userStore(r).Delete(userID); err == users.ErrUserNotFound || err == users.ErrDeletingUser {
+			problem.Error(w, r, http.StatusNotFound, problem.CodeUserNotFound, "user does not exist")
+			return
+		} else if err != nil {
+			problem.Internal(w, r, err)
+			return
+		}
+		// end the current session, and every other session of the user on any gateway instance
+		if _, err := sessions.EndSession(r, ctx.SigningKey, ctx.SessionStore); err != nil && err != sessions.ErrStateNotFound {
+			problem.Internal(w, r, fmt.Errorf("error ending session of deleted user %d: %v", userID, err))
+			return
+		}
+		if err := ctx.EndUserSessions(r.Context(), userID); err != nil {
+			problem.Internal(w, r, fmt.Errorf("error ending sessions of deleted user %d: %v", userID, err))
+			return
+		}
+		// respond with plain text
+		w.Write([]byte("user deleted"))
 	} else {
-		http.Error(w, "request error", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r, "GET, PATCH, DELETE")
 		return
 	}
 }
@@ -185,7 +278,7 @@ func (ctx *HandlerContext) SpecificUserHandler(w http.ResponseWriter, r *http.Re
 func (ctx *HandlerContext) SessionsHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
 		if !strings.HasPrefix(r.Header.Get("Content-Type"), contentTypeJSON) {
-			http.Error(w, "request body must be in JSON", http.StatusUnsupportedMediaType)
+			notJSON(w, r)
 			return
 		}
 		// The request body should contain JSON that can be decoded into a users.Credentials struct. Use those
@@ -195,7 +288,7 @@ func (ctx *HandlerContext) SessionsHandler(w http.ResponseWriter, r *http.Reques
 		cred := &users.Credentials{}
 		dec := json.NewDecoder(r.Body)
 		if err := dec.Decode(cred); err != nil {
-			http.Error(w, "error decoding json", http.StatusBadRequest)
+			invalidJSON(w, r)
 			return
 		}
 
@@ -203,52 +296,40 @@ func (ctx *HandlerContext) SessionsHandler(w http.ResponseWriter, r *http.Reques
 		defer r.Body.Close()
 
 		// get user given that email
-		user, err := ctx.UserStore.GetByEmail(cred.Email)
+		user, err := ctx.userStore(r).GetByEmail(cred.Email)
 		if err != nil {
 			// user not found do fake comparison return error
 			bcrypt.CompareHashAndPassword([]byte("dummypassword"), []byte("dummypassword"))
-			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			problem.Error(w, r, http.StatusUnauthorized, problem.CodeInvalidCredentials, "invalid credentials")
 			return
 		}
 		// do the auth
 		if err := user.Authenticate(cred.Password); err != nil {
-			http.Error(w, "invalid credentials", http.StatusUnauthorized)
+			problem.Error(w, r, http.StatusUnauthorized, problem.CodeInvalidCredentials, "invalid credentials")
 			return
 		}
 		// If authentication is successful, begin a new session.
-		newSessionState := &SessionState{time.Now(), user}
-		_, err = sessions.BeginSession(ctx.SigningKey, ctx.SessionStore, newSessionState, w)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("%s", err), http.StatusBadRequest)
+		if err := ctx.beginUserSession(r, user, w); err != nil {
+			beginSessionProblem(w, r, err)
 			return
 		}
 
-		// Insert Log
-		ip := GetIP(r)
-		ctx.UserStore.Log(user.ID, ip)
+		// Insert Log, alerting the user to sign-ins from new devices
+		ctx.logSignIn(user, r, false)
 
 		// Respond to client
-		w.Header().Add("Content-Type", contentTypeJSON)
-		w.WriteHeader(http.StatusCreated)
-		enc := json.NewEncoder(w)
-		if err := enc.Encode(user); err != nil {
-			http.Error(w, fmt.Sprintf("%s", err), http.StatusInternalServerError)
-			return
-		}
+		writeJSON(w, r, http.StatusCreated, user)
 
 	} else {
-		http.Error(w, "request error", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r, "POST")
 		return
 	}
 }
 
-// GetIP is a helper function for getting IP address from the request
+// GetIP is a helper function for getting IP address from the request.
+// X-Forwarded-For is only believed from trusted proxies, by ForwardedFor,
+// as clients can set it to anything.
 func GetIP(r *http.Request) string {
-	forwarded := r.Header.Get("X-FORWARDED-FOR")
-	if forwarded != "" {
-		ips := strings.Split(forwarded, ", ")
-		return ips[0]
-	}
 	return r.RemoteAddr
 }
 
@@ -260,18 +341,18 @@ func (ctx *HandlerContext) SpecificSessionHandler(w http.ResponseWriter, r *http
 		urlSlice := strings.Split(r.URL.Path, "/")
 		lastSegment := urlSlice[len(urlSlice)-1]
 		if lastSegment != "mine" {
-			http.Error(w, "request not authorized", http.StatusForbidden)
+			problem.Error(w, r, http.StatusForbidden, problem.CodeForbidden, "only your own session may be ended")
 			return
 		}
 		// end current session
 		if _, err := sessions.EndSession(r, ctx.SigningKey, ctx.SessionStore); err != nil {
-			http.Error(w, fmt.Sprintf("%s", err), http.StatusBadRequest)
+			sessionProblem(w, r, err)
 			return
 		}
 		// respond with plain text
 		w.Write([]byte("signed out"))
 	} else {
-		http.Error(w, "reqeust error", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, r, "DELETE")
 		return
 	}
 }
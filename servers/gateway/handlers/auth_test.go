@@ -12,9 +12,25 @@ import (
 	"time"
 
 	"github.com/my/repo/servers/gateway/models/users"
+	"github.com/my/repo/servers/gateway/problem"
 	"github.com/my/repo/servers/gateway/sessions"
 )
 
+// unavailableStore is a session store that cannot be reached
+type unavailableStore struct{}
+
+func (unavailableStore) Save(sid sessions.SessionID, sessionState interface{}) error {
+	return sessions.ErrStoreUnavailable
+}
+
+func (unavailableStore) Get(sid sessions.SessionID, sessionState interface{}) error {
+	return sessions.ErrStoreUnavailable
+}
+
+func (unavailableStore) Delete(sid sessions.SessionID) error {
+	return sessions.ErrStoreUnavailable
+}
+
 // private function to verify correct and incorrect input for TestSessionsHandler
 func verifyUsersHandlerOutput(c struct {
 	name               string
@@ -101,7 +117,7 @@ func TestUsersHandler(t *testing.T) {
 	}{
 		{
 			"valid POST request",
-			&HandlerContext{signingKey, memstore, userStore},
+			&HandlerContext{SigningKey: signingKey, SessionStore: memstore, UserStore: userStore},
 			"POST",
 			contentTypeJSON,
 			http.StatusCreated,
@@ -110,7 +126,7 @@ func TestUsersHandler(t *testing.T) {
 		},
 		{
 			"Invalid Method request",
-			&HandlerContext{signingKey, memstore, userStore},
+			&HandlerContext{SigningKey: signingKey, SessionStore: memstore, UserStore: userStore},
 			"PATCH",
 			contentTypeJSON,
 			http.StatusMethodNotAllowed,
@@ -119,7 +135,7 @@ func TestUsersHandler(t *testing.T) {
 		},
 		{
 			"Invalid header request",
-			&HandlerContext{signingKey, memstore, userStore},
+			&HandlerContext{SigningKey: signingKey, SessionStore: memstore, UserStore: userStore},
 			"POST",
 			"text/plain",
 			http.StatusUnsupportedMediaType,
@@ -128,10 +144,11 @@ func TestUsersHandler(t *testing.T) {
 		},
 		{
 			"POST wiht no user body in request",
-			&HandlerContext{signingKey, memstore, userStore},
+			&HandlerContext{SigningKey: signingKey, SessionStore: memstore, UserStore: userStore},
 			"POST",
 			contentTypeJSON,
-			http.StatusBadRequest,
+			// a null body is valid JSON, with every field missing
+			http.StatusUnprocessableEntity,
 			nil,
 			nil,
 		},
@@ -226,8 +243,9 @@ func TestSpecificUserHandler(t *testing.T) {
 	uStore := &users.FakeSQLStore{TestUser: testUser}
 
 	// make context that will work for all cases
-	context := &HandlerContext{signingKey, sStore, uStore}
-	noUserContext := &HandlerContext{"different key", sStore, uStore}
+	context := &HandlerContext{SigningKey: signingKey, SessionStore: sStore, UserStore: uStore}
+	noUserContext := &HandlerContext{SigningKey: "different key", SessionStore: sStore, UserStore: uStore}
+	storeDownContext := &HandlerContext{SigningKey: signingKey, SessionStore: unavailableStore{}, UserStore: uStore}
 
 	// user update and updated user for PATCH
 	userUpdate := &users.Updates{FirstName: "jack", LastName: "mack"}
@@ -273,6 +291,15 @@ func TestSpecificUserHandler(t *testing.T) {
 			http.StatusUnauthorized,
 			nil,
 		},
+		{
+			"GET request with session store down",
+			storeDownContext,
+			"GET",
+			"",
+			"0",
+			http.StatusServiceUnavailable,
+			nil,
+		},
 		{
 			"GET with error parsing id",
 			context,
@@ -460,9 +487,9 @@ func TestSessionsHandler(t *testing.T) {
 		{"Valid POST request",
 			"POST",
 			contentTypeJSON,
-			&HandlerContext{"the key",
-				sessions.NewMemStore(0, 0),
-				&users.FakeSQLStore{TestUser: testUser},
+			&HandlerContext{SigningKey: "the key",
+				SessionStore: sessions.NewMemStore(0, 0),
+				UserStore:    &users.FakeSQLStore{TestUser: testUser},
 			},
 			&users.Credentials{Email: "test@user.com", Password: "password"},
 			http.StatusCreated,
@@ -471,9 +498,9 @@ func TestSessionsHandler(t *testing.T) {
 		{"Non POST request",
 			"PATCH",
 			contentTypeJSON,
-			&HandlerContext{"the key",
-				sessions.NewMemStore(0, 0),
-				&users.FakeSQLStore{TestUser: testUser},
+			&HandlerContext{SigningKey: "the key",
+				SessionStore: sessions.NewMemStore(0, 0),
+				UserStore:    &users.FakeSQLStore{TestUser: testUser},
 			},
 			&users.Credentials{Email: "test@user.com", Password: "password"},
 			http.StatusMethodNotAllowed,
@@ -482,9 +509,9 @@ func TestSessionsHandler(t *testing.T) {
 		{"POST request wrong Content-Type",
 			"POST",
 			"text/html",
-			&HandlerContext{"the key",
-				sessions.NewMemStore(0, 0),
-				&users.FakeSQLStore{TestUser: testUser},
+			&HandlerContext{SigningKey: "the key",
+				SessionStore: sessions.NewMemStore(0, 0),
+				UserStore:    &users.FakeSQLStore{TestUser: testUser},
 			},
 			&users.Credentials{Email: "test@user.com", Password: "password"},
 			http.StatusUnsupportedMediaType,
@@ -493,9 +520,9 @@ func TestSessionsHandler(t *testing.T) {
 		{"POST request user not found",
 			"POST",
 			contentTypeJSON,
-			&HandlerContext{"the key",
-				sessions.NewMemStore(0, 0),
-				&users.FakeSQLStore{TestUser: testUser},
+			&HandlerContext{SigningKey: "the key",
+				SessionStore: sessions.NewMemStore(0, 0),
+				UserStore:    &users.FakeSQLStore{TestUser: testUser},
 			},
 			&users.Credentials{Email: "invalid@user.com", Password: "password"},
 			http.StatusUnauthorized,
@@ -504,9 +531,9 @@ func TestSessionsHandler(t *testing.T) {
 		{"POST request invalid password",
 			"POST",
 			contentTypeJSON,
-			&HandlerContext{"the key",
-				sessions.NewMemStore(0, 0),
-				&users.FakeSQLStore{TestUser: testUser},
+			&HandlerContext{SigningKey: "the key",
+				SessionStore: sessions.NewMemStore(0, 0),
+				UserStore:    &users.FakeSQLStore{TestUser: testUser},
 			},
 			&users.Credentials{Email: "test@user.com", Password: "ehhhhhhh"},
 			http.StatusUnauthorized,
@@ -592,9 +619,9 @@ func TestSpecificSessionHandler(t *testing.T) {
 	}{
 		{"Valid DELETE request",
 			"DELETE",
-			&HandlerContext{"the key",
-				sessions.NewMemStore(0, 0),
-				&users.FakeSQLStore{TestUser: testUser},
+			&HandlerContext{SigningKey: "the key",
+				SessionStore: sessions.NewMemStore(0, 0),
+				UserStore:    &users.FakeSQLStore{TestUser: testUser},
 			},
 			"mine",
 			http.StatusOK,
@@ -602,9 +629,9 @@ func TestSpecificSessionHandler(t *testing.T) {
 		},
 		{"Invalid request user URL",
 			"DELETE",
-			&HandlerContext{"the key",
-				sessions.NewMemStore(0, 0),
-				&users.FakeSQLStore{TestUser: testUser},
+			&HandlerContext{SigningKey: "the key",
+				SessionStore: sessions.NewMemStore(0, 0),
+				UserStore:    &users.FakeSQLStore{TestUser: testUser},
 			},
 			"0",
 			http.StatusForbidden,
@@ -612,9 +639,9 @@ func TestSpecificSessionHandler(t *testing.T) {
 		},
 		{"Invalid MethodL",
 			"GET",
-			&HandlerContext{"the key",
-				sessions.NewMemStore(0, 0),
-				&users.FakeSQLStore{TestUser: testUser},
+			&HandlerContext{SigningKey: "the key",
+				SessionStore: sessions.NewMemStore(0, 0),
+				UserStore:    &users.FakeSQLStore{TestUser: testUser},
 			},
 			"0",
 			http.StatusMethodNotAllowed,
@@ -638,3 +665,86 @@ func TestSpecificSessionHandler(t *testing.T) {
 		verifySpecificSessionHandlerOutput(c, rr, t)
 	}
 }
+
+// failingUserStore is a user store whose database cannot save users
+type failingUserStore struct {
+	users.FakeSQLStore
+}
+
+func (failingUserStore) Insert(user *users.User) (*users.User, error) {
+	return nil, fmt.Errorf("dial tcp 10.0.0.3:3306: connection refused")
+}
+
+func TestAuthProblems(t *testing.T) {
+	signingKey := "the key"
+	memstore := sessions.NewMemStore(time.Hour, time.Minute)
+	existing := &users.User{ID: 1, Email: "taken@user.com", UserName: "taken", FirstName: "Steven"}
+	ctx := &HandlerContext{SigningKey: signingKey, SessionStore: memstore, UserStore: &users.FakeSQLStore{TestUser: existing}}
+	failing := &HandlerContext{SigningKey: signingKey, SessionStore: memstore, UserStore: &failingUserStore{users.FakeSQLStore{TestUser: existing}}}
+	sid, err := sessions.BeginSession(signingKey, memstore, &SessionState{time.Now(), existing}, httptest.NewRecorder())
+	if err != nil {
+		t.Fatalf("error beginning session: %v", err)
+	}
+	valid := `{"email": "new@user.com", "password": "password", "passwordConf": "password", "userName": "new"}`
+	cases := []struct {
+		name           string
+		handler        http.HandlerFunc
+		method         string
+		path           string
+		contentType    string
+		body           string
+		expectedStatus int
+		expectedCode   string
+		expectedFields []string
+	}{
+		{"malformed JSON", ctx.UsersHandler, "POST", "/v1/users", contentTypeJSON, `{"email"`, http.StatusBadRequest, problem.CodeInvalidJSON, nil},
+		{"not JSON", ctx.UsersHandler, "POST", "/v1/users", "text/plain", valid, http.StatusUnsupportedMediaType, problem.CodeUnsupportedMediaType, nil},
+		{"invalid fields", ctx.UsersHandler, "POST", "/v1/users", contentTypeJSON,
+			`{"email": "nope", "password": "a", "passwordConf": "b", "userName": "ok"}`,
+			http.StatusUnprocessableEntity, problem.CodeValidationFailed, []string{"email", "passwordConf"}},
+		{"email taken", ctx.UsersHandler, "POST", "/v1/users", contentTypeJSON,
+			`{"email": "taken@user.com", "password": "password", "passwordConf": "password", "userName": "other"}`,
+			http.StatusConflict, problem.CodeUserExists, nil},
+		{"database down", failing.UsersHandler, "POST", "/v1/users", contentTypeJSON, valid, http.StatusInternalServerError, problem.CodeInternal, nil},
+		{"wrong method", ctx.UsersHandler, "GET", "/v1/users", contentTypeJSON, "", http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, nil},
+		{"wrong password", ctx.SessionsHandler, "POST", "/v1/sessions", contentTypeJSON,
+			`{"email": "taken@user.com", "password": "nope"}`, http.StatusUnauthorized, problem.CodeInvalidCredentials, nil},
+		{"no session", ctx.SpecificUserHandler, "GET", "/v1/users/me", "", "", http.StatusUnauthorized, problem.CodeUnauthenticated, nil},
+		{"unknown user", ctx.SpecificUserHandler, "GET", "/v1/users/9", "", "", http.StatusNotFound, problem.CodeUserNotFound, nil},
+		{"someone else's profile", ctx.SpecificUserHandler, "PATCH", "/v1/users/9", contentTypeJSON, `{"firstName": "a"}`,
+			http.StatusForbidden, problem.CodeForbidden, nil},
+		{"empty updates", ctx.SpecificUserHandler, "PATCH", "/v1/users/me", contentTypeJSON, `{}`,
+			http.StatusUnprocessableEntity, problem.CodeValidationFailed, []string{"firstName", "lastName"}},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		r.Header.Set("Content-Type", c.contentType)
+		if c.name != "no session" {
+			r.Header.Set("Authorization", "Bearer "+string(sid))
+		}
+		rr := httptest.NewRecorder()
+		c.handler.ServeHTTP(rr, r)
+		if rr.Code != c.expectedStatus || rr.Header().Get("Content-Type") != problem.ContentType {
+			t.Errorf("case %s: expected a %d problem but got %d %s", c.name, c.expectedStatus, rr.Code, rr.Header().Get("Content-Type"))
+			continue
+		}
+		p := &problem.Problem{}
+		if err := json.Unmarshal(rr.Body.Bytes(), p); err != nil {
+			t.Errorf("case %s: error decoding problem: %v", c.name, err)
+			continue
+		}
+		if p.Code != c.expectedCode || p.Status != c.expectedStatus || p.Instance != c.path {
+			t.Errorf("case %s: unexpected problem %+v", c.name, p)
+		}
+		fields := []string{}
+		for _, field := range p.Errors {
+			fields = append(fields, field.Field)
+		}
+		if fmt.Sprint(fields) != fmt.Sprint(c.expectedFields) {
+			t.Errorf("case %s: expected invalid fields %v but got %v", c.name, c.expectedFields, fields)
+		}
+		if strings.Contains(rr.Body.String(), "10.0.0.3") {
+			t.Errorf("case %s: internal details were sent to the client: %s", c.name, rr.Body.String())
+		}
+	}
+}
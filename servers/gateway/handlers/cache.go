@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/my/repo/servers/gateway/cache"
+	"github.com/my/repo/servers/gateway/logging"
+	"github.com/my/repo/servers/gateway/metrics"
+	"github.com/my/repo/servers/gateway/routing"
+)
+
+// CacheStatusHeader tells clients whether a response came from the cache
+const CacheStatusHeader = "X-Cache"
+
+// What happened to requests to cached routes
+const (
+	cacheHit    = "hit"
+	cacheMiss   = "miss"
+	cacheStale  = "stale"
+	cacheBypass = "bypass"
+)
+
+var cacheRequests = metrics.Default.NewCounterVec("gateway_cache_requests_total",
+	"Requests to cached routes, by route and whether they were served from the cache.", "route", "result")
+
+// CacheHandler serves the responses of a route to GET and HEAD requests from the cache,
+// with strong ETags so clients can revalidate their copies for a 304. Concurrent
+// misses are coalesced into one request to the upstream, and when the upstream fails
+// responses are served for a while after they go stale. Requests changing data
+// purge the cached responses of the route and of the paths it is configured to purge.
+type CacheHandler struct {
+	Handler http.Handler
+	Route   *routing.RouteConfig
+	Cache   *cache.Cache
+}
+
+// NewCache makes a new caching wrapper for the handler of `route`, keeping its responses in `c`
+func NewCache(handlerToWrap http.Handler, route *routing.RouteConfig, c *cache.Cache) *CacheHandler {
+	return &CacheHandler{Handler: handlerToWrap, Route: route, Cache: c}
+}
+
+func (ch *CacheHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		if r.Method == "OPTIONS" {
+			ch.Handler.ServeHTTP(w, r)
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		ch.Handler.ServeHTTP(rec, r)
+		if rec.status < http.StatusBadRequest {
+			ch.purge(r)
+		}
+		return
+	}
+	directives := parseCacheControl(r.Header.Get("Cache-Control"))
+	_, noStore := directives["no-store"]
+	if ch.Route.Cache == nil || noStore || len(r.Header.Get("Range")) != 0 {
+		ch.bypass(w, r)
+		return
+	}
+
+	key := r.URL.RequestURI()
+	now := time.Now()
+	entry, err := ch.Cache.Get(key)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("error reading cache, fetching from upstream: %v", err)
+		entry = nil
+	}
+	// clients can ask for the response to be fetched again
+	_, noCache := directives["no-cache"]
+	revalidate := noCache || directives["max-age"] == "0"
+	if entry != nil && entry.Fresh(now) && !revalidate {
+		ch.serve(w, r, entry, cacheHit)
+		return
+	}
+	if r.Method == "HEAD" {
+		ch.bypass(w, r)
+		return
+	}
+
+	fetched, shared := ch.Cache.Fetch(key, func() (*cache.Entry, bool) {
+		return ch.fetch(r, key)
+	})
+	if !shared {
+		fetched, _ = ch.fetch(r, key)
+	}
+	if fetched == nil {
+		// the client has gone
+		return
+	}
+	if fetched.Status >= http.StatusInternalServerError && entry != nil && entry.UsableOnError(now) {
+		logging.FromContext(r.Context()).Errorf("upstream failed with status %d, serving stale response", fetched.Status)
+		ch.serve(w, r, entry, cacheStale)
+		return
+	}
+	ch.serve(w, r, fetched, cacheMiss)
+}
+
+// bypass passes the request on to the route without the cache
+func (ch *CacheHandler) bypass(w http.ResponseWriter, r *http.Request) {
+	logging.Annotate(r.Context(), "cache", cacheBypass)
+	if ch.Route.Cache != nil {
+		cacheRequests.With(ch.Route.Prefix, cacheBypass).Inc()
+	}
+	ch.Handler.ServeHTTP(w, r)
+}
+
+// fetch gets the whole response to the request from the route, storing it under the key
+// if it may be cached, and reports whether it may be given to other clients. It returns
+// nil if the client went away before the response was complete.
+func (ch *CacheHandler) fetch(r *http.Request, key string) (*cache.Entry, bool) {
+	generation := ch.Cache.Generation()
+	// the response is fetched unencoded and in full, so any client can be served from it
+	fetchReq := r.Clone(r.Context())
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "Accept-Encoding"} {
+		fetchReq.Header.Del(name)
+	}
+	buf := &responseBuffer{header: http.Header{}}
+	ch.Handler.ServeHTTP(buf, fetchReq)
+	if r.Context().Err() == context.Canceled {
+		return nil, false
+	}
+	if buf.status == 0 {
+		buf.status = http.StatusOK
+	}
+	entry := &cache.Entry{Status: buf.status, Header: buf.header, Body: buf.body.Bytes(), Stored: time.Now()}
+
+	directives := parseCacheControl(entry.Header.Get("Cache-Control"))
+	_, private := directives["private"]
+	_, noStore := directives["no-store"]
+	shareable := !private && !noStore && len(entry.Header.Get("Set-Cookie")) == 0 && len(entry.Header.Get("Vary")) == 0
+	if _, noCache := directives["no-cache"]; !shareable || noCache || entry.Status != http.StatusOK {
+		return entry, shareable
+	}
+	entry.FreshFor = time.Duration(ch.Route.Cache.TTL)
+	if maxAge, found := directiveSeconds(directives, "s-maxage", "max-age"); found {
+		entry.FreshFor = maxAge
+	}
+	entry.StaleIfError = time.Duration(ch.Route.Cache.StaleIfError)
+	if staleIfError, found := directiveSeconds(directives, "stale-if-error"); found {
+		entry.StaleIfError = staleIfError
+	}
+	if entry.FreshFor <= 0 {
+		return entry, true
+	}
+	entry.ETag = cache.NewETag(entry.Body)
+	if err := ch.Cache.Set(key, entry, generation); err != nil {
+		logging.FromContext(r.Context()).Errorf("error storing response in cache: %v", err)
+	}
+	return entry, true
+}
+
+// serve writes the response, or 304 if the client's copy has the same ETag
+func (ch *CacheHandler) serve(w http.ResponseWriter, r *http.Request, entry *cache.Entry, result string) {
+	logging.Annotate(r.Context(), "cache", result)
+	cacheRequests.With(ch.Route.Prefix, result).Inc()
+	header := w.Header()
+	for name, values := range entry.Header {
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+	header.Set(CacheStatusHeader, strings.ToUpper(result))
+	if len(entry.ETag) != 0 {
+		header.Set("ETag", entry.ETag)
+		header.Set("Age", strconv.Itoa(int(entry.Age(time.Now())/time.Second)))
+		// clients keep their copy but check it is still current before using it
+		if len(header.Get("Cache-Control")) == 0 {
+			header.Set("Cache-Control", "no-cache")
+		}
+		if etagMatches(r.Header.Get("If-None-Match"), entry.ETag) {
+			header.Del("Content-Length")
+			header.Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	header.Set("Content-Length", strconv.Itoa(len(entry.Body)))
+	w.WriteHeader(entry.Status)
+	if r.Method != "HEAD" {
+		w.Write(entry.Body)
+	}
+}
+
+// purge removes the cached responses of the route and those it is configured to purge
+func (ch *CacheHandler) purge(r *http.Request) {
+	prefixes := []string{}
+	if ch.Route.Cache != nil {
+		prefixes = append(prefixes, ch.Route.Prefix)
+	}
+	for _, prefix := range append(prefixes, ch.Route.Purges...) {
+		if _, err := ch.Cache.Purge(prefix); err != nil {
+			logging.FromContext(r.Context()).Errorf("error purging cached responses under %s: %v", prefix, err)
+		}
+	}
+}
+
+// parseCacheControl returns the directives of a Cache-Control header
+// by their lowercase names, with their arguments if they have any
+func parseCacheControl(value string) map[string]string {
+	directives := map[string]string{}
+	for _, directive := range strings.Split(value, ",") {
+		directive = strings.TrimSpace(directive)
+		if len(directive) == 0 {
+			continue
+		}
+		name, arg := directive, ""
+		if i := strings.Index(directive, "="); i >= 0 {
+			name, arg = directive[:i], strings.Trim(directive[i+1:], `"`)
+		}
+		directives[strings.ToLower(strings.TrimSpace(name))] = arg
+	}
+	return directives
+}
+
+// directiveSeconds returns the number of seconds of the first of the directives present
+func directiveSeconds(directives map[string]string, names ...string) (time.Duration, bool) {
+	for _, name := range names {
+		if arg, found := directives[name]; found {
+			seconds, err := strconv.Atoi(arg)
+			if err != nil || seconds < 0 {
+				return 0, true
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// etagMatches reports whether an If-None-Match header matches the ETag,
+// comparing weakly as the header is meant to be compared
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// responseBuffer holds a whole response in memory
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rb *responseBuffer) Header() http.Header {
+	return rb.header
+}
+
+func (rb *responseBuffer) WriteHeader(status int) {
+	if rb.status == 0 {
+		rb.status = status
+	}
+}
+
+func (rb *responseBuffer) Write(p []byte) (int, error) {
+	if rb.status == 0 {
+		rb.status = http.StatusOK
+	}
+	return rb.body.Write(p)
+}
+
+// Flush does nothing, as the response is only sent once it is complete
+func (rb *responseBuffer) Flush() {}
@@ -0,0 +1,212 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/my/repo/servers/gateway/cache"
+	"github.com/my/repo/servers/gateway/routing"
+)
+
+// dataUpstream stands in for the upstream of /v1/data, counting the requests it gets
+type dataUpstream struct {
+	requests int32
+	// status is the status of its responses, to make it fail
+	status int32
+	// delay holds each response back, so concurrent requests overlap
+	delay time.Duration
+	body  string
+}
+
+func (du *dataUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddInt32(&du.requests, 1)
+	time.Sleep(du.delay)
+	if len(r.Header.Get("If-None-Match")) != 0 || len(r.Header.Get("Accept-Encoding")) != 0 {
+		http.Error(w, "expected the whole response to be fetched", http.StatusBadRequest)
+		return
+	}
+	if status := atomic.LoadInt32(&du.status); status != http.StatusOK {
+		http.Error(w, "upstream failed", int(status))
+		return
+	}
+	switch r.URL.Path {
+	case "/v1/data/private":
+		w.Header().Set("Cache-Control", "private")
+	case "/v1/data/cookie":
+		w.Header().Set("Set-Cookie", "id=1")
+	case "/v1/data/short":
+		w.Header().Set("Cache-Control", "max-age=0")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(du.body))
+}
+
+// newCacheTestHandler builds a router caching /v1/data in front of the upstream
+func newCacheTestHandler(t *testing.T, upstream *dataUpstream) (http.Handler, *cache.Cache) {
+	responses := cache.New(cache.NewMemoryBackend(cache.DefaultMaxBytes))
+	router := routing.NewRouter(map[string]http.Handler{"data": upstream, "test": http.HandlerFunc(testHandler)}, nil, nil)
+	router.Cache = func(route *routing.RouteConfig, handler http.Handler) http.Handler {
+		return NewCache(handler, route, responses)
+	}
+	cfg, err := routing.ParseConfig([]byte(`{"routes": [
+		{"prefix": "/v1/data", "target": "data", "methods": ["GET", "HEAD", "DELETE"], "cache": {"ttl": "1m", "staleIfError": "1h"}},
+		{"prefix": "/v1/import", "target": "test", "methods": ["POST"], "purges": ["/v1/data"]}
+	]}`))
+	if err != nil {
+		t.Fatalf("error parsing routes: %v", err)
+	}
+	if err := router.Apply(cfg); err != nil {
+		t.Fatalf("error applying routes: %v", err)
+	}
+	return router, responses
+}
+
+// get makes a GET request with the headers to the handler
+func get(handler http.Handler, target string, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", target, nil)
+	for name, value := range header {
+		r.Header.Set(name, value)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+	return rr
+}
+
+func TestCacheHitsAndRevalidation(t *testing.T) {
+	upstream := &dataUpstream{status: http.StatusOK, body: `[{"state": "Alabama"}]`}
+	handler, _ := newCacheTestHandler(t, upstream)
+	cases := []struct {
+		name           string
+		header         map[string]string
+		expectedStatus int
+		expectedCache  string
+		expectedBody   string
+	}{
+		{"first request", map[string]string{"Accept-Encoding": "gzip"}, http.StatusOK, "MISS", upstream.body},
+		{"served from the cache", nil, http.StatusOK, "HIT", upstream.body},
+		{"current copy", map[string]string{"If-None-Match": cache.NewETag([]byte(upstream.body))}, http.StatusNotModified, "HIT", ""},
+		{"one of the copies is current", map[string]string{"If-None-Match": `"old", W/` + cache.NewETag([]byte(upstream.body))}, http.StatusNotModified, "HIT", ""},
+		{"old copy", map[string]string{"If-None-Match": `"old"`}, http.StatusOK, "HIT", upstream.body},
+		{"client asks for a fresh response", map[string]string{"Cache-Control": "no-cache", "If-None-Match": `"old"`}, http.StatusOK, "MISS", upstream.body},
+		{"client asks for nothing to be stored", map[string]string{"Cache-Control": "no-store"}, http.StatusOK, "", upstream.body},
+	}
+	expectedRequests := []int32{1, 1, 1, 1, 1, 2, 3}
+	for i, c := range cases {
+		rr := get(handler, "/v1/data", c.header)
+		if rr.Code != c.expectedStatus || rr.Body.String() != c.expectedBody {
+			t.Errorf("case %s: expected %d %q but got %d %q", c.name, c.expectedStatus, c.expectedBody, rr.Code, rr.Body.String())
+		}
+		if rr.Header().Get(CacheStatusHeader) != c.expectedCache {
+			t.Errorf("case %s: expected cache status %q but got %q", c.name, c.expectedCache, rr.Header().Get(CacheStatusHeader))
+		}
+		if len(c.expectedCache) != 0 && (rr.Header().Get("ETag") != cache.NewETag([]byte(upstream.body)) || rr.Header().Get("Cache-Control") != "no-cache") {
+			t.Errorf("case %s: unexpected caching headers %v", c.name, rr.Header())
+		}
+		if requests := atomic.LoadInt32(&upstream.requests); requests != expectedRequests[i] {
+			t.Errorf("case %s: expected %d requests upstream but got %d", c.name, expectedRequests[i], requests)
+		}
+	}
+
+	// the query is part of the key
+	if rr := get(handler, "/v1/data?state=Alabama", nil); rr.Header().Get(CacheStatusHeader) != "MISS" {
+		t.Errorf("expected a request with another query to miss but got %q", rr.Header().Get(CacheStatusHeader))
+	}
+	r := httptest.NewRequest("HEAD", "/v1/data", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+	if rr.Header().Get(CacheStatusHeader) != "HIT" || rr.Body.Len() != 0 || rr.Header().Get("Content-Length") != "22" {
+		t.Errorf("expected HEAD to be served from the cache without the body but got %v %q", rr.Header(), rr.Body.String())
+	}
+}
+
+func TestCacheUncacheable(t *testing.T) {
+	upstream := &dataUpstream{status: http.StatusOK, body: "{}"}
+	handler, _ := newCacheTestHandler(t, upstream)
+	for _, path := range []string{"/v1/data/private", "/v1/data/cookie", "/v1/data/short"} {
+		get(handler, path, nil)
+		rr := get(handler, path, nil)
+		if rr.Header().Get(CacheStatusHeader) != "MISS" || len(rr.Header().Get("ETag")) != 0 {
+			t.Errorf("expected %s not to be cached but got %v", path, rr.Header())
+		}
+	}
+	if upstream.requests != 6 {
+		t.Errorf("expected every request to reach the upstream but got %d", upstream.requests)
+	}
+}
+
+func TestCacheCoalescesMisses(t *testing.T) {
+	upstream := &dataUpstream{status: http.StatusOK, body: "{}", delay: 50 * time.Millisecond}
+	handler, _ := newCacheTestHandler(t, upstream)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rr := get(handler, "/v1/data", nil); rr.Code != http.StatusOK || rr.Body.String() != "{}" {
+				t.Errorf("unexpected response %d %q", rr.Code, rr.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+	if upstream.requests != 1 {
+		t.Errorf("expected the misses to share one request upstream but got %d", upstream.requests)
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	upstream := &dataUpstream{status: http.StatusOK, body: "{}"}
+	handler, responses := newCacheTestHandler(t, upstream)
+	get(handler, "/v1/data", nil)
+	entry, _ := responses.Get("/v1/data")
+	entry.Stored = entry.Stored.Add(-10 * time.Minute)
+
+	atomic.StoreInt32(&upstream.status, http.StatusBadGateway)
+	rr := get(handler, "/v1/data", nil)
+	if rr.Code != http.StatusOK || rr.Header().Get(CacheStatusHeader) != "STALE" || rr.Body.String() != "{}" {
+		t.Errorf("expected the stale response while the upstream fails but got %d %v", rr.Code, rr.Header())
+	}
+	if age := rr.Header().Get("Age"); age != "600" {
+		t.Errorf("expected the stale response to be 600 seconds old but got %s", age)
+	}
+	// failures are passed on once nothing is cached
+	if rr := get(handler, "/v1/data?new", nil); rr.Code != http.StatusBadGateway {
+		t.Errorf("expected the upstream's failure but got %d", rr.Code)
+	}
+	// client errors are not hidden
+	atomic.StoreInt32(&upstream.status, http.StatusNotFound)
+	if rr := get(handler, "/v1/data", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("expected the upstream's response but got %d", rr.Code)
+	}
+}
+
+func TestCachePurgeOnWrite(t *testing.T) {
+	upstream := &dataUpstream{status: http.StatusOK, body: "{}"}
+	handler, _ := newCacheTestHandler(t, upstream)
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		purges bool
+	}{
+		{"write to another route purging it", "POST", "/v1/import", true},
+		{"write to the route", "DELETE", "/v1/data", true},
+		{"failed write", "DELETE", "/v1/data/missing", false},
+	}
+	for _, c := range cases {
+		atomic.StoreInt32(&upstream.status, http.StatusOK)
+		get(handler, "/v1/data", nil)
+		if c.name == "failed write" {
+			atomic.StoreInt32(&upstream.status, http.StatusNotFound)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(c.method, c.path, nil))
+		atomic.StoreInt32(&upstream.status, http.StatusOK)
+		if hit := get(handler, "/v1/data", nil).Header().Get(CacheStatusHeader) == "HIT"; hit == c.purges {
+			t.Errorf("case %s: expected purged %v", c.name, c.purges)
+		}
+	}
+}
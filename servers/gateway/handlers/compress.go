@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultMinCompressSize is the smallest response body compressed, below
+// which compression saves too little to be worth the time
+const DefaultMinCompressSize = 1024
+
+// encodings are the content codings the gateway can compress with, most preferred first.
+// Brotli and zstd are not offered, as the standard library has no encoder for them.
+var encodings = []string{"gzip", "deflate"}
+
+// compressibleTypes are the media types worth compressing, besides text/*;
+// images, video, archives and the like are already compressed
+var compressibleTypes = map[string]bool{
+	"application/json": true, "application/javascript": true, "application/xml": true,
+	"application/problem+json": true, "application/x-ndjson": true, "image/svg+xml": true,
+	"application/manifest+json": true, "application/wasm": true,
+}
+
+var (
+	gzipWriters  = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	flateWriters = sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+)
+
+// CompressHandler is a middleware handler that compresses responses with the
+// content coding the client prefers of those in its Accept-Encoding header.
+// Small bodies, bodies of types that do not compress, and responses the
+// handler or upstream already encoded are sent as they are.
+type CompressHandler struct {
+	Handler http.Handler
+	// MinSize is the smallest body compressed
+	MinSize int
+}
+
+// NewCompression makes a new compressing wrapper, compressing bodies of at least DefaultMinCompressSize
+func NewCompression(handlerToWrap http.Handler) *CompressHandler {
+	return &CompressHandler{Handler: handlerToWrap, MinSize: DefaultMinCompressSize}
+}
+
+func (ch *CompressHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cw := &compressWriter{ResponseWriter: w, encoding: negotiateEncoding(r.Header.Get("Accept-Encoding")),
+		minSize: ch.MinSize, head: r.Method == "HEAD"}
+	defer cw.close()
+	ch.Handler.ServeHTTP(cw, r)
+}
+
+// negotiateEncoding returns the content coding of those the gateway can compress with
+// that the Accept-Encoding header prefers, or "" if it accepts none of them
+func negotiateEncoding(acceptEncoding string) string {
+	qualities := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(fields[0]))
+		if coding == "x-gzip" {
+			coding = "gzip"
+		}
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+		if len(coding) != 0 {
+			qualities[coding] = quality
+		}
+	}
+	best, bestQuality := "", 0.0
+	for _, encoding := range encodings {
+		quality, found := qualities[encoding]
+		if !found {
+			quality, found = qualities["*"]
+		}
+		if found && quality > bestQuality {
+			best, bestQuality = encoding, quality
+		}
+	}
+	return best
+}
+
+// compressible reports whether a body of the content type is worth compressing
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || compressibleTypes[mediaType] ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// compressWriter compresses the response once it knows the body is worth compressing:
+// when the Content-Length says so, once MinSize bytes have been written, or when the
+// handler flushes, since a streamed response is likely to be long
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	head     bool
+
+	status int
+	// buf holds the start of the body until compression is decided
+	buf     []byte
+	decided bool
+	// encoder compresses the body, if it is being compressed
+	encoder  io.WriteCloser
+	hijacked bool
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 || cw.hijacked {
+		return
+	}
+	// informational responses are sent on, the final one coming later
+	if status >= 100 && status < 200 {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	cw.status = status
+	header := cw.Header()
+	if cw.canEncode() {
+		// caches must keep the response apart from those to clients accepting other codings
+		addVary(header, "Accept-Encoding")
+	}
+	if !cw.canEncode() || len(cw.encoding) == 0 || !cw.bodyAllowed() || !compressible(header.Get("Content-Type")) {
+		cw.decide(false)
+		return
+	}
+	if length, err := strconv.Atoi(header.Get("Content-Length")); err == nil {
+		cw.decide(length >= cw.minSize)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.status == 0 {
+		if len(cw.Header().Get("Content-Type")) == 0 {
+			cw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.decided {
+		if cw.encoder != nil {
+			return cw.encoder.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.minSize {
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush sends the body written so far to the client, compressed if it is being
+// compressed, for streamed responses
+func (cw *compressWriter) Flush() {
+	if cw.hijacked {
+		return
+	}
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if flusher, ok := cw.encoder.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the handler take over the connection, for WebSockets
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	cw.hijacked = true
+	return hijacker.Hijack()
+}
+
+// canEncode reports whether the gateway may pick the coding of the response,
+// which it may not if the handler or upstream already encoded it
+func (cw *compressWriter) canEncode() bool {
+	encoding := cw.Header().Get("Content-Encoding")
+	return (len(encoding) == 0 || encoding == "identity") && cw.status != http.StatusPartialContent
+}
+
+// bodyAllowed reports whether the response has a body to compress
+func (cw *compressWriter) bodyAllowed() bool {
+	return !cw.head && cw.status != http.StatusNoContent && cw.status != http.StatusNotModified
+}
+
+// decide sends the header, compressing the body if `compress`,
+// and then the part of the body held back until now
+func (cw *compressWriter) decide(compress bool) error {
+	cw.decided = true
+	header := cw.Header()
+	if compress {
+		header.Del("Content-Length")
+		header.Del("Accept-Ranges")
+		header.Set("Content-Encoding", cw.encoding)
+		// the compressed body is not byte for byte the one the strong ETag was made for
+		if etag := header.Get("ETag"); len(etag) != 0 && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+		switch cw.encoding {
+		case "gzip":
+			gz := gzipWriters.Get().(*gzip.Writer)
+			gz.Reset(cw.ResponseWriter)
+			cw.encoder = gz
+		case "deflate":
+			fl := flateWriters.Get().(*flate.Writer)
+			fl.Reset(cw.ResponseWriter)
+			cw.encoder = fl
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+	buf := cw.buf
+	cw.buf = nil
+	var err error
+	if cw.encoder != nil {
+		_, err = cw.encoder.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// close sends what is left of the body once the handler returns
+func (cw *compressWriter) close() {
+	if cw.hijacked {
+		return
+	}
+	if cw.status == 0 {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if !cw.decided {
+		// the whole body is smaller than MinSize
+		cw.decide(false)
+	}
+	switch encoder := cw.encoder.(type) {
+	case *gzip.Writer:
+		encoder.Close()
+		gzipWriters.Put(encoder)
+	case *flate.Writer:
+		encoder.Close()
+		flateWriters.Put(encoder)
+	}
+}
+
+// addVary adds the header name to the Vary header, unless it is already there
+func addVary(header http.Header, name string) {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field == "*" || strings.EqualFold(field, name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
@@ -0,0 +1,284 @@
+package handlers
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	cases := []struct {
+		acceptEncoding string
+		expected       string
+	}{
+		{"", ""},
+		{"gzip, deflate, br", "gzip"},
+		{"deflate", "deflate"},
+		{"br;q=1.0, deflate;q=0.8, gzip;q=0.5", "deflate"},
+		{"GZIP", "gzip"},
+		{"x-gzip", "gzip"},
+		{"gzip;q=0, deflate;q=0", ""},
+		{"*", "gzip"},
+		{"*;q=0.5, gzip;q=0", "deflate"},
+		{"identity", ""},
+		{"br, zstd", ""},
+	}
+	for _, c := range cases {
+		if encoding := negotiateEncoding(c.acceptEncoding); encoding != c.expected {
+			t.Errorf("case %q: expected %q but got %q", c.acceptEncoding, c.expected, encoding)
+		}
+	}
+}
+
+// decode returns the body of the response, decompressed
+func decode(t *testing.T, rr *httptest.ResponseRecorder) string {
+	var reader io.Reader = rr.Body
+	switch rr.Header().Get("Content-Encoding") {
+	case "gzip":
+		gz, err := gzip.NewReader(rr.Body)
+		if err != nil {
+			t.Fatalf("error reading gzip body: %v", err)
+		}
+		reader = gz
+	case "deflate":
+		reader = flate.NewReader(rr.Body)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("error decompressing body: %v", err)
+	}
+	return string(body)
+}
+
+func TestCompression(t *testing.T) {
+	large := `{"states": [` + strings.Repeat(`{"state": "Alabama", "tested": 1356420}, `, 100) + `{}]}`
+	cases := []struct {
+		name             string
+		acceptEncoding   string
+		method           string
+		status           int
+		header           map[string]string
+		body             string
+		expectedEncoding string
+		expectedVary     bool
+	}{
+		{"gzip", "gzip, deflate", "GET", http.StatusOK, map[string]string{"Content-Type": "application/json"}, large, "gzip", true},
+		{"deflate", "deflate", "GET", http.StatusOK, map[string]string{"Content-Type": "application/json"}, large, "deflate", true},
+		{"known length", "gzip", "GET", http.StatusOK,
+			map[string]string{"Content-Type": "text/csv", "Content-Length": strconv.Itoa(len(large))}, large, "gzip", true},
+		{"sniffed type", "gzip", "GET", http.StatusOK, nil, large, "gzip", true},
+		{"no accepted encoding", "br", "GET", http.StatusOK, map[string]string{"Content-Type": "application/json"}, large, "", true},
+		{"small body", "gzip", "GET", http.StatusOK, map[string]string{"Content-Type": "application/json"}, `{"ok": true}`, "", true},
+		{"errors are compressed too", "gzip", "GET", http.StatusNotFound, map[string]string{"Content-Type": "text/plain"}, large, "gzip", true},
+		{"already compressed type", "gzip", "GET", http.StatusOK, map[string]string{"Content-Type": "image/png"}, large, "", true},
+		{"already encoded by the upstream", "gzip", "GET", http.StatusOK,
+			map[string]string{"Content-Type": "application/json", "Content-Encoding": "br"}, large, "br", false},
+		{"HEAD", "gzip", "HEAD", http.StatusOK, map[string]string{"Content-Type": "application/json"}, "", "", true},
+		{"not modified", "gzip", "GET", http.StatusNotModified, map[string]string{"ETag": `"abc"`}, "", "", true},
+		{"no content", "gzip", "GET", http.StatusNoContent, nil, "", "", true},
+	}
+	for _, c := range cases {
+		handler := NewCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for name, value := range c.header {
+				w.Header().Set(name, value)
+			}
+			w.Header().Set("ETag", `"strong"`)
+			if c.status != http.StatusOK {
+				w.WriteHeader(c.status)
+			}
+			// written in pieces, as the proxy does
+			for i := 0; i < len(c.body); i += 100 {
+				end := i + 100
+				if end > len(c.body) {
+					end = len(c.body)
+				}
+				w.Write([]byte(c.body[i:end]))
+			}
+		}))
+		r := httptest.NewRequest(c.method, "/v1/data", nil)
+		r.Header.Set("Accept-Encoding", c.acceptEncoding)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		if rr.Code != c.status {
+			t.Errorf("case %s: expected status %d but got %d", c.name, c.status, rr.Code)
+		}
+		if encoding := rr.Header().Get("Content-Encoding"); encoding != c.expectedEncoding {
+			t.Errorf("case %s: expected encoding %q but got %q", c.name, c.expectedEncoding, encoding)
+		}
+		if vary := rr.Header().Get("Vary") == "Accept-Encoding"; vary != c.expectedVary {
+			t.Errorf("case %s: expected Vary %v but got %v", c.name, c.expectedVary, rr.Header().Values("Vary"))
+		}
+		compressed := c.expectedEncoding == "gzip" || c.expectedEncoding == "deflate"
+		if compressed {
+			if len(rr.Header().Get("Content-Length")) != 0 || rr.Header().Get("ETag") != `W/"strong"` || rr.Body.Len() >= len(c.body) {
+				t.Errorf("case %s: unexpected compressed response %v of %d bytes", c.name, rr.Header(), rr.Body.Len())
+			}
+			if body := decode(t, rr); body != c.body {
+				t.Errorf("case %s: expected the body to decompress to what was written", c.name)
+			}
+		} else if rr.Body.String() != c.body || rr.Header().Get("ETag") != `"strong"` && c.status != http.StatusNotModified {
+			t.Errorf("case %s: expected the response unchanged but got %v %q", c.name, rr.Header(), rr.Body.String())
+		}
+	}
+}
+
+func TestCompressionVary(t *testing.T) {
+	handler := NewCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin, accept-encoding")
+		w.Write([]byte("hello"))
+	}))
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if vary := rr.Header().Values("Vary"); len(vary) != 1 {
+		t.Errorf("expected Accept-Encoding not to be added twice but got %v", vary)
+	}
+}
+
+func TestCompressionStreaming(t *testing.T) {
+	chunks := []string{"data: first\n\n", "data: second\n\n", "data: third\n\n"}
+	var gz *gzip.Reader
+	handler := NewCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		rr := w.(*compressWriter).ResponseWriter.(*httptest.ResponseRecorder)
+		for _, chunk := range chunks {
+			w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+			// each chunk reaches the client as it is flushed, though it is far smaller than MinSize
+			if gz == nil {
+				var err error
+				if gz, err = gzip.NewReader(rr.Body); err != nil {
+					t.Fatalf("error reading streamed gzip body: %v", err)
+				}
+			}
+			received := make([]byte, len(chunk))
+			if _, err := io.ReadFull(gz, received); err != nil || string(received) != chunk {
+				t.Errorf("expected %q to be flushed but got %q, %v", chunk, received, err)
+			}
+		}
+	}))
+	r := httptest.NewRequest("GET", "/v1/events", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+	if !rr.Flushed || rr.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("expected a flushed gzip stream but got %v", rr.Header())
+	}
+}
+
+// loadDataPayload builds the /v1/data response the dashboards upstream makes from the CSV it imports
+func loadDataPayload(b *testing.B) []byte {
+	file, err := os.Open("../../dashboards/COVID19_state.csv")
+	if err != nil {
+		b.Skipf("dashboards data not found: %v", err)
+	}
+	defer file.Close()
+	rows, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		b.Fatalf("error reading data: %v", err)
+	}
+	fields := []string{"state", "tested", "infected", "deaths", "population", "popDensity", "gini", "icuBeds",
+		"income", "gdp", "unemployment", "sexRatio", "smokingRate", "fluDeaths", "respDeaths", "physicians",
+		"hospitals", "healthSpending", "pollution", "medLargeAirports", "temperature", "urban"}
+	docs := []map[string]interface{}{}
+	for i, row := range rows[1:] {
+		// documents as Mongo stores them, with an ObjectId and version
+		doc := map[string]interface{}{"_id": hex.EncodeToString([]byte(fmt.Sprintf("5fb1c2%06d", i))), "__v": 0}
+		for j, field := range fields {
+			if n, err := strconv.ParseFloat(row[j], 64); err == nil {
+				doc[field] = n
+			} else {
+				doc[field] = row[j]
+			}
+		}
+		doc["schoolClosureDate"] = row[len(row)-1]
+		docs = append(docs, doc)
+	}
+	payload, _ := json.Marshal(docs)
+	return payload
+}
+
+// dashboardsPayload builds a list of dashboards like the dashboards upstream serves
+func dashboardsPayload() []byte {
+	dashboards := []map[string]interface{}{}
+	for i := 0; i < 50; i++ {
+		dashboards = append(dashboards, map[string]interface{}{
+			"_id":         fmt.Sprintf("5fb1c2%018d", i),
+			"creator":     map[string]interface{}{"id": i, "userName": fmt.Sprintf("user%d", i), "firstName": "Ada", "lastName": "Lovelace"},
+			"title":       fmt.Sprintf("Infections against ICU beds %d", i),
+			"description": "Compares the infections in each state with the ICU beds available",
+			"params":      map[string]interface{}{"x": "icuBeds", "y": "infected", "chartType": "scatter"},
+			"createdAt":   "2020-11-16T00:00:00.000Z",
+			"private":     false,
+		})
+	}
+	payload, _ := json.Marshal(dashboards)
+	return payload
+}
+
+func BenchmarkCompression(b *testing.B) {
+	payloads := []struct {
+		name string
+		body []byte
+	}{
+		{"data", loadDataPayload(b)},
+		{"dashboards", dashboardsPayload()},
+	}
+	for _, payload := range payloads {
+		body := payload.body
+		handler := NewCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			// the proxy copies bodies in 32KB pieces
+			for i := 0; i < len(body); i += 32 << 10 {
+				end := i + 32<<10
+				if end > len(body) {
+					end = len(body)
+				}
+				w.Write(body[i:end])
+			}
+		}))
+		for _, encoding := range []string{"identity", "gzip", "deflate"} {
+			b.Run(payload.name+"/"+encoding, func(b *testing.B) {
+				r := httptest.NewRequest("GET", "/v1/data", nil)
+				r.Header.Set("Accept-Encoding", encoding)
+				b.SetBytes(int64(len(body)))
+				b.ReportAllocs()
+				size := 0
+				for i := 0; i < b.N; i++ {
+					rr := &discardRecorder{header: http.Header{}}
+					handler.ServeHTTP(rr, r)
+					size = rr.size
+				}
+				b.ReportMetric(float64(size), "wire-bytes")
+				b.ReportMetric(float64(size)/float64(len(body)), "ratio")
+			})
+		}
+	}
+}
+
+// discardRecorder counts the bytes of a response without keeping them
+type discardRecorder struct {
+	header http.Header
+	size   int
+}
+
+func (dr *discardRecorder) Header() http.Header {
+	return dr.header
+}
+
+func (dr *discardRecorder) WriteHeader(status int) {}
+
+func (dr *discardRecorder) Write(p []byte) (int, error) {
+	dr.size += len(p)
+	return len(p), nil
+}
@@ -1,6 +1,8 @@
 package handlers
 
 import (
+	"net/http"
+
 	"github.com/my/repo/servers/gateway/models/users"
 	"github.com/my/repo/servers/gateway/sessions"
 )
@@ -17,4 +19,11 @@ type HandlerContext struct {
 	SigningKey   string
 	SessionStore sessions.Store
 	UserStore    users.Store
+	// Notifier is told about sign-ins from devices the user has not used before; no one is told if nil
+	Notifier Notifier
+}
+
+// userStore returns the user store, with its queries traced as part of the request
+func (ctx *HandlerContext) userStore(r *http.Request) users.Store {
+	return users.TraceStore(r.Context(), ctx.UserStore)
 }
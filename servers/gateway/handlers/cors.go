@@ -2,41 +2,61 @@ package handlers
 
 import (
 	"net/http"
-)
-
-/* TODO: implement a CORS middleware handler, as described
-in https://drstearns.github.io/tutorials/cors/ that responds
-with the following headers to all requests:
 
-  Access-Control-Allow-Origin: *
-  Access-Control-Allow-Methods: GET, PUT, POST, PATCH, DELETE
-  Access-Control-Allow-Headers: Content-Type, Authorization
-  Access-Control-Expose-Headers: Authorization
-  Access-Control-Max-Age: 600
-*/
+	"github.com/my/repo/servers/gateway/cors"
+	"github.com/my/repo/servers/gateway/problem"
+	"github.com/my/repo/servers/gateway/routing"
+)
 
-// CORSHandler is a middleware handler that responds to preflight requests
+// CORSHandler is a middleware handler that applies the CORS policy of each route,
+// as described in https://drstearns.github.io/tutorials/cors/. It answers preflight
+// requests itself, checking them against the route the request would be sent to,
+// and lets pages on allowed origins read the responses to their requests.
 type CORSHandler struct {
 	Handler http.Handler
+	Router  *routing.Router
 }
 
-func (cors *CORSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, PATCH, DELETE")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
-	w.Header().Set("Access-Control-Expose-Headers", "Authorization")
-	w.Header().Set("Access-Control-Max-Age", "600")
+// NewCORS makes a new CORS wrapper, applying the policies of the routes of `router`
+func NewCORS(handlerToWrap http.Handler, router *routing.Router) *CORSHandler {
+	return &CORSHandler{Handler: handlerToWrap, Router: router}
+}
 
-	// if its a preflight request
-	if r.Method == "OPTIONS" {
-		w.WriteHeader(http.StatusOK)
+func (ch *CORSHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	policy, found := ch.Router.CORS(r.URL.Path)
+	if r.Method == "OPTIONS" && len(origin) != 0 && len(r.Header.Get(cors.RequestMethodHeader)) != 0 {
+		ch.preflight(w, r, origin, policy, found)
 		return
 	}
-	// else just serve normally
-	cors.Handler.ServeHTTP(w, r)
+	if policy != nil {
+		// responses differ by origin, so caches must keep them apart,
+		// including those to requests made without one
+		if policy.VariesByOrigin() {
+			w.Header().Add("Vary", "Origin")
+		}
+		if len(origin) != 0 {
+			policy.Allow(w.Header(), origin)
+		}
+	}
+	ch.Handler.ServeHTTP(w, r)
 }
 
-// NewCORS makes a new CORS wrapper
-func NewCORS(handlerToWrap http.Handler) *CORSHandler {
-	return &CORSHandler{handlerToWrap}
+// preflight answers a preflight request, which asks whether the page at `origin` may
+// make a request with the method and headers named in the request's headers
+func (ch *CORSHandler) preflight(w http.ResponseWriter, r *http.Request, origin string, policy *cors.Policy, found bool) {
+	w.Header().Add("Vary", "Origin")
+	w.Header().Add("Vary", cors.RequestMethodHeader)
+	w.Header().Add("Vary", cors.RequestHeadersHeader)
+	if !found {
+		problem.Error(w, r, http.StatusNotFound, problem.CodeNotFound, "no route serves "+r.URL.Path)
+		return
+	}
+	// requests that are not allowed get no CORS headers, so the browser does not make them
+	if policy == nil || !policy.Preflight(w.Header(), origin, r.Header.Get(cors.RequestMethodHeader),
+		r.Header.Get(cors.RequestHeadersHeader)) {
+		problem.Error(w, r, http.StatusForbidden, problem.CodeOriginNotAllowed, "cross-origin request not allowed")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
@@ -4,6 +4,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/my/repo/servers/gateway/cors"
+	"github.com/my/repo/servers/gateway/routing"
 )
 
 // private handler to test cors handler. It will return StatusAccepted instead of StatusOK for difference
@@ -12,55 +15,176 @@ func testHandler(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("this handler is just for test, does nothing and returns StatusAccepted"))
 }
 
-func TestCorsServeHTTP(t *testing.T) {
+// newCORSTestHandler builds a CORS handler in front of a router with the configuration
+func newCORSTestHandler(t *testing.T, config string) http.Handler {
+	router := routing.NewRouter(map[string]http.Handler{"test": http.HandlerFunc(testHandler)}, nil, nil)
+	cfg, err := routing.ParseConfig([]byte(config))
+	if err != nil {
+		t.Fatalf("error parsing routes: %v", err)
+	}
+	if err := router.Apply(cfg); err != nil {
+		t.Fatalf("error applying routes: %v", err)
+	}
+	return NewCORS(router, router)
+}
+
+const corsTestConfig = `{
+	"cors": {"origins": ["https://example.com", "https://*.example.org"], "credentials": true,
+		"exposeHeaders": ["Authorization", "X-Request-ID"], "maxAge": "1h"},
+	"routes": [
+		{"prefix": "/v1/users", "target": "test", "methods": ["POST"]},
+		{"prefix": "/v1/users/", "target": "test", "methods": ["GET", "PATCH", "OPTIONS"]},
+		{"prefix": "/v1/dashboards", "target": "test", "cors": {"methods": ["GET"], "headers": ["Authorization"]}},
+		{"prefix": "/v1/admin", "target": "test", "cors": {"disabled": true}}
+	]
+}`
+
+func TestCORSPreflight(t *testing.T) {
+	handler := newCORSTestHandler(t, corsTestConfig)
 	cases := []struct {
-		name               string
-		method             string
-		expectedStatusCode int
+		name           string
+		path           string
+		origin         string
+		method         string
+		headers        string
+		expectedStatus int
+		expectedAllow  string
+		expectedHeads  string
 	}{
-		{
-			"preflight request",
-			"OPTIONS",
-			http.StatusOK,
-		}, {
-			"normal request",
-			"GET",
-			http.StatusAccepted,
-		},
+		{"allowed", "/v1/users", "https://example.com", "POST", "Content-Type, Authorization",
+			http.StatusNoContent, "POST", "Content-Type, Authorization, Idempotency-Key"},
+		{"wildcard subdomain", "/v1/users/me", "https://app.example.org", "PATCH", "content-type",
+			http.StatusNoContent, "GET, PATCH", "Content-Type, Authorization, Idempotency-Key"},
+		{"route's own methods", "/v1/users", "https://example.com", "DELETE", "", http.StatusForbidden, "", ""},
+		{"origin not allowed", "/v1/users", "https://evil.com", "POST", "", http.StatusForbidden, "", ""},
+		{"apex of wildcard not allowed", "/v1/users", "https://example.org", "POST", "", http.StatusForbidden, "", ""},
+		{"header not allowed", "/v1/users", "https://example.com", "POST", "X-Secret", http.StatusForbidden, "", ""},
+		{"per-route methods", "/v1/dashboards/1", "https://example.com", "GET", "authorization",
+			http.StatusNoContent, "GET", "Authorization"},
+		{"per-route method not allowed", "/v1/dashboards/1", "https://example.com", "POST", "", http.StatusForbidden, "", ""},
+		{"per-route header not allowed", "/v1/dashboards/1", "https://example.com", "GET", "content-type", http.StatusForbidden, "", ""},
+		{"route disabled", "/v1/admin", "https://example.com", "GET", "", http.StatusForbidden, "", ""},
+		{"no route", "/v2/users", "https://example.com", "GET", "", http.StatusNotFound, "", ""},
 	}
-
 	for _, c := range cases {
-		req, err := http.NewRequest(c.method, "", nil)
-		if err != nil {
-			t.Fatalf("case [%s] unexpected error making new request: %s", c.name, err)
+		r := httptest.NewRequest("OPTIONS", c.path, nil)
+		r.Header.Set("Origin", c.origin)
+		r.Header.Set(cors.RequestMethodHeader, c.method)
+		if len(c.headers) != 0 {
+			r.Header.Set(cors.RequestHeadersHeader, c.headers)
 		}
 		rr := httptest.NewRecorder()
-		wrappedCorsHandler := NewCORS(http.HandlerFunc(testHandler))
-		wrappedCorsHandler.ServeHTTP(rr, req)
-		if rr.Header().Get("Access-Control-Allow-Origin") != "*" {
-			t.Errorf("case [%s] Access-Control-Allow-Origin header -> expected: %s received: %s", c.name, "*",
-				rr.Header().Get("Access-Control-Allow-Origin"))
+		handler.ServeHTTP(rr, r)
+		if rr.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d", c.name, c.expectedStatus, rr.Code)
 		}
-		if rr.Header().Get("Access-Control-Allow-Methods") != "GET, PUT, POST, PATCH, DELETE" {
-			t.Errorf("case [%s] Access-Control-Allow-Methods header -> expected: %s received: %s", c.name,
-				"GET, PUT, POST, PATCH, DELETE", rr.Header().Get("Access-Control-Allow-Methods"))
+		// preflights are never passed on to the route
+		if rr.Code == http.StatusAccepted {
+			t.Errorf("case %s: preflight request reached the handler", c.name)
 		}
-		if rr.Header().Get("Access-Control-Allow-Headers") != "Content-Type, Authorization" {
-			t.Errorf("case [%s] Access-Control-Allow-Headers header -> expected: %s received: %s", c.name,
-				"Content-Type, Authorization", rr.Header().Get("Access-Control-Allow-Headers"))
+		vary := rr.Header().Values("Vary")
+		if len(vary) != 3 || vary[0] != "Origin" || vary[1] != cors.RequestMethodHeader || vary[2] != cors.RequestHeadersHeader {
+			t.Errorf("case %s: unexpected Vary headers %v", c.name, vary)
 		}
-		if rr.Header().Get("Access-Control-Expose-Headers") != "Authorization" {
-			t.Errorf("case [%s] Access-Control-Expose-Headers header -> expected: %s received: %s", c.name, "Authorization",
-				rr.Header().Get("Access-Control-Expose-Headers"))
+		if c.expectedStatus != http.StatusNoContent {
+			if allowOrigin := rr.Header().Get(cors.AllowOriginHeader); len(allowOrigin) != 0 {
+				t.Errorf("case %s: expected no %s header but got %q", c.name, cors.AllowOriginHeader, allowOrigin)
+			}
+			continue
 		}
-		if rr.Header().Get("Access-Control-Max-Age") != "600" {
-			t.Errorf("case [%s] Access-Control-Max-Age header -> expected: %s received: %s", c.name, "600",
-				rr.Header().Get("Access-Control-Max-Age"))
+		expected := map[string]string{
+			cors.AllowOriginHeader:      c.origin,
+			cors.AllowCredentialsHeader: "true",
+			cors.AllowMethodsHeader:     c.expectedAllow,
+			cors.AllowHeadersHeader:     c.expectedHeads,
+			cors.MaxAgeHeader:           "3600",
 		}
+		for name, value := range expected {
+			if rr.Header().Get(name) != value {
+				t.Errorf("case %s: expected %s %q but got %q", c.name, name, value, rr.Header().Get(name))
+			}
+		}
+	}
+}
 
-		if rr.Result().StatusCode != c.expectedStatusCode {
-			t.Errorf("case [%s] returned wrong status code -> expected: %d received: %d", c.name, c.expectedStatusCode,
-				rr.Result().StatusCode)
+func TestCORSRequests(t *testing.T) {
+	handler := newCORSTestHandler(t, corsTestConfig)
+	cases := []struct {
+		name           string
+		method         string
+		path           string
+		origin         string
+		expectedStatus int
+		allowed        bool
+	}{
+		{"allowed origin", "POST", "/v1/users", "https://example.com", http.StatusAccepted, true},
+		{"wildcard subdomain", "GET", "/v1/users/me", "https://deep.app.example.org", http.StatusAccepted, true},
+		{"other origin is served but not readable", "POST", "/v1/users", "https://evil.com", http.StatusAccepted, false},
+		{"same-origin request", "POST", "/v1/users", "", http.StatusAccepted, false},
+		{"route disabled", "GET", "/v1/admin", "https://example.com", http.StatusAccepted, false},
+		{"errors are readable", "GET", "/v1/users", "https://example.com", http.StatusMethodNotAllowed, true},
+		{"OPTIONS that is not a preflight reaches the route", "OPTIONS", "/v1/users/me", "https://example.com", http.StatusAccepted, true},
+		{"OPTIONS the route does not allow", "OPTIONS", "/v1/users", "https://example.com", http.StatusMethodNotAllowed, true},
+		{"no route", "GET", "/v2/users", "https://example.com", http.StatusNotFound, false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, nil)
+		if len(c.origin) != 0 {
+			r.Header.Set("Origin", c.origin)
 		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		if rr.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d", c.name, c.expectedStatus, rr.Code)
+		}
+		allowOrigin := rr.Header().Get(cors.AllowOriginHeader)
+		if c.allowed && (allowOrigin != c.origin || rr.Header().Get(cors.AllowCredentialsHeader) != "true" ||
+			rr.Header().Get(cors.ExposeHeadersHeader) != "Authorization, X-Request-ID") {
+			t.Errorf("case %s: expected the origin to be allowed but got headers %v", c.name, rr.Header())
+		}
+		if !c.allowed && len(allowOrigin) != 0 {
+			t.Errorf("case %s: expected the origin not to be allowed but got %q", c.name, allowOrigin)
+		}
+		if len(rr.Header().Get(cors.AllowMethodsHeader)) != 0 {
+			t.Errorf("case %s: unexpected preflight headers %v", c.name, rr.Header())
+		}
+		// caches keep the responses of routes with a policy apart by origin
+		varies := c.path != "/v1/admin" && c.path != "/v2/users"
+		if (rr.Header().Get("Vary") == "Origin") != varies {
+			t.Errorf("case %s: unexpected Vary header %q", c.name, rr.Header().Get("Vary"))
+		}
+	}
+}
+
+func TestCORSAnyOrigin(t *testing.T) {
+	handler := newCORSTestHandler(t, `{"cors": {"origins": ["*"]}, "routes": [{"prefix": "/v1/data", "target": "test"}]}`)
+	r := httptest.NewRequest("GET", "/v1/data", nil)
+	r.Header.Set("Origin", "https://anywhere.test")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+	if rr.Header().Get(cors.AllowOriginHeader) != "*" || len(rr.Header().Get(cors.AllowCredentialsHeader)) != 0 {
+		t.Errorf("expected any origin to be allowed without credentials but got %v", rr.Header())
+	}
+	if len(rr.Header().Get("Vary")) != 0 {
+		t.Errorf("expected the response not to vary by origin but got %q", rr.Header().Get("Vary"))
+	}
+}
+
+func TestCORSWithoutPolicy(t *testing.T) {
+	handler := newCORSTestHandler(t, `{"routes": [{"prefix": "/v1/data", "target": "test"}]}`)
+	r := httptest.NewRequest("OPTIONS", "/v1/data", nil)
+	r.Header.Set("Origin", "https://example.com")
+	r.Header.Set(cors.RequestMethodHeader, "GET")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+	if rr.Code != http.StatusForbidden || len(rr.Header().Get(cors.AllowOriginHeader)) != 0 {
+		t.Errorf("expected the preflight to be refused but got %d %v", rr.Code, rr.Header())
+	}
+	r = httptest.NewRequest("GET", "/v1/data", nil)
+	r.Header.Set("Origin", "https://example.com")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+	if rr.Code != http.StatusAccepted || len(rr.Header().Get(cors.AllowOriginHeader)) != 0 {
+		t.Errorf("expected the request to be served without CORS headers but got %d %v", rr.Code, rr.Header())
 	}
 }
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ForwardedFor is a handler that takes the address of the client from the X-Forwarded-For
+// header of requests sent through the proxies in front of the gateway. Clients can set the
+// header to anything, so it is only believed as far back as the proxies the gateway trusts
+// added to it; otherwise a client could pose as another address on every request, such as
+// to get round the rate limits on signing in.
+type ForwardedFor struct {
+	Handler http.Handler
+	// Trusted are the networks of the proxies in front of the gateway
+	Trusted []*net.IPNet
+}
+
+// NewForwardedFor makes a new wrapper taking the client address of requests
+// from the `trusted` proxies from the X-Forwarded-For header
+func NewForwardedFor(handlerToWrap http.Handler, trusted []*net.IPNet) *ForwardedFor {
+	return &ForwardedFor{Handler: handlerToWrap, Trusted: trusted}
+}
+
+func (ff *ForwardedFor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if addr := ff.clientAddr(r); addr != r.RemoteAddr {
+		r = r.WithContext(r.Context())
+		r.RemoteAddr = addr
+	}
+	ff.Handler.ServeHTTP(w, r)
+}
+
+// clientAddr returns the address of the client: the address the request came from,
+// unless it is a trusted proxy, in which case the address the proxy forwarded it
+// for, going back through X-Forwarded-For for as long as the addresses are trusted
+func (ff *ForwardedFor) clientAddr(r *http.Request) string {
+	forwarded := []string{}
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(header, ",") {
+			forwarded = append(forwarded, strings.TrimSpace(addr))
+		}
+	}
+	addr := r.RemoteAddr
+	for i := len(forwarded) - 1; i >= 0 && ff.trusts(addr); i-- {
+		if net.ParseIP(forwarded[i]) == nil {
+			break
+		}
+		addr = forwarded[i]
+	}
+	return addr
+}
+
+// trusts returns whether the address, with or without a port, is of a trusted proxy
+func (ff *ForwardedFor) trusts(addr string) bool {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range ff.Trusted {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
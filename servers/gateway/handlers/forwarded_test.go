@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedFor(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	cases := []struct {
+		name       string
+		remoteAddr string
+		forwarded  []string
+		expectedIP string
+	}{
+		{"direct", "203.0.113.5:5555", nil, "203.0.113.5"},
+		{"forged by a client", "203.0.113.5:5555", []string{"198.51.100.1"}, "203.0.113.5"},
+		{"through a trusted proxy", "10.0.0.2:5555", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"forged through a trusted proxy", "10.0.0.2:5555", []string{"192.0.2.7, 198.51.100.1"}, "198.51.100.1"},
+		{"through trusted proxies", "10.0.0.2:5555", []string{"198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"in separate headers", "10.0.0.2:5555", []string{"192.0.2.7", "198.51.100.1"}, "198.51.100.1"},
+		{"malformed", "10.0.0.2:5555", []string{"198.51.100.1, bogus"}, "10.0.0.2"},
+		{"only trusted proxies", "10.0.0.2:5555", []string{"10.0.0.3"}, "10.0.0.3"},
+	}
+	for _, c := range cases {
+		var ip string
+		handler := NewForwardedFor(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip = clientIP(r)
+		}), []*net.IPNet{proxies})
+		r := httptest.NewRequest("POST", "/v1/sessions", nil)
+		r.RemoteAddr = c.remoteAddr
+		for _, forwarded := range c.forwarded {
+			r.Header.Add("X-Forwarded-For", forwarded)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+		if ip != c.expectedIP {
+			t.Errorf("case %s: expected client IP %s but got %s", c.name, c.expectedIP, ip)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/my/repo/servers/gateway/idempotency"
+	"github.com/my/repo/servers/gateway/logging"
+	"github.com/my/repo/servers/gateway/metrics"
+	"github.com/my/repo/servers/gateway/problem"
+	"github.com/my/repo/servers/gateway/sessions"
+)
+
+// IdempotencyKeyHeader is the header clients send a key for each request in, reusing
+// it when they retry the request, so the request is only carried out once
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader tells clients a response was sent before, to the first request with its key
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// idempotencyMaxKey is the longest key accepted
+const idempotencyMaxKey = 255
+
+// idempotencyMaxBytes is the largest request body read to fingerprint the request,
+// and the largest response recorded
+const idempotencyMaxBytes = 1 << 20
+
+// What happened to requests with an Idempotency-Key
+const (
+	idempotencyNew        = "new"
+	idempotencyReplayed   = "replayed"
+	idempotencyInProgress = "in_progress"
+	idempotencyMismatch   = "mismatch"
+	idempotencyError      = "error"
+)
+
+var idempotencyRequests = metrics.Default.NewCounterVec("gateway_idempotency_requests_total",
+	"Requests sent with an Idempotency-Key, by whether they were carried out, replayed or refused.", "result")
+
+// IdempotencyHandler carries out each POST and PATCH request sent with an Idempotency-Key
+// once, recording its response and replaying it when the client retries the request with
+// the same key, whether the request was for a handler of the gateway or an upstream.
+// Keys are held per signed-in user, or shared by everyone not signed in; a key is only
+// replayed for a request with the same method, URI and body as the first. A retry sent
+// while the first request is in progress is refused with 409, and reusing a key for
+// another request with 422. Responses with a 5xx status are not recorded, so retrying
+// them carries the request out again.
+type IdempotencyHandler struct {
+	Handler http.Handler
+	Store   idempotency.Store
+	// TTL is how long responses are kept for retries
+	TTL time.Duration
+	// LockTTL is the longest a request is considered in progress
+	LockTTL time.Duration
+	ctx     *HandlerContext
+}
+
+// NewIdempotency makes a new wrapper replaying the responses to requests with an
+// Idempotency-Key, keeping them in `store` for `ttl`
+func NewIdempotency(handlerToWrap http.Handler, ctx *HandlerContext, store idempotency.Store, ttl time.Duration) *IdempotencyHandler {
+	return &IdempotencyHandler{Handler: handlerToWrap, Store: store, TTL: ttl, LockTTL: idempotency.DefaultLockTTL, ctx: ctx}
+}
+
+func (ih *IdempotencyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get(IdempotencyKeyHeader)
+	if len(key) == 0 || (r.Method != "POST" && r.Method != "PATCH") {
+		ih.Handler.ServeHTTP(w, r)
+		return
+	}
+	if len(key) > idempotencyMaxKey {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest,
+			IdempotencyKeyHeader+" must be at most "+strconv.Itoa(idempotencyMaxKey)+" characters")
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, idempotencyMaxBytes+1))
+	if err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "error reading request body")
+		return
+	}
+	if len(body) > idempotencyMaxBytes {
+		problem.Error(w, r, http.StatusRequestEntityTooLarge, problem.CodeRequestTooLarge, "request body is too large")
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	fingerprint := idempotency.Fingerprint(r.Method, r.URL.RequestURI(), body)
+	key = ih.scope(r) + ":" + key
+
+	record, err := ih.Store.Get(key)
+	if err != nil {
+		ih.bypass(w, r, err)
+		return
+	}
+	if record != nil {
+		ih.replay(w, r, record, fingerprint)
+		return
+	}
+	unlock, err := ih.Store.Lock(key, ih.LockTTL)
+	if err == idempotency.ErrInProgress {
+		logging.Annotate(r.Context(), "idempotency", idempotencyInProgress)
+		idempotencyRequests.With(idempotencyInProgress).Inc()
+		w.Header().Set("Retry-After", "1")
+		problem.Error(w, r, http.StatusConflict, problem.CodeRequestInProgress,
+			"a request with this "+IdempotencyKeyHeader+" is in progress, please try again later")
+		return
+	}
+	if err != nil {
+		ih.bypass(w, r, err)
+		return
+	}
+	defer unlock()
+	// the first request may have finished between looking for its response and locking
+	if record, err := ih.Store.Get(key); err == nil && record != nil {
+		ih.replay(w, r, record, fingerprint)
+		return
+	}
+
+	logging.Annotate(r.Context(), "idempotency", idempotencyNew)
+	idempotencyRequests.With(idempotencyNew).Inc()
+	buf := &responseBuffer{header: http.Header{}}
+	ih.Handler.ServeHTTP(buf, r)
+	if buf.status == 0 {
+		buf.status = http.StatusOK
+	}
+	record = &idempotency.Record{Fingerprint: fingerprint, Status: buf.status, Header: buf.header,
+		Body: buf.body.Bytes(), Stored: time.Now()}
+	// the response is recorded even if the client has gone, as it is the client
+	// that timed out waiting for it that will retry
+	if record.Status < http.StatusInternalServerError && len(record.Body) <= idempotencyMaxBytes {
+		if err := ih.Store.Set(key, record, ih.TTL); err != nil {
+			logging.FromContext(r.Context()).Errorf("error recording response for idempotency key: %v", err)
+		}
+	}
+	writeRecord(w, record)
+}
+
+// scope returns what the key of the request is held under: the signed-in user, or
+// anonymous for requests without one, such as signing up. Anonymous keys can only
+// be replayed by a request with the same body, which whoever sends it already knows.
+func (ih *IdempotencyHandler) scope(r *http.Request) string {
+	sessionState := &SessionState{}
+	if _, err := sessions.GetState(r, ih.ctx.SigningKey, ih.ctx.SessionStore, sessionState); err == nil && sessionState.User != nil {
+		return "user:" + strconv.FormatInt(sessionState.User.ID, 10)
+	}
+	return "anonymous"
+}
+
+// bypass carries out the request without recording its response, as the store failed
+func (ih *IdempotencyHandler) bypass(w http.ResponseWriter, r *http.Request, err error) {
+	// an outage of the store should not take the routes down with it
+	logging.FromContext(r.Context()).Errorf("error checking idempotency key, handling request: %v", err)
+	logging.Annotate(r.Context(), "idempotency", idempotencyError)
+	idempotencyRequests.With(idempotencyError).Inc()
+	ih.Handler.ServeHTTP(w, r)
+}
+
+// replay responds with the recorded response, unless it was the response to another request
+func (ih *IdempotencyHandler) replay(w http.ResponseWriter, r *http.Request, record *idempotency.Record, fingerprint string) {
+	if record.Fingerprint != fingerprint {
+		logging.Annotate(r.Context(), "idempotency", idempotencyMismatch)
+		idempotencyRequests.With(idempotencyMismatch).Inc()
+		problem.Error(w, r, http.StatusUnprocessableEntity, problem.CodeIdempotencyKeyReused,
+			IdempotencyKeyHeader+" was already used for another request")
+		return
+	}
+	logging.Annotate(r.Context(), "idempotency", idempotencyReplayed)
+	idempotencyRequests.With(idempotencyReplayed).Inc()
+	w.Header().Set(IdempotentReplayedHeader, "true")
+	writeRecord(w, record)
+}
+
+// writeRecord writes the recorded response
+func writeRecord(w http.ResponseWriter, record *idempotency.Record) {
+	header := w.Header()
+	for name, values := range record.Header {
+		for _, value := range values {
+			header.Add(name, value)
+		}
+	}
+	header.Set("Content-Length", strconv.Itoa(len(record.Body)))
+	w.WriteHeader(record.Status)
+	w.Write(record.Body)
+}
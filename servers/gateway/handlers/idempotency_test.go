@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/my/repo/servers/gateway/idempotency"
+	"github.com/my/repo/servers/gateway/models/users"
+	"github.com/my/repo/servers/gateway/sessions"
+)
+
+var errIdempotencyStoreDown = errors.New("connection refused")
+
+// failingIdempotencyStore is a store that is down
+type failingIdempotencyStore struct{}
+
+func (failingIdempotencyStore) Get(string) (*idempotency.Record, error) {
+	return nil, errIdempotencyStoreDown
+}
+
+func (failingIdempotencyStore) Set(string, *idempotency.Record, time.Duration) error {
+	return errIdempotencyStoreDown
+}
+
+func (failingIdempotencyStore) Lock(string, time.Duration) (func(), error) {
+	return nil, errIdempotencyStoreDown
+}
+
+func TestIdempotency(t *testing.T) {
+	signingKey := "the key"
+	sessStore := sessions.NewMemStore(time.Hour, time.Minute)
+	ctx := &HandlerContext{SigningKey: signingKey, SessionStore: sessStore}
+	begin := func(id int64) string {
+		sid, err := sessions.BeginSession(signingKey, sessStore, &SessionState{time.Now(), &users.User{ID: id}}, httptest.NewRecorder())
+		if err != nil {
+			t.Fatalf("error beginning session: %v", err)
+		}
+		return "Bearer " + string(sid)
+	}
+	seven, eight := begin(7), begin(8)
+
+	var calls int32
+	status := http.StatusCreated
+	handler := NewIdempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&calls, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Authorization", "Bearer new-session")
+		w.WriteHeader(status)
+		w.Write([]byte(`{"call":` + strconv.Itoa(int(n)) + `}`))
+	}), ctx, idempotency.NewMemoryStore(), time.Hour)
+
+	send := func(method string, path string, key string, auth string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if len(key) != 0 {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		if len(auth) != 0 {
+			req.Header.Set("Authorization", auth)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	cases := []struct {
+		name             string
+		method           string
+		path             string
+		key              string
+		auth             string
+		body             string
+		expectedStatus   int
+		expectedBody     string
+		expectedReplayed bool
+	}{
+		{"First Sign Up", "POST", "/v1/users", "signup-1", "", `{"email":"a@b.c"}`, http.StatusCreated, `{"call":1}`, false},
+		{"Retried Sign Up", "POST", "/v1/users", "signup-1", "", `{"email":"a@b.c"}`, http.StatusCreated, `{"call":1}`, true},
+		{"Key Reused For Other Body", "POST", "/v1/users", "signup-1", "", `{"email":"d@e.f"}`, http.StatusUnprocessableEntity, "", false},
+		{"Key Reused For Other Path", "POST", "/v1/sessions", "signup-1", "", `{"email":"a@b.c"}`, http.StatusUnprocessableEntity, "", false},
+		{"No Key", "POST", "/v1/users", "", "", `{"email":"a@b.c"}`, http.StatusCreated, `{"call":2}`, false},
+		{"Signed In User", "POST", "/v1/dashboards", "dash-1", seven, `{"title":"t"}`, http.StatusCreated, `{"call":3}`, false},
+		{"Signed In User Retrying", "POST", "/v1/dashboards", "dash-1", seven, `{"title":"t"}`, http.StatusCreated, `{"call":3}`, true},
+		{"Another User With The Same Key", "POST", "/v1/dashboards", "dash-1", eight, `{"title":"t"}`, http.StatusCreated, `{"call":4}`, false},
+		{"Not Signed In With The Same Key", "POST", "/v1/dashboards", "dash-1", "", `{"title":"t"}`, http.StatusCreated, `{"call":5}`, false},
+		{"Patch", "PATCH", "/v1/users/me", "patch-1", seven, `{"firstName":"x"}`, http.StatusCreated, `{"call":6}`, false},
+		{"Patch Retried", "PATCH", "/v1/users/me", "patch-1", seven, `{"firstName":"x"}`, http.StatusCreated, `{"call":6}`, true},
+		{"Other Methods Ignore Keys", "DELETE", "/v1/sessions/mine", "delete-1", seven, "", http.StatusCreated, `{"call":7}`, false},
+		{"Other Methods Ignore Keys Retried", "DELETE", "/v1/sessions/mine", "delete-1", seven, "", http.StatusCreated, `{"call":8}`, false},
+		{"Key Too Long", "POST", "/v1/users", strings.Repeat("k", 256), "", `{}`, http.StatusBadRequest, "", false},
+	}
+	for _, c := range cases {
+		rr := send(c.method, c.path, c.key, c.auth, c.body)
+		if rr.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d: %s", c.name, c.expectedStatus, rr.Code, rr.Body.String())
+			continue
+		}
+		if len(c.expectedBody) != 0 && rr.Body.String() != c.expectedBody {
+			t.Errorf("case %s: expected body %s but got %s", c.name, c.expectedBody, rr.Body.String())
+		}
+		if replayed := rr.Header().Get(IdempotentReplayedHeader) == "true"; replayed != c.expectedReplayed {
+			t.Errorf("case %s: expected replayed=%v but got %v", c.name, c.expectedReplayed, rr.Header())
+		}
+		// the replayed response carries the session the client never received
+		if c.expectedReplayed && rr.Header().Get("Authorization") != "Bearer new-session" {
+			t.Errorf("case %s: expected the recorded headers but got %v", c.name, rr.Header())
+		}
+	}
+
+	// failed responses are not recorded, so retrying carries the request out again
+	status = http.StatusBadGateway
+	send("POST", "/v1/dashboards", "failing", seven, `{}`)
+	status = http.StatusCreated
+	if rr := send("POST", "/v1/dashboards", "failing", seven, `{}`); rr.Code != http.StatusCreated || rr.Header().Get(IdempotentReplayedHeader) != "" {
+		t.Errorf("expected the request to be carried out again after a 502 but got %d %v", rr.Code, rr.Header())
+	}
+}
+
+func TestIdempotencyInProgress(t *testing.T) {
+	ctx := &HandlerContext{SigningKey: "the key", SessionStore: sessions.NewMemStore(time.Hour, time.Minute)}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	var calls int32
+	handler := NewIdempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusCreated)
+	}), ctx, idempotency.NewMemoryStore(), time.Hour)
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/users", strings.NewReader(`{}`))
+		req.Header.Set(IdempotencyKeyHeader, "concurrent")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() {
+		first <- send()
+	}()
+	<-started
+	if rr := send(); rr.Code != http.StatusConflict || len(rr.Header().Get("Retry-After")) == 0 {
+		t.Errorf("expected the concurrent duplicate to be refused but got %d %v", rr.Code, rr.Header())
+	}
+	close(release)
+	if rr := <-first; rr.Code != http.StatusCreated {
+		t.Errorf("expected the first request to be carried out but got %d", rr.Code)
+	}
+	if rr := send(); rr.Code != http.StatusCreated || rr.Header().Get(IdempotentReplayedHeader) != "true" {
+		t.Errorf("expected the retry to be replayed but got %d %v", rr.Code, rr.Header())
+	}
+	if atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("expected the request to be carried out once but it was %d times", calls)
+	}
+}
+
+func TestIdempotencyStoreDown(t *testing.T) {
+	ctx := &HandlerContext{SigningKey: "the key", SessionStore: sessions.NewMemStore(time.Hour, time.Minute)}
+	handler := NewIdempotency(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}), ctx, failingIdempotencyStore{}, time.Hour)
+	req := httptest.NewRequest("POST", "/v1/users", strings.NewReader(`{}`))
+	req.Header.Set(IdempotencyKeyHeader, "k")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Errorf("expected the request to be carried out while the store is down but got %d", rr.Code)
+	}
+}
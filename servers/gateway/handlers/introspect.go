@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/my/repo/servers/gateway/introspect"
+	"github.com/my/repo/servers/gateway/logging"
+	"github.com/my/repo/servers/gateway/problem"
+	"github.com/my/repo/servers/gateway/sessions"
+)
+
+// introspectMaxBody is the largest form accepted by the introspection endpoint,
+// which only ever holds a single token
+const introspectMaxBody = 16 << 10
+
+// IntrospectionHandler tells the services behind the gateway about the session of a
+// session ID or access token, so they need neither trust X-User nor read the session
+// store themselves. It is only for the gateway's internal listener, and only answers
+// services with credentials for it.
+type IntrospectionHandler struct {
+	ctx *HandlerContext
+	// credentials are the secrets of the services allowed to introspect, by service name
+	credentials map[string]string
+	// roles are the roles of every signed-in user
+	roles []string
+	// idle is how long a session lasts unused, for stores that cannot tell its expiry
+	idle time.Duration
+}
+
+// NewIntrospection constructs a new IntrospectionHandler answering the services
+// in `credentials`, telling them users have `roles` and that sessions last `idle`
+// past their last use unless the session store knows better
+func NewIntrospection(ctx *HandlerContext, credentials map[string]string, roles []string, idle time.Duration) *IntrospectionHandler {
+	return &IntrospectionHandler{ctx: ctx, credentials: credentials, roles: roles, idle: idle}
+}
+
+// ServeHTTP responds to a POST of a form with the token, as described by RFC 7662,
+// with the session it belongs to, or {"active":false} if it does not belong to one
+func (ih *IntrospectionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		problem.Error(w, r, http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, "method must be POST")
+		return
+	}
+	service, ok := authenticateService(r, ih.credentials)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="introspection"`)
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthenticated, "service credentials required")
+		return
+	}
+	logging.Annotate(r.Context(), "service", service)
+	r.Body = http.MaxBytesReader(w, r.Body, introspectMaxBody)
+	if err := r.ParseForm(); err != nil {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "request must be a form holding the token")
+		return
+	}
+	token := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(r.PostForm.Get("token")), "Bearer "))
+	if len(token) == 0 {
+		problem.Error(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "token is required")
+		return
+	}
+
+	session, err := ih.introspect(r, token)
+	if err != nil {
+		if sessions.IsUnavailable(err) {
+			problem.Error(w, r, http.StatusServiceUnavailable, problem.CodeSessionsUnavailable,
+				"sessions are temporarily unavailable, please try again later")
+			return
+		}
+		problem.Internal(w, r, err)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
+
+// introspect returns the session the token belongs to, which is inactive if the token is
+// invalid or its session has expired or ended, or an error if the session store failed
+func (ih *IntrospectionHandler) introspect(r *http.Request, token string) (*introspect.Session, error) {
+	inactive := &introspect.Session{Active: false}
+	sid, err := sessions.ValidateID(token, ih.ctx.SigningKey)
+	if err != nil {
+		return inactive, nil
+	}
+	state := &SessionState{}
+	if err := ih.ctx.SessionStore.Get(sid, state); err != nil {
+		if err == sessions.ErrStateNotFound {
+			return inactive, nil
+		}
+		return nil, err
+	}
+	if state.User == nil {
+		return inactive, nil
+	}
+	// reading the session extends it by the idle time, unless its expiry is fixed
+	expiresAt := time.Now().Add(ih.idle)
+	if expirer, ok := ih.ctx.SessionStore.(sessions.Expirer); ok {
+		if expiresAt, err = expirer.Expiry(sid); err != nil {
+			if err == sessions.ErrStateNotFound {
+				return inactive, nil
+			}
+			return nil, err
+		}
+	}
+	user, err := json.Marshal(state.User)
+	if err != nil {
+		return nil, fmt.Errorf("error encoding user: %v", err)
+	}
+	return &introspect.Session{
+		Active:    true,
+		Session:   sid.Fingerprint(),
+		UserID:    state.User.ID,
+		Roles:     ih.roles,
+		BeginTime: state.BeginTime,
+		ExpiresAt: expiresAt,
+		User:      user,
+	}, nil
+}
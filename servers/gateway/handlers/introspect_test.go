@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/my/repo/servers/gateway/introspect"
+	"github.com/my/repo/servers/gateway/models/users"
+	"github.com/my/repo/servers/gateway/sessions"
+)
+
+func TestIntrospection(t *testing.T) {
+	signingKey := "the key"
+	memStore := sessions.NewMemStore(time.Hour, time.Minute)
+	tokenStore, err := sessions.NewTokenStore("", time.Minute, time.Hour, sessions.NewMemDenylist(time.Minute))
+	if err != nil {
+		t.Fatalf("error creating token store: %v", err)
+	}
+	begun := time.Now().Add(-time.Minute).Round(time.Second)
+	user := &users.User{ID: 7, UserName: "seven"}
+	begin := func(store sessions.Store) string {
+		sid, err := sessions.BeginSession(signingKey, store, &SessionState{begun, user}, httptest.NewRecorder())
+		if err != nil {
+			t.Fatalf("error beginning session: %v", err)
+		}
+		return string(sid)
+	}
+	sid := begin(memStore)
+	token := begin(tokenStore)
+	ended := begin(memStore)
+	memStore.Delete(sessions.SessionID(ended))
+
+	cases := []struct {
+		name           string
+		store          sessions.Store
+		method         string
+		service        string
+		secret         string
+		token          string
+		expectedStatus int
+		expectedActive bool
+		expectedExpiry time.Duration
+	}{
+		{"Session ID", memStore, "POST", "reports", "s3cret", sid, http.StatusOK, true, time.Hour},
+		{"Bearer Session ID", memStore, "POST", "reports", "s3cret", "Bearer " + sid, http.StatusOK, true, time.Hour},
+		{"Access Token", tokenStore, "POST", "reports", "s3cret", token, http.StatusOK, true, time.Minute},
+		{"Ended Session", memStore, "POST", "reports", "s3cret", ended, http.StatusOK, false, 0},
+		{"Invalid Token", memStore, "POST", "reports", "s3cret", "nope", http.StatusOK, false, 0},
+		{"Token Of Other Store", memStore, "POST", "reports", "s3cret", token, http.StatusOK, false, 0},
+		{"Missing Token", memStore, "POST", "reports", "s3cret", "", http.StatusBadRequest, false, 0},
+		{"Wrong Secret", memStore, "POST", "reports", "guess", sid, http.StatusUnauthorized, false, 0},
+		{"Unknown Service", memStore, "POST", "dashboards", "s3cret", sid, http.StatusUnauthorized, false, 0},
+		{"No Credentials", memStore, "POST", "", "", sid, http.StatusUnauthorized, false, 0},
+		{"Wrong Method", memStore, "GET", "reports", "s3cret", sid, http.StatusMethodNotAllowed, false, 0},
+	}
+	for _, c := range cases {
+		ctx := &HandlerContext{SigningKey: signingKey, SessionStore: c.store}
+		handler := NewIntrospection(ctx, map[string]string{"reports": "s3cret"}, []string{"user"}, time.Hour)
+		form := url.Values{"token": {c.token}}
+		req := httptest.NewRequest(c.method, introspect.Path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if len(c.service) != 0 {
+			req.SetBasicAuth(c.service, c.secret)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d: %s", c.name, c.expectedStatus, rr.Code, rr.Body.String())
+			continue
+		}
+		if c.expectedStatus == http.StatusUnauthorized && !strings.HasPrefix(rr.Header().Get("WWW-Authenticate"), "Basic") {
+			t.Errorf("case %s: expected a Basic challenge but got %v", c.name, rr.Header())
+		}
+		if rr.Code != http.StatusOK {
+			continue
+		}
+		session := &introspect.Session{}
+		if err := json.Unmarshal(rr.Body.Bytes(), session); err != nil {
+			t.Fatalf("case %s: error decoding response %q: %v", c.name, rr.Body.String(), err)
+		}
+		if session.Active != c.expectedActive {
+			t.Errorf("case %s: expected active=%v but got %s", c.name, c.expectedActive, rr.Body.String())
+		}
+		if !c.expectedActive {
+			if session.UserID != 0 || len(session.User) != 0 {
+				t.Errorf("case %s: expected nothing about the session but got %s", c.name, rr.Body.String())
+			}
+			continue
+		}
+		if session.UserID != 7 || !session.BeginTime.Equal(begun) || len(session.Roles) != 1 || session.Roles[0] != "user" {
+			t.Errorf("case %s: unexpected session %s", c.name, rr.Body.String())
+		}
+		// the session is identified without revealing its token
+		if len(session.Session) == 0 || strings.Contains(rr.Body.String(), strings.TrimPrefix(c.token, "Bearer ")) {
+			t.Errorf("case %s: expected the session's fingerprint but got %q", c.name, session.Session)
+		}
+		decoded := &users.User{}
+		if err := json.Unmarshal(session.User, decoded); err != nil || decoded.UserName != "seven" {
+			t.Errorf("case %s: unexpected user %s", c.name, session.User)
+		}
+		if until := time.Until(session.ExpiresAt); until > c.expectedExpiry || until < c.expectedExpiry-5*time.Second {
+			t.Errorf("case %s: expected the session to expire in %v but got %v", c.name, c.expectedExpiry, session.ExpiresAt)
+		}
+		if rr.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("case %s: expected the response not to be cached", c.name)
+		}
+	}
+}
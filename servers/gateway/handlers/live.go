@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/my/repo/servers/gateway/live"
+	"github.com/my/repo/servers/gateway/logging"
+	"github.com/my/repo/servers/gateway/problem"
+	"github.com/my/repo/servers/gateway/routing"
+	"github.com/my/repo/servers/gateway/sessions"
+	"golang.org/x/net/websocket"
+)
+
+// LiveCookie is the cookie browsers may carry their session ID in to the live updates
+// endpoint, besides the Authorization header and auth query parameter, as the
+// WebSocket API cannot set headers
+const LiveCookie = "auth"
+
+const (
+	// DefaultHeartbeatInterval is how often live connections are sent a ping
+	DefaultHeartbeatInterval = 30 * time.Second
+	// liveWriteTimeout is how long a client has to take each message
+	liveWriteTimeout = 10 * time.Second
+	// liveMaxMessage is the largest message a client may send
+	liveMaxMessage = 4 << 10
+	// liveReplies is how many replies to a client's messages may wait to be sent,
+	// beyond which its messages are not read until it catches up
+	liveReplies = 8
+)
+
+// Types of the messages of the live updates protocol
+const (
+	liveSubscribe    = "subscribe"
+	liveUnsubscribe  = "unsubscribe"
+	liveSubscribed   = "subscribed"
+	liveUnsubscribed = "unsubscribed"
+	liveEvent        = "event"
+	liveError        = "error"
+	livePing         = "ping"
+	livePong         = "pong"
+)
+
+// liveMessage is a message of the live updates protocol, in either direction
+type liveMessage struct {
+	Type  string          `json:"type"`
+	Topic string          `json:"topic,omitempty"`
+	Data  json.RawMessage `json:"data,omitempty"`
+	Error string          `json:"error,omitempty"`
+}
+
+// LiveHandler serves the WebSocket endpoint signed-in users receive live updates from.
+// Clients send {"type": "subscribe", "topic": "dashboard:<id>"} to receive the events of a
+// topic as {"type": "event", "topic": ..., "data": ...}, and {"type": "unsubscribe", ...}
+// to stop. They are sent {"type": "ping"} every HeartbeatInterval and must answer with
+// {"type": "pong"}, or send anything else, within two intervals or be disconnected.
+// Pages on other origins may only connect if the route's CORS policy allows them.
+type LiveHandler struct {
+	Hub    *live.Hub
+	Router *routing.Router
+	// HeartbeatInterval is how often clients are sent a ping
+	HeartbeatInterval time.Duration
+	ctx               *HandlerContext
+}
+
+// NewLive makes a new live updates handler, subscribing clients to the topics of `hub`
+// and allowing the origins the CORS policies of the routes of `router` allow
+func NewLive(ctx *HandlerContext, hub *live.Hub, router *routing.Router) *LiveHandler {
+	return &LiveHandler{Hub: hub, Router: router, HeartbeatInterval: DefaultHeartbeatInterval, ctx: ctx}
+}
+
+func (lh *LiveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// browsers send cookies with connections made by any page, so connections
+	// from other origins' pages are refused unless the origin is trusted
+	if !lh.allowsOrigin(r) {
+		problem.Error(w, r, http.StatusForbidden, problem.CodeOriginNotAllowed, "origin not allowed")
+		return
+	}
+	sessionState, err := lh.sessionState(r)
+	if err != nil {
+		sessionProblem(w, r, err)
+		return
+	}
+	logging.Annotate(r.Context(), "userId", sessionState.User.ID)
+	subscriber, err := lh.Hub.NewSubscriber(sessionState.User.ID)
+	if err == live.ErrTooManyConnections {
+		problem.Error(w, r, http.StatusTooManyRequests, problem.CodeTooManyConnections, "too many live connections")
+		return
+	} else if err != nil {
+		problem.Error(w, r, http.StatusServiceUnavailable, problem.CodeUnavailable, "live updates are unavailable")
+		return
+	}
+	defer subscriber.Close()
+	websocket.Server{Handler: func(conn *websocket.Conn) {
+		lh.serve(conn, subscriber)
+	}}.ServeHTTP(w, r)
+}
+
+// allowsOrigin reports whether the page the request comes from may connect:
+// clients other than browsers and pages on the gateway's own origin may,
+// as may those on origins the route's CORS policy allows
+func (lh *LiveHandler) allowsOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && u.Host == r.Host {
+		return true
+	}
+	policy, _ := lh.Router.CORS(r.URL.Path)
+	return policy != nil && policy.AllowsOrigin(origin)
+}
+
+// sessionState finds the session of the request, by its Authorization header,
+// auth query parameter or LiveCookie, unless the route already required one
+func (lh *LiveHandler) sessionState(r *http.Request) (*SessionState, error) {
+	if sessionState, found := SessionStateFrom(r.Context()); found {
+		return sessionState, nil
+	}
+	if len(r.Header.Get("Authorization")) == 0 && len(r.URL.Query().Get("auth")) == 0 {
+		if cookie, err := r.Cookie(LiveCookie); err == nil {
+			r = r.Clone(r.Context())
+			r.Header.Set("Authorization", "Bearer "+cookie.Value)
+		}
+	}
+	sessionState := &SessionState{}
+	if _, err := sessions.GetState(r, lh.ctx.SigningKey, lh.ctx.SessionStore, sessionState); err != nil {
+		return nil, err
+	}
+	return sessionState, nil
+}
+
+// serve reads the client's messages until it goes away, while the events of the
+// topics it subscribes to, the replies to its messages and pings are sent to it
+func (lh *LiveHandler) serve(conn *websocket.Conn, subscriber *live.Subscriber) {
+	conn.MaxPayloadBytes = liveMaxMessage
+	replies := make(chan *liveMessage, liveReplies)
+	stopped := make(chan struct{})
+	go lh.write(conn, subscriber, replies, stopped)
+	defer close(stopped)
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * lh.HeartbeatInterval))
+		msg := &liveMessage{}
+		if err := websocket.JSON.Receive(conn, msg); err != nil {
+			switch err.(type) {
+			case *json.SyntaxError, *json.UnmarshalTypeError:
+				// answered as a message of an unknown type
+				msg.Type = ""
+			default:
+				return
+			}
+		}
+		reply := &liveMessage{Type: liveError, Topic: msg.Topic}
+		switch msg.Type {
+		case liveSubscribe:
+			if err := subscriber.Subscribe(msg.Topic); err != nil {
+				reply.Error = err.Error()
+			} else {
+				reply.Type = liveSubscribed
+			}
+		case liveUnsubscribe:
+			subscriber.Unsubscribe(msg.Topic)
+			reply.Type = liveUnsubscribed
+		case livePong:
+			continue
+		default:
+			reply.Error = `messages are JSON objects with a "type" of "subscribe", "unsubscribe" or "pong"`
+		}
+		select {
+		case replies <- reply:
+		case <-subscriber.Done():
+			return
+		}
+	}
+}
+
+// write sends the client its events, replies and pings until `stopped` is closed, the
+// subscriber is dropped or the client takes too long to take a message, and then closes
+// the connection
+func (lh *LiveHandler) write(conn *websocket.Conn, subscriber *live.Subscriber, replies <-chan *liveMessage, stopped <-chan struct{}) {
+	defer conn.Close()
+	heartbeat := time.NewTicker(lh.HeartbeatInterval)
+	defer heartbeat.Stop()
+	send := func(msg *liveMessage) bool {
+		conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+		return websocket.JSON.Send(conn, msg) == nil
+	}
+	for {
+		var msg *liveMessage
+		select {
+		case event := <-subscriber.Events():
+			msg = &liveMessage{Type: liveEvent, Topic: event.Topic, Data: event.Data}
+		case msg = <-replies:
+		case <-heartbeat.C:
+			msg = &liveMessage{Type: livePing}
+		case <-subscriber.Done():
+			// the client is told why, so it knows to reconnect
+			send(&liveMessage{Type: liveError, Error: subscriber.Err().Error()})
+			return
+		case <-stopped:
+			return
+		}
+		if !send(msg) {
+			return
+		}
+	}
+}
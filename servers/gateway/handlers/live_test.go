@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/my/repo/servers/gateway/live"
+	"github.com/my/repo/servers/gateway/models/users"
+	"github.com/my/repo/servers/gateway/routing"
+	"github.com/my/repo/servers/gateway/sessions"
+	"golang.org/x/net/websocket"
+)
+
+// newLiveTestServer serves the live updates endpoint of a router allowing pages on
+// https://example.com, returning the ID of a session of user 7 to connect with
+func newLiveTestServer(t *testing.T, store sessions.Store) (*httptest.Server, *LiveHandler, string) {
+	signingKey := "the key"
+	ctx := &HandlerContext{SigningKey: signingKey, SessionStore: store}
+	router := routing.NewRouter(map[string]http.Handler{}, nil, nil)
+	lh := NewLive(ctx, live.NewHub(), router)
+	router.Builtins["live"] = lh
+	cfg, err := routing.ParseConfig([]byte(`{
+		"cors": {"origins": ["https://example.com"], "credentials": true},
+		"routes": [{"prefix": "/v1/live", "target": "live", "methods": ["GET"]}]
+	}`))
+	if err != nil {
+		t.Fatalf("error parsing routes: %v", err)
+	}
+	if err := router.Apply(cfg); err != nil {
+		t.Fatalf("error applying routes: %v", err)
+	}
+	sid := ""
+	if _, ok := store.(*sessions.MemStore); ok {
+		id, err := sessions.BeginSession(signingKey, store, &SessionState{time.Now(), &users.User{ID: 7}}, httptest.NewRecorder())
+		if err != nil {
+			t.Fatalf("error beginning session: %v", err)
+		}
+		sid = string(id)
+	}
+	return httptest.NewServer(router), lh, sid
+}
+
+// dialLive connects to the live updates endpoint of the server from a page on `origin`
+func dialLive(t *testing.T, server *httptest.Server, query string, header http.Header, origin string) *websocket.Conn {
+	cfg, err := websocket.NewConfig(strings.Replace(server.URL, "http", "ws", 1)+"/v1/live"+query, origin)
+	if err != nil {
+		t.Fatalf("error configuring connection: %v", err)
+	}
+	cfg.Header = header
+	conn, err := websocket.DialConfig(cfg)
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	return conn
+}
+
+// receiveLive returns the next message sent to the client, failing if none comes
+func receiveLive(t *testing.T, conn *websocket.Conn) *liveMessage {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	msg := &liveMessage{}
+	if err := websocket.JSON.Receive(conn, msg); err != nil {
+		t.Fatalf("error receiving message: %v", err)
+	}
+	return msg
+}
+
+func TestLiveRefusals(t *testing.T) {
+	server, lh, sid := newLiveTestServer(t, sessions.NewMemStore(time.Hour, time.Minute))
+	defer server.Close()
+	lh.Hub.MaxConnectionsPerUser = 0
+	unavailableServer, unavailable, _ := newLiveTestServer(t, unavailableStore{})
+	unavailableServer.Close()
+	cases := []struct {
+		name           string
+		handler        http.Handler
+		origin         string
+		auth           string
+		expectedStatus int
+	}{
+		{"no session", lh, "", "", http.StatusUnauthorized},
+		{"invalid session", lh, "", "Bearer forged!", http.StatusUnauthorized},
+		{"untrusted origin", lh, "https://evil.example", "Bearer " + sid, http.StatusForbidden},
+		{"sessions unavailable", unavailable, "", "Bearer " + sid, http.StatusServiceUnavailable},
+		{"too many connections", lh, "https://example.com", "Bearer " + sid, http.StatusTooManyRequests},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/v1/live", nil)
+		r.Header.Set("Origin", c.origin)
+		r.Header.Set("Authorization", c.auth)
+		rr := httptest.NewRecorder()
+		c.handler.ServeHTTP(rr, r)
+		if rr.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d", c.name, c.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func TestLiveUpdates(t *testing.T) {
+	server, lh, sid := newLiveTestServer(t, sessions.NewMemStore(time.Hour, time.Minute))
+	defer server.Close()
+	connections := []struct {
+		name   string
+		query  string
+		header http.Header
+		origin string
+	}{
+		{"auth query", "?auth=Bearer%20" + sid, nil, server.URL},
+		{"cookie from a trusted origin", "", http.Header{"Cookie": {LiveCookie + "=" + sid}}, "https://example.com"},
+	}
+	for _, c := range connections {
+		conn := dialLive(t, server, c.query, c.header, c.origin)
+		websocket.JSON.Send(conn, &liveMessage{Type: liveSubscribe, Topic: "dashboard:1"})
+		if msg := receiveLive(t, conn); msg.Type != liveSubscribed || msg.Topic != "dashboard:1" {
+			t.Errorf("case %s: expected the subscription to be confirmed but got %+v", c.name, msg)
+		}
+		lh.Hub.Publish(&live.Event{Topic: "dashboard:1", Data: []byte(`{"title":"ICU beds"}`)})
+		if msg := receiveLive(t, conn); msg.Type != liveEvent || string(msg.Data) != `{"title":"ICU beds"}` {
+			t.Errorf("case %s: expected the event but got %+v", c.name, msg)
+		}
+
+		websocket.Message.Send(conn, "not JSON")
+		if msg := receiveLive(t, conn); msg.Type != liveError {
+			t.Errorf("case %s: expected an error but got %+v", c.name, msg)
+		}
+		websocket.JSON.Send(conn, &liveMessage{Type: liveSubscribe, Topic: "dashboard:a/b"})
+		if msg := receiveLive(t, conn); msg.Type != liveError || msg.Error != live.ErrInvalidTopic.Error() {
+			t.Errorf("case %s: expected the topic to be refused but got %+v", c.name, msg)
+		}
+		websocket.JSON.Send(conn, &liveMessage{Type: liveUnsubscribe, Topic: "dashboard:1"})
+		if msg := receiveLive(t, conn); msg.Type != liveUnsubscribed {
+			t.Errorf("case %s: expected the unsubscription to be confirmed but got %+v", c.name, msg)
+		}
+		conn.Close()
+	}
+}
+
+func TestLiveHeartbeat(t *testing.T) {
+	server, lh, sid := newLiveTestServer(t, sessions.NewMemStore(time.Hour, time.Minute))
+	defer server.Close()
+	lh.HeartbeatInterval = 50 * time.Millisecond
+	conn := dialLive(t, server, "", http.Header{"Authorization": {"Bearer " + sid}}, server.URL)
+	defer conn.Close()
+	// a client answering pings stays connected
+	for i := 0; i < 3; i++ {
+		if msg := receiveLive(t, conn); msg.Type != livePing {
+			t.Fatalf("expected a ping but got %+v", msg)
+		}
+		websocket.JSON.Send(conn, &liveMessage{Type: livePong})
+	}
+	// one that stops answering is disconnected
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		msg := &liveMessage{}
+		if err := websocket.JSON.Receive(conn, msg); err != nil {
+			if err != io.EOF {
+				t.Errorf("expected the connection to be closed but got %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestLiveSlowClient(t *testing.T) {
+	server, lh, sid := newLiveTestServer(t, sessions.NewMemStore(time.Hour, time.Minute))
+	defer server.Close()
+	lh.Hub.BufferSize = 1
+	conn := dialLive(t, server, "?auth=Bearer%20"+sid, nil, server.URL)
+	defer conn.Close()
+	websocket.JSON.Send(conn, &liveMessage{Type: liveSubscribe, Topic: "data"})
+	receiveLive(t, conn)
+	// events published faster than they can be queued drop the client, which is told why
+	for i := 0; i < 100; i++ {
+		lh.Hub.Publish(&live.Event{Topic: "data"})
+	}
+	for {
+		msg := receiveLive(t, conn)
+		if msg.Type == liveError {
+			if msg.Error != live.ErrTooSlow.Error() {
+				t.Errorf("expected the client to be dropped for being slow but got %q", msg.Error)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/my/repo/servers/gateway/metrics"
+	"github.com/my/repo/servers/gateway/routing"
+)
+
+// unmatchedRoute is the route label of requests that match no route, which
+// are counted together so scanners cannot make a series for every path
+const unmatchedRoute = "unmatched"
+
+// knownMethods are the methods counted under their own name, any others being counted as "other"
+var knownMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true, "OPTIONS": true,
+}
+
+var (
+	requestsTotal = metrics.Default.NewCounterVec("gateway_http_requests_total",
+		"Requests served, by route, method and status.", "route", "method", "status")
+	requestDuration = metrics.Default.NewHistogramVec("gateway_http_request_duration_seconds",
+		"Time taken to serve requests, by route and status.", metrics.DefaultBuckets, "route", "status")
+)
+
+// MetricsHandler is a middleware handler that counts requests to each route
+// and measures how long they take
+type MetricsHandler struct {
+	Handler http.Handler
+	Router  *routing.Router
+}
+
+// NewMetrics makes a new request metrics wrapper, labelling requests with the routes of `router`
+func NewMetrics(handlerToWrap http.Handler, router *routing.Router) *MetricsHandler {
+	return &MetricsHandler{Handler: handlerToWrap, Router: router}
+}
+
+func (mh *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	route := unmatchedRoute
+	if matched := mh.Router.Match(r.URL.Path); matched != nil {
+		route = matched.Prefix
+	}
+	rec := &statusRecorder{ResponseWriter: w}
+	defer func() {
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		method := r.Method
+		if !knownMethods[method] {
+			method = "other"
+		}
+		status := strconv.Itoa(rec.status)
+		requestsTotal.With(route, method, status).Inc()
+		requestDuration.With(route, status).Observe(time.Since(start).Seconds())
+	}()
+	mh.Handler.ServeHTTP(rec, r)
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/my/repo/servers/gateway/routing"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	router := routing.NewRouter(map[string]http.Handler{"test": http.HandlerFunc(testHandler)}, nil, nil)
+	cfg, err := routing.ParseConfig([]byte(`{"routes": [{"prefix": "/v1/measured", "target": "test"}]}`))
+	if err != nil {
+		t.Fatalf("error parsing routes: %v", err)
+	}
+	if err := router.Apply(cfg); err != nil {
+		t.Fatalf("error applying routes: %v", err)
+	}
+	handler := NewMetrics(router, router)
+
+	cases := []struct {
+		method string
+		path   string
+		route  string
+		label  string
+		status string
+	}{
+		{"GET", "/v1/measured/1", "/v1/measured", "GET", "202"},
+		{"BREW", "/v1/measured", "/v1/measured", "other", "202"},
+		{"GET", "/scanning/for/admin.php", unmatchedRoute, "GET", "404"},
+	}
+	for _, c := range cases {
+		before := requestsTotal.With(c.route, c.label, c.status).Value()
+		observed := requestDuration.With(c.route, c.status).Count()
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(c.method, c.path, nil))
+		if count := requestsTotal.With(c.route, c.label, c.status).Value(); count != before+1 {
+			t.Errorf("%s %s: expected the request to be counted under %s %s %s", c.method, c.path, c.route, c.label, c.status)
+		}
+		if requestDuration.With(c.route, c.status).Count() != observed+1 {
+			t.Errorf("%s %s: expected the request to be timed under %s %s", c.method, c.path, c.route, c.status)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/my/repo/servers/gateway/logging"
+	"github.com/my/repo/servers/gateway/models/users"
+)
+
+// SignInAlert describes a sign-in from a device the user has not signed in from before
+type SignInAlert struct {
+	User   *users.User   `json:"user"`
+	Device *users.Device `json:"device"`
+	IP     string        `json:"ip"`
+	Time   time.Time     `json:"time"`
+}
+
+// Notifier tells users about sign-ins from new devices. Notify is called while the
+// sign-in request is being handled, so slow deliveries should be made in the background.
+type Notifier interface {
+	Notify(alert *SignInAlert) error
+}
+
+// LogNotifier writes alerts to the server log
+type LogNotifier struct{}
+
+// Notify logs the alert
+func (LogNotifier) Notify(alert *SignInAlert) error {
+	log.Printf("new device sign-in for user %d: %s from %s", alert.User.ID, alert.Device.Fingerprint(), alert.IP)
+	return nil
+}
+
+// WebhookNotifier posts alerts as JSON to a URL, such as a mail service
+// that emails the user, without holding up the sign-in
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookNotifier makes a new WebhookNotifier posting to the URL
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{URL: url, Client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Notify posts the alert in the background, logging any failure
+func (wn *WebhookNotifier) Notify(alert *SignInAlert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	go func() {
+		if err := wn.post(body); err != nil {
+			log.Printf("error sending sign-in alert for user %d: %v", alert.User.ID, err)
+		}
+	}()
+	return nil
+}
+
+// post sends the encoded alert to the webhook
+func (wn *WebhookNotifier) post(body []byte) error {
+	resp, err := wn.Client.Post(wn.URL, contentTypeJSON, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// logSignIn records the sign-in in the user log, and notifies the user if it
+// came from a device the user has not signed in from before. Sign-ins that
+// create the account are recorded without notifying anyone.
+func (ctx *HandlerContext) logSignIn(user *users.User, r *http.Request, newAccount bool) {
+	logging.Annotate(r.Context(), "userId", user.ID)
+	logger := logging.FromContext(r.Context())
+	ip := clientIP(r)
+	device := users.NewDevice(r.UserAgent(), ip)
+	known, err := ctx.userStore(r).KnownDevice(user.ID, device.Fingerprint())
+	if err != nil {
+		logger.Errorf("error checking devices of user %d: %v", user.ID, err)
+		known = true
+	}
+	if err := ctx.userStore(r).Log(user.ID, ip, device.Fingerprint()); err != nil {
+		logger.Errorf("error logging sign-in of user %d: %v", user.ID, err)
+	}
+	if known || newAccount || ctx.Notifier == nil {
+		return
+	}
+	alert := &SignInAlert{User: user, Device: device, IP: ip, Time: time.Now()}
+	if err := ctx.Notifier.Notify(alert); err != nil {
+		logger.Errorf("error sending sign-in alert for user %d: %v", user.ID, err)
+	}
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/my/repo/servers/gateway/models/users"
+	"github.com/my/repo/servers/gateway/sessions"
+)
+
+// recordingNotifier keeps the alerts it is sent
+type recordingNotifier struct {
+	alerts []*SignInAlert
+}
+
+func (rn *recordingNotifier) Notify(alert *SignInAlert) error {
+	rn.alerts = append(rn.alerts, alert)
+	return nil
+}
+
+func TestNewDeviceAlerts(t *testing.T) {
+	testUser := &users.User{ID: 1, Email: "test@user.com", UserName: "StevieG"}
+	if err := testUser.SetPassword("password"); err != nil {
+		t.Fatalf("unexpected test error %s", err)
+	}
+	userStore := &users.FakeSQLStore{TestUser: testUser}
+	notifier := &recordingNotifier{}
+	ctx := &HandlerContext{SigningKey: "the key", SessionStore: sessions.NewMemStore(0, 0),
+		UserStore: userStore, Notifier: notifier}
+	// the account was created from a laptop at home
+	ctx.logSignIn(testUser, signInRequest(t, "Firefox/82.0", "203.0.113.10"), true)
+
+	cases := []struct {
+		name      string
+		userAgent string
+		ip        string
+		alerted   bool
+	}{
+		{"same device", "Firefox/82.0", "203.0.113.10", false},
+		{"same browser on the same network", "Firefox/83.0", "203.0.113.99", false},
+		{"different browser", "Chrome/86.0", "203.0.113.10", true},
+		{"different network", "Firefox/82.0", "198.51.100.10", true},
+		{"different network again", "Firefox/82.0", "198.51.100.10", false},
+	}
+	for _, c := range cases {
+		before := len(notifier.alerts)
+		rr := httptest.NewRecorder()
+		ctx.SessionsHandler(rr, signInRequest(t, c.userAgent, c.ip))
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("case [%s] unexpected status code -> expected: %d received: %d", c.name, http.StatusCreated, rr.Code)
+		}
+		alerted := len(notifier.alerts) > before
+		if alerted != c.alerted {
+			t.Errorf("case [%s] expected alerted = %t but got %t", c.name, c.alerted, alerted)
+		}
+		if alerted && (notifier.alerts[before].User.ID != testUser.ID || notifier.alerts[before].IP != c.ip) {
+			t.Errorf("case [%s] incorrect alert %+v", c.name, notifier.alerts[before])
+		}
+	}
+}
+
+// signInRequest makes a sign-in request for the test user from the client and address
+func signInRequest(t *testing.T, userAgent string, ip string) *http.Request {
+	credJSON, _ := json.Marshal(&users.Credentials{Email: "test@user.com", Password: "password"})
+	req, err := http.NewRequest("POST", "/v1/sessions", bytes.NewReader(credJSON))
+	if err != nil {
+		t.Fatalf("unexpected test error %s", err)
+	}
+	req.Header.Set("Content-Type", contentTypeJSON)
+	req.Header.Set("User-Agent", userAgent)
+	req.RemoteAddr = ip + ":50000"
+	return req
+}
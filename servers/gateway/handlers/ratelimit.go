@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/my/repo/servers/gateway/logging"
+	"github.com/my/repo/servers/gateway/problem"
+	"github.com/my/repo/servers/gateway/ratelimit"
+	"github.com/my/repo/servers/gateway/routing"
+	"github.com/my/repo/servers/gateway/sessions"
+)
+
+// RateLimitHandler is a middleware handler that limits how often clients can make
+// requests to each route, according to the route's rate limit configuration
+type RateLimitHandler struct {
+	Handler http.Handler
+	Router  *routing.Router
+	Backend ratelimit.Backend
+	ctx     *HandlerContext
+}
+
+// NewRateLimiter makes a new rate limiting wrapper, taking the rate limits from
+// the routes of `router` and keeping the token buckets in `backend`
+func NewRateLimiter(handlerToWrap http.Handler, ctx *HandlerContext, router *routing.Router, backend ratelimit.Backend) *RateLimitHandler {
+	return &RateLimitHandler{Handler: handlerToWrap, Router: router, Backend: backend, ctx: ctx}
+}
+
+func (rl *RateLimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := rl.Router.Match(r.URL.Path)
+	// preflight requests never count against the limit
+	if route == nil || route.RateLimit == nil || r.Method == "OPTIONS" {
+		rl.Handler.ServeHTTP(w, r)
+		return
+	}
+	cfg := route.RateLimit
+	limit := ratelimit.PerDuration(cfg.Requests, time.Duration(cfg.Per), cfg.Burst)
+	result, err := rl.Backend.Take(route.Prefix+" "+rl.clientKey(r, cfg.By), limit)
+	if err != nil {
+		// an outage of the backend should not take the routes down with it
+		logging.FromContext(r.Context()).Errorf("error checking rate limit, allowing request: %v", err)
+		rl.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d;burst=%d", cfg.Requests, ceilSeconds(time.Duration(cfg.Per)), limit.Burst))
+	if !result.Allowed {
+		w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+		problem.Error(w, r, http.StatusTooManyRequests, problem.CodeRateLimited, "too many requests, please try again later")
+		return
+	}
+	rl.Handler.ServeHTTP(w, r)
+}
+
+// clientKey returns the key requests are counted by for the route: the client IP address,
+// the signed-in user, or the access token. Requests without a user or token are counted
+// by IP address.
+func (rl *RateLimitHandler) clientKey(r *http.Request, by string) string {
+	switch by {
+	case routing.RateLimitByUser:
+		sessionState := &SessionState{}
+		if _, err := sessions.GetState(r, rl.ctx.SigningKey, rl.ctx.SessionStore, sessionState); err == nil && sessionState.User != nil {
+			return "user:" + strconv.FormatInt(sessionState.User.ID, 10)
+		}
+	case routing.RateLimitByToken:
+		if sid, err := sessions.GetSessionID(r, rl.ctx.SigningKey); err == nil {
+			// the token itself is a credential, so only its fingerprint is stored
+			return "token:" + sid.Fingerprint()
+		}
+	}
+	return "ip:" + clientIP(r)
+}
+
+// ceilSeconds rounds the duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
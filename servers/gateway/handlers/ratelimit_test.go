@@ -0,0 +1,143 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/my/repo/servers/gateway/models/users"
+	"github.com/my/repo/servers/gateway/ratelimit"
+	"github.com/my/repo/servers/gateway/routing"
+	"github.com/my/repo/servers/gateway/sessions"
+)
+
+// failingBackend is a rate limit backend that is down
+type failingBackend struct{}
+
+func (failingBackend) Take(key string, limit ratelimit.Limit) (*ratelimit.Result, error) {
+	return nil, errors.New("backend down")
+}
+
+func newRateLimitedRouter(t *testing.T) *routing.Router {
+	router := routing.NewRouter(map[string]http.Handler{"test": http.HandlerFunc(testHandler)}, nil, nil)
+	cfg, err := routing.ParseConfig([]byte(`{"routes": [
+		{"prefix": "/v1/users", "target": "test", "rateLimit": {"requests": 2, "per": "1m"}},
+		{"prefix": "/v1/data", "target": "test", "rateLimit": {"requests": 2, "per": "1m", "by": "user"}},
+		{"prefix": "/v1/tokens", "target": "test", "rateLimit": {"requests": 2, "per": "1m", "by": "token"}},
+		{"prefix": "/v1/dashboards", "target": "test"}
+	]}`))
+	if err != nil {
+		t.Fatalf("error parsing routes: %v", err)
+	}
+	if err := router.Apply(cfg); err != nil {
+		t.Fatalf("error applying routes: %v", err)
+	}
+	return router
+}
+
+func TestRateLimitHandler(t *testing.T) {
+	signingKey := "the key"
+	store := sessions.NewMemStore(time.Hour, time.Minute)
+	ctx := &HandlerContext{SigningKey: signingKey, SessionStore: store}
+	userSession := func(id int64) string {
+		rr := httptest.NewRecorder()
+		sid, err := sessions.BeginSession(signingKey, store, &SessionState{time.Now(), &users.User{ID: id}}, rr)
+		if err != nil {
+			t.Fatalf("error beginning session: %v", err)
+		}
+		return "Bearer " + sid.String()
+	}
+	alice, bob, aliceAgain := userSession(1), userSession(2), userSession(1)
+
+	type request struct {
+		path          string
+		ip            string
+		authorization string
+		expectAllowed bool
+	}
+	cases := []struct {
+		name     string
+		requests []request
+	}{
+		{"by IP address", []request{
+			{"/v1/users", "1.2.3.4:1000", "", true},
+			{"/v1/users", "1.2.3.4:1001", "", true},
+			{"/v1/users", "1.2.3.4:1002", "", false},
+			{"/v1/users", "5.6.7.8:1000", "", true},
+		}},
+		{"by user, across sessions and addresses", []request{
+			{"/v1/data", "1.2.3.4:1000", alice, true},
+			{"/v1/data", "5.6.7.8:1000", aliceAgain, true},
+			{"/v1/data", "1.2.3.4:1000", alice, false},
+			{"/v1/data", "1.2.3.4:1000", bob, true},
+			{"/v1/data", "1.2.3.4:1000", "", true},
+		}},
+		{"by token", []request{
+			{"/v1/tokens", "1.2.3.4:1000", alice, true},
+			{"/v1/tokens", "5.6.7.8:1000", alice, true},
+			{"/v1/tokens", "1.2.3.4:1000", alice, false},
+			{"/v1/tokens", "1.2.3.4:1000", aliceAgain, true},
+		}},
+		{"no rate limit", []request{
+			{"/v1/dashboards", "1.2.3.4:1000", "", true},
+			{"/v1/dashboards", "1.2.3.4:1000", "", true},
+			{"/v1/dashboards", "1.2.3.4:1000", "", true},
+		}},
+	}
+	for _, c := range cases {
+		router := newRateLimitedRouter(t)
+		handler := NewRateLimiter(router, ctx, router, ratelimit.NewMemoryBackend())
+		for i, req := range c.requests {
+			r := httptest.NewRequest("GET", req.path, nil)
+			r.RemoteAddr = req.ip
+			if len(req.authorization) != 0 {
+				r.Header.Set("Authorization", req.authorization)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, r)
+			if allowed := rr.Code != http.StatusTooManyRequests; allowed != req.expectAllowed {
+				t.Errorf("case [%s] request %d allowed -> expected: %v received: %v", c.name, i, req.expectAllowed, allowed)
+			}
+			limited := req.path != "/v1/dashboards"
+			if (len(rr.Header().Get("RateLimit-Limit")) != 0) != limited {
+				t.Errorf("case [%s] request %d RateLimit headers -> expected: %v received: %v", c.name, i, limited, rr.Header())
+			}
+		}
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	router := newRateLimitedRouter(t)
+	handler := NewRateLimiter(router, &HandlerContext{}, router, ratelimit.NewMemoryBackend())
+	expected := []map[string]string{
+		{"RateLimit-Limit": "2", "RateLimit-Remaining": "1", "RateLimit-Reset": "30", "RateLimit-Policy": "2;w=60;burst=2", "Retry-After": ""},
+		{"RateLimit-Limit": "2", "RateLimit-Remaining": "0", "RateLimit-Reset": "60", "Retry-After": ""},
+		{"RateLimit-Limit": "2", "RateLimit-Remaining": "0", "RateLimit-Reset": "60", "Retry-After": "30"},
+	}
+	for i, headers := range expected {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/users", nil))
+		for name, value := range headers {
+			if rr.Header().Get(name) != value {
+				t.Errorf("request %d: expected %s %q but got %q", i, name, value, rr.Header().Get(name))
+			}
+		}
+	}
+
+	// preflight requests are not counted
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("OPTIONS", "/v1/users", nil))
+	if rr.Code == http.StatusTooManyRequests || len(rr.Header().Get("RateLimit-Limit")) != 0 {
+		t.Errorf("preflight request was rate limited: %d", rr.Code)
+	}
+
+	// requests are let through while the backend is down
+	handler.Backend = failingBackend{}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("POST", "/v1/users", nil))
+	if rr.Code == http.StatusTooManyRequests {
+		t.Error("request was rejected while the rate limit backend is down")
+	}
+}
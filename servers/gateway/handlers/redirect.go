@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// HTTPSRedirect is a handler that sends plain-HTTP requests to the same URL over HTTPS
+type HTTPSRedirect struct {
+	// Port is the port HTTPS is served on, left out of the URL if it is the default of 443
+	Port string
+}
+
+// NewHTTPSRedirect makes a new redirect to HTTPS served at `httpsAddr`, such as ":443"
+func NewHTTPSRedirect(httpsAddr string) *HTTPSRedirect {
+	_, port, err := net.SplitHostPort(httpsAddr)
+	if err != nil || port == "443" {
+		port = ""
+	}
+	return &HTTPSRedirect{Port: port}
+}
+
+func (hr *HTTPSRedirect) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+	if len(host) == 0 || strings.ContainsAny(host, "/\\@ ") {
+		http.Error(w, "request has no valid host", http.StatusBadRequest)
+		return
+	}
+	if strings.Contains(host, ":") {
+		// IPv6 addresses are bracketed in URLs
+		host = "[" + host + "]"
+	}
+	if len(hr.Port) != 0 {
+		host += ":" + hr.Port
+	}
+	// other methods keep their method and body with a 308
+	status := http.StatusPermanentRedirect
+	if r.Method == "GET" || r.Method == "HEAD" {
+		status = http.StatusMovedPermanently
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), status)
+}
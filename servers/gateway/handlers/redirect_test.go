@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPSRedirect(t *testing.T) {
+	cases := []struct {
+		name      string
+		httpsAddr string
+		method    string
+		host      string
+		target    string
+		status    int
+		location  string
+	}{
+		{"default port", ":443", "GET", "api.example.com", "/v1/users?page=2", http.StatusMovedPermanently, "https://api.example.com/v1/users?page=2"},
+		{"plain port dropped", ":443", "HEAD", "api.example.com:80", "/", http.StatusMovedPermanently, "https://api.example.com/"},
+		{"other port", "0.0.0.0:8443", "GET", "localhost:8080", "/v1/sessions", http.StatusMovedPermanently, "https://localhost:8443/v1/sessions"},
+		{"method kept", ":443", "POST", "api.example.com", "/v1/sessions", http.StatusPermanentRedirect, "https://api.example.com/v1/sessions"},
+		{"IPv6", ":8443", "GET", "[::1]:80", "/", http.StatusMovedPermanently, "https://[::1]:8443/"},
+		{"IPv6 without port", ":443", "GET", "[::1]", "/", http.StatusMovedPermanently, "https://[::1]/"},
+		{"invalid host", ":443", "GET", "evil.com/", "/", http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.target, nil)
+		r.Host = c.host
+		rr := httptest.NewRecorder()
+		NewHTTPSRedirect(c.httpsAddr).ServeHTTP(rr, r)
+		if rr.Code != c.status {
+			t.Errorf("case %s: expected status %d but got %d", c.name, c.status, rr.Code)
+		}
+		if location := rr.Header().Get("Location"); location != c.location {
+			t.Errorf("case %s: expected redirect to %q but got %q", c.name, c.location, location)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/my/repo/servers/gateway/sessions"
+)
+
+// SessionRefresher is a middleware handler that reissues short-lived session tokens
+// when they are due, sending the new token back in the Authorization response header
+type SessionRefresher struct {
+	Handler http.Handler
+	ctx     *HandlerContext
+}
+
+func (sr *SessionRefresher) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// requests without a valid session are left for the wrapped handler to reject
+	sessions.RefreshSession(r, sr.ctx.SigningKey, sr.ctx.SessionStore, w)
+	sr.Handler.ServeHTTP(w, r)
+}
+
+// NewSessionRefresher makes a new SessionRefresher wrapper
+func NewSessionRefresher(handlerToWrap http.Handler, ctx *HandlerContext) *SessionRefresher {
+	return &SessionRefresher{handlerToWrap, ctx}
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/my/repo/servers/gateway/models/users"
+	"github.com/my/repo/servers/gateway/sessions"
+)
+
+func TestSessionRefresherServeHTTP(t *testing.T) {
+	signingKey := "the key"
+	store, err := sessions.NewTokenStore("", time.Minute, time.Hour, sessions.NewMemDenylist(time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error creating token store: %s", err)
+	}
+	ctx := &HandlerContext{SigningKey: signingKey, SessionStore: store, UserStore: &users.FakeSQLStore{TestUser: &users.User{ID: 1}}}
+	sid, err := store.Issue(signingKey, &SessionState{time.Now(), &users.User{ID: 1}})
+	if err != nil {
+		t.Fatalf("unexpected error issuing token: %s", err)
+	}
+	// a zero lifetime makes every token due for refresh immediately
+	store.Lifetime = 0
+
+	cases := []struct {
+		name          string
+		authorization string
+		expectRefresh bool
+	}{
+		{"no session", "", false},
+		{"valid session due for refresh", "Bearer " + sid.String(), true},
+	}
+	for _, c := range cases {
+		req, _ := http.NewRequest("GET", "/v1/dashboards", nil)
+		if len(c.authorization) != 0 {
+			req.Header.Set("Authorization", c.authorization)
+		}
+		rr := httptest.NewRecorder()
+		NewSessionRefresher(http.HandlerFunc(testHandler), ctx).ServeHTTP(rr, req)
+		if rr.Code != http.StatusAccepted {
+			t.Errorf("case [%s] wrapped handler was not called -> received status: %d", c.name, rr.Code)
+		}
+		refreshed := len(rr.Header().Get("Authorization")) != 0
+		if refreshed != c.expectRefresh {
+			t.Errorf("case [%s] refreshed token -> expected: %v received: %v", c.name, c.expectRefresh, refreshed)
+		}
+	}
+}
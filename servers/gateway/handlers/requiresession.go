@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/my/repo/servers/gateway/logging"
+	"github.com/my/repo/servers/gateway/sessions"
+)
+
+// sessionStateKey is the request context key of the SessionState found by RequireSession
+type sessionStateKey struct{}
+
+// SessionStateFrom returns the SessionState RequireSession found for the request, if any
+func SessionStateFrom(ctx context.Context) (*SessionState, bool) {
+	state, ok := ctx.Value(sessionStateKey{}).(*SessionState)
+	return state, ok
+}
+
+// RequireSession wraps a handler so it is only called for requests with a valid session,
+// which it can get with SessionStateFrom. Other requests are rejected with 401, or 503
+// when the session store is unavailable.
+func (ctx *HandlerContext) RequireSession(handlerToWrap http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sessionState := &SessionState{}
+		if _, err := sessions.GetState(r, ctx.SigningKey, ctx.SessionStore, sessionState); err != nil {
+			sessionProblem(w, r, err)
+			return
+		}
+		logging.Annotate(r.Context(), "userId", sessionState.User.ID)
+		handlerToWrap.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionStateKey{}, sessionState)))
+	})
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/my/repo/servers/gateway/routing"
+	"github.com/my/repo/servers/gateway/security"
+)
+
+// SecurityHeadersHandler is a middleware handler that sets the security headers of the
+// route of each request, replacing any the handler or upstream set. When the route's
+// Content-Security-Policy uses a nonce, a fresh one is made for each response and passed
+// on in the request's security.NonceHeader for the page to put on its scripts.
+type SecurityHeadersHandler struct {
+	Handler http.Handler
+	Router  *routing.Router
+}
+
+// NewSecurityHeaders makes a new security headers wrapper, setting the headers of the routes of `router`
+func NewSecurityHeaders(handlerToWrap http.Handler, router *routing.Router) *SecurityHeadersHandler {
+	return &SecurityHeadersHandler{Handler: handlerToWrap, Router: router}
+}
+
+func (sh *SecurityHeadersHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// never pass on a nonce the client made up
+	r.Header.Del(security.NonceHeader)
+	policy := sh.Router.Security(r.URL.Path)
+	if policy == nil {
+		sh.Handler.ServeHTTP(w, r)
+		return
+	}
+	nonce := ""
+	if policy.UsesNonce() {
+		nonce = security.NewNonce()
+		r.Header.Set(security.NonceHeader, nonce)
+	}
+	sw := &securityWriter{ResponseWriter: w, policy: policy, nonce: nonce}
+	sh.Handler.ServeHTTP(sw, r)
+	// responses the handler wrote nothing to are sent once it returns
+	sw.apply()
+}
+
+// securityWriter sets the security headers just before the response is sent,
+// so they replace those set by the handler
+type securityWriter struct {
+	http.ResponseWriter
+	policy  *security.Policy
+	nonce   string
+	applied bool
+}
+
+func (sw *securityWriter) apply() {
+	if !sw.applied {
+		sw.applied = true
+		sw.policy.Apply(sw.ResponseWriter.Header(), sw.nonce)
+	}
+}
+
+func (sw *securityWriter) WriteHeader(status int) {
+	sw.apply()
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *securityWriter) Write(p []byte) (int, error) {
+	sw.apply()
+	return sw.ResponseWriter.Write(p)
+}
+
+// Flush sends any buffered data to the client, for streamed responses
+func (sw *securityWriter) Flush() {
+	sw.apply()
+	if flusher, ok := sw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack lets the handler take over the connection, for WebSockets
+func (sw *securityWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	sw.applied = true
+	return hijacker.Hijack()
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/my/repo/servers/gateway/routing"
+	"github.com/my/repo/servers/gateway/security"
+)
+
+func TestSecurityHeaders(t *testing.T) {
+	// the page upstream sets its own, weaker headers and echoes the nonce it was given
+	page := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(security.CSPHeader, "script-src *")
+		w.Header().Set(security.FrameOptionsHeader, "ALLOWALL")
+		w.Write([]byte(r.Header.Get(security.NonceHeader)))
+	})
+	router := routing.NewRouter(map[string]http.Handler{"page": page, "test": http.HandlerFunc(testHandler)}, nil, nil)
+	cfg, err := routing.ParseConfig([]byte(`{
+		"security": {"hsts": "8760h", "csp": "default-src 'none'", "reportUri": "/v1/csp-reports"},
+		"routes": [
+			{"prefix": "/v1/users", "target": "test"},
+			{"prefix": "/v1/dashboards", "target": "page", "security": {"csp": "default-src 'self'; script-src {nonce}", "frameAncestors": ["'self'"]}}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("error parsing routes: %v", err)
+	}
+	if err := router.Apply(cfg); err != nil {
+		t.Fatalf("error applying routes: %v", err)
+	}
+	handler := NewSecurityHeaders(router, router)
+
+	cases := []struct {
+		name             string
+		path             string
+		expectedCSP      string
+		expectedHSTS     string
+		expectedFraming  string
+		expectedEndpoint string
+	}{
+		{"global policy", "/v1/users", "default-src 'none'; frame-ancestors 'none'; report-uri /v1/csp-reports; report-to csp",
+			"max-age=31536000", "DENY", `csp="/v1/csp-reports"`},
+		{"no route", "/v2/users", "default-src 'none'; frame-ancestors 'none'; report-uri /v1/csp-reports; report-to csp",
+			"max-age=31536000", "DENY", `csp="/v1/csp-reports"`},
+		{"route's own policy", "/v1/dashboards/1", "default-src 'self'; script-src 'nonce-{}'; frame-ancestors 'self'",
+			"", "SAMEORIGIN", ""},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", c.path, nil)
+		r.Header.Set(security.NonceHeader, "chosen-by-client")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		nonce := ""
+		if strings.HasPrefix(c.path, "/v1/dashboards") {
+			nonce = rr.Body.String()
+			if len(nonce) == 0 || nonce == "chosen-by-client" {
+				t.Errorf("case %s: expected a fresh nonce to be passed on but got %q", c.name, nonce)
+			}
+		}
+		expected := map[string]string{
+			security.CSPHeader:                strings.Replace(c.expectedCSP, "{}", nonce, 1),
+			security.HSTSHeader:               c.expectedHSTS,
+			security.FrameOptionsHeader:       c.expectedFraming,
+			security.ReportingEndpointsHeader: c.expectedEndpoint,
+			security.ContentTypeOptionsHeader: "nosniff",
+			security.ReferrerPolicyHeader:     security.DefaultReferrerPolicy,
+		}
+		for name, value := range expected {
+			if values := rr.Header().Values(name); (len(value) == 0 && len(values) != 0) || (len(value) != 0 && (len(values) != 1 || values[0] != value)) {
+				t.Errorf("case %s: expected %s %q but got %q", c.name, name, value, values)
+			}
+		}
+	}
+
+	// each response gets its own nonce
+	first, second := httptest.NewRecorder(), httptest.NewRecorder()
+	handler.ServeHTTP(first, httptest.NewRequest("GET", "/v1/dashboards", nil))
+	handler.ServeHTTP(second, httptest.NewRequest("GET", "/v1/dashboards", nil))
+	if first.Body.String() == second.Body.String() {
+		t.Errorf("expected different nonces but got %q twice", first.Body.String())
+	}
+}
+
+func TestSecurityHeadersWithoutPolicy(t *testing.T) {
+	router := routing.NewRouter(map[string]http.Handler{"test": http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get(security.NonceHeader)))
+	})}, nil, nil)
+	cfg, err := routing.ParseConfig([]byte(`{"routes": [{"prefix": "/v1/data", "target": "test"}]}`))
+	if err != nil {
+		t.Fatalf("error parsing routes: %v", err)
+	}
+	if err := router.Apply(cfg); err != nil {
+		t.Fatalf("error applying routes: %v", err)
+	}
+	r := httptest.NewRequest("GET", "/v1/data", nil)
+	r.Header.Set(security.NonceHeader, "chosen-by-client")
+	rr := httptest.NewRecorder()
+	NewSecurityHeaders(router, router).ServeHTTP(rr, r)
+	if rr.Body.Len() != 0 || len(rr.Header().Get(security.CSPHeader)) != 0 {
+		t.Errorf("expected no headers or nonce but got %q %v", rr.Body.String(), rr.Header())
+	}
+}
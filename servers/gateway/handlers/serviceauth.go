@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/my/repo/servers/gateway/logging"
+	"github.com/my/repo/servers/gateway/problem"
+)
+
+// ServiceAuth is a handler that only lets through requests from the services behind the
+// gateway with credentials for it, sent with HTTP basic authentication, so endpoints for
+// those services can be served where the services can reach them
+type ServiceAuth struct {
+	Handler http.Handler
+	// Realm is the realm services without credentials are told to authenticate to
+	Realm string
+	// credentials are the secrets of the services let through, by service name
+	credentials map[string]string
+}
+
+// NewServiceAuth makes a new wrapper letting through the services in `credentials`
+func NewServiceAuth(handlerToWrap http.Handler, credentials map[string]string, realm string) *ServiceAuth {
+	return &ServiceAuth{Handler: handlerToWrap, Realm: realm, credentials: credentials}
+}
+
+func (sa *ServiceAuth) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	service, ok := authenticateService(r, sa.credentials)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="`+sa.Realm+`"`)
+		problem.Error(w, r, http.StatusUnauthorized, problem.CodeUnauthenticated, "service credentials required")
+		return
+	}
+	logging.Annotate(r.Context(), "service", service)
+	sa.Handler.ServeHTTP(w, r)
+}
+
+// authenticateService returns the name of the service the request was sent by, if its credentials are valid
+func authenticateService(r *http.Request, credentials map[string]string) (string, bool) {
+	service, secret, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	expected, found := credentials[service]
+	// the secret is compared even for unknown services, so they take as long to refuse
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(expected)) != 1 || !found || len(expected) == 0 {
+		return "", false
+	}
+	return service, true
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/my/repo/servers/gateway/live"
+)
+
+func TestServiceAuth(t *testing.T) {
+	hub := live.NewHub()
+	defer hub.Close()
+	subscriber, err := hub.NewSubscriber(7)
+	if err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	subscriber.Subscribe("dashboard:abc")
+	publish := NewServiceAuth(hub, map[string]string{"dashboards": "the secret"}, "live")
+
+	cases := []struct {
+		name           string
+		service        string
+		secret         string
+		expectedStatus int
+	}{
+		{"No Credentials", "", "", http.StatusUnauthorized},
+		{"Wrong Secret", "dashboards", "guess", http.StatusUnauthorized},
+		{"Unknown Service", "other", "the secret", http.StatusUnauthorized},
+		{"Valid Credentials", "dashboards", "the secret", http.StatusAccepted},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("POST", "/live/publish", strings.NewReader(`{"topic":"dashboard:abc","data":{"action":"updated"}}`))
+		if len(c.service) != 0 {
+			r.SetBasicAuth(c.service, c.secret)
+		}
+		rr := httptest.NewRecorder()
+		publish.ServeHTTP(rr, r)
+		if rr.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d: %s", c.name, c.expectedStatus, rr.Code, rr.Body.String())
+		}
+		if rr.Code == http.StatusUnauthorized && len(rr.Header().Get("WWW-Authenticate")) == 0 {
+			t.Errorf("case %s: expected a WWW-Authenticate challenge", c.name)
+		}
+	}
+
+	// only the event published with valid credentials reaches the subscriber
+	select {
+	case event := <-subscriber.Events():
+		if event.Topic != "dashboard:abc" {
+			t.Errorf("expected an event of dashboard:abc but got %+v", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the published event to reach the subscriber")
+	}
+	select {
+	case event := <-subscriber.Events():
+		t.Errorf("expected a single event but also got %+v", event)
+	default:
+	}
+}
@@ -15,3 +15,8 @@ type SessionState struct {
 	BeginTime time.Time   `json:"beginTime"`
 	User      *users.User `json:"user"`
 }
+
+// SessionOwner returns the ID of the user the session belongs to
+func (ss SessionState) SessionOwner() int64 {
+	return ss.User.ID
+}
@@ -0,0 +1,59 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/my/repo/servers/gateway/logging"
+	"github.com/my/repo/servers/gateway/routing"
+	"github.com/my/repo/servers/gateway/tracing"
+)
+
+// TracingHandler is a middleware handler that traces each request, continuing
+// the trace of the client when the request carries a traceparent header
+type TracingHandler struct {
+	Handler http.Handler
+	Tracer  *tracing.Tracer
+	Router  *routing.Router
+}
+
+// NewTracing makes a new tracing wrapper, beginning traces with `tracer` and
+// naming the span of each request after its route in `router`
+func NewTracing(handlerToWrap http.Handler, tracer *tracing.Tracer, router *routing.Router) *TracingHandler {
+	return &TracingHandler{Handler: handlerToWrap, Tracer: tracer, Router: router}
+}
+
+func (th *TracingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := unmatchedRoute
+	if matched := th.Router.Match(r.URL.Path); matched != nil {
+		route = matched.Prefix
+	}
+	ctx, span := th.Tracer.StartRequest(r, r.Method+" "+route)
+	span.SetAttribute("http.request.method", r.Method)
+	span.SetAttribute("http.route", route)
+	span.SetAttribute("url.path", r.URL.Path)
+	span.SetAttribute("client.address", clientIP(r))
+	span.SetAttribute("request.id", r.Header.Get(RequestIDHeader))
+	// the trace can be found from the access log line, whether or not it is being recorded
+	logging.Annotate(ctx, "traceId", span.Context().TraceID.String())
+
+	rec := &statusRecorder{ResponseWriter: w}
+	defer func() {
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttribute("http.response.status_code", rec.status)
+		if rec.status >= 500 {
+			span.SetError(statusError(rec.status))
+		}
+		span.End()
+	}()
+	th.Handler.ServeHTTP(rec, r.WithContext(ctx))
+}
+
+// statusError is the error of a span whose request failed with the status
+type statusError int
+
+func (se statusError) Error() string {
+	return strconv.Itoa(int(se)) + " " + http.StatusText(int(se))
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/my/repo/servers/gateway/models/users"
+	"github.com/my/repo/servers/gateway/routing"
+	"github.com/my/repo/servers/gateway/sessions"
+	"github.com/my/repo/servers/gateway/tracetest"
+	"github.com/my/repo/servers/gateway/tracing"
+	"github.com/my/repo/servers/gateway/upstream"
+)
+
+func TestTracingHandler(t *testing.T) {
+	collector := tracetest.NewCollector()
+	defer collector.Close()
+	exporter := tracing.NewOTLPExporter(collector.URL(), "gateway", time.Hour)
+	defer exporter.Close()
+
+	var traceparent string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceparent = r.Header.Get(tracing.TraceparentHeader)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer backend.Close()
+	pool := upstream.NewPool("dashboards", []*upstream.Backend{{Addr: strings.TrimPrefix(backend.URL, "http://")}}, &upstream.RoundRobin{})
+	pool.MaxFails = 0
+	proxy := upstream.NewProxy(pool)
+	proxy.Retries = 0
+	defer proxy.Close()
+
+	signingKey := "the key"
+	store := sessions.NewMemStore(time.Hour, time.Minute)
+	ctx := &HandlerContext{SigningKey: signingKey, SessionStore: store}
+	sid, err := sessions.BeginSession(signingKey, store, &SessionState{time.Now(), &users.User{ID: 7}}, httptest.NewRecorder())
+	if err != nil {
+		t.Fatalf("error beginning session: %v", err)
+	}
+	router := routing.NewRouter(map[string]http.Handler{"dashboards": proxy}, nil, ctx.RequireSession)
+	cfg, err := routing.ParseConfig([]byte(`{"routes": [{"prefix": "/v1/dashboards", "target": "dashboards", "auth": true}]}`))
+	if err != nil {
+		t.Fatalf("error parsing routes: %v", err)
+	}
+	if err := router.Apply(cfg); err != nil {
+		t.Fatalf("error applying routes: %v", err)
+	}
+	handler := NewTracing(router, tracing.NewTracer(exporter, 0), router)
+
+	// a trace sampled by the client is continued through the gateway to the upstream
+	r := httptest.NewRequest("GET", "/v1/dashboards/1", nil)
+	r.Header.Set("Authorization", "Bearer "+string(sid))
+	r.Header.Set(tracing.TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.Header.Set(tracing.TracestateHeader, "vendor=a")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+	if rr.Code != http.StatusBadGateway {
+		t.Fatalf("expected status %d but got %d", http.StatusBadGateway, rr.Code)
+	}
+	if err := exporter.Flush(); err != nil {
+		t.Fatalf("error flushing spans: %v", err)
+	}
+
+	spans := map[string]tracetest.Span{}
+	for _, span := range collector.Spans() {
+		if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.TraceState != "vendor=a" {
+			t.Errorf("expected span %s to continue the client's trace but got %+v", span.Name, span)
+		}
+		spans[span.Name] = span
+	}
+	server, ok := spans["GET /v1/dashboards"]
+	if !ok || server.ParentSpanID != "00f067aa0ba902b7" || server.Kind != int(tracing.KindServer) ||
+		server.Attributes["http.route"] != "/v1/dashboards" || server.Attributes["http.response.status_code"] != int64(http.StatusBadGateway) ||
+		server.Error != "502 Bad Gateway" {
+		t.Errorf("unexpected server span %+v", server)
+	}
+	handlerSpan, ok := spans["handler dashboards"]
+	if !ok || handlerSpan.ParentSpanID != server.SpanID {
+		t.Errorf("unexpected handler span %+v", handlerSpan)
+	}
+	// the session is checked as part of the handler
+	session, ok := spans["sessions.Store.Get"]
+	if !ok || session.ParentSpanID != handlerSpan.SpanID || session.Kind != int(tracing.KindClient) {
+		t.Errorf("unexpected session store span %+v", session)
+	}
+	proxySpan, ok := spans["proxy dashboards"]
+	if !ok || proxySpan.ParentSpanID != handlerSpan.SpanID || proxySpan.Attributes["http.response.status_code"] != int64(http.StatusBadGateway) ||
+		len(proxySpan.Error) == 0 {
+		t.Errorf("unexpected proxy span %+v", proxySpan)
+	}
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + proxySpan.SpanID + "-01"; traceparent != want {
+		t.Errorf("expected the upstream to be sent traceparent %s but got %s", want, traceparent)
+	}
+
+	// traces begun by the gateway are passed on but, at a sample rate of 0, not recorded
+	collector.Reset()
+	r = httptest.NewRequest("GET", "/v1/dashboards/1", nil)
+	r.Header.Set("Authorization", "Bearer "+string(sid))
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	exporter.Flush()
+	if spans := collector.Spans(); len(spans) != 0 {
+		t.Errorf("expected no spans to be recorded but got %+v", spans)
+	}
+	if sc, ok := tracing.ParseTraceparent(traceparent); !ok || sc.Sampled {
+		t.Errorf("expected an unsampled traceparent to be sent to the upstream but got %q", traceparent)
+	}
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/my/repo/servers/gateway/models/users"
+	"github.com/my/repo/servers/gateway/sessions"
+)
+
+// beginUserSession begins a new session for the user. If the session store indexes sessions by user,
+// the user is reloaded and the session begun while holding the user's session lock, so a profile
+// change made while the user was signing in cannot be missed by both the new session and SyncUserSessions
+func (ctx *HandlerContext) beginUserSession(r *http.Request, user *users.User, w http.ResponseWriter) error {
+	userSessions, ok := ctx.SessionStore.(sessions.UserSessions)
+	if !ok {
+		_, err := sessions.BeginSessionContext(r.Context(), ctx.SigningKey, ctx.SessionStore, &SessionState{time.Now(), user}, w)
+		return err
+	}
+	unlock, err := sessions.TraceUserSessions(r.Context(), userSessions).LockUser(user.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	current, err := ctx.currentUser(r.Context(), user.ID)
+	if err != nil {
+		return err
+	}
+	*user = *current
+	_, err = sessions.BeginSessionContext(r.Context(), ctx.SigningKey, userSessions, &SessionState{time.Now(), user}, w)
+	return err
+}
+
+// SyncUserSessions rewrites every live session of the user with the user's current profile,
+// so changes made to the user are seen by handlers and forwarded in X-User without signing in again.
+// It should be called after any change to the user is saved to the user store. If the user no
+// longer exists, its sessions are ended instead. The store is traced as part of the request `c` belongs to.
+// Stores that cannot find the sessions of a user, such as the sessions.TokenStore, are left unchanged:
+// their sessions keep the old profile until they end, unless the client is reissued a token.
+func (ctx *HandlerContext) SyncUserSessions(c context.Context, userID int64) error {
+	userSessions, ok := ctx.SessionStore.(sessions.UserSessions)
+	if !ok {
+		return nil
+	}
+	userSessions = sessions.TraceUserSessions(c, userSessions)
+	unlock, err := userSessions.LockUser(userID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	// reload the user while holding the lock so concurrent changes are applied in order
+	user, err := ctx.currentUser(c, userID)
+	if err != nil && err != users.ErrUserNotFound {
+		return err
+	}
+	sids, err := userSessions.Sessions(userID)
+	if err != nil {
+		return err
+	}
+	for _, sid := range sids {
+		// sessions of a user that no longer exists are ended
+		if user == nil {
+			if err := userSessions.Delete(sid); err != nil {
+				return err
+			}
+			continue
+		}
+		state := &SessionState{}
+		if err := userSessions.Get(sid, state); err != nil {
+			if err == sessions.ErrStateNotFound {
+				continue
+			}
+			return err
+		}
+		state.User = user
+		if err := userSessions.Save(sid, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EndUserSessions ends every session of the user. It should be called when the user is deleted.
+// The store is traced as part of the request `c` belongs to. Stores that cannot find the sessions
+// of a user, such as the sessions.TokenStore, are left unchanged, so their sessions last until they expire.
+func (ctx *HandlerContext) EndUserSessions(c context.Context, userID int64) error {
+	userSessions, ok := ctx.SessionStore.(sessions.UserSessions)
+	if !ok {
+		return nil
+	}
+	userSessions = sessions.TraceUserSessions(c, userSessions)
+	unlock, err := userSessions.LockUser(userID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	sids, err := userSessions.Sessions(userID)
+	if err != nil {
+		return err
+	}
+	for _, sid := range sids {
+		if err := userSessions.Delete(sid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// currentUser loads the user from the user store, returning users.ErrUserNotFound if it no longer exists
+func (ctx *HandlerContext) currentUser(c context.Context, userID int64) (*users.User, error) {
+	user, err := users.TraceStore(c, ctx.UserStore).GetByID(userID)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || len(user.UserName) == 0 {
+		return nil, users.ErrUserNotFound
+	}
+	return user, nil
+}
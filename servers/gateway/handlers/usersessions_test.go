@@ -0,0 +1,239 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/my/repo/servers/gateway/models/users"
+	"github.com/my/repo/servers/gateway/redistest"
+	"github.com/my/repo/servers/gateway/sessions"
+)
+
+// syncUserStore is a users.Store holding a single user that is safe for concurrent use
+type syncUserStore struct {
+	users.FakeSQLStore
+	mu      sync.Mutex
+	deleted bool
+}
+
+func (store *syncUserStore) GetByID(id int64) (*users.User, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.deleted || id != store.TestUser.ID {
+		return nil, users.ErrUserNotFound
+	}
+	user := *store.TestUser
+	return &user, nil
+}
+
+func (store *syncUserStore) Update(id int64, updates *users.Updates) (*users.User, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if err := store.TestUser.ApplyUpdates(updates); err != nil {
+		return nil, err
+	}
+	user := *store.TestUser
+	return &user, nil
+}
+
+func (store *syncUserStore) Delete(id int64) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.deleted = true
+	return nil
+}
+
+/*
+TestSyncUserSessionsConcurrent signs a user in many times while the user's profile is
+updated concurrently, and checks that once everything has finished every session carries
+the final profile. It runs against both the MemStore and the RedisStore (using a local
+redis stand-in, with two handler contexts standing in for two gateway instances).
+*/
+func TestSyncUserSessionsConcurrent(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("unexpected error starting redis stand-in: %s", err)
+	}
+	defer server.Close()
+	newRedisStore := func() sessions.Store {
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		return sessions.NewIndexedStore(sessions.NewRedisStore(client, time.Hour), sessions.NewRedisIndex(client))
+	}
+	memstore := sessions.NewIndexedStore(sessions.NewMemStore(time.Hour, time.Minute), sessions.NewMemIndex())
+
+	cases := []struct {
+		name   string
+		stores []sessions.Store
+	}{
+		{"MemStore", []sessions.Store{memstore, memstore}},
+		{"RedisStore", []sessions.Store{newRedisStore(), newRedisStore()}},
+	}
+	for _, c := range cases {
+		userStore := &syncUserStore{FakeSQLStore: users.FakeSQLStore{
+			TestUser: &users.User{ID: 1, UserName: "user", FirstName: "first", LastName: "last"}}}
+		contexts := []*HandlerContext{
+			{SigningKey: "the key", SessionStore: c.stores[0], UserStore: userStore},
+			{SigningKey: "the key", SessionStore: c.stores[1], UserStore: userStore},
+		}
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		sids := []sessions.SessionID{}
+		for i := 0; i < 20; i++ {
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				ctx := contexts[i%2]
+				// the user read before authenticating may already be out of date
+				user, _ := userStore.GetByID(1)
+				rr := httptest.NewRecorder()
+				if err := ctx.beginUserSession(httptest.NewRequest("POST", "/v1/sessions", nil), user, rr); err != nil {
+					t.Errorf("case [%s] unexpected error beginning session: %s", c.name, err)
+					return
+				}
+				sid, err := sessions.ValidateID(rr.Header().Get("Authorization")[len("Bearer "):], ctx.SigningKey)
+				if err != nil {
+					t.Errorf("case [%s] unexpected error validating session: %s", c.name, err)
+					return
+				}
+				mu.Lock()
+				sids = append(sids, sid)
+				mu.Unlock()
+			}(i)
+			go func(i int) {
+				defer wg.Done()
+				ctx := contexts[(i+1)%2]
+				if _, err := ctx.UserStore.Update(1, &users.Updates{FirstName: fmt.Sprintf("name%d", i)}); err != nil {
+					t.Errorf("case [%s] unexpected error updating user: %s", c.name, err)
+					return
+				}
+				if err := ctx.SyncUserSessions(context.Background(), 1); err != nil {
+					t.Errorf("case [%s] unexpected error syncing sessions: %s", c.name, err)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		final, _ := userStore.GetByID(1)
+		for _, sid := range sids {
+			state := &SessionState{}
+			if err := c.stores[0].Get(sid, state); err != nil {
+				t.Fatalf("case [%s] unexpected error getting session: %s", c.name, err)
+			}
+			if state.User.FirstName != final.FirstName {
+				t.Errorf("case [%s] stale session -> expected first name: %s received: %s", c.name,
+					final.FirstName, state.User.FirstName)
+			}
+		}
+
+		// once the user is deleted, syncing ends every session
+		userStore.Delete(1)
+		if err := contexts[1].SyncUserSessions(context.Background(), 1); err != nil {
+			t.Fatalf("case [%s] unexpected error syncing sessions of deleted user: %s", c.name, err)
+		}
+		for _, sid := range sids {
+			if err := c.stores[0].Get(sid, &SessionState{}); err != sessions.ErrStateNotFound {
+				t.Errorf("case [%s] session of deleted user still live -> received: %v", c.name, err)
+			}
+		}
+	}
+}
+
+func TestEndUserSessions(t *testing.T) {
+	store := sessions.NewIndexedStore(sessions.NewMemStore(time.Hour, time.Minute), sessions.NewMemIndex())
+	userStore := &syncUserStore{FakeSQLStore: users.FakeSQLStore{TestUser: &users.User{ID: 1, UserName: "user"}}}
+	ctx := &HandlerContext{SigningKey: "the key", SessionStore: store, UserStore: userStore}
+	rr := httptest.NewRecorder()
+	if err := ctx.beginUserSession(httptest.NewRequest("POST", "/v1/sessions", nil), userStore.TestUser, rr); err != nil {
+		t.Fatalf("unexpected error beginning session: %s", err)
+	}
+	if err := ctx.EndUserSessions(context.Background(), 1); err != nil {
+		t.Fatalf("unexpected error ending sessions: %s", err)
+	}
+	if sids, _ := store.Sessions(1); len(sids) != 0 {
+		t.Errorf("sessions still live after ending them: %v", sids)
+	}
+}
+
+func TestDeleteUserEndsSessions(t *testing.T) {
+	store := sessions.NewIndexedStore(sessions.NewMemStore(time.Hour, time.Minute), sessions.NewMemIndex())
+	userStore := &syncUserStore{FakeSQLStore: users.FakeSQLStore{TestUser: &users.User{ID: 1, UserName: "user"}}}
+	ctx := &HandlerContext{SigningKey: "the key", SessionStore: store, UserStore: userStore}
+	// the user is signed in on two devices
+	auths := []string{}
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		if err := ctx.beginUserSession(httptest.NewRequest("POST", "/v1/sessions", nil), userStore.TestUser, rr); err != nil {
+			t.Fatalf("unexpected error beginning session: %s", err)
+		}
+		auths = append(auths, rr.Header().Get("Authorization"))
+	}
+	send := func(method string, path string, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("Authorization", auth)
+		rr := httptest.NewRecorder()
+		ctx.SpecificUserHandler(rr, req)
+		return rr
+	}
+
+	if rr := send("DELETE", "/v1/users/2", auths[0]); rr.Code != http.StatusForbidden {
+		t.Errorf("expected deleting another user to be forbidden but got %d", rr.Code)
+	}
+	if rr := send("DELETE", "/v1/users/me", auths[0]); rr.Code != http.StatusOK {
+		t.Fatalf("expected the user to be deleted but got %d: %s", rr.Code, rr.Body.String())
+	}
+	// neither the session that deleted the user nor the other one works any longer
+	for i, auth := range auths {
+		if rr := send("GET", "/v1/users/me", auth); rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected session %d of the deleted user to be ended but got %d", i, rr.Code)
+		}
+	}
+	if sids, _ := store.Sessions(1); len(sids) != 0 {
+		t.Errorf("sessions still indexed after deleting the user: %v", sids)
+	}
+}
+
+func TestUpdateUserReissuesToken(t *testing.T) {
+	store, err := sessions.NewTokenStore("", time.Minute, time.Hour, sessions.NewMemDenylist(time.Minute))
+	if err != nil {
+		t.Fatalf("unexpected error creating token store: %s", err)
+	}
+	userStore := &syncUserStore{FakeSQLStore: users.FakeSQLStore{TestUser: &users.User{ID: 1, UserName: "user"}}}
+	ctx := &HandlerContext{SigningKey: "the key", SessionStore: store, UserStore: userStore}
+	rr := httptest.NewRecorder()
+	if err := ctx.beginUserSession(httptest.NewRequest("POST", "/v1/sessions", nil), userStore.TestUser, rr); err != nil {
+		t.Fatalf("unexpected error beginning session: %s", err)
+	}
+
+	req := httptest.NewRequest("PATCH", "/v1/users/me", strings.NewReader(`{"firstName":"changed"}`))
+	req.Header.Set("Authorization", rr.Header().Get("Authorization"))
+	req.Header.Set("Content-Type", contentTypeJSON)
+	rr = httptest.NewRecorder()
+	ctx.SpecificUserHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected the user to be updated but got %d: %s", rr.Code, rr.Body.String())
+	}
+	// the token returned with the response carries the new profile
+	auth := rr.Header().Get("Authorization")
+	if len(auth) == 0 || auth == req.Header.Get("Authorization") {
+		t.Fatal("expected a new token to be returned after updating the user")
+	}
+	sid, err := sessions.ValidateID(auth[len("Bearer "):], ctx.SigningKey)
+	if err != nil {
+		t.Fatalf("unexpected error validating reissued token: %s", err)
+	}
+	state := &SessionState{}
+	if err := store.Get(sid, state); err != nil {
+		t.Fatalf("unexpected error getting session: %s", err)
+	}
+	if state.User.FirstName != "changed" {
+		t.Errorf("stale session -> expected first name: changed received: %s", state.User.FirstName)
+	}
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/my/repo/servers/gateway/openapi"
+	"github.com/my/repo/servers/gateway/problem"
+)
+
+// ValidationHandler is a middleware handler that checks each request against the
+// operation the API's OpenAPI document describes for it, refusing requests whose
+// method, parameters, content type or body do not match before they reach the handler
+type ValidationHandler struct {
+	Handler http.Handler
+	Spec    *openapi.Document
+}
+
+// NewValidation makes a new validation wrapper, checking requests against `spec`
+func NewValidation(handlerToWrap http.Handler, spec *openapi.Document) *ValidationHandler {
+	return &ValidationHandler{Handler: handlerToWrap, Spec: spec}
+}
+
+func (vh *ValidationHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := vh.Spec.Validate(r)
+	if p == nil {
+		vh.Handler.ServeHTTP(w, r)
+		return
+	}
+	if p.Status == http.StatusMethodNotAllowed {
+		_, item, _ := vh.Spec.Find(r.URL.Path)
+		w.Header().Set("Allow", item.Allow())
+	}
+	problem.Write(w, r, p)
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/my/repo/servers/gateway/openapi"
+	"github.com/my/repo/servers/gateway/problem"
+)
+
+func TestValidation(t *testing.T) {
+	spec, err := openapi.Parse([]byte(`{
+		"openapi": "3.0.3",
+		"info": {"title": "test", "version": "1"},
+		"paths": {
+			"/v1/users": {
+				"post": {
+					"operationId": "createUser",
+					"requestBody": {"required": true, "content": {"application/json": {"schema": {
+						"type": "object", "required": ["email"], "properties": {"email": {"type": "string", "format": "email"}}
+					}}}},
+					"responses": {"201": {"description": "created"}}
+				}
+			},
+			"/v1/users/{userID}": {
+				"parameters": [{"name": "userID", "in": "path", "required": true, "schema": {"type": "string", "pattern": "^(me|[0-9]+)$"}}],
+				"get": {"operationId": "getUser", "responses": {"200": {"description": "the user"}}},
+				"patch": {"operationId": "updateUser", "responses": {"200": {"description": "the user"}}}
+			}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("error parsing spec: %v", err)
+	}
+	// the handler echoes the body it was sent, to show it is passed on intact
+	handler := NewValidation(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(r.Header.Get("Content-Type"))
+	}), spec)
+
+	cases := []struct {
+		name           string
+		method         string
+		path           string
+		contentType    string
+		body           string
+		expectedStatus int
+		expectedCode   string
+		expectedAllow  string
+	}{
+		{"Valid", "POST", "/v1/users", "application/json", `{"email": "a@b.c"}`, http.StatusAccepted, "", ""},
+		{"Undocumented path", "GET", "/v1/data", "", "", http.StatusAccepted, "", ""},
+		{"Invalid body", "POST", "/v1/users", "application/json", `{"email": 1}`,
+			http.StatusUnprocessableEntity, problem.CodeValidationFailed, ""},
+		{"Wrong content type", "POST", "/v1/users", "text/plain", `email=a@b.c`,
+			http.StatusUnsupportedMediaType, problem.CodeUnsupportedMediaType, ""},
+		{"Unknown user", "GET", "/v1/users/bob", "", "", http.StatusNotFound, problem.CodeNotFound, ""},
+		{"Undocumented method", "DELETE", "/v1/users/me", "", "", http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, "GET, PATCH"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		if len(c.contentType) != 0 {
+			r.Header.Set("Content-Type", c.contentType)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		if rr.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d: %s", c.name, c.expectedStatus, rr.Code, rr.Body.String())
+			continue
+		}
+		if allow := rr.Header().Get("Allow"); allow != c.expectedAllow {
+			t.Errorf("case %s: expected Allow %q but got %q", c.name, c.expectedAllow, allow)
+		}
+		if len(c.expectedCode) == 0 {
+			continue
+		}
+		p := &problem.Problem{}
+		if rr.Header().Get("Content-Type") != problem.ContentType || json.Unmarshal(rr.Body.Bytes(), p) != nil || p.Code != c.expectedCode {
+			t.Errorf("case %s: expected problem %s but got %s %s", c.name, c.expectedCode, rr.Header().Get("Content-Type"), rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,231 @@
+//Package health reports whether the gateway is alive, and whether it is ready
+//to serve requests, by checking the dependencies it needs at once and within
+//a time limit.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//Statuses of the gateway's readiness
+const (
+	//StatusReady is every check passing
+	StatusReady = "ready"
+	//StatusDegraded is a check the gateway can serve without failing
+	StatusDegraded = "degraded"
+	//StatusUnready is a check the gateway cannot serve without failing
+	StatusUnready = "unready"
+	//StatusDraining is the gateway shutting down, whatever its checks say
+	StatusDraining = "draining"
+)
+
+//Statuses of a check
+const (
+	CheckOK     = "ok"
+	CheckFailed = "failed"
+)
+
+//DefaultTimeout is how long each check is given, unless the Checker says otherwise
+const DefaultTimeout = 2 * time.Second
+
+//Check checks a dependency, returning why the gateway cannot use it
+type Check func(ctx context.Context) error
+
+//Result is the outcome of a check
+type Result struct {
+	Status string `json:"status"`
+	//Critical is whether the gateway is unready while the check fails
+	Critical  bool    `json:"critical"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+}
+
+//Report is the readiness of the gateway, with the result of each check
+type Report struct {
+	Status string             `json:"status"`
+	Checks map[string]*Result `json:"checks"`
+}
+
+//Ready reports whether the gateway should be sent requests
+func (rep *Report) Ready() bool {
+	return rep.Status == StatusReady || rep.Status == StatusDegraded
+}
+
+//check is a Check added to a Checker
+type check struct {
+	run      Check
+	critical bool
+}
+
+//source gives checks that change while the gateway runs
+type source struct {
+	checks   func() map[string]Check
+	critical bool
+}
+
+//Checker runs the checks of the gateway's dependencies, and is marked draining
+//once the gateway begins shutting down so it stops being sent requests
+type Checker struct {
+	//Timeout is how long each check is given
+	Timeout time.Duration
+
+	mu       sync.Mutex
+	checks   map[string]*check
+	sources  []*source
+	draining int32
+}
+
+//NewChecker constructs a new Checker without any checks
+func NewChecker(timeout time.Duration) *Checker {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Checker{Timeout: timeout, checks: map[string]*check{}}
+}
+
+//Add adds the check under the name. The gateway is unready while a
+//critical check fails, and only degraded while another check fails.
+func (c *Checker) Add(name string, critical bool, run Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.checks[name] = &check{run, critical}
+}
+
+//AddSource adds the checks `checks` returns each time the checks are run,
+//for dependencies that come and go, such as the upstreams of reloaded routes
+func (c *Checker) AddSource(critical bool, checks func() map[string]Check) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sources = append(c.sources, &source{checks, critical})
+}
+
+//Drain marks the gateway as draining, failing readiness from now on
+func (c *Checker) Drain() {
+	atomic.StoreInt32(&c.draining, 1)
+}
+
+//Draining reports whether the gateway is draining
+func (c *Checker) Draining() bool {
+	return atomic.LoadInt32(&c.draining) != 0
+}
+
+//Run runs every check at once, each for up to the Checker's Timeout, and
+//reports the results. A check that does not return in time fails, though it
+//is left to finish in the background.
+func (c *Checker) Run(ctx context.Context) *Report {
+	c.mu.Lock()
+	checks := make(map[string]*check, len(c.checks))
+	for name, ch := range c.checks {
+		checks[name] = ch
+	}
+	sources := append([]*source{}, c.sources...)
+	c.mu.Unlock()
+	for _, src := range sources {
+		for name, run := range src.checks() {
+			checks[name] = &check{run, src.critical}
+		}
+	}
+
+	report := &Report{Status: StatusReady, Checks: make(map[string]*Result, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, ch := range checks {
+		wg.Add(1)
+		go func(name string, ch *check) {
+			defer wg.Done()
+			result := c.run(ctx, ch)
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+		}(name, ch)
+	}
+	wg.Wait()
+
+	for _, result := range report.Checks {
+		if result.Status == CheckOK {
+			continue
+		}
+		if result.Critical {
+			report.Status = StatusUnready
+		} else if report.Status == StatusReady {
+			report.Status = StatusDegraded
+		}
+	}
+	if c.Draining() {
+		report.Status = StatusDraining
+	}
+	return report
+}
+
+//run runs the check within the Checker's Timeout
+func (c *Checker) run(ctx context.Context, ch *check) *Result {
+	ctx, cancel := context.WithTimeout(ctx, c.Timeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- ch.run(ctx)
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("timed out after %v", c.Timeout)
+	}
+	result := &Result{Status: CheckOK, Critical: ch.critical, LatencyMs: float64(time.Since(start)) / float64(time.Millisecond)}
+	if err != nil {
+		result.Status = CheckFailed
+		result.Error = err.Error()
+	}
+	return result
+}
+
+//Live responds that the gateway is alive, which it is for as long as it can
+//respond at all, even while draining; restarting it would not help it serve
+func (c *Checker) Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+//Ready responds with the report of the checks as JSON, with status 200 if the
+//gateway is ready or degraded and 503 otherwise. The checks are not run while
+//the gateway is draining.
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	c.ready(w, r, true)
+}
+
+//ReadySummary responds as Ready does, but without the errors of the checks,
+//which would tell clients of a public address about the gateway's internals
+func (c *Checker) ReadySummary(w http.ResponseWriter, r *http.Request) {
+	c.ready(w, r, false)
+}
+
+//ready responds with the report of the checks, with their errors if `details` is set
+func (c *Checker) ready(w http.ResponseWriter, r *http.Request, details bool) {
+	report := &Report{Status: StatusDraining, Checks: map[string]*Result{}}
+	if !c.Draining() {
+		report = c.Run(r.Context())
+	}
+	if !details {
+		for _, result := range report.Checks {
+			result.Error = ""
+		}
+	}
+	status := http.StatusOK
+	if !report.Ready() {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+}
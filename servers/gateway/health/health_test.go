@@ -0,0 +1,125 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//passing is a check that always passes
+func passing(ctx context.Context) error {
+	return nil
+}
+
+//failing is a check that always fails, revealing an address
+func failing(ctx context.Context) error {
+	return errors.New("dial tcp 10.0.0.3:3306: connection refused")
+}
+
+//hanging is a check that never returns, ignoring its context
+func hanging(ctx context.Context) error {
+	select {}
+}
+
+func TestRun(t *testing.T) {
+	cases := []struct {
+		name           string
+		critical       map[string]Check
+		other          map[string]Check
+		expectedStatus string
+		expectedFailed []string
+	}{
+		{"Ready", map[string]Check{"users": passing, "sessions": passing}, map[string]Check{"upstream:a": passing}, StatusReady, nil},
+		{"Degraded", map[string]Check{"users": passing}, map[string]Check{"upstream:a": failing, "upstream:b": passing},
+			StatusDegraded, []string{"upstream:a"}},
+		{"Unready", map[string]Check{"users": failing, "sessions": passing}, map[string]Check{"upstream:a": failing},
+			StatusUnready, []string{"upstream:a", "users"}},
+		{"Timed out", map[string]Check{"sessions": hanging}, nil, StatusUnready, []string{"sessions"}},
+		{"No checks", nil, nil, StatusReady, nil},
+	}
+	for _, c := range cases {
+		checks := NewChecker(50 * time.Millisecond)
+		for name, check := range c.critical {
+			checks.Add(name, true, check)
+		}
+		other := c.other
+		checks.AddSource(false, func() map[string]Check { return other })
+
+		start := time.Now()
+		report := checks.Run(context.Background())
+		//the checks run at once, so the slowest bounds how long they take
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("case %s: checks took %v", c.name, elapsed)
+		}
+		if report.Status != c.expectedStatus {
+			t.Errorf("case %s: expected status %s but got %s", c.name, c.expectedStatus, report.Status)
+		}
+		if len(report.Checks) != len(c.critical)+len(c.other) {
+			t.Errorf("case %s: expected a result for every check but got %v", c.name, report.Checks)
+		}
+		failed := map[string]bool{}
+		for _, name := range c.expectedFailed {
+			failed[name] = true
+		}
+		for name, result := range report.Checks {
+			if (result.Status == CheckFailed) != failed[name] || (result.Status == CheckFailed) != (len(result.Error) != 0) {
+				t.Errorf("case %s: unexpected result of %s: %+v", c.name, name, result)
+			}
+			if _, isCritical := c.critical[name]; result.Critical != isCritical {
+				t.Errorf("case %s: expected %s critical=%v", c.name, name, isCritical)
+			}
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	checks := NewChecker(time.Second)
+	checks.Add("users", true, passing)
+	checks.Add("upstream:dashboards", false, failing)
+
+	get := func(handler http.HandlerFunc) (*httptest.ResponseRecorder, *Report) {
+		rr := httptest.NewRecorder()
+		handler(rr, httptest.NewRequest("GET", "/readyz", nil))
+		report := &Report{}
+		if err := json.Unmarshal(rr.Body.Bytes(), report); err != nil {
+			t.Fatalf("error decoding report %q: %v", rr.Body.String(), err)
+		}
+		return rr, report
+	}
+
+	//a degraded gateway is still sent requests
+	rr, report := get(checks.Ready)
+	if rr.Code != http.StatusOK || report.Status != StatusDegraded || rr.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("unexpected response %d %v %s", rr.Code, rr.Header(), rr.Body.String())
+	}
+	if !strings.Contains(report.Checks["upstream:dashboards"].Error, "10.0.0.3") {
+		t.Errorf("expected the error of the failed check but got %+v", report.Checks["upstream:dashboards"])
+	}
+	//the summary does not tell the public why
+	if rr, _ := get(checks.ReadySummary); strings.Contains(rr.Body.String(), "10.0.0.3") {
+		t.Errorf("expected the errors of the checks to be left out but got %s", rr.Body.String())
+	}
+
+	checks.Add("sessions", true, failing)
+	if rr, report := get(checks.Ready); rr.Code != http.StatusServiceUnavailable || report.Status != StatusUnready {
+		t.Errorf("expected the gateway to be unready but got %d %s", rr.Code, rr.Body.String())
+	}
+
+	//a draining gateway is unready without running its checks, but still alive
+	checks.Add("sessions", true, hanging)
+	checks.Drain()
+	rr, report = get(checks.Ready)
+	if rr.Code != http.StatusServiceUnavailable || report.Status != StatusDraining || len(report.Checks) != 0 {
+		t.Errorf("expected the gateway to be draining but got %d %s", rr.Code, rr.Body.String())
+	}
+	live := httptest.NewRecorder()
+	checks.Live(live, httptest.NewRequest("GET", "/healthz", nil))
+	if live.Code != http.StatusOK {
+		t.Errorf("expected the draining gateway to be alive but got %d", live.Code)
+	}
+}
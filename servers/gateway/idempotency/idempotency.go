@@ -0,0 +1,59 @@
+//Package idempotency keeps the responses to requests sent with an Idempotency-Key,
+//so that a client retrying a request it never got the answer to is sent the first
+//response instead of the request being carried out again, as described by
+//https://datatracker.ietf.org/doc/draft-ietf-httpapi-idempotency-key-header/.
+//Responses are kept in memory or in redis so that every gateway instance shares them.
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+)
+
+//Defaults of how long keys are held
+const (
+	//DefaultTTL is how long a response is kept for retries
+	DefaultTTL = 24 * time.Hour
+	//DefaultLockTTL is the longest a request is considered in progress,
+	//in case the gateway handling it stops before it finishes
+	DefaultLockTTL = time.Minute
+)
+
+//ErrInProgress is returned from Store.Lock when a request
+//with the key is already being handled
+var ErrInProgress = errors.New("a request with the idempotency key is in progress")
+
+//Record is the response to the first request sent with a key
+type Record struct {
+	//Fingerprint identifies the request, so the key is not reused for another
+	Fingerprint string      `json:"fingerprint"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+	//Stored is when the response was recorded
+	Stored time.Time `json:"stored"`
+}
+
+//Store keeps the responses to requests by their keys, and which keys
+//have requests in progress
+type Store interface {
+	//Get returns the record of the key, or nil if there is none
+	Get(key string) (*Record, error)
+	//Set stores the record under the key for the ttl
+	Set(key string, record *Record, ttl time.Duration) error
+	//Lock marks a request with the key in progress for up to the ttl, returning
+	//the function ending it, or ErrInProgress if another request already is
+	Lock(key string, ttl time.Duration) (func(), error)
+}
+
+//Fingerprint returns a hash identifying the request with the method, URI and body,
+//which holds none of the body itself as it may contain passwords
+func Fingerprint(method string, uri string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method + " " + uri + "\n"))
+	h.Write(body)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
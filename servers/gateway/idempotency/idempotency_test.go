@@ -0,0 +1,130 @@
+package idempotency
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/my/repo/servers/gateway/redistest"
+)
+
+//testStore checks the behaviour every store shares
+func testStore(t *testing.T, store Store) {
+	if record, err := store.Get("user:7:abc"); record != nil || err != nil {
+		t.Fatalf("expected no record but got %v, %v", record, err)
+	}
+	record := &Record{Fingerprint: Fingerprint("POST", "/v1/dashboards", []byte(`{"title":"t"}`)), Status: http.StatusCreated,
+		Header: http.Header{"Content-Type": {"application/json"}}, Body: []byte(`{"_id":"1"}`), Stored: time.Now()}
+	if err := store.Set("user:7:abc", record, time.Hour); err != nil {
+		t.Fatalf("error setting record: %v", err)
+	}
+	got, err := store.Get("user:7:abc")
+	if err != nil || got == nil {
+		t.Fatalf("expected a record but got %v, %v", got, err)
+	}
+	if got.Fingerprint != record.Fingerprint || got.Status != http.StatusCreated || string(got.Body) != `{"_id":"1"}` ||
+		got.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("unexpected record %+v", got)
+	}
+	//keys are kept apart, whatever characters clients choose for them
+	if got, _ := store.Get("user:8:abc"); got != nil {
+		t.Errorf("expected no record for another user's key but got %+v", got)
+	}
+	if err := store.Set("anonymous:a*b c", record, time.Hour); err != nil {
+		t.Errorf("error setting record under a key with special characters: %v", err)
+	}
+
+	unlock, err := store.Lock("user:7:def", time.Minute)
+	if err != nil {
+		t.Fatalf("error locking: %v", err)
+	}
+	if _, err := store.Lock("user:7:def", time.Minute); err != ErrInProgress {
+		t.Errorf("expected ErrInProgress but got %v", err)
+	}
+	if other, err := store.Lock("user:8:def", time.Minute); err != nil {
+		t.Errorf("expected another key to be locked independently but got %v", err)
+	} else {
+		other()
+	}
+	unlock()
+	again, err := store.Lock("user:7:def", time.Minute)
+	if err != nil {
+		t.Fatalf("expected the released lock to be taken again but got %v", err)
+	}
+	//releasing a lock again does not release the one taken since
+	unlock()
+	if _, err := store.Lock("user:7:def", time.Minute); err != ErrInProgress {
+		t.Errorf("expected the lock taken since to be held but got %v", err)
+	}
+	again()
+}
+
+func TestFingerprint(t *testing.T) {
+	first := Fingerprint("POST", "/v1/users", []byte(`{"email":"a@b.c"}`))
+	if first != Fingerprint("POST", "/v1/users", []byte(`{"email":"a@b.c"}`)) {
+		t.Errorf("expected the same request to have the same fingerprint")
+	}
+	for _, other := range []string{
+		Fingerprint("PATCH", "/v1/users", []byte(`{"email":"a@b.c"}`)),
+		Fingerprint("POST", "/v1/sessions", []byte(`{"email":"a@b.c"}`)),
+		Fingerprint("POST", "/v1/users", []byte(`{"email":"d@e.f"}`)),
+	} {
+		if other == first {
+			t.Errorf("expected different requests to have different fingerprints")
+		}
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryStore()
+	store.Now = func() time.Time { return now }
+	testStore(t, store)
+
+	//records and locks expire
+	store.Set("expiring", &Record{Status: http.StatusOK}, time.Minute)
+	store.Lock("locked", time.Minute)
+	now = now.Add(2 * time.Hour)
+	if record, _ := store.Get("expiring"); record != nil {
+		t.Errorf("expected the record to have expired but got %+v", record)
+	}
+	if _, err := store.Lock("locked", time.Minute); err != nil {
+		t.Errorf("expected the lock to have expired but got %v", err)
+	}
+	store.Set("new", &Record{Status: http.StatusOK}, time.Minute)
+	if store.Len() != 1 {
+		t.Errorf("expected the expired records to be swept but %d are held", store.Len())
+	}
+}
+
+func TestRedisStore(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	store := NewRedisStore(client, "idempotency:")
+	testStore(t, store)
+
+	store.Set("user:7:ghi", &Record{Status: http.StatusOK}, time.Hour)
+	if ttl := client.TTL("idempotency:record:user%3A7%3Aghi").Val(); ttl < 59*time.Minute || ttl > time.Hour {
+		t.Errorf("expected the record to expire in an hour but got %v", ttl)
+	}
+	stale, _ := store.Lock("user:7:ghi", time.Minute)
+	if ttl := client.TTL("idempotency:lock:user%3A7%3Aghi").Val(); ttl < 59*time.Second || ttl > time.Minute {
+		t.Errorf("expected the lock to expire in a minute but got %v", ttl)
+	}
+
+	//a lock that expired and was taken by another request is not released by the first
+	client.Del("idempotency:lock:user%3A7%3Aghi")
+	if _, err := store.Lock("user:7:ghi", time.Minute); err != nil {
+		t.Fatalf("expected the expired lock to be taken but got %v", err)
+	}
+	stale()
+	if _, err := store.Lock("user:7:ghi", time.Minute); err != ErrInProgress {
+		t.Errorf("expected the lock to still be held after the stale unlock but got %v", err)
+	}
+}
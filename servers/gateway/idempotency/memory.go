@@ -0,0 +1,108 @@
+package idempotency
+
+import (
+	"sync"
+	"time"
+)
+
+//memoryRecord is a record held by a MemoryStore
+type memoryRecord struct {
+	record  *Record
+	expires time.Time
+}
+
+//memoryLock is a lock held by a MemoryStore
+type memoryLock struct {
+	expires time.Time
+}
+
+//MemoryStore keeps records in memory, so each gateway instance only replays
+//the responses it sent itself. It is meant for tests and for running a single instance.
+type MemoryStore struct {
+	//Now returns the current time; time.Now if nil
+	Now func() time.Time
+
+	mu        sync.Mutex
+	records   map[string]*memoryRecord
+	locks     map[string]*memoryLock
+	lastSweep time.Time
+}
+
+//NewMemoryStore constructs a new MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: map[string]*memoryRecord{}, locks: map[string]*memoryLock{}}
+}
+
+func (ms *MemoryStore) now() time.Time {
+	if ms.Now != nil {
+		return ms.Now()
+	}
+	return time.Now()
+}
+
+//Get returns the record of the key, or nil if there is none
+func (ms *MemoryStore) Get(key string) (*Record, error) {
+	now := ms.now()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	held, found := ms.records[key]
+	if !found || !now.Before(held.expires) {
+		return nil, nil
+	}
+	return held.record, nil
+}
+
+//Set stores the record under the key for the ttl
+func (ms *MemoryStore) Set(key string, record *Record, ttl time.Duration) error {
+	now := ms.now()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.sweep(now)
+	ms.records[key] = &memoryRecord{record, now.Add(ttl)}
+	return nil
+}
+
+//Lock marks a request with the key in progress for up to the ttl
+func (ms *MemoryStore) Lock(key string, ttl time.Duration) (func(), error) {
+	now := ms.now()
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if held, found := ms.locks[key]; found && now.Before(held.expires) {
+		return nil, ErrInProgress
+	}
+	lock := &memoryLock{now.Add(ttl)}
+	ms.locks[key] = lock
+	return func() {
+		ms.mu.Lock()
+		defer ms.mu.Unlock()
+		//only release the lock if it has not expired and been taken by another request
+		if ms.locks[key] == lock {
+			delete(ms.locks, key)
+		}
+	}, nil
+}
+
+//sweep forgets the expired records and locks once a minute; the caller holds ms.mu
+func (ms *MemoryStore) sweep(now time.Time) {
+	if now.Sub(ms.lastSweep) < time.Minute {
+		return
+	}
+	ms.lastSweep = now
+	for key, held := range ms.records {
+		if !now.Before(held.expires) {
+			delete(ms.records, key)
+		}
+	}
+	for key, held := range ms.locks {
+		if !now.Before(held.expires) {
+			delete(ms.locks, key)
+		}
+	}
+}
+
+//Len returns the number of records held
+func (ms *MemoryStore) Len() int {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return len(ms.records)
+}
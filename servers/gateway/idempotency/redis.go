@@ -0,0 +1,80 @@
+package idempotency
+
+import (
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/my/repo/servers/gateway/redislock"
+)
+
+//RedisStore keeps records in redis, so a retry is replayed by whichever
+//gateway instance it reaches. Records are stored as JSON, expiring with
+//their ttl, and locks are held under keys of their own.
+type RedisStore struct {
+	Client *redis.Client
+	//Prefix is added to the keys of records and locks
+	Prefix string
+}
+
+//NewRedisStore constructs a new RedisStore, keeping records under the prefix
+func NewRedisStore(client *redis.Client, prefix string) *RedisStore {
+	return &RedisStore{Client: client, Prefix: prefix}
+}
+
+//recordKey returns the redis key of the record of the key, which is escaped
+//as the key is chosen by the client
+func (rs *RedisStore) recordKey(key string) string {
+	return rs.Prefix + "record:" + url.QueryEscape(key)
+}
+
+//lockKey returns the redis key of the lock of the key
+func (rs *RedisStore) lockKey(key string) string {
+	return rs.Prefix + "lock:" + url.QueryEscape(key)
+}
+
+//Get returns the record of the key, or nil if there is none
+func (rs *RedisStore) Get(key string) (*Record, error) {
+	data, err := rs.Client.Get(rs.recordKey(key)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := &Record{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+//Set stores the record under the key for the ttl
+func (rs *RedisStore) Set(key string, record *Record, ttl time.Duration) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return rs.Client.Set(rs.recordKey(key), data, ttl).Err()
+}
+
+//Lock marks a request with the key in progress for up to the ttl, on every gateway instance
+func (rs *RedisStore) Lock(key string, ttl time.Duration) (func(), error) {
+	token, err := redislock.NewToken()
+	if err != nil {
+		return nil, err
+	}
+	lockKey := rs.lockKey(key)
+	acquired, err := redislock.TryAcquire(rs.Client, lockKey, token, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if !acquired {
+		return nil, ErrInProgress
+	}
+	return func() {
+		//only release the lock if it has not expired and been taken by another request
+		redislock.Release(rs.Client, lockKey, token)
+	}, nil
+}
@@ -0,0 +1,164 @@
+//Package identity signs and verifies the assertions the gateway sends
+//upstream services about the user a request was made by. Assertions are
+//compact JSON Web Tokens signed with HS256 or EdDSA, so services written
+//in any language can verify them; Go services can use a Verifier.
+package identity
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+//Errors returned from Verifier.Verify
+var (
+	ErrMalformed        = errors.New("identity assertion is malformed")
+	ErrUnknownKey       = errors.New("identity assertion is signed with an unknown key")
+	ErrInvalidSignature = errors.New("identity assertion signature is invalid")
+	ErrExpired          = errors.New("identity assertion has expired")
+)
+
+//Claims are the statements an assertion makes about the user
+type Claims struct {
+	//UserID is the ID of the user
+	UserID int64 `json:"uid"`
+	//Roles the user has
+	Roles []string `json:"roles"`
+	//Session identifies the session the request was made in, without
+	//revealing the session ID itself
+	Session string `json:"sid"`
+	//IssuedAt and Expires are the unix times the assertion
+	//was issued and stops being valid
+	IssuedAt int64 `json:"iat"`
+	Expires  int64 `json:"exp"`
+	//User is the JSON encoded profile of the user
+	User json.RawMessage `json:"user,omitempty"`
+}
+
+//header is the JOSE header of an assertion
+type header struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+	Type      string `json:"typ"`
+}
+
+//Signer signs assertions with the signing key of a KeySet
+type Signer struct {
+	Keys *KeySet
+	//Lifetime is how long each assertion is valid for. Assertions are
+	//issued per request, so this only needs to cover the request's
+	//journey through the upstream services.
+	Lifetime time.Duration
+}
+
+//NewSigner constructs a new Signer, returning an
+//error if the key set has no signing key
+func NewSigner(keys *KeySet, lifetime time.Duration) (*Signer, error) {
+	if keys.Signing == nil {
+		return nil, errors.New("no signing key is set")
+	}
+	return &Signer{Keys: keys, Lifetime: lifetime}, nil
+}
+
+//Sign returns an assertion of the claims, setting their IssuedAt and Expires
+func (s *Signer) Sign(claims *Claims) (string, error) {
+	key := s.Keys.Signing
+	now := time.Now()
+	claims.IssuedAt = now.Unix()
+	claims.Expires = now.Add(s.Lifetime).Unix()
+	head, err := json.Marshal(&header{Algorithm: key.Algorithm, KeyID: key.ID, Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := encode(head) + "." + encode(payload)
+	var sig []byte
+	switch key.Algorithm {
+	case HS256:
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case EdDSA:
+		sig = ed25519.Sign(key.private, []byte(signed))
+	}
+	return signed + "." + encode(sig), nil
+}
+
+//Verifier verifies assertions signed with any key of a KeySet
+type Verifier struct {
+	Keys *KeySet
+	//Leeway allows for clocks differing between the gateway and the service
+	Leeway time.Duration
+}
+
+//NewVerifier constructs a new Verifier
+func NewVerifier(keys *KeySet) *Verifier {
+	return &Verifier{Keys: keys, Leeway: 30 * time.Second}
+}
+
+//Verify checks the assertion's signature and expiry, returning its claims
+func (v *Verifier) Verify(assertion string) (*Claims, error) {
+	parts := strings.Split(assertion, ".")
+	if len(parts) != 3 {
+		return nil, ErrMalformed
+	}
+	head := &header{}
+	if err := decodeJSON(parts[0], head); err != nil {
+		return nil, ErrMalformed
+	}
+	key, found := v.Keys.Key(head.KeyID)
+	if !found {
+		return nil, ErrUnknownKey
+	}
+	//the algorithm is the key's, whatever the header says
+	if head.Algorithm != key.Algorithm {
+		return nil, ErrInvalidSignature
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrMalformed
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	switch key.Algorithm {
+	case HS256:
+		mac := hmac.New(sha256.New, key.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, ErrInvalidSignature
+		}
+	case EdDSA:
+		if !ed25519.Verify(key.public, signed, sig) {
+			return nil, ErrInvalidSignature
+		}
+	}
+	claims := &Claims{}
+	if err := decodeJSON(parts[1], claims); err != nil {
+		return nil, ErrMalformed
+	}
+	if !time.Now().Before(time.Unix(claims.Expires, 0).Add(v.Leeway)) {
+		return nil, ErrExpired
+	}
+	return claims, nil
+}
+
+//encode encodes part of an assertion
+func encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+//decodeJSON decodes a JSON part of an assertion
+func decodeJSON(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,148 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestKeys(t *testing.T) (hmacKey *Key, edKey *Key, edPublic *Key) {
+	hmacKey, err := NewHMACKey("hmac", []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("error creating HMAC key: %v", err)
+	}
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatalf("error generating Ed25519 key: %v", err)
+	}
+	edKey, err = NewEd25519Key("ed", private)
+	if err != nil {
+		t.Fatalf("error creating Ed25519 key: %v", err)
+	}
+	edPublic, _ = NewEd25519PublicKey("ed", private.Public().(ed25519.PublicKey))
+	return hmacKey, edKey, edPublic
+}
+
+func TestSignVerify(t *testing.T) {
+	hmacKey, edKey, edPublic := newTestKeys(t)
+	claims := &Claims{UserID: 7, Roles: []string{"user"}, Session: "abc", User: json.RawMessage(`{"id":7}`)}
+
+	cases := []struct {
+		name   string
+		signer *Key
+		//keys the verifier has
+		verifier []*Key
+		tamper   func(assertion string) string
+		expected error
+	}{
+		{"HMAC", hmacKey, []*Key{hmacKey}, nil, nil},
+		{"Ed25519 verified with the public key", edKey, []*Key{edPublic}, nil, nil},
+		{"key rotated out", hmacKey, []*Key{edPublic}, nil, ErrUnknownKey},
+		{"tampered claims", hmacKey, []*Key{hmacKey}, func(a string) string {
+			parts := strings.Split(a, ".")
+			forged, _ := json.Marshal(&Claims{UserID: 1, Expires: time.Now().Add(time.Hour).Unix()})
+			return parts[0] + "." + encode(forged) + "." + parts[2]
+		}, ErrInvalidSignature},
+		{"algorithm swapped in the header", edKey, []*Key{edPublic}, func(a string) string {
+			parts := strings.Split(a, ".")
+			head, _ := json.Marshal(&header{Algorithm: HS256, KeyID: "ed", Type: "JWT"})
+			return encode(head) + "." + parts[1] + "." + parts[2]
+		}, ErrInvalidSignature},
+		{"not an assertion", hmacKey, []*Key{hmacKey}, func(a string) string { return `{"id":7}` }, ErrMalformed},
+	}
+	for _, c := range cases {
+		signingKeys, _ := NewKeySet(c.signer.ID, c.signer)
+		signer, err := NewSigner(signingKeys, time.Minute)
+		if err != nil {
+			t.Fatalf("case %s: error creating signer: %v", c.name, err)
+		}
+		assertion, err := signer.Sign(claims)
+		if err != nil {
+			t.Fatalf("case %s: error signing: %v", c.name, err)
+		}
+		if c.tamper != nil {
+			assertion = c.tamper(assertion)
+		}
+		verifyingKeys, _ := NewKeySet("", c.verifier...)
+		verified, err := NewVerifier(verifyingKeys).Verify(assertion)
+		if err != c.expected {
+			t.Errorf("case %s: expected error %v but got %v", c.name, c.expected, err)
+		}
+		if err == nil && !reflect.DeepEqual(verified, claims) {
+			t.Errorf("case %s: expected claims %+v but got %+v", c.name, claims, verified)
+		}
+	}
+}
+
+func TestVerifyExpired(t *testing.T) {
+	hmacKey, _, _ := newTestKeys(t)
+	keys, _ := NewKeySet("hmac", hmacKey)
+	signer, _ := NewSigner(keys, -time.Minute)
+	assertion, _ := signer.Sign(&Claims{UserID: 7})
+	verifier := NewVerifier(keys)
+	if _, err := verifier.Verify(assertion); err != ErrExpired {
+		t.Errorf("expected ErrExpired but got %v", err)
+	}
+	verifier.Leeway = 2 * time.Minute
+	if _, err := verifier.Verify(assertion); err != nil {
+		t.Errorf("expected the assertion accepted within the leeway but got %v", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	hmacKey, _, _ := newTestKeys(t)
+	keys, _ := NewKeySet("hmac", hmacKey)
+	signer, _ := NewSigner(keys, time.Minute)
+	assertion, _ := signer.Sign(&Claims{UserID: 7})
+	handler := NewVerifier(keys).Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := FromContext(r.Context())
+		if !ok || claims.UserID != 7 {
+			t.Errorf("expected the verified claims in the request context but got %+v", claims)
+		}
+	}))
+
+	for _, value := range []string{"", `{"id":7}`, assertion} {
+		req := httptest.NewRequest("GET", "/v1/dashboards", nil)
+		req.Header.Set(Header, value)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		expected := http.StatusUnauthorized
+		if value == assertion {
+			expected = http.StatusOK
+		}
+		if rr.Code != expected {
+			t.Errorf("header %q: expected status %d but got %d", value, expected, rr.Code)
+		}
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	cases := []struct {
+		name        string
+		keys        string
+		expectError string
+	}{
+		{"HMAC", `{"signing": "a", "keys": [{"kid": "a", "alg": "HS256", "secret": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}]}`, ""},
+		{"Ed25519 seed", `{"signing": "a", "keys": [{"kid": "a", "alg": "EdDSA", "privateKey": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}]}`, ""},
+		{"Ed25519 public key", `{"keys": [{"kid": "a", "alg": "EdDSA", "publicKey": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}]}`, ""},
+		{"signing with a public key", `{"signing": "a", "keys": [{"kid": "a", "alg": "EdDSA", "publicKey": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}]}`, "no private key"},
+		{"short secret", `{"keys": [{"kid": "a", "alg": "HS256", "secret": "c2hvcnQ="}]}`, "at least 32 bytes"},
+		{"unknown algorithm", `{"keys": [{"kid": "a", "alg": "RS256"}]}`, "unknown algorithm"},
+		{"unlisted signing key", `{"signing": "b", "keys": [{"kid": "a", "alg": "HS256", "secret": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}]}`, "not listed"},
+		{"no keys", `{"keys": []}`, "no keys"},
+	}
+	for _, c := range cases {
+		_, err := ParseKeys([]byte(c.keys))
+		if len(c.expectError) == 0 && err != nil {
+			t.Errorf("case %s: unexpected error: %v", c.name, err)
+		}
+		if len(c.expectError) != 0 && (err == nil || !strings.Contains(err.Error(), c.expectError)) {
+			t.Errorf("case %s: expected error containing %q but got %v", c.name, c.expectError, err)
+		}
+	}
+}
@@ -0,0 +1,202 @@
+package identity
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+//Algorithms assertions can be signed with
+const (
+	//HS256 is HMAC with SHA-256, using a secret shared by the gateway and the services
+	HS256 = "HS256"
+	//EdDSA is Ed25519, so services only need the gateway's public key
+	EdDSA = "EdDSA"
+)
+
+//Key is a key assertions are signed or verified with, identified by its ID
+//so that several keys can be accepted while the signing key is rotated
+type Key struct {
+	//ID is sent in the header of every assertion signed with the key
+	ID string
+	//Algorithm is HS256 or EdDSA
+	Algorithm string
+
+	secret  []byte
+	private ed25519.PrivateKey
+	public  ed25519.PublicKey
+}
+
+//NewHMACKey constructs a new HS256 Key from a shared secret
+func NewHMACKey(id string, secret []byte) (*Key, error) {
+	if len(secret) < 32 {
+		return nil, fmt.Errorf("key %q: HMAC secrets must be at least 32 bytes", id)
+	}
+	return &Key{ID: id, Algorithm: HS256, secret: secret}, nil
+}
+
+//NewEd25519Key constructs a new EdDSA Key that can sign assertions
+func NewEd25519Key(id string, private ed25519.PrivateKey) (*Key, error) {
+	if len(private) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("key %q: Ed25519 private keys must be %d bytes", id, ed25519.PrivateKeySize)
+	}
+	return &Key{ID: id, Algorithm: EdDSA, private: private, public: private.Public().(ed25519.PublicKey)}, nil
+}
+
+//NewEd25519PublicKey constructs a new EdDSA Key that can only verify assertions
+func NewEd25519PublicKey(id string, public ed25519.PublicKey) (*Key, error) {
+	if len(public) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("key %q: Ed25519 public keys must be %d bytes", id, ed25519.PublicKeySize)
+	}
+	return &Key{ID: id, Algorithm: EdDSA, public: public}, nil
+}
+
+//CanSign reports whether the key can sign assertions as well as verify them
+func (k *Key) CanSign() bool {
+	return len(k.secret) != 0 || len(k.private) != 0
+}
+
+//KeySet is the set of keys assertions are verified with,
+//and the key new assertions are signed with
+type KeySet struct {
+	//Signing is the key new assertions are signed with, if any
+	Signing *Key
+	keys    map[string]*Key
+}
+
+//NewKeySet constructs a new KeySet from the keys, signing
+//with the one whose ID is `signing` unless it is empty
+func NewKeySet(signing string, keys ...*Key) (*KeySet, error) {
+	ks := &KeySet{keys: map[string]*Key{}}
+	for _, k := range keys {
+		if _, found := ks.keys[k.ID]; found {
+			return nil, fmt.Errorf("key %q is listed more than once", k.ID)
+		}
+		ks.keys[k.ID] = k
+	}
+	if len(signing) != 0 {
+		ks.Signing = ks.keys[signing]
+		if ks.Signing == nil {
+			return nil, fmt.Errorf("signing key %q is not listed", signing)
+		}
+		if !ks.Signing.CanSign() {
+			return nil, fmt.Errorf("signing key %q has no private key", signing)
+		}
+	}
+	return ks, nil
+}
+
+//Key returns the key with the ID, if it is in the set
+func (ks *KeySet) Key(id string) (*Key, bool) {
+	k, found := ks.keys[id]
+	return k, found
+}
+
+//keyFile is the JSON format of a key file. Secrets and
+//keys are base64 encoded, in the standard alphabet.
+type keyFile struct {
+	//Signing is the ID of the key to sign with; services that only verify leave it out
+	Signing string `json:"signing,omitempty"`
+	Keys    []struct {
+		ID        string `json:"kid"`
+		Algorithm string `json:"alg"`
+		//Secret is the shared secret of an HS256 key
+		Secret string `json:"secret,omitempty"`
+		//PrivateKey is the seed or full private key of an EdDSA key
+		PrivateKey string `json:"privateKey,omitempty"`
+		//PublicKey is the public key of an EdDSA key
+		PublicKey string `json:"publicKey,omitempty"`
+	} `json:"keys"`
+}
+
+//ParseKeys parses a JSON key file such as
+//
+//	{
+//	  "signing": "2020-12",
+//	  "keys": [
+//	    {"kid": "2020-12", "alg": "EdDSA", "privateKey": "<base64 seed>"},
+//	    {"kid": "2020-11", "alg": "HS256", "secret": "<base64 secret>"}
+//	  ]
+//	}
+//
+//Services verifying assertions list the same keys, giving EdDSA keys by
+//their publicKey, and leave out "signing". To rotate keys, add the new key
+//everywhere, then sign with it, then remove the old key once the assertions
+//signed with it have expired.
+func ParseKeys(data []byte) (*KeySet, error) {
+	file := &keyFile{}
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, fmt.Errorf("error parsing keys: %v", err)
+	}
+	if len(file.Keys) == 0 {
+		return nil, errors.New("no keys listed")
+	}
+	keys := []*Key{}
+	for _, entry := range file.Keys {
+		if len(entry.ID) == 0 {
+			return nil, errors.New("every key needs a kid")
+		}
+		var k *Key
+		var err error
+		switch entry.Algorithm {
+		case HS256:
+			var secret []byte
+			if secret, err = decodeKey(entry.ID, "secret", entry.Secret); err == nil {
+				k, err = NewHMACKey(entry.ID, secret)
+			}
+		case EdDSA:
+			k, err = parseEd25519Key(entry.ID, entry.PrivateKey, entry.PublicKey)
+		default:
+			err = fmt.Errorf("key %q: unknown algorithm %q", entry.ID, entry.Algorithm)
+		}
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return NewKeySet(file.Signing, keys...)
+}
+
+//LoadKeys reads and parses the JSON key file at the path
+func LoadKeys(path string) (*KeySet, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeys(data)
+}
+
+//parseEd25519Key builds an EdDSA key from its base64 private key or seed,
+//or failing that its public key
+func parseEd25519Key(id string, private string, public string) (*Key, error) {
+	if len(private) == 0 {
+		publicKey, err := decodeKey(id, "publicKey", public)
+		if err != nil {
+			return nil, err
+		}
+		return NewEd25519PublicKey(id, publicKey)
+	}
+	privateKey, err := decodeKey(id, "privateKey", private)
+	if err != nil {
+		return nil, err
+	}
+	if len(privateKey) == ed25519.SeedSize {
+		privateKey = ed25519.NewKeyFromSeed(privateKey)
+	}
+	return NewEd25519Key(id, privateKey)
+}
+
+//decodeKey decodes the named base64 field of a key
+func decodeKey(id string, field string, value string) ([]byte, error) {
+	if len(value) == 0 {
+		return nil, fmt.Errorf("key %q: %s is required", id, field)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("key %q: %s is not valid base64: %v", id, field, err)
+	}
+	return decoded, nil
+}
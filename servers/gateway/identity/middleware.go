@@ -0,0 +1,32 @@
+package identity
+
+import (
+	"context"
+	"net/http"
+)
+
+//Header is the request header the gateway sends assertions in
+const Header = "X-User-Assertion"
+
+//claimsKey is the request context key of the verified Claims
+type claimsKey struct{}
+
+//FromContext returns the Claims the Verifier's middleware verified for the request, if any
+func FromContext(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	return claims, ok
+}
+
+//Middleware wraps a handler so it is only called for requests with a valid
+//assertion in the Header, whose claims it can get with FromContext. Other
+//requests are rejected with 401.
+func (v *Verifier) Middleware(handlerToWrap http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, err := v.Verify(r.Header.Get(Header))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		handlerToWrap.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, claims)))
+	})
+}
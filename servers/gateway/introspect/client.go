@@ -0,0 +1,208 @@
+//Package introspect asks the gateway about the sessions of the tokens clients send,
+//for services behind the gateway that are sent session tokens rather than identity
+//assertions. The gateway answers on its introspection listener, as described by
+//RFC 7662: https://tools.ietf.org/html/rfc7662, to services with credentials for it.
+package introspect
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Path is the path of the gateway's introspection endpoint
+const Path = "/sessions/introspect"
+
+//Defaults of a Client
+const (
+	DefaultCacheTTL   = 10 * time.Second
+	DefaultMaxEntries = 10000
+	DefaultTimeout    = 5 * time.Second
+)
+
+//ErrInactive is returned from Client.Introspect when the token does not belong
+//to a live session: it is malformed, was not issued by the gateway, or its
+//session has expired or ended
+var ErrInactive = errors.New("session is not active")
+
+//Session is what the gateway knows about the live session of a token
+type Session struct {
+	//Active is whether the token belongs to a live session; the
+	//other fields are only set if it does
+	Active bool `json:"active"`
+	//Session identifies the session without revealing its token,
+	//as identity assertions do
+	Session string `json:"sid,omitempty"`
+	//UserID is the ID of the user the session belongs to
+	UserID int64 `json:"uid,omitempty"`
+	//Roles the user has
+	Roles []string `json:"roles,omitempty"`
+	//BeginTime is when the user signed in
+	BeginTime time.Time `json:"beginTime"`
+	//ExpiresAt is when the session expires, unless it is used or
+	//refreshed first, or ended sooner
+	ExpiresAt time.Time `json:"expiresAt"`
+	//User is the JSON encoded profile of the user
+	User json.RawMessage `json:"user,omitempty"`
+}
+
+//entry is a cached answer of the gateway
+type entry struct {
+	session *Session
+	expires time.Time
+}
+
+//Client asks the gateway's introspection endpoint about the sessions of tokens,
+//reusing its answers for a while. A session ended in the meantime is reported
+//active until its answer expires from the cache.
+type Client struct {
+	//URL of the introspection endpoint, such as http://gateway:8082/sessions/introspect
+	URL string
+	//Service and Secret are the credentials the service was given for the gateway
+	Service string
+	Secret  string
+	//HTTPClient sends the requests
+	HTTPClient *http.Client
+	//CacheTTL is how long answers are reused; they are not cached if zero
+	CacheTTL time.Duration
+	//MaxEntries is the most answers cached at once
+	MaxEntries int
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]*entry
+}
+
+//NewClient constructs a new Client of the introspection endpoint at `endpoint`,
+//authenticating as `service` with `secret`
+func NewClient(endpoint string, service string, secret string) *Client {
+	return &Client{
+		URL:        endpoint,
+		Service:    service,
+		Secret:     secret,
+		HTTPClient: &http.Client{Timeout: DefaultTimeout},
+		CacheTTL:   DefaultCacheTTL,
+		MaxEntries: DefaultMaxEntries,
+		cache:      map[[sha256.Size]byte]*entry{},
+	}
+}
+
+//Introspect returns the session of the token, which may be a session ID or an
+//access token, with or without its "Bearer " scheme. It returns ErrInactive if
+//the token does not belong to a live session.
+func (c *Client) Introspect(ctx context.Context, token string) (*Session, error) {
+	token = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(token), "Bearer "))
+	if len(token) == 0 {
+		return nil, ErrInactive
+	}
+	//tokens are cached by their hash, so the cache holds no usable tokens
+	key := sha256.Sum256([]byte(token))
+	session, found := c.cached(key)
+	if !found {
+		var err error
+		if session, err = c.request(ctx, token); err != nil {
+			return nil, err
+		}
+		c.remember(key, session)
+	}
+	if !session.Active {
+		return nil, ErrInactive
+	}
+	return session, nil
+}
+
+//cached returns the cached answer for the token with the hash, if it has not expired
+func (c *Client) cached(key [sha256.Size]byte) (*Session, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, found := c.cache[key]
+	if !found || !time.Now().Before(e.expires) {
+		return nil, false
+	}
+	return e.session, true
+}
+
+//remember caches the answer for the token with the hash, for no
+//longer than the session lasts, making room for it if need be
+func (c *Client) remember(key [sha256.Size]byte, session *Session) {
+	if c.CacheTTL <= 0 {
+		return
+	}
+	now := time.Now()
+	expires := now.Add(c.CacheTTL)
+	if session.Active && session.ExpiresAt.Before(expires) {
+		expires = session.ExpiresAt
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cache == nil {
+		c.cache = map[[sha256.Size]byte]*entry{}
+	}
+	if c.MaxEntries > 0 && len(c.cache) >= c.MaxEntries {
+		for k, e := range c.cache {
+			if !now.Before(e.expires) {
+				delete(c.cache, k)
+			}
+		}
+		//the cache is full of live answers, so they are all dropped
+		//rather than tracking which was used least recently
+		if len(c.cache) >= c.MaxEntries {
+			c.cache = map[[sha256.Size]byte]*entry{}
+		}
+	}
+	c.cache[key] = &entry{session, expires}
+}
+
+//request asks the gateway about the token
+func (c *Client) request(ctx context.Context, token string) (*Session, error) {
+	form := url.Values{"token": {token}}
+	req, err := http.NewRequest("POST", c.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(c.Service, c.Secret)
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection failed with %s%s", resp.Status, detail(resp.Body))
+	}
+	session := &Session{}
+	if err := json.NewDecoder(resp.Body).Decode(session); err != nil {
+		return nil, fmt.Errorf("error decoding introspection response: %v", err)
+	}
+	return session, nil
+}
+
+//detail returns the detail of the problem the gateway responded with, if any
+func detail(body io.Reader) string {
+	data, _ := ioutil.ReadAll(io.LimitReader(body, 4096))
+	problem := struct {
+		Detail string `json:"detail"`
+	}{}
+	if json.Unmarshal(data, &problem) != nil || len(problem.Detail) == 0 {
+		return ""
+	}
+	return ": " + problem.Detail
+}
+
+//Token returns the token of the request, from its Authorization header or
+//its auth query parameter, as browsers send them to the gateway
+func Token(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); len(auth) != 0 {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return r.URL.Query().Get("auth")
+}
@@ -0,0 +1,129 @@
+package introspect
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//newTestGateway serves an introspection endpoint knowing the tokens "live",
+//"expiring" and "dead", counting the requests it is sent
+func newTestGateway(t *testing.T, hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		if service, secret, ok := r.BasicAuth(); !ok || service != "reports" || secret != "s3cret" {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"status":401,"code":"unauthenticated","detail":"service credentials required"}`))
+			return
+		}
+		session := &Session{}
+		switch r.PostFormValue("token") {
+		case "live":
+			session = &Session{Active: true, Session: "fp", UserID: 7, Roles: []string{"user"},
+				ExpiresAt: time.Now().Add(time.Hour), User: json.RawMessage(`{"id":7}`)}
+		case "expiring":
+			session = &Session{Active: true, UserID: 8, ExpiresAt: time.Now().Add(50 * time.Millisecond)}
+		}
+		json.NewEncoder(w).Encode(session)
+	}))
+}
+
+func TestIntrospect(t *testing.T) {
+	var hits int32
+	gateway := newTestGateway(t, &hits)
+	defer gateway.Close()
+	client := NewClient(gateway.URL+Path, "reports", "s3cret")
+	ctx := context.Background()
+
+	session, err := client.Introspect(ctx, "Bearer live")
+	if err != nil {
+		t.Fatalf("unexpected error introspecting: %v", err)
+	}
+	if !session.Active || session.UserID != 7 || session.Session != "fp" || string(session.User) != `{"id":7}` {
+		t.Errorf("unexpected session %+v", session)
+	}
+	//the answer is reused, with or without the scheme
+	if _, err := client.Introspect(ctx, "live"); err != nil || atomic.LoadInt32(&hits) != 1 {
+		t.Errorf("expected the cached answer but got %v after %d requests", err, hits)
+	}
+
+	//inactive answers are cached too
+	for i := 0; i < 2; i++ {
+		if _, err := client.Introspect(ctx, "dead"); err != ErrInactive {
+			t.Errorf("expected ErrInactive but got %v", err)
+		}
+	}
+	if atomic.LoadInt32(&hits) != 2 {
+		t.Errorf("expected the inactive answer to be cached but got %d requests", hits)
+	}
+	if _, err := client.Introspect(ctx, " "); err != ErrInactive || atomic.LoadInt32(&hits) != 2 {
+		t.Errorf("expected an empty token to be inactive without asking but got %v", err)
+	}
+
+	//answers are not reused past the session's expiry
+	client.Introspect(ctx, "expiring")
+	time.Sleep(100 * time.Millisecond)
+	client.Introspect(ctx, "expiring")
+	if atomic.LoadInt32(&hits) != 4 {
+		t.Errorf("expected the expired answer to be asked again but got %d requests", hits)
+	}
+
+	//nor past the client's TTL
+	client.CacheTTL = 50 * time.Millisecond
+	client.Introspect(ctx, "other")
+	time.Sleep(100 * time.Millisecond)
+	client.Introspect(ctx, "other")
+	if atomic.LoadInt32(&hits) != 6 {
+		t.Errorf("expected the answer to expire after the TTL but got %d requests", hits)
+	}
+}
+
+func TestIntrospectFailure(t *testing.T) {
+	var hits int32
+	gateway := newTestGateway(t, &hits)
+	defer gateway.Close()
+	client := NewClient(gateway.URL+Path, "reports", "guess")
+
+	for i := 0; i < 2; i++ {
+		_, err := client.Introspect(context.Background(), "live")
+		if err == nil || err == ErrInactive || !strings.Contains(err.Error(), "service credentials required") {
+			t.Errorf("expected the gateway's problem but got %v", err)
+		}
+	}
+	//failures are not cached
+	if atomic.LoadInt32(&hits) != 2 {
+		t.Errorf("expected every failed request to be retried but got %d requests", hits)
+	}
+}
+
+func TestCacheLimit(t *testing.T) {
+	var hits int32
+	gateway := newTestGateway(t, &hits)
+	defer gateway.Close()
+	client := NewClient(gateway.URL+Path, "reports", "s3cret")
+	client.MaxEntries = 2
+
+	for _, token := range []string{"live", "dead", "other"} {
+		client.Introspect(context.Background(), token)
+	}
+	if len(client.cache) > client.MaxEntries {
+		t.Errorf("expected at most %d cached answers but got %d", client.MaxEntries, len(client.cache))
+	}
+}
+
+func TestToken(t *testing.T) {
+	r := httptest.NewRequest("GET", "/reports?auth=query", nil)
+	if token := Token(r); token != "query" {
+		t.Errorf("expected the token of the query but got %q", token)
+	}
+	r.Header.Set("Authorization", "Bearer header")
+	if token := Token(r); token != "header" {
+		t.Errorf("expected the token of the header but got %q", token)
+	}
+}
@@ -0,0 +1,323 @@
+//Package live fans events out to the clients subscribed to their topics,
+//such as the viewers of a dashboard, across every gateway instance
+//through redis pub/sub.
+package live
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/go-redis/redis"
+	"github.com/my/repo/servers/gateway/metrics"
+)
+
+//eventsChannel is the redis pub/sub channel events are fanned out over
+const eventsChannel = "live:events"
+
+//maxEventBody is the largest event published through the internal endpoint
+const maxEventBody = 64 << 10
+
+//Defaults of the limits of a Hub
+const (
+	DefaultMaxTopics             = 50
+	DefaultBufferSize            = 64
+	DefaultMaxConnectionsPerUser = 10
+)
+
+//topicPattern matches topic names: a kind such as "data", optionally
+//followed by the ID of what it is about, as in "dashboard:5fb1c2"
+var topicPattern = regexp.MustCompile(`^[a-z]+(:[A-Za-z0-9_-]{1,64})?$`)
+
+//Errors subscribers are refused or dropped with
+var (
+	ErrInvalidTopic       = errors.New("topics are a lowercase kind, optionally followed by a colon and an ID")
+	ErrTooManyTopics      = errors.New("too many topics subscribed to")
+	ErrTooManyConnections = errors.New("too many connections")
+	ErrTooSlow            = errors.New("events were not received fast enough")
+	ErrClosed             = errors.New("the hub is closed")
+)
+
+var (
+	eventsPublished = metrics.Default.NewCounterVec("gateway_live_events_published_total",
+		"Events published to live subscribers.")
+	subscribersDropped = metrics.Default.NewCounterVec("gateway_live_subscribers_dropped_total",
+		"Live subscribers disconnected for not receiving events fast enough.")
+)
+
+//Event is something that happened to a topic
+type Event struct {
+	Topic string          `json:"topic"`
+	Data  json.RawMessage `json:"data,omitempty"`
+}
+
+//Hub keeps the subscribers of each topic. Events published to a hub with
+//a redis client reach the subscribers of every hub sharing the redis server.
+type Hub struct {
+	//MaxTopics is how many topics each subscriber may subscribe to
+	MaxTopics int
+	//BufferSize is how many events may wait to be received by each subscriber;
+	//subscribers falling further behind are dropped
+	BufferSize int
+	//MaxConnectionsPerUser is how many subscribers each user may have
+	MaxConnectionsPerUser int
+
+	client *redis.Client
+	pubsub *redis.PubSub
+
+	mu          sync.Mutex
+	subscribers map[*Subscriber]bool
+	topics      map[string]map[*Subscriber]bool
+	users       map[int64]int
+	closed      bool
+	wg          sync.WaitGroup
+}
+
+//NewHub constructs a new Hub delivering events to its own subscribers only
+func NewHub() *Hub {
+	return &Hub{
+		MaxTopics:             DefaultMaxTopics,
+		BufferSize:            DefaultBufferSize,
+		MaxConnectionsPerUser: DefaultMaxConnectionsPerUser,
+		subscribers:           map[*Subscriber]bool{},
+		topics:                map[string]map[*Subscriber]bool{},
+		users:                 map[int64]int{},
+	}
+}
+
+//NewRedisHub constructs a new Hub fanning events out to every hub sharing
+//the redis server, and starts listening for them. Close must be called to stop it.
+func NewRedisHub(client *redis.Client) (*Hub, error) {
+	h := NewHub()
+	h.client = client
+	h.pubsub = client.Subscribe(eventsChannel)
+	//wait for the subscription to be confirmed so no event is missed
+	if _, err := h.pubsub.Receive(); err != nil {
+		h.pubsub.Close()
+		return nil, err
+	}
+	h.wg.Add(1)
+	go h.listen()
+	return h, nil
+}
+
+//listen delivers the events published through redis
+func (h *Hub) listen() {
+	defer h.wg.Done()
+	for msg := range h.pubsub.Channel() {
+		event := &Event{}
+		if err := json.Unmarshal([]byte(msg.Payload), event); err != nil {
+			log.Printf("error decoding live event: %v", err)
+			continue
+		}
+		h.deliver(event)
+	}
+}
+
+//Publish sends the event to the subscribers of its topic
+func (h *Hub) Publish(event *Event) error {
+	if !topicPattern.MatchString(event.Topic) {
+		return ErrInvalidTopic
+	}
+	eventsPublished.With().Inc()
+	if h.client == nil {
+		h.deliver(event)
+		return nil
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return h.client.Publish(eventsChannel, data).Err()
+}
+
+//deliver queues the event for each subscriber of its topic,
+//dropping those whose queues are full
+func (h *Hub) deliver(event *Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.topics[event.Topic] {
+		select {
+		case s.events <- event:
+		default:
+			subscribersDropped.With().Inc()
+			h.drop(s, ErrTooSlow)
+		}
+	}
+}
+
+//NewSubscriber adds a subscriber for the user, unless the user already has too many
+func (h *Hub) NewSubscriber(userID int64) (*Subscriber, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil, ErrClosed
+	}
+	if h.users[userID] >= h.MaxConnectionsPerUser {
+		return nil, ErrTooManyConnections
+	}
+	h.users[userID]++
+	s := &Subscriber{
+		hub:    h,
+		userID: userID,
+		topics: map[string]bool{},
+		events: make(chan *Event, h.BufferSize),
+		done:   make(chan struct{}),
+	}
+	h.subscribers[s] = true
+	return s, nil
+}
+
+//drop removes the subscriber from every topic and tells it why; the caller holds h.mu
+func (h *Hub) drop(s *Subscriber, err error) {
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	close(s.done)
+	delete(h.subscribers, s)
+	for topic := range s.topics {
+		delete(h.topics[topic], s)
+		if len(h.topics[topic]) == 0 {
+			delete(h.topics, topic)
+		}
+	}
+	h.users[s.userID]--
+	if h.users[s.userID] <= 0 {
+		delete(h.users, s.userID)
+	}
+}
+
+//Subscribers returns the number of subscribers to the topic
+func (h *Hub) Subscribers(topic string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.topics[topic])
+}
+
+//Close drops every subscriber and stops listening for events
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	h.closed = true
+	for s := range h.subscribers {
+		h.drop(s, ErrClosed)
+	}
+	h.mu.Unlock()
+	if h.pubsub != nil {
+		h.pubsub.Close()
+		h.wg.Wait()
+	}
+	return nil
+}
+
+//ServeHTTP publishes the event posted as JSON, for backends to tell
+//the subscribers of a topic what happened to it
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "events must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxEventBody+1))
+	if err != nil {
+		http.Error(w, "error reading event", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxEventBody {
+		http.Error(w, "event too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	event := &Event{}
+	if err := json.Unmarshal(body, event); err != nil {
+		http.Error(w, "invalid event: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.Publish(event); err == ErrInvalidTopic {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, "error publishing event: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+//Subscriber receives the events of the topics it subscribed to
+type Subscriber struct {
+	hub    *Hub
+	userID int64
+	//topics, events and err are guarded by hub.mu
+	topics map[string]bool
+	events chan *Event
+	done   chan struct{}
+	err    error
+}
+
+//Subscribe starts delivering the events of the topic
+func (s *Subscriber) Subscribe(topic string) error {
+	if !topicPattern.MatchString(topic) {
+		return ErrInvalidTopic
+	}
+	h := s.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	if s.topics[topic] {
+		return nil
+	}
+	if len(s.topics) >= h.MaxTopics {
+		return ErrTooManyTopics
+	}
+	s.topics[topic] = true
+	if h.topics[topic] == nil {
+		h.topics[topic] = map[*Subscriber]bool{}
+	}
+	h.topics[topic][s] = true
+	return nil
+}
+
+//Unsubscribe stops delivering the events of the topic
+func (s *Subscriber) Unsubscribe(topic string) {
+	h := s.hub
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !s.topics[topic] {
+		return
+	}
+	delete(s.topics, topic)
+	delete(h.topics[topic], s)
+	if len(h.topics[topic]) == 0 {
+		delete(h.topics, topic)
+	}
+}
+
+//Events returns the events of the subscribed topics
+func (s *Subscriber) Events() <-chan *Event {
+	return s.events
+}
+
+//Done is closed once the subscriber is dropped, as Err explains
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+//Err returns why the subscriber was dropped, if it was
+func (s *Subscriber) Err() error {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	return s.err
+}
+
+//Close drops the subscriber
+func (s *Subscriber) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.drop(s, ErrClosed)
+}
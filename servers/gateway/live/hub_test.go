@@ -0,0 +1,209 @@
+package live
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/my/repo/servers/gateway/redistest"
+)
+
+//receive returns the next event of the subscriber, failing if none comes
+func receive(t *testing.T, s *Subscriber) *Event {
+	select {
+	case event := <-s.Events():
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("expected an event")
+		return nil
+	}
+}
+
+//expectNone fails if the subscriber has an event waiting
+func expectNone(t *testing.T, s *Subscriber) {
+	select {
+	case event := <-s.Events():
+		t.Errorf("expected no event but got %s %s", event.Topic, event.Data)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	h := NewHub()
+	viewer, err := h.NewSubscriber(1)
+	if err != nil {
+		t.Fatalf("error adding subscriber: %v", err)
+	}
+	other, _ := h.NewSubscriber(2)
+	if err := viewer.Subscribe("dashboard:5fb1c2"); err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+	other.Subscribe("data")
+	if n := h.Subscribers("dashboard:5fb1c2"); n != 1 {
+		t.Errorf("expected 1 subscriber but got %d", n)
+	}
+
+	h.Publish(&Event{Topic: "dashboard:5fb1c2", Data: []byte(`{"title": "ICU beds"}`)})
+	if event := receive(t, viewer); event.Topic != "dashboard:5fb1c2" || string(event.Data) != `{"title": "ICU beds"}` {
+		t.Errorf("unexpected event %s %s", event.Topic, event.Data)
+	}
+	expectNone(t, other)
+
+	viewer.Unsubscribe("dashboard:5fb1c2")
+	h.Publish(&Event{Topic: "dashboard:5fb1c2"})
+	expectNone(t, viewer)
+	if n := h.Subscribers("dashboard:5fb1c2"); n != 0 {
+		t.Errorf("expected no subscribers left but got %d", n)
+	}
+}
+
+func TestTopics(t *testing.T) {
+	h := NewHub()
+	h.MaxTopics = 2
+	s, _ := h.NewSubscriber(1)
+	for _, topic := range []string{"", "Dashboard", "dashboard:", "dashboard:a/b", "data:" + strings.Repeat("a", 65), "a:b:c"} {
+		if err := s.Subscribe(topic); err != ErrInvalidTopic {
+			t.Errorf("expected topic %q to be invalid but got %v", topic, err)
+		}
+		if err := h.Publish(&Event{Topic: topic}); err != ErrInvalidTopic {
+			t.Errorf("expected publishing to %q to fail but got %v", topic, err)
+		}
+	}
+	s.Subscribe("data")
+	s.Subscribe("dashboard:1")
+	//subscribing again is not another topic
+	if err := s.Subscribe("data"); err != nil {
+		t.Errorf("expected subscribing twice to succeed but got %v", err)
+	}
+	if err := s.Subscribe("dashboard:2"); err != ErrTooManyTopics {
+		t.Errorf("expected too many topics but got %v", err)
+	}
+}
+
+func TestConnectionsPerUser(t *testing.T) {
+	h := NewHub()
+	h.MaxConnectionsPerUser = 2
+	first, _ := h.NewSubscriber(1)
+	h.NewSubscriber(1)
+	if _, err := h.NewSubscriber(1); err != ErrTooManyConnections {
+		t.Errorf("expected too many connections but got %v", err)
+	}
+	if _, err := h.NewSubscriber(2); err != nil {
+		t.Errorf("expected another user to connect but got %v", err)
+	}
+	first.Close()
+	if _, err := h.NewSubscriber(1); err != nil {
+		t.Errorf("expected to connect once another connection closed but got %v", err)
+	}
+}
+
+func TestSlowSubscriber(t *testing.T) {
+	h := NewHub()
+	h.BufferSize = 2
+	slow, _ := h.NewSubscriber(1)
+	fast, _ := h.NewSubscriber(2)
+	slow.Subscribe("data")
+	fast.Subscribe("data")
+	for i := 0; i < 3; i++ {
+		h.Publish(&Event{Topic: "data"})
+		receive(t, fast)
+	}
+	select {
+	case <-slow.Done():
+	default:
+		t.Fatalf("expected the slow subscriber to be dropped")
+	}
+	if slow.Err() != ErrTooSlow {
+		t.Errorf("expected ErrTooSlow but got %v", slow.Err())
+	}
+	if fast.Err() != nil || h.Subscribers("data") != 1 {
+		t.Errorf("expected only the slow subscriber to be dropped")
+	}
+	if err := slow.Subscribe("data"); err != ErrTooSlow {
+		t.Errorf("expected a dropped subscriber not to subscribe but got %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	h := NewHub()
+	subscribed, _ := h.NewSubscriber(1)
+	subscribed.Subscribe("data")
+	idle, _ := h.NewSubscriber(2)
+	h.Close()
+	for _, s := range []*Subscriber{subscribed, idle} {
+		select {
+		case <-s.Done():
+		default:
+			t.Errorf("expected every subscriber to be dropped")
+		}
+	}
+	if _, err := h.NewSubscriber(3); err != ErrClosed {
+		t.Errorf("expected a closed hub to refuse subscribers but got %v", err)
+	}
+}
+
+func TestRedisHub(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	hubs := []*Hub{}
+	for i := 0; i < 2; i++ {
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		defer client.Close()
+		h, err := NewRedisHub(client)
+		if err != nil {
+			t.Fatalf("error starting hub: %v", err)
+		}
+		defer h.Close()
+		hubs = append(hubs, h)
+	}
+	subscribers := []*Subscriber{}
+	for _, h := range hubs {
+		s, _ := h.NewSubscriber(1)
+		s.Subscribe("dashboard:1")
+		subscribers = append(subscribers, s)
+	}
+	//events published to either instance reach the subscribers of both
+	if err := hubs[0].Publish(&Event{Topic: "dashboard:1", Data: []byte(`"edited"`)}); err != nil {
+		t.Fatalf("error publishing: %v", err)
+	}
+	for _, s := range subscribers {
+		if event := receive(t, s); string(event.Data) != `"edited"` {
+			t.Errorf("unexpected event %s", event.Data)
+		}
+	}
+}
+
+func TestPublishEndpoint(t *testing.T) {
+	h := NewHub()
+	s, _ := h.NewSubscriber(1)
+	s.Subscribe("dashboard:1")
+	cases := []struct {
+		name           string
+		method         string
+		body           string
+		expectedStatus int
+	}{
+		{"event", "POST", `{"topic": "dashboard:1", "data": {"title": "ICU beds"}}`, http.StatusAccepted},
+		{"not posted", "GET", "", http.StatusMethodNotAllowed},
+		{"invalid JSON", "POST", `{"topic"`, http.StatusBadRequest},
+		{"invalid topic", "POST", `{"topic": "dashboard:a/b"}`, http.StatusBadRequest},
+		{"too large", "POST", `{"topic": "data", "data": "` + strings.Repeat("a", maxEventBody) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(c.method, "/live/publish", strings.NewReader(c.body)))
+		if rr.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d", c.name, c.expectedStatus, rr.Code)
+		}
+	}
+	if event := receive(t, s); string(event.Data) != `{"title": "ICU beds"}` {
+		t.Errorf("unexpected event %s", event.Data)
+	}
+	expectNone(t, s)
+}
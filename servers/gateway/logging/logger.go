@@ -0,0 +1,127 @@
+//Package logging writes structured logs as JSON lines, and carries a logger
+//and the fields of each request's access log line in the request context.
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+//Fields are the key/value pairs of a log line
+type Fields map[string]interface{}
+
+//Logger writes log lines as JSON objects, one per line, with
+//the time, level and message, its own fields and any given
+//to each line. Loggers are safe for concurrent use.
+type Logger struct {
+	out    io.Writer
+	mu     *sync.Mutex
+	fields Fields
+}
+
+//Default is the logger of requests that have none of their own
+var Default = New(os.Stdout)
+
+//New constructs a new Logger writing to `out`
+func New(out io.Writer) *Logger {
+	return &Logger{out: out, mu: &sync.Mutex{}, fields: Fields{}}
+}
+
+//With returns a logger adding the fields to every line, as well as this logger's
+func (l *Logger) With(fields Fields) *Logger {
+	merged := make(Fields, len(l.fields)+len(fields))
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{out: l.out, mu: l.mu, fields: merged}
+}
+
+//Log writes a line at the level with the message and fields
+func (l *Logger) Log(level string, msg string, fields Fields) {
+	line := make(Fields, len(l.fields)+len(fields)+3)
+	for k, v := range l.fields {
+		line[k] = v
+	}
+	for k, v := range fields {
+		line[k] = v
+	}
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["level"] = level
+	line["msg"] = msg
+	data, err := json.Marshal(line)
+	if err != nil {
+		data, _ = json.Marshal(Fields{"time": line["time"], "level": "error", "msg": "error encoding log line: " + err.Error()})
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(data, '\n'))
+}
+
+//Printf writes an info line with the formatted message
+func (l *Logger) Printf(format string, args ...interface{}) {
+	l.Log("info", fmt.Sprintf(format, args...), nil)
+}
+
+//Errorf writes an error line with the formatted message
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.Log("error", fmt.Sprintf(format, args...), nil)
+}
+
+//loggerKey is the request context key of the request's Logger
+type loggerKey struct{}
+
+//NewContext returns a copy of the context carrying the logger
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+//FromContext returns the logger carried by the context, or Default if there is none
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return l
+	}
+	return Default
+}
+
+//annotations are the fields the handlers serving a request
+//add to the request's access log line
+type annotations struct {
+	mu     sync.Mutex
+	fields Fields
+}
+
+//annotationsKey is the request context key of the request's annotations
+type annotationsKey struct{}
+
+//WithAnnotations returns a copy of the context that collects the
+//fields given to Annotate, and a function returning them
+func WithAnnotations(ctx context.Context) (context.Context, func() Fields) {
+	a := &annotations{fields: Fields{}}
+	return context.WithValue(ctx, annotationsKey{}, a), func() Fields {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		fields := make(Fields, len(a.fields))
+		for k, v := range a.fields {
+			fields[k] = v
+		}
+		return fields
+	}
+}
+
+//Annotate adds the field to the access log line of the request the context
+//belongs to. It does nothing if the context is not collecting annotations.
+func Annotate(ctx context.Context, key string, value interface{}) {
+	if a, ok := ctx.Value(annotationsKey{}).(*annotations); ok {
+		a.mu.Lock()
+		a.fields[key] = value
+		a.mu.Unlock()
+	}
+}
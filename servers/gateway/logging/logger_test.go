@@ -0,0 +1,60 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := New(buf).With(Fields{"requestId": "abc"})
+	logger.Printf("hello %s", "world")
+	logger.With(Fields{"requestId": "def", "user": 1}).Log("warn", "overridden", Fields{"extra": true})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines but got %d: %q", len(lines), buf.String())
+	}
+	expected := []Fields{
+		{"requestId": "abc", "level": "info", "msg": "hello world"},
+		{"requestId": "def", "level": "warn", "msg": "overridden", "user": 1.0, "extra": true},
+	}
+	for i, line := range lines {
+		fields := Fields{}
+		if err := json.Unmarshal([]byte(line), &fields); err != nil {
+			t.Fatalf("line %d is not JSON: %v", i, err)
+		}
+		if _, ok := fields["time"]; !ok {
+			t.Errorf("line %d has no time", i)
+		}
+		for k, v := range expected[i] {
+			if fields[k] != v {
+				t.Errorf("line %d: expected %s %v but got %v", i, k, v, fields[k])
+			}
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	if FromContext(context.Background()) != Default {
+		t.Error("expected the default logger for a context without one")
+	}
+	logger := New(&bytes.Buffer{})
+	if FromContext(NewContext(context.Background(), logger)) != logger {
+		t.Error("expected the logger carried by the context")
+	}
+
+	//annotating a context that is not collecting them is harmless
+	Annotate(context.Background(), "ignored", 1)
+
+	ctx, annotations := WithAnnotations(context.Background())
+	Annotate(ctx, "route", "/v1/users")
+	Annotate(context.WithValue(ctx, loggerKey{}, logger), "userId", 2)
+	fields := annotations()
+	if len(fields) != 2 || fields["route"] != "/v1/users" || fields["userId"] != 2 {
+		t.Errorf("unexpected annotations %v", fields)
+	}
+}
@@ -1,49 +1,126 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
-	"net/http/httputil"
 	"os"
-	"strings"
-	"sync/atomic"
 	"time"
 
 	"github.com/go-redis/redis"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/my/repo/servers/gateway/handlers"
+	"github.com/my/repo/servers/gateway/health"
+	"github.com/my/repo/servers/gateway/idempotency"
+	"github.com/my/repo/servers/gateway/identity"
+	"github.com/my/repo/servers/gateway/live"
+	"github.com/my/repo/servers/gateway/logging"
+	"github.com/my/repo/servers/gateway/metrics"
 	"github.com/my/repo/servers/gateway/models/users"
+	"github.com/my/repo/servers/gateway/problem"
+	"github.com/my/repo/servers/gateway/ratelimit"
+	"github.com/my/repo/servers/gateway/security"
 	"github.com/my/repo/servers/gateway/sessions"
+	"github.com/my/repo/servers/gateway/upstream"
 )
 
-// Director is a custom director to modify reverse proxy requests
-type Director func(r *http.Request)
-
-// CustomDashDirector is a wrapper class for reverse proxies so we can pass request on to dash microservices
-func CustomDashDirector(targets []string, ctx *handlers.HandlerContext) Director {
-	var counter int32
-	counter = 0
-	return func(r *http.Request) {
-		// round robin selecting
-		target := targets[counter%int32(len(targets))]
-		atomic.AddInt32(&counter, 1)
-		// find currently authenticated user
-		sessionState := &handlers.SessionState{}
-		_, err := sessions.GetState(r, ctx.SigningKey, ctx.SessionStore, sessionState)
+// userRoles are the roles asserted for every signed-in user, since
+// the user store does not yet give users any roles of their own
+var userRoles = []string{"user"}
+
+// dashHandler proxies requests to the dash microservices, asserting the identity
+// of the currently authenticated user in a signed header
+type dashHandler struct {
+	proxy  http.Handler
+	ctx    *handlers.HandlerContext
+	signer *identity.Signer
+}
+
+// DashHandler wraps the proxy to the dash microservices, passing the currently authenticated
+// user along in an identity assertion signed by `signer`, in the identity.Header header.
+// If the session store is down the request is rejected with 503, rather than forwarded
+// as if the user had signed out.
+func DashHandler(proxy http.Handler, ctx *handlers.HandlerContext, signer *identity.Signer) http.Handler {
+	return &dashHandler{proxy: proxy, ctx: ctx, signer: signer}
+}
+
+func (dh *dashHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// never pass on identities the client made up
+	r.Header.Del("X-User")
+	r.Header.Del(identity.Header)
+	// find currently authenticated user, unless the route already required one
+	sessionState, found := handlers.SessionStateFrom(r.Context())
+	var err error
+	if !found {
+		sessionState = &handlers.SessionState{}
+		_, err = sessions.GetState(r, dh.ctx.SigningKey, dh.ctx.SessionStore, sessionState)
+	}
+	if err != nil && sessions.IsUnavailable(err) {
+		problem.Error(w, r, http.StatusServiceUnavailable, problem.CodeSessionsUnavailable,
+			"sessions are temporarily unavailable, please try again later")
+		return
+	}
+	if err == nil {
+		logging.Annotate(r.Context(), "userId", sessionState.User.ID)
+		assertion, err := dh.assert(r, sessionState)
 		if err != nil {
-			r.Header.Del("X-User")
-		} else {
-			userByteSlice, err := json.Marshal(sessionState.User)
-			if err == nil {
-				r.Header.Set("X-User", string(userByteSlice[:]))
-			}
+			problem.Internal(w, r, fmt.Errorf("error signing identity assertion: %v", err))
+			return
 		}
-		r.Host = target
-		r.URL.Host = target
-		r.URL.Scheme = "http"
+		r.Header.Set(identity.Header, assertion)
 	}
+	dh.proxy.ServeHTTP(w, r)
+}
+
+// assert signs an identity assertion for the user of the session
+func (dh *dashHandler) assert(r *http.Request, sessionState *handlers.SessionState) (string, error) {
+	user, err := json.Marshal(sessionState.User)
+	if err != nil {
+		return "", err
+	}
+	sid, err := sessions.GetSessionID(r, dh.ctx.SigningKey)
+	if err != nil {
+		return "", err
+	}
+	// upstreams are told which session the request was made in, but not its ID,
+	// which would let them act as the user
+	return dh.signer.Sign(&identity.Claims{
+		UserID:  sessionState.User.ID,
+		Roles:   userRoles,
+		Session: sid.Fingerprint(),
+		User:    user,
+	})
+}
+
+// Close closes the proxy, if it needs closing, once the route to it is removed
+func (dh *dashHandler) Close() error {
+	if closer, ok := dh.proxy.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// newReadinessChecks builds the checks of the gateway's readiness: the users database
+// and the redis server holding the sessions, without which it cannot serve, and each
+// upstream in service, without which it serves only the routes of the others
+func newReadinessChecks(timeout time.Duration, db *sql.DB, redisClient *redis.Client, upstreams *upstream.Registry) *health.Checker {
+	checks := health.NewChecker(timeout)
+	checks.Add("users", true, db.PingContext)
+	checks.Add("sessions", true, func(ctx context.Context) error {
+		return redisClient.WithContext(ctx).Ping().Err()
+	})
+	checks.AddSource(false, func() map[string]health.Check {
+		pools := map[string]health.Check{}
+		for _, pool := range upstreams.Pools() {
+			pools["upstream:"+pool.Name] = pool.Check
+		}
+		return pools
+	})
+	return checks
 }
 
 //main is the main entry point for the server
@@ -54,7 +131,6 @@ func main() {
 	sessKey := os.Getenv("SESSIONKEY")
 	redisaddr := os.Getenv("REDDISADDR")
 	dsn := os.Getenv("DSN")
-	dashboardAddresses := strings.Split(os.Getenv("DASHBOARDADDR"), ",")
 
 	if len(addr) == 0 {
 		addr = ":8443"
@@ -65,13 +141,47 @@ func main() {
 	}
 	tlsKeyPath := os.Getenv("TLSKEY")
 	tlsCertPath := os.Getenv("TLSCERT")
-	if len(tlsCertPath) == 0 || len(tlsCertPath) == 0 {
+	if len(tlsKeyPath) == 0 || len(tlsCertPath) == 0 {
 		log.Fatalln("TLSKEY and/or TLSCERT environment variables not set")
 	}
+	tlsConfig, err := newServerTLS(tlsCertPath, tlsKeyPath)
+	if err != nil {
+		log.Fatalf("error configuring TLS: %v", err)
+	}
+	shutdownAfter, err := shutdownTimeout()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	drainFor, err := drainDelay()
+	if err != nil {
+		log.Fatalln(err)
+	}
+	checkTimeout, err := readyTimeout()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// keys the identity assertions sent to upstreams are signed with
+	identityKeysPath := os.Getenv("IDENTITYKEYS")
+	if len(identityKeysPath) == 0 {
+		log.Fatalln("IDENTITYKEYS environment variable not set")
+	}
+	identityKeys, err := identity.LoadKeys(identityKeysPath)
+	if err != nil {
+		log.Fatalf("error loading identity keys: %v", err)
+	}
+	signer, err := identity.NewSigner(identityKeys, time.Minute)
+	if err != nil {
+		log.Fatalf("error loading identity keys: %v", err)
+	}
 
-	sessStore := sessions.NewRedisStore(redis.NewClient(&redis.Options{
+	redisClient := redis.NewClient(&redis.Options{
 		Addr: redisaddr,
-	}), time.Hour)
+	})
+	sessStore, err := newSessionStore(redisClient)
+	if err != nil {
+		log.Fatalf("error creating session store: %v", err)
+	}
 
 	// new user store
 	db, err := sql.Open("mysql", dsn)
@@ -79,6 +189,7 @@ func main() {
 		log.Fatal("error opening database")
 	}
 	userStore := &users.MySQLStore{Db: db}
+	registerDBMetrics(db)
 	defer db.Close()
 
 	if err := userStore.Db.Ping(); err != nil {
@@ -88,29 +199,125 @@ func main() {
 	}
 
 	// creating new context
-	ctx := handlers.HandlerContext{SigningKey: sessKey, SessionStore: sessStore, UserStore: userStore}
+	ctx := handlers.HandlerContext{SigningKey: sessKey, SessionStore: sessStore, UserStore: userStore,
+		Notifier: handlers.LogNotifier{}}
+	// tell users about sign-ins from new devices through the webhook, if one is set
+	if webhook := os.Getenv("NEWDEVICEWEBHOOK"); len(webhook) != 0 {
+		ctx.Notifier = handlers.NewWebhookNotifier(webhook)
+	}
 	/*
-		- Create a new mux for the web server. */
-	mux := http.NewServeMux()
+		- Create a new router for the web server. */
+	upstreams := &upstream.Registry{}
+	cspReports := security.NewReports()
+	responses, err := newResponseCache(redisClient)
+	if err != nil {
+		log.Fatalf("error configuring response cache: %v", err)
+	}
+	// live updates reach the subscribers on every gateway instance through redis, unless LIVEBACKEND is "memory"
+	hub := live.NewHub()
+	if os.Getenv("LIVEBACKEND") != "memory" {
+		if hub, err = live.NewRedisHub(redisClient); err != nil {
+			log.Fatalf("error subscribing to live events: %v", err)
+		}
+	}
+	defer hub.Close()
+	spec, err := newAPISpec()
+	if err != nil {
+		log.Fatalf("error reading the API description: %v", err)
+	}
+	mux, err := newRouter(&ctx, upstreams, signer, cspReports, responses, hub, spec)
+	if err != nil {
+		log.Fatalf("error loading routes: %v", err)
+	}
+
+	// rate limits are shared by every gateway instance through redis, unless RATELIMITBACKEND is "memory"
+	var rateLimits ratelimit.Backend = ratelimit.NewRedisBackend(redisClient, "ratelimit:")
+	if os.Getenv("RATELIMITBACKEND") == "memory" {
+		rateLimits = ratelimit.NewMemoryBackend()
+	}
+
+	// responses to retried requests are shared by every gateway instance through redis, unless
+	// IDEMPOTENCYBACKEND is "memory", and kept for IDEMPOTENCYTTL, a day unless set
+	var idempotencyStore idempotency.Store = idempotency.NewRedisStore(redisClient, "idempotency:")
+	if os.Getenv("IDEMPOTENCYBACKEND") == "memory" {
+		idempotencyStore = idempotency.NewMemoryStore()
+	}
+	idempotencyTTL, err := durationEnv("IDEMPOTENCYTTL", idempotency.DefaultTTL)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if idempotencyTTL == 0 {
+		log.Fatalln("IDEMPOTENCYTTL must be longer than 0s")
+	}
 
-	dashProxy := &httputil.ReverseProxy{Director: CustomDashDirector(dashboardAddresses, &ctx)}
+	tracer, traceExporter, err := newTracer()
+	if err != nil {
+		log.Fatalf("error configuring tracing: %v", err)
+	}
+	if traceExporter != nil {
+		defer traceExporter.Close()
+	}
 
-	mux.HandleFunc("/v1/users", ctx.UsersHandler)
-	mux.HandleFunc("/v1/users/", ctx.SpecificUserHandler)
-	mux.HandleFunc("/v1/sessions", ctx.SessionsHandler)
-	mux.HandleFunc("/v1/sessions/", ctx.SpecificSessionHandler)
-	mux.Handle("/v1/dashboards", dashProxy)
-	mux.Handle("/v1/dashboards/", dashProxy)
-	mux.Handle("/v1/data", dashProxy)
+	// wrap the router in middleware, innermost first
+	var wrappedMux http.Handler = handlers.NewValidation(mux, spec)
+	wrappedMux = handlers.NewIdempotency(wrappedMux, &ctx, idempotencyStore, idempotencyTTL)
+	wrappedMux = handlers.NewSessionRefresher(wrappedMux, &ctx)
+	wrappedMux = handlers.NewRateLimiter(wrappedMux, &ctx, mux, rateLimits)
+	wrappedMux = handlers.NewCORS(wrappedMux, mux)
+	wrappedMux = handlers.NewSecurityHeaders(wrappedMux, mux)
+	wrappedMux = handlers.NewMetrics(wrappedMux, mux)
+	wrappedMux = handlers.NewTracing(wrappedMux, tracer, mux)
+	wrappedMux = handlers.NewCompression(wrappedMux)
+	wrappedMux = handlers.NewAccessLogger(wrappedMux, &ctx, logging.Default)
+	// client addresses are only taken from X-Forwarded-For when it was added by the
+	// comma-separated TRUSTEDPROXIES, as the gateway is reached directly unless set
+	if proxies := os.Getenv("TRUSTEDPROXIES"); len(proxies) != 0 {
+		trusted, err := parseTrustedProxies(proxies)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		wrappedMux = handlers.NewForwardedFor(wrappedMux, trusted)
+	}
 
-	wrappedMux := handlers.NewCORS(mux)
+	// serve the state of the upstream pools and the metrics on the internal address only
+	internalAddr := os.Getenv("INTERNALADDR")
+	if len(internalAddr) == 0 {
+		internalAddr = "127.0.0.1:8081"
+	}
+	checks := newReadinessChecks(checkTimeout, db, redisClient, upstreams)
+	internalMux := http.NewServeMux()
+	internalMux.Handle("/upstreams", upstreams)
+	upstreams.RegisterMetrics(metrics.Default)
+	internalMux.Handle("/metrics", metrics.Default)
+	internalMux.HandleFunc("/healthz", checks.Live)
+	internalMux.HandleFunc("/readyz", checks.Ready)
+	internalMux.Handle("/csp-reports", cspReports)
+	internalMux.Handle("/cache/purge", responses)
+	internalMux.Handle("/live/publish", hub)
 
-	/*
-		- Start a web server listening on the address you read from
-		  the environment variable, using the mux you created as
-		  the root handler. Use log.Fatal() to report any errors
-		  that occur when trying to start the web server.
-	*/
-	log.Printf("Listening at https://%s", addr)
-	log.Fatal(http.ListenAndServeTLS(addr, tlsCertPath, tlsKeyPath, wrappedMux))
+	listeners := []*listener{
+		{server: &http.Server{Addr: addr, Handler: wrappedMux, TLSConfig: tlsConfig}, tls: true},
+		{server: &http.Server{Addr: internalAddr, Handler: internalMux}},
+	}
+	// plain-HTTP requests are redirected to HTTPS, if HTTPADDR is set
+	if httpAddr := os.Getenv("HTTPADDR"); len(httpAddr) != 0 {
+		listeners = append(listeners, &listener{server: newRedirectServer(httpAddr, addr, checks)})
+	}
+	// services behind the gateway may look up sessions and publish live events on their own
+	// listener, if INTROSPECTADDR is set, with the credentials in INTROSPECTCREDENTIALS,
+	// a comma-separated list of name:secret
+	if introspectAddr := os.Getenv("INTROSPECTADDR"); len(introspectAddr) != 0 {
+		credentials, err := parseServiceCredentials(os.Getenv("INTROSPECTCREDENTIALS"))
+		if err != nil {
+			log.Fatalf("error reading INTROSPECTCREDENTIALS: %v", err)
+		}
+		introspection := handlers.NewIntrospection(&ctx, credentials, userRoles, sessionDuration)
+		publish := handlers.NewServiceAuth(hub, credentials, "live")
+		listeners = append(listeners, &listener{server: newIntrospectionServer(introspectAddr, introspection, publish, &ctx)})
+	}
+	// serve until told to stop, then let the requests in flight finish
+	// before the deferred cleanup sends the last spans and closes the database
+	if err := serve(listeners, checks, drainFor, shutdownAfter); err != nil {
+		log.Fatal(err)
+	}
 }
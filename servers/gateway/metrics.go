@@ -0,0 +1,66 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/my/repo/servers/gateway/metrics"
+	"github.com/my/repo/servers/gateway/sessions"
+)
+
+// registerDBMetrics adds gauges and counters of the database connection pool to the default registry
+func registerDBMetrics(db *sql.DB) {
+	stat := func(value func(sql.DBStats) float64) func() []metrics.Sample {
+		return func() []metrics.Sample {
+			return []metrics.Sample{{Value: value(db.Stats())}}
+		}
+	}
+	metrics.Default.NewGaugeFunc("gateway_mysql_open_connections", "Connections to MySQL, in use or idle.", nil,
+		stat(func(s sql.DBStats) float64 { return float64(s.OpenConnections) }))
+	metrics.Default.NewGaugeFunc("gateway_mysql_in_use_connections", "Connections to MySQL in use.", nil,
+		stat(func(s sql.DBStats) float64 { return float64(s.InUse) }))
+	metrics.Default.NewGaugeFunc("gateway_mysql_idle_connections", "Idle connections to MySQL.", nil,
+		stat(func(s sql.DBStats) float64 { return float64(s.Idle) }))
+	metrics.Default.NewGaugeFunc("gateway_mysql_max_open_connections", "The most connections to MySQL allowed, or 0 for no limit.", nil,
+		stat(func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }))
+	metrics.Default.NewCounterFunc("gateway_mysql_wait_count_total", "Times a query waited for a connection to MySQL.", nil,
+		stat(func(s sql.DBStats) float64 { return float64(s.WaitCount) }))
+	metrics.Default.NewCounterFunc("gateway_mysql_wait_duration_seconds_total", "Time spent waiting for connections to MySQL.", nil,
+		stat(func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }))
+	metrics.Default.NewCounterFunc("gateway_mysql_closed_connections_total", "Connections to MySQL closed for being idle or too old.", nil,
+		stat(func(s sql.DBStats) float64 {
+			return float64(s.MaxIdleClosed + s.MaxIdleTimeClosed + s.MaxLifetimeClosed)
+		}))
+}
+
+// sessionCountInterval is how often the live sessions are counted for the gauge
+const sessionCountInterval = time.Minute
+
+// registerSessionMetrics adds a gauge of the live sessions in the store to the default registry.
+// Counting them scans every key in redis, so they are counted every sessionCountInterval rather
+// than on every scrape, and the gauge reports the last count.
+func registerSessionMetrics(store sessions.Counter) {
+	count := int64(-1)
+	go func() {
+		ticker := time.NewTicker(sessionCountInterval)
+		defer ticker.Stop()
+		for {
+			if n, err := store.Count(); err != nil {
+				log.Printf("error counting sessions: %v", err)
+			} else {
+				atomic.StoreInt64(&count, int64(n))
+			}
+			<-ticker.C
+		}
+	}()
+	metrics.Default.NewGaugeFunc("gateway_sessions_active", "Live sessions in the session store, counted every minute.", nil, func() []metrics.Sample {
+		n := atomic.LoadInt64(&count)
+		if n < 0 {
+			// not counted yet
+			return nil
+		}
+		return []metrics.Sample{{Value: float64(n)}}
+	})
+}
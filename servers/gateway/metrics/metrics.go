@@ -0,0 +1,354 @@
+//Package metrics keeps counters, histograms and gauges of the gateway's
+//work, and serves them in the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//DefaultBuckets are the upper bounds, in seconds, of the histogram
+//buckets suited to the latency of requests and their parts
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+//ContentType is the content type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+//metric is a named metric that writes its samples in the text exposition format
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+//Registry holds the metrics that are served together.
+//Registries are safe for concurrent use.
+type Registry struct {
+	mu      sync.Mutex
+	metrics map[string]metric
+}
+
+//Default is the registry of the gateway's own metrics
+var Default = NewRegistry()
+
+//NewRegistry constructs a new, empty Registry
+func NewRegistry() *Registry {
+	return &Registry{metrics: map[string]metric{}}
+}
+
+//register adds the metric, panicking if one with the same name was added before,
+//as metrics are made once when the program starts
+func (reg *Registry) register(name string, m metric) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	if _, found := reg.metrics[name]; found {
+		panic("metrics: " + name + " registered twice")
+	}
+	reg.metrics[name] = m
+}
+
+//NewCounterVec adds a counter with the label names, with a series for
+//each set of label values it is counted with
+func (reg *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	cv := &CounterVec{desc: desc{name, help, "counter", labels}, series: map[string]*Counter{}}
+	reg.register(name, cv)
+	return cv
+}
+
+//NewHistogramVec adds a histogram with the bucket upper bounds and label names,
+//with a series for each set of label values it is observed with
+func (reg *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	bounds := append([]float64{}, buckets...)
+	sort.Float64s(bounds)
+	hv := &HistogramVec{desc: desc{name, help, "histogram", labels}, buckets: bounds, series: map[string]*Histogram{}}
+	reg.register(name, hv)
+	return hv
+}
+
+//NewGaugeFunc adds a gauge whose samples are collected by calling `collect`
+//each time the metrics are served, for values kept elsewhere
+func (reg *Registry) NewGaugeFunc(name, help string, labels []string, collect func() []Sample) {
+	reg.register(name, &funcMetric{desc: desc{name, help, "gauge", labels}, collect: collect})
+}
+
+//NewCounterFunc adds a counter whose samples are collected by calling `collect`
+//each time the metrics are served, for totals kept elsewhere
+func (reg *Registry) NewCounterFunc(name, help string, labels []string, collect func() []Sample) {
+	reg.register(name, &funcMetric{desc: desc{name, help, "counter", labels}, collect: collect})
+}
+
+//WriteText writes every metric in the text exposition format, sorted by name
+func (reg *Registry) WriteText(w io.Writer) error {
+	reg.mu.Lock()
+	names := make([]string, 0, len(reg.metrics))
+	for name := range reg.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = reg.metrics[name]
+	}
+	reg.mu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+//ServeHTTP responds with every metric in the text exposition format
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", ContentType)
+	reg.WriteText(w)
+}
+
+//Sample is a value of a metric collected by a function,
+//with its label values in the order of the label names
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+//desc describes a metric
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+//writeHeader writes the HELP and TYPE lines of the metric
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, helpEscaper.Replace(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+//writeSample writes a line with the value of the series
+func (d *desc) writeSample(w *bufio.Writer, name string, values []string, extra string, value float64) {
+	w.WriteString(name)
+	if len(values) != 0 || len(extra) != 0 {
+		w.WriteByte('{')
+		for i, label := range d.labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", label, labelEscaper.Replace(values[i]))
+		}
+		if len(extra) != 0 {
+			if len(values) != 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(extra)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+//helpEscaper and labelEscaper escape help text and label values
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+//formatFloat formats the value as the exposition format expects
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+//seriesKey joins label values into the key of their series
+func seriesKey(d *desc, values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels but was given %d values", d.name, len(d.labels), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+//atomicFloat is a float64 that can be added to concurrently
+type atomicFloat struct {
+	bits uint64
+}
+
+func (f *atomicFloat) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&f.bits)
+		updated := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&f.bits, old, updated) {
+			return
+		}
+	}
+}
+
+func (f *atomicFloat) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&f.bits))
+}
+
+//CounterVec is a counter with a series for each set of label values
+type CounterVec struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*Counter
+}
+
+//Counter is a series of a CounterVec, which only goes up
+type Counter struct {
+	//the atomically updated fields come first, to keep them aligned
+	value  atomicFloat
+	values []string
+}
+
+//With returns the series with the label values, in the order of the label names
+func (cv *CounterVec) With(values ...string) *Counter {
+	key := seriesKey(&cv.desc, values)
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	c, found := cv.series[key]
+	if !found {
+		c = &Counter{values: append([]string{}, values...)}
+		cv.series[key] = c
+	}
+	return c
+}
+
+//Inc adds one to the counter
+func (c *Counter) Inc() {
+	c.value.add(1)
+}
+
+//Add adds the delta, which must not be negative, to the counter
+func (c *Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counters cannot go down")
+	}
+	c.value.add(delta)
+}
+
+//Value returns the current count
+func (c *Counter) Value() float64 {
+	return c.value.load()
+}
+
+func (cv *CounterVec) write(w *bufio.Writer) {
+	cv.writeHeader(w)
+	cv.mu.Lock()
+	keys := make([]string, 0, len(cv.series))
+	for key := range cv.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]*Counter, len(keys))
+	for i, key := range keys {
+		series[i] = cv.series[key]
+	}
+	cv.mu.Unlock()
+	for _, c := range series {
+		cv.writeSample(w, cv.name, c.values, "", c.Value())
+	}
+}
+
+//HistogramVec is a histogram with a series for each set of label values
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*Histogram
+}
+
+//Histogram is a series of a HistogramVec, counting observations into buckets
+type Histogram struct {
+	count   uint64
+	sum     atomicFloat
+	values  []string
+	buckets []float64
+	counts  []uint64
+}
+
+//With returns the series with the label values, in the order of the label names
+func (hv *HistogramVec) With(values ...string) *Histogram {
+	key := seriesKey(&hv.desc, values)
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	h, found := hv.series[key]
+	if !found {
+		h = &Histogram{values: append([]string{}, values...), buckets: hv.buckets, counts: make([]uint64, len(hv.buckets))}
+		hv.series[key] = h
+	}
+	return h
+}
+
+//Observe counts the value into the histogram
+func (h *Histogram) Observe(v float64) {
+	//the buckets are counted individually and summed up when written
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	h.sum.add(v)
+}
+
+//Count returns the number of values observed
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+func (hv *HistogramVec) write(w *bufio.Writer) {
+	hv.writeHeader(w)
+	hv.mu.Lock()
+	keys := make([]string, 0, len(hv.series))
+	for key := range hv.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	series := make([]*Histogram, len(keys))
+	for i, key := range keys {
+		series[i] = hv.series[key]
+	}
+	hv.mu.Unlock()
+	for _, h := range series {
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += atomic.LoadUint64(&h.counts[i])
+			hv.writeSample(w, hv.name+"_bucket", h.values, `le="`+formatFloat(bound)+`"`, float64(cumulative))
+		}
+		//observations made while writing may be in the buckets but not yet the count
+		count := h.Count()
+		if count < cumulative {
+			count = cumulative
+		}
+		hv.writeSample(w, hv.name+"_bucket", h.values, `le="+Inf"`, float64(count))
+		hv.writeSample(w, hv.name+"_sum", h.values, "", h.sum.load())
+		hv.writeSample(w, hv.name+"_count", h.values, "", float64(count))
+	}
+}
+
+//funcMetric is a gauge or counter whose samples are collected by a function
+type funcMetric struct {
+	desc
+	collect func() []Sample
+}
+
+func (fm *funcMetric) write(w *bufio.Writer) {
+	fm.writeHeader(w)
+	for _, s := range fm.collect() {
+		seriesKey(&fm.desc, s.LabelValues)
+		fm.writeSample(w, fm.name, s.LabelValues, "", s.Value)
+	}
+}
@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	reg := NewRegistry()
+	requests := reg.NewCounterVec("requests_total", "Requests served.", "route", "status")
+	latency := reg.NewHistogramVec("latency_seconds", "Request latency.", []float64{1, 0.1}, "route")
+	reg.NewGaugeFunc("pool_up", "Whether the pool is up.", []string{"pool"}, func() []Sample {
+		return []Sample{{LabelValues: []string{`a "quoted"\name`}, Value: 1}}
+	})
+	reg.NewCounterFunc("waits_total", "Times waited,\nin total.", nil, func() []Sample {
+		return []Sample{{Value: 3}}
+	})
+
+	requests.With("/v1/users", "200").Inc()
+	requests.With("/v1/users", "200").Add(2)
+	requests.With("/v1/data", "500").Inc()
+	latency.With("/v1/users").Observe(0.05)
+	latency.With("/v1/users").Observe(0.5)
+	latency.With("/v1/users").Observe(5)
+
+	buf := &bytes.Buffer{}
+	if err := reg.WriteText(buf); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := `# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/v1/users",le="0.1"} 1
+latency_seconds_bucket{route="/v1/users",le="1"} 2
+latency_seconds_bucket{route="/v1/users",le="+Inf"} 3
+latency_seconds_sum{route="/v1/users"} 5.55
+latency_seconds_count{route="/v1/users"} 3
+# HELP pool_up Whether the pool is up.
+# TYPE pool_up gauge
+pool_up{pool="a \"quoted\"\\name"} 1
+# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{route="/v1/data",status="500"} 1
+requests_total{route="/v1/users",status="200"} 3
+# HELP waits_total Times waited,\nin total.
+# TYPE waits_total counter
+waits_total 3
+`
+	if buf.String() != expected {
+		t.Errorf("expected:\n%s\nbut got:\n%s", expected, buf.String())
+	}
+
+	rr := httptest.NewRecorder()
+	reg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+	if rr.Header().Get("Content-Type") != ContentType || rr.Body.String() != expected {
+		t.Errorf("unexpected response %q: %q", rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	reg := NewRegistry()
+	counter := reg.NewCounterVec("counter_total", "A counter.")
+	histogram := reg.NewHistogramVec("histogram", "A histogram.", DefaultBuckets)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				counter.With().Add(0.5)
+				histogram.With().Observe(0.5)
+			}
+		}()
+	}
+	wg.Wait()
+	if counter.With().Value() != 5000 || histogram.With().Count() != 10000 {
+		t.Errorf("lost updates: counter %v, histogram count %d", counter.With().Value(), histogram.With().Count())
+	}
+	buf := &bytes.Buffer{}
+	reg.WriteText(buf)
+	if !strings.Contains(buf.String(), "histogram_sum 5000\n") || !strings.Contains(buf.String(), "counter_total 5000\n") {
+		t.Errorf("unexpected output %s", buf.String())
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	reg := NewRegistry()
+	counter := reg.NewCounterVec("counter_total", "A counter.", "label")
+	cases := map[string]func(){
+		"registered twice":       func() { reg.NewCounterVec("counter_total", "Again.") },
+		"wrong number of labels": func() { counter.With("a", "b") },
+		"counter going down":     func() { counter.With("a").Add(-1) },
+	}
+	for name, misuse := range cases {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("case %s: expected a panic", name)
+				}
+			}()
+			misuse()
+		}()
+	}
+}
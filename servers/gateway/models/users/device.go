@@ -0,0 +1,70 @@
+package users
+
+import (
+	"net"
+	"strings"
+)
+
+//userAgentFamilies maps tokens found in User-Agent headers to the
+//family of client they identify. Order matters: many browsers also
+//claim to be the ones listed after them.
+var userAgentFamilies = []struct {
+	token  string
+	family string
+}{
+	{"Edg/", "Edge"},
+	{"Edge/", "Edge"},
+	{"OPR/", "Opera"},
+	{"SamsungBrowser/", "Samsung Internet"},
+	{"Firefox/", "Firefox"},
+	{"FxiOS/", "Firefox"},
+	{"CriOS/", "Chrome"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+	{"curl/", "curl"},
+	{"Go-http-client/", "Go"},
+}
+
+//Device describes the client and network a user signed in from,
+//coarsely enough that it stays the same across browser updates
+//and addresses handed out by the same network
+type Device struct {
+	//Family is the family of client, such as "Firefox"
+	Family string `json:"family"`
+	//Network is the /24 (IPv4) or /48 (IPv6) network the user signed in from
+	Network string `json:"network"`
+}
+
+//NewDevice returns the Device described by a User-Agent header
+//and a client IP address, which may include a port
+func NewDevice(userAgent string, ip string) *Device {
+	family := "Other"
+	for _, f := range userAgentFamilies {
+		if strings.Contains(userAgent, f.token) {
+			family = f.family
+			break
+		}
+	}
+	return &Device{Family: family, Network: networkOf(ip)}
+}
+
+//Fingerprint returns the string recorded in the user log
+//for sign-ins from the Device
+func (d *Device) Fingerprint() string {
+	return d.Family + " " + d.Network
+}
+
+//networkOf returns the coarse network prefix of the IP address
+func networkOf(ip string) string {
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return "unknown"
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
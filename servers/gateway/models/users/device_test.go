@@ -0,0 +1,54 @@
+package users
+
+import "testing"
+
+// TestNewDevice is a test function for the fingerprints of sign-in devices
+func TestNewDevice(t *testing.T) {
+	cases := []struct {
+		name        string
+		userAgent   string
+		ip          string
+		fingerprint string
+	}{
+		{
+			"Chrome on IPv4 with port",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/86.0.4240.111 Safari/537.36",
+			"203.0.113.57:51234",
+			"Chrome 203.0.113.0/24",
+		},
+		{
+			"Edge claiming to be Chrome",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/86.0.4240.111 Safari/537.36 Edg/86.0.622.51",
+			"203.0.113.200",
+			"Edge 203.0.113.0/24",
+		},
+		{
+			"Safari on IPv6",
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_6) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0 Safari/605.1.15",
+			"[2001:db8:abcd:12::1]:443",
+			"Safari 2001:db8:abcd::/48",
+		},
+		{
+			"Firefox",
+			"Mozilla/5.0 (X11; Linux x86_64; rv:82.0) Gecko/20100101 Firefox/82.0",
+			"198.51.100.1",
+			"Firefox 198.51.100.0/24",
+		},
+		{
+			"unknown client and address",
+			"",
+			"not an ip",
+			"Other unknown",
+		},
+	}
+	for _, c := range cases {
+		device := NewDevice(c.userAgent, c.ip)
+		if device.Fingerprint() != c.fingerprint {
+			t.Errorf("case %s -> expected fingerprint %q but got %q", c.name, c.fingerprint, device.Fingerprint())
+		}
+	}
+	// addresses on the same network share a fingerprint
+	if NewDevice("curl/7.68.0", "192.0.2.1").Fingerprint() != NewDevice("curl/7.72.0", "192.0.2.254").Fingerprint() {
+		t.Error("devices on the same network with the same client family should share a fingerprint")
+	}
+}
@@ -1,7 +1,5 @@
 package users
 
-import "errors"
-
 //mport "assignments-towm1204/servers/gateway/models/users"
 
 // TestUser is the test user which is the single default user in the fake mysql database
@@ -10,6 +8,8 @@ import "errors"
 // TestUser in this store.
 type FakeSQLStore struct {
 	TestUser *User
+	// Devices holds the fingerprints of the devices logged for each user
+	Devices map[int64][]string
 }
 
 //GetByID returns the User with the given ID
@@ -17,7 +17,7 @@ func (fakestore *FakeSQLStore) GetByID(id int64) (*User, error) {
 	if id == fakestore.TestUser.ID {
 		return fakestore.TestUser, nil
 	}
-	return nil, errors.New("User not found")
+	return nil, ErrUserNotFound
 }
 
 //GetByEmail returns the User with the given email
@@ -25,7 +25,7 @@ func (fakestore *FakeSQLStore) GetByEmail(email string) (*User, error) {
 	if email == fakestore.TestUser.Email {
 		return fakestore.TestUser, nil
 	}
-	return nil, errors.New("user not found")
+	return nil, ErrUserNotFound
 
 }
 
@@ -34,7 +34,7 @@ func (fakestore *FakeSQLStore) GetByUserName(username string) (*User, error) {
 	if username == fakestore.TestUser.UserName {
 		return fakestore.TestUser, nil
 	}
-	return nil, errors.New("user not found")
+	return nil, ErrUserNotFound
 }
 
 //Insert inserts the user into the database, and returns
@@ -49,10 +49,24 @@ func (fakestore *FakeSQLStore) Insert(user *User) (*User, error) {
 }
 
 //Log logs user logins into our database table
-func (fakestore *FakeSQLStore) Log(userID int64, ip string) error {
+func (fakestore *FakeSQLStore) Log(userID int64, ip string, device string) error {
+	if fakestore.Devices == nil {
+		fakestore.Devices = map[int64][]string{}
+	}
+	fakestore.Devices[userID] = append(fakestore.Devices[userID], device)
 	return nil
 }
 
+//KnownDevice reports whether the user has logged in from the device before
+func (fakestore *FakeSQLStore) KnownDevice(userID int64, device string) (bool, error) {
+	for _, known := range fakestore.Devices[userID] {
+		if known == device {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 //Update applies UserUpdates to the given user ID
 //and returns the newly-updated user
 func (fakestore *FakeSQLStore) Update(id int64, updates *Updates) (*User, error) {
@@ -68,13 +82,13 @@ func (fakestore *FakeSQLStore) Update(id int64, updates *Updates) (*User, error)
 		return &User{fakestore.TestUser.ID, fakestore.TestUser.Email, fakestore.TestUser.PassHash, fakestore.TestUser.UserName,
 			firstName, lastName, fakestore.TestUser.PhotoURL}, nil
 	}
-	return nil, errors.New("user not found")
+	return nil, ErrUserNotFound
 }
 
 //Delete deletes the user with the given ID
 func (fakestore *FakeSQLStore) Delete(id int64) error {
 	if id != fakestore.TestUser.ID {
-		return errors.New("user not found")
+		return ErrUserNotFound
 	}
 	return nil
 }
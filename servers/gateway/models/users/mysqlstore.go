@@ -52,9 +52,9 @@ func (ms *MySQLStore) Insert(user *User) (*User, error) {
 }
 
 //Log logs user logins into our database table
-func (ms *MySQLStore) Log(userID int64, ip string) error {
-	insq := "insert into userLog(userID, inTime, clientIP) values (?,?,?)"
-	_, execErr := ms.Db.Exec(insq, userID, time.Now(), ip)
+func (ms *MySQLStore) Log(userID int64, ip string, device string) error {
+	insq := "insert into userLog(userID, inTime, clientIP, device) values (?,?,?,?)"
+	_, execErr := ms.Db.Exec(insq, userID, time.Now(), ip, device)
 	if execErr != nil {
 		return errors.New("could not insert new log")
 	}
@@ -62,6 +62,17 @@ func (ms *MySQLStore) Log(userID int64, ip string) error {
 	return nil
 }
 
+//KnownDevice reports whether the user log has a sign-in
+//by the user from a device with the fingerprint
+func (ms *MySQLStore) KnownDevice(userID int64, device string) (bool, error) {
+	var count int
+	row := ms.Db.QueryRow("SELECT COUNT(*) FROM userLog WHERE userID=? AND device=?", userID, device)
+	if err := row.Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
 // GetByEmail returns User with given email
 func (ms *MySQLStore) GetByEmail(email string) (*User, error) {
 	result := &User{}
@@ -628,3 +628,44 @@ func TestGetByUsername(t *testing.T) {
 
 	}
 }
+
+// TestKnownDevice is a test function for the SQLStore's Log and KnownDevice
+func TestKnownDevice(t *testing.T) {
+	cases := []struct {
+		name     string
+		count    int
+		expected bool
+	}{
+		{"Known device", 2, true},
+		{"New device", 0, false},
+	}
+	for _, c := range cases {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("There was a problem opening a database connection: [%v]", err)
+		}
+		defer db.Close()
+
+		mainSQLStore := &MySQLStore{db}
+		insert := regexp.QuoteMeta("insert into userLog(userID, inTime, clientIP, device) values (?,?,?,?)")
+		mock.ExpectExec(insert).WithArgs(1, sqlmock.AnyArg(), "203.0.113.57", "Chrome 203.0.113.0/24").
+			WillReturnResult(sqlmock.NewResult(1, 1))
+		query := regexp.QuoteMeta("SELECT COUNT(*) FROM userLog WHERE userID=? AND device=?")
+		mock.ExpectQuery(query).WithArgs(1, "Chrome 203.0.113.0/24").
+			WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(c.count))
+
+		if err := mainSQLStore.Log(1, "203.0.113.57", "Chrome 203.0.113.0/24"); err != nil {
+			t.Errorf("Unexpected error logging sign-in [%s]: %v", c.name, err)
+		}
+		known, err := mainSQLStore.KnownDevice(1, "Chrome 203.0.113.0/24")
+		if err != nil {
+			t.Errorf("Unexpected error on successful test [%s]: %v", c.name, err)
+		}
+		if known != c.expected {
+			t.Errorf("Test case: [%s] Expected known = %t but got %t", c.name, c.expected, known)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("Test case: [%s] There were unfulfilled expectations: %s", c.name, err)
+		}
+	}
+}
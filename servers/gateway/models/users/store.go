@@ -22,8 +22,13 @@ type Store interface {
 	//the newly-inserted User, complete with the DBMS-assigned ID
 	Insert(user *User) (*User, error)
 
-	// //Log logs user logins into our database table
-	Log(userID int64, ip string) error
+	// //Log logs user logins into our database table, along with
+	// the fingerprint of the device the user signed in from
+	Log(userID int64, ip string, device string) error
+
+	//KnownDevice reports whether the user has signed in
+	//from a device with the fingerprint before
+	KnownDevice(userID int64, device string) (bool, error)
 
 	//Update applies UserUpdates to the given user ID
 	//and returns the newly-updated user
@@ -0,0 +1,92 @@
+package users
+
+import (
+	"context"
+
+	"github.com/my/repo/servers/gateway/tracing"
+)
+
+//tracedStore traces the queries made to a store as part of a request
+type tracedStore struct {
+	ctx   context.Context
+	store Store
+}
+
+//TraceStore returns the store, with its queries traced as part
+//of the request the context belongs to
+func TraceStore(ctx context.Context, store Store) Store {
+	if tracing.FromContext(ctx) == nil {
+		return store
+	}
+	return &tracedStore{ctx: ctx, store: store}
+}
+
+//trace begins the span of a query
+func (ts *tracedStore) trace(op string) *tracing.Span {
+	_, span := tracing.StartClient(ts.ctx, "users.Store."+op)
+	return span
+}
+
+//end ends the span of a query, which failed if it returned an error other than ErrUserNotFound
+func end(span *tracing.Span, err error) {
+	if err != ErrUserNotFound {
+		span.SetError(err)
+	}
+	span.End()
+}
+
+func (ts *tracedStore) GetByID(id int64) (*User, error) {
+	span := ts.trace("GetByID")
+	user, err := ts.store.GetByID(id)
+	end(span, err)
+	return user, err
+}
+
+func (ts *tracedStore) GetByEmail(email string) (*User, error) {
+	span := ts.trace("GetByEmail")
+	user, err := ts.store.GetByEmail(email)
+	end(span, err)
+	return user, err
+}
+
+func (ts *tracedStore) GetByUserName(username string) (*User, error) {
+	span := ts.trace("GetByUserName")
+	user, err := ts.store.GetByUserName(username)
+	end(span, err)
+	return user, err
+}
+
+func (ts *tracedStore) Insert(user *User) (*User, error) {
+	span := ts.trace("Insert")
+	inserted, err := ts.store.Insert(user)
+	end(span, err)
+	return inserted, err
+}
+
+func (ts *tracedStore) Log(userID int64, ip string, device string) error {
+	span := ts.trace("Log")
+	err := ts.store.Log(userID, ip, device)
+	end(span, err)
+	return err
+}
+
+func (ts *tracedStore) KnownDevice(userID int64, device string) (bool, error) {
+	span := ts.trace("KnownDevice")
+	known, err := ts.store.KnownDevice(userID, device)
+	end(span, err)
+	return known, err
+}
+
+func (ts *tracedStore) Update(id int64, updates *Updates) (*User, error) {
+	span := ts.trace("Update")
+	user, err := ts.store.Update(id, updates)
+	end(span, err)
+	return user, err
+}
+
+func (ts *tracedStore) Delete(id int64) error {
+	span := ts.trace("Delete")
+	err := ts.store.Delete(id)
+	end(span, err)
+	return err
+}
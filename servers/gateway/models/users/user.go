@@ -2,12 +2,13 @@ package users
 
 import (
 	"crypto/md5"
-	"errors"
 	"fmt"
 	"net/mail"
-	"regexp"
 	"strings"
+	"time"
+	"unicode"
 
+	"github.com/my/repo/servers/gateway/metrics"
 	"golang.org/x/crypto/bcrypt"
 )
 
@@ -18,6 +19,11 @@ const gravatarBasePhotoURL = "https://www.gravatar.com/avatar/"
 //bcryptCost is the default bcrypt cost to use when hashing passwords
 var bcryptCost = 13
 
+//bcryptDuration measures password hashing, which takes long enough by design to matter
+var bcryptDuration = metrics.Default.NewHistogramVec("gateway_bcrypt_duration_seconds",
+	"Time taken to hash and compare passwords with bcrypt, by operation.",
+	[]float64{.05, .1, .25, .5, .75, 1, 1.5, 2, 3, 5}, "op")
+
 //User represents a user account in the database
 type User struct {
 	ID        int64  `json:"id"`
@@ -51,14 +57,49 @@ type Updates struct {
 	LastName  string `json:"lastName"`
 }
 
-//Validate validates the new user and returns an error if
-//any of the validation rules fail, or nil if its valid
+//FieldError tells why a field is invalid, by the field's JSON name
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+//ValidationError lists every invalid field of a NewUser or Updates
+type ValidationError struct {
+	Fields []FieldError
+}
+
+//Error returns the messages of the invalid fields
+func (ve *ValidationError) Error() string {
+	messages := make([]string, 0, len(ve.Fields))
+	for _, field := range ve.Fields {
+		messages = append(messages, field.Message)
+	}
+	return strings.Join(messages, "; ")
+}
+
+//add adds the invalid field to the list
+func (ve *ValidationError) add(field string, code string, message string) {
+	ve.Fields = append(ve.Fields, FieldError{Field: field, Code: code, Message: message})
+}
+
+//err returns the ValidationError if any field is invalid, or nil
+func (ve *ValidationError) err() error {
+	if len(ve.Fields) == 0 {
+		return nil
+	}
+	return ve
+}
+
+//Validate validates the new user and returns a *ValidationError listing
+//every validation rule that fails, or nil if its valid
 func (nu *NewUser) Validate() error {
+	invalid := &ValidationError{}
 	//validate the new user according to these rules:
 	//- Email field must be a valid email address (hint: see mail.ParseAddress)
 	_, emailAddrErr := mail.ParseAddress(nu.Email)
 	if emailAddrErr != nil {
-		return errors.New("Invalid Email Address")
+		invalid.add("email", "invalid", "Invalid Email Address")
 	}
 
 	//- Password must be at least 6 characters
@@ -67,20 +108,14 @@ func (nu *NewUser) Validate() error {
 	// }
 	//- Password and PasswordConf must match
 	if nu.Password != nu.PasswordConf {
-		return errors.New("Password and its confirmation does not match")
-	}
-
-	// Username mst not contain space
-	hasSpace, err := regexp.MatchString(`\s`, nu.UserName)
-	if err != nil {
-		return err
+		invalid.add("passwordConf", "mismatch", "Password and its confirmation does not match")
 	}
 
 	//- UserName must be non-zero length and may not contain spaces
-	if len(nu.UserName) == 0 || hasSpace == true {
-		return errors.New("Username must be non-zero length and may not contain spaces")
+	if len(nu.UserName) == 0 || strings.IndexFunc(nu.UserName, unicode.IsSpace) >= 0 {
+		invalid.add("userName", "invalid", "Username must be non-zero length and may not contain spaces")
 	}
-	return nil
+	return invalid.err()
 }
 
 //ToUser converts the NewUser to a User, setting the
@@ -136,7 +171,9 @@ func (u *User) FullName() string {
 func (u *User) SetPassword(password string) error {
 	//use the bcrypt package to generate a new hash of the password
 	//https://godoc.org/golang.org/x/crypto/bcrypt
+	start := time.Now()
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	bcryptDuration.With("hash").Observe(time.Since(start).Seconds())
 	if err != nil {
 		return err
 	}
@@ -150,16 +187,29 @@ func (u *User) Authenticate(password string) error {
 	//use the bcrypt package to compare the supplied
 	//password with the stored PassHash
 	//https://godoc.org/golang.org/x/crypto/bcrypt
+	start := time.Now()
+	defer func() { bcryptDuration.With("compare").Observe(time.Since(start).Seconds()) }()
 	return bcrypt.CompareHashAndPassword(u.PassHash, []byte(password))
 }
 
-//ApplyUpdates applies the updates to the user. An error
+//Validate returns a *ValidationError if the updates change nothing, or nil if they are valid
+func (updates *Updates) Validate() error {
+	invalid := &ValidationError{}
+	if len(updates.FirstName) == 0 && len(updates.LastName) == 0 {
+		message := "Updates not applied, both fields are empty"
+		invalid.add("firstName", "required", message)
+		invalid.add("lastName", "required", message)
+	}
+	return invalid.err()
+}
+
+//ApplyUpdates applies the updates to the user. A *ValidationError
 //is returned if the updates are invalid
 func (u *User) ApplyUpdates(updates *Updates) error {
 	//set the fields of `u` to the values of the related
 	//field in the `updates` struct
-	if len(updates.FirstName) == 0 && len(updates.LastName) == 0 {
-		return errors.New("Updates not applied, both fields are empty")
+	if err := updates.Validate(); err != nil {
+		return err
 	}
 	if len(updates.FirstName) != 0 {
 		u.FirstName = updates.FirstName
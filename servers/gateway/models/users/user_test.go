@@ -170,6 +170,36 @@ func TestNewUserValidate(t *testing.T) {
 	}
 }
 
+func TestValidationErrorFields(t *testing.T) {
+	cases := []struct {
+		name           string
+		err            error
+		expectedFields []string
+	}{
+		{"every invalid field", (&NewUser{Email: "nope", Password: "a", PasswordConf: "b", UserName: "a b"}).Validate(),
+			[]string{"email", "passwordConf", "userName"}},
+		{"one invalid field", (&NewUser{Email: "a@b.com", UserName: ""}).Validate(), []string{"userName"}},
+		{"empty updates", (&Updates{}).Validate(), []string{"firstName", "lastName"}},
+	}
+	for _, c := range cases {
+		invalid, ok := c.err.(*ValidationError)
+		if !ok {
+			t.Errorf("case %s: expected a *ValidationError but got %v", c.name, c.err)
+			continue
+		}
+		fields := []string{}
+		for _, field := range invalid.Fields {
+			fields = append(fields, field.Field)
+		}
+		if fmt.Sprint(fields) != fmt.Sprint(c.expectedFields) {
+			t.Errorf("case %s: expected invalid fields %v but got %v", c.name, c.expectedFields, fields)
+		}
+	}
+	if err := (&Updates{LastName: "Gerrard"}).Validate(); err != nil {
+		t.Errorf("expected valid updates but got %v", err)
+	}
+}
+
 func TestToUser(t *testing.T) {
 	cases := []struct {
 		name             string
@@ -0,0 +1,332 @@
+//Package openapi reads the OpenAPI 3 document describing the gateway's API,
+//serves it to clients, and checks requests against the operations it describes.
+//Only the parts of OpenAPI the gateway's document uses are understood.
+package openapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+//Document is an OpenAPI 3 document
+type Document struct {
+	OpenAPI    string               `json:"openapi"`
+	Info       *Info                `json:"info"`
+	Paths      map[string]*PathItem `json:"paths"`
+	Components *Components          `json:"components,omitempty"`
+
+	//raw is the document as it was read, which is what clients are served
+	raw []byte
+	//templates are the paths, most specific first
+	templates []*template
+}
+
+//Info describes the API
+type Info struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+//Components are the schemas and responses the rest of the document refers to
+type Components struct {
+	Schemas   map[string]*Schema   `json:"schemas,omitempty"`
+	Responses map[string]*Response `json:"responses,omitempty"`
+}
+
+//PathItem holds the operations on a path, by method
+type PathItem struct {
+	Parameters []*Parameter `json:"parameters,omitempty"`
+	Get        *Operation   `json:"get,omitempty"`
+	Post       *Operation   `json:"post,omitempty"`
+	Put        *Operation   `json:"put,omitempty"`
+	Patch      *Operation   `json:"patch,omitempty"`
+	Delete     *Operation   `json:"delete,omitempty"`
+}
+
+//Operations returns the operations on the path, by method
+func (item *PathItem) Operations() map[string]*Operation {
+	operations := map[string]*Operation{}
+	for method, operation := range map[string]*Operation{
+		"GET": item.Get, "POST": item.Post, "PUT": item.Put, "PATCH": item.Patch, "DELETE": item.Delete,
+	} {
+		if operation != nil {
+			operations[method] = operation
+		}
+	}
+	return operations
+}
+
+//Allow returns the methods of the operations on the path, for the Allow header
+func (item *PathItem) Allow() string {
+	methods := []string{}
+	for method := range item.Operations() {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return strings.Join(methods, ", ")
+}
+
+//Operation is a method of a path
+type Operation struct {
+	OperationID string               `json:"operationId"`
+	Summary     string               `json:"summary,omitempty"`
+	Parameters  []*Parameter         `json:"parameters,omitempty"`
+	RequestBody *RequestBody         `json:"requestBody,omitempty"`
+	Responses   map[string]*Response `json:"responses"`
+}
+
+//Parameter is a path, query or header parameter of an operation
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+//RequestBody lists the media types an operation accepts, with the schema of each
+type RequestBody struct {
+	Required bool                  `json:"required,omitempty"`
+	Content  map[string]*MediaType `json:"content"`
+}
+
+//MediaType gives the schema of a body of the media type
+type MediaType struct {
+	Schema *Schema `json:"schema,omitempty"`
+}
+
+//Response describes a response of an operation
+type Response struct {
+	Ref         string                `json:"$ref,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Content     map[string]*MediaType `json:"content,omitempty"`
+}
+
+//Schema is a JSON schema, of the keywords the gateway checks
+type Schema struct {
+	Ref                  string             `json:"$ref,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Format               string             `json:"format,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Nullable             bool               `json:"nullable,omitempty"`
+	Enum                 []interface{}      `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *bool              `json:"additionalProperties,omitempty"`
+	MinProperties        *int               `json:"minProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	MinLength            *int               `json:"minLength,omitempty"`
+	MaxLength            *int               `json:"maxLength,omitempty"`
+	Pattern              string             `json:"pattern,omitempty"`
+	Minimum              *float64           `json:"minimum,omitempty"`
+	Maximum              *float64           `json:"maximum,omitempty"`
+
+	//target is the schema Ref refers to
+	target *Schema
+	//pattern is Pattern, compiled
+	pattern *regexp.Regexp
+}
+
+//Prefixes of the references to the schemas and responses of the components
+const (
+	schemaRefPrefix   = "#/components/schemas/"
+	responseRefPrefix = "#/components/responses/"
+)
+
+//template is a path of the document, such as /v1/users/{userID}, split into segments
+type template struct {
+	path     string
+	item     *PathItem
+	segments []string
+}
+
+//match returns the values of the path's parameters if the path matches the template
+func (t *template) match(path string) (map[string]string, bool) {
+	segments := strings.Split(path, "/")
+	if len(segments) != len(t.segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, segment := range t.segments {
+		if name, ok := paramName(segment); ok {
+			if len(segments[i]) == 0 {
+				return nil, false
+			}
+			params[name] = segments[i]
+		} else if segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+//paramName returns the name of the parameter if the segment of a path template is one
+func paramName(segment string) (string, bool) {
+	if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+		return segment[1 : len(segment)-1], true
+	}
+	return "", false
+}
+
+//Parse reads the document, checking that its references resolve,
+//its patterns compile, and the parameters of its paths are declared
+func Parse(data []byte) (*Document, error) {
+	doc := &Document{}
+	if err := json.Unmarshal(data, doc); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(doc.OpenAPI, "3.") {
+		return nil, fmt.Errorf("unsupported OpenAPI version %q", doc.OpenAPI)
+	}
+	if doc.Components == nil {
+		doc.Components = &Components{}
+	}
+	for name, schema := range doc.Components.Schemas {
+		if err := doc.prepare(schema); err != nil {
+			return nil, fmt.Errorf("schema %s: %v", name, err)
+		}
+	}
+	for name, response := range doc.Components.Responses {
+		if len(response.Ref) != 0 {
+			return nil, fmt.Errorf("response %s: references between responses are not supported", name)
+		}
+		if err := doc.prepareResponse(response); err != nil {
+			return nil, fmt.Errorf("response %s: %v", name, err)
+		}
+	}
+	for path, item := range doc.Paths {
+		if !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("path %q must start with /", path)
+		}
+		for method, operation := range item.Operations() {
+			if err := doc.prepareOperation(path, item, operation); err != nil {
+				return nil, fmt.Errorf("%s %s: %v", method, path, err)
+			}
+		}
+		doc.templates = append(doc.templates, &template{path: path, item: item, segments: strings.Split(path, "/")})
+	}
+	//paths without parameters are matched before templates that could match them too
+	sort.Slice(doc.templates, func(i, j int) bool {
+		return strings.Count(doc.templates[i].path, "{") < strings.Count(doc.templates[j].path, "{")
+	})
+	doc.raw = data
+	return doc, nil
+}
+
+//prepareOperation checks the operation's parameters and prepares its schemas
+func (doc *Document) prepareOperation(path string, item *PathItem, operation *Operation) error {
+	if len(operation.OperationID) == 0 {
+		return fmt.Errorf("no operationId")
+	}
+	declared := map[string]bool{}
+	for _, param := range append(append([]*Parameter{}, item.Parameters...), operation.Parameters...) {
+		switch param.In {
+		case "path":
+			declared[param.Name] = true
+		case "query", "header":
+		default:
+			return fmt.Errorf("parameter %s is in unsupported location %q", param.Name, param.In)
+		}
+		if param.Schema == nil {
+			return fmt.Errorf("parameter %s has no schema", param.Name)
+		}
+		if err := doc.prepare(param.Schema); err != nil {
+			return fmt.Errorf("parameter %s: %v", param.Name, err)
+		}
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if name, ok := paramName(segment); ok && !declared[name] {
+			return fmt.Errorf("path parameter %s is not declared", name)
+		}
+	}
+	if operation.RequestBody != nil {
+		for mediaType, content := range operation.RequestBody.Content {
+			if content.Schema == nil {
+				continue
+			}
+			if err := doc.prepare(content.Schema); err != nil {
+				return fmt.Errorf("%s body: %v", mediaType, err)
+			}
+		}
+	}
+	for status, response := range operation.Responses {
+		if len(response.Ref) != 0 {
+			if doc.Components.Responses[strings.TrimPrefix(response.Ref, responseRefPrefix)] == nil ||
+				!strings.HasPrefix(response.Ref, responseRefPrefix) {
+				return fmt.Errorf("%s response: reference %q does not resolve", status, response.Ref)
+			}
+			//the target is prepared as a component
+			continue
+		}
+		if err := doc.prepareResponse(response); err != nil {
+			return fmt.Errorf("%s response: %v", status, err)
+		}
+	}
+	return nil
+}
+
+//prepareResponse prepares the schemas of the response's content
+func (doc *Document) prepareResponse(response *Response) error {
+	for _, content := range response.Content {
+		if content.Schema == nil {
+			continue
+		}
+		if err := doc.prepare(content.Schema); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//prepare resolves the references of the schema and compiles its patterns
+func (doc *Document) prepare(schema *Schema) error {
+	if len(schema.Ref) != 0 {
+		if !strings.HasPrefix(schema.Ref, schemaRefPrefix) {
+			return fmt.Errorf("unsupported reference %q", schema.Ref)
+		}
+		schema.target = doc.Components.Schemas[strings.TrimPrefix(schema.Ref, schemaRefPrefix)]
+		if schema.target == nil {
+			return fmt.Errorf("reference %q does not resolve", schema.Ref)
+		}
+		//the target is prepared as a component
+		return nil
+	}
+	if len(schema.Pattern) != 0 && schema.pattern == nil {
+		pattern, err := regexp.Compile(schema.Pattern)
+		if err != nil {
+			return err
+		}
+		schema.pattern = pattern
+	}
+	for name, property := range schema.Properties {
+		if err := doc.prepare(property); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	if schema.Items != nil {
+		return doc.prepare(schema.Items)
+	}
+	return nil
+}
+
+//Find returns the path template of the document matching the path, with the
+//operations on it and the values of its parameters, or nil if none matches
+func (doc *Document) Find(path string) (string, *PathItem, map[string]string) {
+	for _, t := range doc.templates {
+		if params, ok := t.match(path); ok {
+			return t.path, t.item, params
+		}
+	}
+	return "", nil, nil
+}
+
+//ServeHTTP serves the document as it was read
+func (doc *Document) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(doc.raw)
+}
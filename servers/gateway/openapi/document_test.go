@@ -0,0 +1,135 @@
+package openapi
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//testDoc describes a small API using every feature the package understands
+const testDoc = `{
+	"openapi": "3.0.3",
+	"info": {"title": "test", "version": "1"},
+	"paths": {
+		"/v1/users": {
+			"post": {
+				"operationId": "createUser",
+				"requestBody": {"required": true, "content": {"application/json": {"schema": {"$ref": "#/components/schemas/NewUser"}}}},
+				"responses": {"201": {"description": "created"}, "422": {"$ref": "#/components/responses/Problem"}}
+			}
+		},
+		"/v1/users/me": {
+			"get": {"operationId": "getMe", "responses": {"200": {"description": "you"}}}
+		},
+		"/v1/users/{userID}": {
+			"parameters": [{"name": "userID", "in": "path", "required": true, "schema": {"type": "string", "pattern": "^[0-9]+$"}}],
+			"get": {
+				"operationId": "getUser",
+				"parameters": [
+					{"name": "limit", "in": "query", "schema": {"type": "integer", "minimum": 1, "maximum": 100}},
+					{"name": "X-Client", "in": "header", "required": true, "schema": {"type": "string", "enum": ["web", "cli"]}}
+				],
+				"responses": {"200": {"description": "the user"}}
+			},
+			"delete": {"operationId": "deleteUser", "responses": {"204": {"description": "deleted"}}}
+		}
+	},
+	"components": {
+		"schemas": {
+			"NewUser": {
+				"type": "object",
+				"required": ["email", "userName"],
+				"additionalProperties": false,
+				"properties": {
+					"email": {"type": "string", "format": "email"},
+					"userName": {"type": "string", "minLength": 1, "maxLength": 8},
+					"age": {"type": "integer", "minimum": 0},
+					"tags": {"type": "array", "items": {"type": "string"}},
+					"address": {"type": "object", "required": ["city"], "properties": {"city": {"type": "string"}}},
+					"nickName": {"type": "string", "nullable": true}
+				}
+			}
+		},
+		"responses": {
+			"Problem": {"description": "problem", "content": {"application/problem+json": {"schema": {"type": "object"}}}}
+		}
+	}
+}`
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name          string
+		doc           string
+		expectedError string
+	}{
+		{"Valid", testDoc, ""},
+		{"Swagger 2", `{"swagger": "2.0", "paths": {}}`, "unsupported OpenAPI version"},
+		{"Bad JSON", `{"openapi": `, "unexpected end"},
+		{"Unresolved schema", `{"openapi": "3.0.0", "paths": {"/a": {"get": {"operationId": "a", "responses": {},
+			"requestBody": {"content": {"application/json": {"schema": {"$ref": "#/components/schemas/Nope"}}}}}}}}`, "does not resolve"},
+		{"Unresolved response", `{"openapi": "3.0.0", "paths": {"/a": {"get": {"operationId": "a",
+			"responses": {"400": {"$ref": "#/components/responses/Nope"}}}}}}`, "does not resolve"},
+		{"Bad pattern", `{"openapi": "3.0.0", "components": {"schemas": {"A": {"type": "string", "pattern": "("}}}, "paths": {}}`, "schema A"},
+		{"Undeclared path parameter", `{"openapi": "3.0.0", "paths": {"/a/{id}": {"get": {"operationId": "a", "responses": {}}}}}`,
+			"path parameter id is not declared"},
+		{"No operationId", `{"openapi": "3.0.0", "paths": {"/a": {"get": {"responses": {}}}}}`, "no operationId"},
+		{"Cookie parameter", `{"openapi": "3.0.0", "paths": {"/a": {"get": {"operationId": "a", "responses": {},
+			"parameters": [{"name": "s", "in": "cookie", "schema": {"type": "string"}}]}}}}`, "unsupported location"},
+	}
+	for _, c := range cases {
+		_, err := Parse([]byte(c.doc))
+		if len(c.expectedError) == 0 && err != nil {
+			t.Errorf("case %s: unexpected error %v", c.name, err)
+		}
+		if len(c.expectedError) != 0 && (err == nil || !strings.Contains(err.Error(), c.expectedError)) {
+			t.Errorf("case %s: expected error containing %q but got %v", c.name, c.expectedError, err)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	doc, err := Parse([]byte(testDoc))
+	if err != nil {
+		t.Fatalf("error parsing document: %v", err)
+	}
+	cases := []struct {
+		path             string
+		expectedTemplate string
+		expectedParams   map[string]string
+	}{
+		{"/v1/users", "/v1/users", map[string]string{}},
+		//paths without parameters win over templates
+		{"/v1/users/me", "/v1/users/me", map[string]string{}},
+		{"/v1/users/42", "/v1/users/{userID}", map[string]string{"userID": "42"}},
+		{"/v1/users/", "", nil},
+		{"/v1/users/42/avatar", "", nil},
+		{"/v2/users", "", nil},
+	}
+	for _, c := range cases {
+		template, item, params := doc.Find(c.path)
+		if template != c.expectedTemplate || (item == nil) != (len(c.expectedTemplate) == 0) {
+			t.Errorf("%s: expected template %q but got %q", c.path, c.expectedTemplate, template)
+			continue
+		}
+		for name, value := range c.expectedParams {
+			if params[name] != value {
+				t.Errorf("%s: expected %s to be %q but got %q", c.path, name, value, params[name])
+			}
+		}
+	}
+	if _, item, _ := doc.Find("/v1/users/42"); item.Allow() != "DELETE, GET" {
+		t.Errorf("expected the methods of the path to be allowed but got %q", item.Allow())
+	}
+}
+
+func TestServeHTTP(t *testing.T) {
+	doc, err := Parse([]byte(testDoc))
+	if err != nil {
+		t.Fatalf("error parsing document: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	doc.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/openapi.json", nil))
+	if rr.Header().Get("Content-Type") != "application/json" || rr.Body.String() != testDoc {
+		t.Errorf("expected the document as it was read but got %s %q", rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+}
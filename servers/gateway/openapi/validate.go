@@ -0,0 +1,277 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/my/repo/servers/gateway/problem"
+)
+
+//MaxBodyBytes is the largest request body checked against its schema;
+//larger bodies are refused
+const MaxBodyBytes = 1 << 20
+
+//Validate checks the request against the operation the document describes for
+//its path and method, returning the problem to respond with if it does not match.
+//The body is read and replaced, so the handler can still read it. Requests to
+//paths the document does not describe are left to the router to refuse.
+func (doc *Document) Validate(r *http.Request) *problem.Problem {
+	_, item, pathParams := doc.Find(r.URL.Path)
+	if item == nil || r.Method == "OPTIONS" {
+		return nil
+	}
+	method := r.Method
+	if method == "HEAD" {
+		method = "GET"
+	}
+	operations := item.Operations()
+	operation := operations[method]
+	if operation == nil {
+		return problem.New(http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, r.Method+" is not allowed")
+	}
+
+	invalid := []problem.FieldError{}
+	for _, param := range append(append([]*Parameter{}, item.Parameters...), operation.Parameters...) {
+		var value string
+		var present bool
+		switch param.In {
+		case "path":
+			value, present = pathParams[param.Name]
+		case "query":
+			values, found := r.URL.Query()[param.Name]
+			if found {
+				value, present = values[0], true
+			}
+		case "header":
+			value = r.Header.Get(param.Name)
+			present = len(value) != 0
+		}
+		if !present {
+			if param.Required {
+				invalid = append(invalid, problem.FieldError{Field: param.Name, Code: "required",
+					Message: fmt.Sprintf("%s parameter %s is required", param.In, param.Name)})
+			}
+			continue
+		}
+		paramErrors := []problem.FieldError{}
+		param.Schema.validate(paramValue(param.Schema.resolve(), value), param.Name, &paramErrors)
+		//a path that does not match is a resource that does not exist
+		if len(paramErrors) != 0 && param.In == "path" {
+			return problem.New(http.StatusNotFound, problem.CodeNotFound, "no resource at "+r.URL.Path)
+		}
+		invalid = append(invalid, paramErrors...)
+	}
+	if len(invalid) != 0 {
+		p := problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "invalid request parameters")
+		p.Errors = invalid
+		return p
+	}
+	if operation.RequestBody == nil {
+		return nil
+	}
+	return operation.RequestBody.validate(r)
+}
+
+//validate checks the content type and body of the request against the request body
+func (rb *RequestBody) validate(r *http.Request) *problem.Problem {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxBodyBytes+1))
+	r.Body.Close()
+	if err != nil {
+		return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "error reading request body")
+	}
+	if len(body) > MaxBodyBytes {
+		return problem.New(http.StatusRequestEntityTooLarge, problem.CodeRequestTooLarge,
+			fmt.Sprintf("request body must be at most %d bytes", MaxBodyBytes))
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if len(body) == 0 {
+		if rb.Required {
+			return problem.New(http.StatusBadRequest, problem.CodeInvalidRequest, "request body is required")
+		}
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	content, found := rb.Content[mediaType]
+	if !found {
+		types := make([]string, 0, len(rb.Content))
+		for t := range rb.Content {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		return problem.New(http.StatusUnsupportedMediaType, problem.CodeUnsupportedMediaType,
+			"request body must be "+strings.Join(types, " or "))
+	}
+	if content.Schema == nil {
+		return nil
+	}
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return problem.New(http.StatusBadRequest, problem.CodeInvalidJSON, "request body is not valid JSON")
+	}
+	invalid := []problem.FieldError{}
+	content.Schema.validate(value, "", &invalid)
+	if len(invalid) == 0 {
+		return nil
+	}
+	messages := make([]string, 0, len(invalid))
+	for _, field := range invalid {
+		messages = append(messages, field.Message)
+	}
+	p := problem.New(http.StatusUnprocessableEntity, problem.CodeValidationFailed, strings.Join(messages, "; "))
+	p.Errors = invalid
+	return p
+}
+
+//paramValue converts the parameter's value to the type of its schema, leaving it a
+//string if it does not convert, so it fails validation
+func paramValue(schema *Schema, value string) interface{} {
+	switch schema.Type {
+	case "integer", "number":
+		if n, err := strconv.ParseFloat(value, 64); err == nil {
+			return n
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	}
+	return value
+}
+
+//resolve returns the schema a reference refers to, or the schema itself
+func (schema *Schema) resolve() *Schema {
+	if schema.target != nil {
+		return schema.target.resolve()
+	}
+	return schema
+}
+
+//validate adds to `invalid` every way the value does not match the schema, naming
+//the field at `field`: an object property's name, joined to its parents' with dots
+func (schema *Schema) validate(value interface{}, field string, invalid *[]problem.FieldError) {
+	schema = schema.resolve()
+	name := field
+	if len(name) == 0 {
+		name = "body"
+	}
+	fail := func(code string, format string, args ...interface{}) {
+		*invalid = append(*invalid, problem.FieldError{Field: name, Code: code, Message: name + " " + fmt.Sprintf(format, args...)})
+	}
+	if value == nil {
+		if !schema.Nullable && len(schema.Type) != 0 {
+			fail("type", "must be a %s", schema.Type)
+		}
+		return
+	}
+	if len(schema.Enum) != 0 && !inEnum(schema.Enum, value) {
+		fail("enum", "must be one of %v", schema.Enum)
+		return
+	}
+	switch v := value.(type) {
+	case string:
+		if schema.Type != "" && schema.Type != "string" {
+			fail("type", "must be a %s", schema.Type)
+			return
+		}
+		length := utf8.RuneCountInString(v)
+		if schema.MinLength != nil && length < *schema.MinLength {
+			fail("minLength", "must be at least %d characters", *schema.MinLength)
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			fail("maxLength", "must be at most %d characters", *schema.MaxLength)
+		}
+		if schema.pattern != nil && !schema.pattern.MatchString(v) {
+			fail("pattern", "must match %s", schema.Pattern)
+		}
+		if schema.Format == "email" {
+			if _, err := mail.ParseAddress(v); err != nil {
+				fail("format", "must be an email address")
+			}
+		}
+	case float64:
+		if schema.Type != "" && schema.Type != "number" && (schema.Type != "integer" || v != math.Trunc(v)) {
+			fail("type", "must be a %s", schema.Type)
+			return
+		}
+		if schema.Minimum != nil && v < *schema.Minimum {
+			fail("minimum", "must be at least %v", *schema.Minimum)
+		}
+		if schema.Maximum != nil && v > *schema.Maximum {
+			fail("maximum", "must be at most %v", *schema.Maximum)
+		}
+	case bool:
+		if schema.Type != "" && schema.Type != "boolean" {
+			fail("type", "must be a %s", schema.Type)
+		}
+	case []interface{}:
+		if schema.Type != "" && schema.Type != "array" {
+			fail("type", "must be a %s", schema.Type)
+			return
+		}
+		if schema.Items != nil {
+			for i, item := range v {
+				schema.Items.validate(item, fmt.Sprintf("%s[%d]", field, i), invalid)
+			}
+		}
+	case map[string]interface{}:
+		if schema.Type != "" && schema.Type != "object" {
+			fail("type", "must be a %s", schema.Type)
+			return
+		}
+		if schema.MinProperties != nil && len(v) < *schema.MinProperties {
+			fail("minProperties", "must have at least %d properties", *schema.MinProperties)
+		}
+		for _, required := range schema.Required {
+			if _, found := v[required]; !found {
+				*invalid = append(*invalid, problem.FieldError{Field: join(field, required), Code: "required",
+					Message: join(field, required) + " is required"})
+			}
+		}
+		names := make([]string, 0, len(v))
+		for property := range v {
+			names = append(names, property)
+		}
+		//the errors are listed in a stable order
+		sort.Strings(names)
+		for _, property := range names {
+			propertySchema, declared := schema.Properties[property]
+			if !declared {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					*invalid = append(*invalid, problem.FieldError{Field: join(field, property), Code: "unknown",
+						Message: join(field, property) + " is not allowed"})
+				}
+				continue
+			}
+			propertySchema.validate(v[property], join(field, property), invalid)
+		}
+	}
+}
+
+//join names the property of the object at `field`
+func join(field string, property string) string {
+	if len(field) == 0 {
+		return property
+	}
+	return field + "." + property
+}
+
+//inEnum reports whether the value is one of the values of the enum
+func inEnum(enum []interface{}, value interface{}) bool {
+	for _, allowed := range enum {
+		if allowed == value {
+			return true
+		}
+	}
+	return false
+}
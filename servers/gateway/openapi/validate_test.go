@@ -0,0 +1,109 @@
+package openapi
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/my/repo/servers/gateway/problem"
+)
+
+func TestValidate(t *testing.T) {
+	doc, err := Parse([]byte(testDoc))
+	if err != nil {
+		t.Fatalf("error parsing document: %v", err)
+	}
+	cases := []struct {
+		name           string
+		method         string
+		path           string
+		header         map[string]string
+		body           string
+		expectedStatus int
+		expectedCode   string
+		//expectedFields are the fields expected to be reported invalid, in order
+		expectedFields []string
+	}{
+		{"Valid body", "POST", "/v1/users", map[string]string{"Content-Type": "application/json; charset=utf-8"},
+			`{"email": "a@b.c", "userName": "bob", "tags": ["x"], "address": {"city": "Seattle"}, "nickName": null}`, 0, "", nil},
+		{"Undocumented path", "POST", "/v2/anything", nil, "not json", 0, "", nil},
+		{"Preflight", "OPTIONS", "/v1/users", nil, "", 0, "", nil},
+		{"Undocumented method", "PUT", "/v1/users", nil, "", http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, nil},
+		{"Missing body", "POST", "/v1/users", map[string]string{"Content-Type": "application/json"}, "",
+			http.StatusBadRequest, problem.CodeInvalidRequest, nil},
+		{"Wrong content type", "POST", "/v1/users", map[string]string{"Content-Type": "text/plain"}, `{}`,
+			http.StatusUnsupportedMediaType, problem.CodeUnsupportedMediaType, nil},
+		{"Invalid JSON", "POST", "/v1/users", map[string]string{"Content-Type": "application/json"}, `{"email": `,
+			http.StatusBadRequest, problem.CodeInvalidJSON, nil},
+		{"Not an object", "POST", "/v1/users", map[string]string{"Content-Type": "application/json"}, `[]`,
+			http.StatusUnprocessableEntity, problem.CodeValidationFailed, []string{"body"}},
+		{"Invalid fields", "POST", "/v1/users", map[string]string{"Content-Type": "application/json"},
+			`{"email": "nope", "userName": "much too long", "age": 1.5, "tags": ["x", 2], "address": {}, "admin": true}`,
+			http.StatusUnprocessableEntity, problem.CodeValidationFailed,
+			[]string{"address.city", "admin", "age", "email", "tags[1]", "userName"}},
+		{"Missing fields", "POST", "/v1/users", map[string]string{"Content-Type": "application/json"}, `{}`,
+			http.StatusUnprocessableEntity, problem.CodeValidationFailed, []string{"email", "userName"}},
+		{"Null field", "POST", "/v1/users", map[string]string{"Content-Type": "application/json"}, `{"email": null, "userName": "bob"}`,
+			http.StatusUnprocessableEntity, problem.CodeValidationFailed, []string{"email"}},
+		{"Valid parameters", "GET", "/v1/users/42?limit=10", map[string]string{"X-Client": "web"}, "", 0, "", nil},
+		{"HEAD is GET", "HEAD", "/v1/users/42", map[string]string{"X-Client": "cli"}, "", 0, "", nil},
+		{"Path parameter mismatch", "GET", "/v1/users/bob", map[string]string{"X-Client": "web"}, "",
+			http.StatusNotFound, problem.CodeNotFound, nil},
+		{"Invalid parameters", "GET", "/v1/users/42?limit=1000", map[string]string{"X-Client": "curl"}, "",
+			http.StatusBadRequest, problem.CodeInvalidRequest, []string{"limit", "X-Client"}},
+		{"Missing header", "GET", "/v1/users/42?limit=ten", nil, "",
+			http.StatusBadRequest, problem.CodeInvalidRequest, []string{"limit", "X-Client"}},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(c.method, c.path, strings.NewReader(c.body))
+		for name, value := range c.header {
+			r.Header.Set(name, value)
+		}
+		p := doc.Validate(r)
+		if c.expectedStatus == 0 {
+			if p != nil {
+				t.Errorf("case %s: unexpected problem %d %s: %s", c.name, p.Status, p.Code, p.Detail)
+			}
+			continue
+		}
+		if p == nil {
+			t.Errorf("case %s: expected %d %s but the request was valid", c.name, c.expectedStatus, c.expectedCode)
+			continue
+		}
+		if p.Status != c.expectedStatus || p.Code != c.expectedCode {
+			t.Errorf("case %s: expected %d %s but got %d %s: %s", c.name, c.expectedStatus, c.expectedCode, p.Status, p.Code, p.Detail)
+		}
+		fields := []string{}
+		for _, field := range p.Errors {
+			fields = append(fields, field.Field)
+		}
+		if strings.Join(fields, ",") != strings.Join(c.expectedFields, ",") {
+			t.Errorf("case %s: expected invalid fields %v but got %v", c.name, c.expectedFields, p.Errors)
+		}
+	}
+}
+
+func TestValidateBody(t *testing.T) {
+	doc, err := Parse([]byte(testDoc))
+	if err != nil {
+		t.Fatalf("error parsing document: %v", err)
+	}
+	//the body is still there for the handler once it is checked
+	body := `{"email": "a@b.c", "userName": "bob"}`
+	r := httptest.NewRequest("POST", "/v1/users", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	if p := doc.Validate(r); p != nil {
+		t.Fatalf("unexpected problem %s", p.Detail)
+	}
+	if read, _ := ioutil.ReadAll(r.Body); string(read) != body {
+		t.Errorf("expected the body to be readable after validation but got %q", read)
+	}
+
+	r = httptest.NewRequest("POST", "/v1/users", strings.NewReader(`"`+strings.Repeat("x", MaxBodyBytes)+`"`))
+	r.Header.Set("Content-Type", "application/json")
+	if p := doc.Validate(r); p == nil || p.Status != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected a body over the limit to be refused but got %v", p)
+	}
+}
@@ -0,0 +1,109 @@
+//Package problem writes the gateway's error responses as problem details,
+//as described by RFC 7807: https://tools.ietf.org/html/rfc7807
+package problem
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/my/repo/servers/gateway/logging"
+)
+
+//ContentType is the media type of problem details
+const ContentType = "application/problem+json"
+
+//typePrefix begins the type URI of every problem, which ends with its code
+const typePrefix = "urn:problem:gateway:"
+
+//requestIDHeader is the header the access logger puts the ID of each request in
+const requestIDHeader = "X-Request-ID"
+
+//Codes of the problems the gateway responds with. Clients may rely on them
+//not changing, unlike the detail, which is meant for people.
+const (
+	CodeInvalidJSON          = "invalid_json"
+	CodeUnsupportedMediaType = "unsupported_media_type"
+	CodeValidationFailed     = "validation_failed"
+	CodeUnauthenticated      = "unauthenticated"
+	CodeInvalidCredentials   = "invalid_credentials"
+	CodeForbidden            = "forbidden"
+	CodeOriginNotAllowed     = "origin_not_allowed"
+	CodeNotFound             = "not_found"
+	CodeUserNotFound         = "user_not_found"
+	CodeMethodNotAllowed     = "method_not_allowed"
+	CodeUserExists           = "user_exists"
+	CodeRateLimited          = "rate_limited"
+	CodeRequestInProgress    = "request_in_progress"
+	CodeIdempotencyKeyReused = "idempotency_key_reused"
+	CodeTooManyConnections   = "too_many_connections"
+	CodeInvalidRequest       = "invalid_request"
+	CodeRequestTooLarge      = "request_too_large"
+	CodeInternal             = "internal_error"
+	CodeSessionsUnavailable  = "sessions_unavailable"
+	CodeUnavailable          = "unavailable"
+	CodeUpstreamUnreachable  = "upstream_unreachable"
+	CodeUpstreamTimeout      = "upstream_timeout"
+)
+
+//FieldError tells which field of the request body is invalid, and why
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+//Problem is the body of an error response
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	//Instance is the path of the request that had the problem
+	Instance string `json:"instance,omitempty"`
+	Code     string `json:"code"`
+	//RequestID is the ID the request was logged with, for reporting the problem
+	RequestID string `json:"requestId,omitempty"`
+	//Errors are the invalid fields of the request body, for validation problems
+	Errors []FieldError `json:"errors,omitempty"`
+}
+
+//New constructs a new Problem with the status, code and detail
+func New(status int, code string, detail string) *Problem {
+	return &Problem{Type: typePrefix + code, Title: http.StatusText(status), Status: status, Detail: detail, Code: code}
+}
+
+//Write responds to the request with the problem
+func Write(w http.ResponseWriter, r *http.Request, p *Problem) {
+	WriteExtended(w, r, p, p)
+}
+
+//WriteExtended responds to the request with the problem, sending `body` in its
+//place: a struct embedding the problem that adds members of its own
+func WriteExtended(w http.ResponseWriter, r *http.Request, p *Problem, body interface{}) {
+	p.Instance = r.URL.Path
+	p.RequestID = r.Header.Get(requestIDHeader)
+	data, err := json.Marshal(body)
+	if err != nil {
+		logging.FromContext(r.Context()).Errorf("error encoding problem: %v", err)
+		data, _ = json.Marshal(p)
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	//an error replaces whatever the response would have been
+	w.Header().Del("Content-Length")
+	w.Header().Del("Content-Encoding")
+	w.WriteHeader(p.Status)
+	w.Write(append(data, '\n'))
+}
+
+//Error responds to the request with a problem of the status, code and detail
+func Error(w http.ResponseWriter, r *http.Request, status int, code string, detail string) {
+	Write(w, r, New(status, code, detail))
+}
+
+//Internal logs the error and responds with a 500 problem that does not reveal it,
+//since the details of the gateway's failures are no business of its clients
+func Internal(w http.ResponseWriter, r *http.Request, err error) {
+	logging.FromContext(r.Context()).Errorf("%s %s: %v", r.Method, r.URL.Path, err)
+	Error(w, r, http.StatusInternalServerError, CodeInternal, "something went wrong, please try again later")
+}
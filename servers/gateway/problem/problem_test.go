@@ -0,0 +1,73 @@
+package problem
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/my/repo/servers/gateway/logging"
+)
+
+func TestWrite(t *testing.T) {
+	r := httptest.NewRequest("POST", "/v1/users?x=1", nil)
+	r.Header.Set(requestIDHeader, "abc")
+	rr := httptest.NewRecorder()
+	rr.Header().Set("Content-Length", "100")
+	p := New(http.StatusUnprocessableEntity, CodeValidationFailed, "Invalid Email Address")
+	p.Errors = []FieldError{{Field: "email", Code: "invalid", Message: "Invalid Email Address"}}
+	Write(rr, r, p)
+
+	if rr.Code != http.StatusUnprocessableEntity || rr.Header().Get("Content-Type") != ContentType {
+		t.Fatalf("unexpected response %d %v", rr.Code, rr.Header())
+	}
+	if len(rr.Header().Get("Content-Length")) != 0 {
+		t.Errorf("expected the length of the replaced response to be removed")
+	}
+	written := map[string]interface{}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &written); err != nil {
+		t.Fatalf("error decoding problem: %v", err)
+	}
+	expected := map[string]interface{}{
+		"type": "urn:problem:gateway:validation_failed", "title": "Unprocessable Entity", "status": 422.0,
+		"detail": "Invalid Email Address", "instance": "/v1/users", "code": "validation_failed", "requestId": "abc",
+	}
+	for member, value := range expected {
+		if written[member] != value {
+			t.Errorf("expected %s %v but got %v", member, value, written[member])
+		}
+	}
+	if errs, _ := written["errors"].([]interface{}); len(errs) != 1 {
+		t.Errorf("expected the field errors but got %v", written["errors"])
+	}
+}
+
+func TestWriteExtended(t *testing.T) {
+	body := &struct {
+		*Problem
+		Upstream string `json:"upstream"`
+	}{New(http.StatusBadGateway, CodeUpstreamUnreachable, "upstream could not be reached"), "dashboards"}
+	rr := httptest.NewRecorder()
+	WriteExtended(rr, httptest.NewRequest("GET", "/v1/data", nil), body.Problem, body)
+	if s := rr.Body.String(); !strings.Contains(s, `"upstream":"dashboards"`) || !strings.Contains(s, `"instance":"/v1/data"`) {
+		t.Errorf("expected the problem with its extension but got %s", s)
+	}
+}
+
+func TestInternal(t *testing.T) {
+	buf := &bytes.Buffer{}
+	r := httptest.NewRequest("GET", "/v1/users/me", nil)
+	r = r.WithContext(logging.NewContext(r.Context(), logging.New(buf)))
+	rr := httptest.NewRecorder()
+	Internal(rr, r, errors.New("dial tcp 10.0.0.3:3306: connection refused"))
+	if rr.Code != http.StatusInternalServerError || !strings.Contains(rr.Body.String(), CodeInternal) {
+		t.Errorf("unexpected response %d %s", rr.Code, rr.Body.String())
+	}
+	//the details are logged, not sent
+	if strings.Contains(rr.Body.String(), "10.0.0.3") || !strings.Contains(buf.String(), "10.0.0.3") {
+		t.Errorf("expected the error to be logged only, but sent %s and logged %s", rr.Body.String(), buf.String())
+	}
+}
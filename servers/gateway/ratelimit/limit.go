@@ -0,0 +1,79 @@
+//Package ratelimit limits how often clients can make requests with token
+//buckets, kept in memory or in redis so that every gateway instance
+//draws on the same budget.
+package ratelimit
+
+import (
+	"math"
+	"time"
+)
+
+//Limit is a token bucket: each request takes a token, and tokens are
+//put back at Rate per second up to Burst, the most the bucket holds
+type Limit struct {
+	//Rate is the number of tokens added each second
+	Rate float64
+	//Burst is the number of tokens the bucket holds when full
+	Burst int
+}
+
+//PerDuration returns a Limit allowing `requests` requests each `per` on
+//average, in bursts of up to `burst`; `burst` is `requests` if zero
+func PerDuration(requests int, per time.Duration, burst int) Limit {
+	if burst <= 0 {
+		burst = requests
+	}
+	return Limit{Rate: float64(requests) / per.Seconds(), Burst: burst}
+}
+
+//Result is the outcome of taking a token from a bucket
+type Result struct {
+	//Allowed is true if a token was taken, and the request may go ahead
+	Allowed bool
+	//Limit is the number of tokens the bucket holds when full
+	Limit int
+	//Remaining is the number of whole tokens left in the bucket
+	Remaining int
+	//Reset is how long until the bucket is full again
+	Reset time.Duration
+	//RetryAfter is how long until a token is available, if none was
+	RetryAfter time.Duration
+}
+
+//Backend keeps the token buckets
+type Backend interface {
+	//Take takes a token from the bucket with the key, creating
+	//it full if it does not exist, and reports the outcome
+	Take(key string, limit Limit) (*Result, error)
+}
+
+//refill returns the tokens in a bucket that held `tokens` `elapsed` ago,
+//less the one taken if there was one to take
+func refill(tokens float64, elapsed time.Duration, limit Limit) (float64, bool) {
+	if elapsed > 0 {
+		tokens = math.Min(float64(limit.Burst), tokens+elapsed.Seconds()*limit.Rate)
+	}
+	if tokens >= 1 {
+		return tokens - 1, true
+	}
+	return tokens, false
+}
+
+//newResult describes a bucket left holding `tokens`
+func newResult(limit Limit, tokens float64, allowed bool) *Result {
+	result := &Result{
+		Allowed:   allowed,
+		Limit:     limit.Burst,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     seconds((float64(limit.Burst) - tokens) / limit.Rate),
+	}
+	if !allowed {
+		result.RetryAfter = seconds((1 - tokens) / limit.Rate)
+	}
+	return result
+}
+
+//seconds converts a number of seconds to a Duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+//bucket is a token bucket held in memory
+type bucket struct {
+	tokens  float64
+	updated time.Time
+	limit   Limit
+}
+
+//MemoryBackend keeps token buckets in memory, so each gateway
+//instance has its own budget. It is meant for tests and for
+//running a single instance.
+type MemoryBackend struct {
+	//Now returns the current time; time.Now if nil
+	Now func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+//NewMemoryBackend constructs a new MemoryBackend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{buckets: map[string]*bucket{}}
+}
+
+//Take takes a token from the bucket with the key
+func (mb *MemoryBackend) Take(key string, limit Limit) (*Result, error) {
+	now := time.Now()
+	if mb.Now != nil {
+		now = mb.Now()
+	}
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.sweep(now)
+	b, found := mb.buckets[key]
+	if !found {
+		b = &bucket{tokens: float64(limit.Burst), updated: now}
+		mb.buckets[key] = b
+	}
+	tokens, allowed := refill(b.tokens, now.Sub(b.updated), limit)
+	b.tokens, b.updated, b.limit = tokens, now, limit
+	return newResult(limit, tokens, allowed), nil
+}
+
+//sweep forgets the buckets that have filled up again, which are no
+//different from ones that were never used, once a minute; the caller holds mb.mu
+func (mb *MemoryBackend) sweep(now time.Time) {
+	if now.Sub(mb.lastSweep) < time.Minute {
+		return
+	}
+	mb.lastSweep = now
+	for key, b := range mb.buckets {
+		if tokens, _ := refill(b.tokens, now.Sub(b.updated), b.limit); tokens+1 >= float64(b.limit.Burst) {
+			delete(mb.buckets, key)
+		}
+	}
+}
+
+//Len returns the number of buckets held
+func (mb *MemoryBackend) Len() int {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return len(mb.buckets)
+}
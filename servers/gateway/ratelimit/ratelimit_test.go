@@ -0,0 +1,174 @@
+package ratelimit
+
+import (
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/my/repo/servers/gateway/redistest"
+)
+
+//takeStandIn does what TakeScript does, for the redis stand-in that cannot run Lua
+func takeStandIn(call func(args ...string) interface{}, keys []string, args []string) interface{} {
+	rate, _ := strconv.ParseFloat(args[0], 64)
+	burst, _ := strconv.Atoi(args[1])
+	now, _ := strconv.ParseInt(args[2], 10, 64)
+	state := call("hmget", keys[0], "tokens", "ts").([]interface{})
+	tokens, ts := float64(burst), now
+	if state[0] != nil && state[1] != nil {
+		tokens, _ = strconv.ParseFloat(state[0].(string), 64)
+		ts, _ = strconv.ParseInt(state[1].(string), 10, 64)
+	}
+	limit := Limit{Rate: rate * 1000, Burst: burst}
+	tokens, allowed := refill(tokens, time.Duration(now-ts)*time.Millisecond, limit)
+	remaining := strconv.FormatFloat(tokens, 'g', -1, 64)
+	call("hset", keys[0], "tokens", remaining, "ts", strconv.FormatInt(now, 10))
+	call("pexpire", keys[0], strconv.FormatInt(int64((float64(burst)-tokens)/rate)+1000, 10))
+	if allowed {
+		return []interface{}{int64(1), remaining}
+	}
+	return []interface{}{int64(0), remaining}
+}
+
+func TestMemoryBackend(t *testing.T) {
+	now := time.Now()
+	mb := NewMemoryBackend()
+	mb.Now = func() time.Time { return now }
+	limit := PerDuration(2, time.Second, 3)
+
+	for i := 0; i < 3; i++ {
+		result, _ := mb.Take("a", limit)
+		if !result.Allowed || result.Remaining != 2-i || result.Limit != 3 {
+			t.Errorf("request %d in the burst: unexpected result %+v", i, result)
+		}
+	}
+	result, _ := mb.Take("a", limit)
+	if result.Allowed || result.RetryAfter != 500*time.Millisecond || result.Reset != 1500*time.Millisecond {
+		t.Errorf("request after the burst: unexpected result %+v", result)
+	}
+	if result, _ := mb.Take("b", limit); !result.Allowed {
+		t.Error("buckets with other keys are not independent")
+	}
+
+	//tokens are put back at the rate
+	now = now.Add(500 * time.Millisecond)
+	if result, _ := mb.Take("a", limit); !result.Allowed || result.Remaining != 0 {
+		t.Errorf("expected a token back after 500ms but got %+v", result)
+	}
+	if result, _ := mb.Take("a", limit); result.Allowed {
+		t.Errorf("expected a single token back after 500ms but got %+v", result)
+	}
+
+	//full buckets are forgotten
+	now = now.Add(time.Hour)
+	mb.Take("c", limit)
+	if mb.Len() != 1 {
+		t.Errorf("expected only the bucket just used to be kept but %d are", mb.Len())
+	}
+}
+
+func TestRedisBackend(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	server.RegisterScript(TakeScript, takeStandIn)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+
+	//two gateway instances share the budget
+	instances := []*RedisBackend{NewRedisBackend(client, "ratelimit:"), NewRedisBackend(client, "ratelimit:")}
+	limit := PerDuration(1, time.Hour, 10)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(rb *RedisBackend) {
+			defer wg.Done()
+			result, err := rb.Take("a", limit)
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if result.Allowed {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}(instances[i%2])
+	}
+	wg.Wait()
+	if allowed != 10 {
+		t.Errorf("expected the burst of 10 shared between instances but %d requests were allowed", allowed)
+	}
+	result, _ := instances[0].Take("a", limit)
+	if result.Allowed || result.Remaining != 0 || result.RetryAfter <= 59*time.Minute {
+		t.Errorf("unexpected result once the bucket is empty %+v", result)
+	}
+	if keys := server.Keys(); len(keys) != 1 || keys[0] != "ratelimit:a" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+	if ttl := server.TTL("ratelimit:a"); ttl < 9*time.Hour || ttl > 11*time.Hour {
+		t.Errorf("expected the bucket to expire once it would be full again, in about 10h, but got %v", ttl)
+	}
+
+	//errors reach the caller, who decides whether to fail open
+	server.Close()
+	if _, err := instances[0].Take("a", limit); err == nil {
+		t.Error("expected error with redis down")
+	}
+}
+
+//TestTakeScript runs TakeScript on a real redis, at REDISADDR or the default port,
+//checking it agrees with takeStandIn, which the other tests run in its place
+func TestTakeScript(t *testing.T) {
+	redisaddr := os.Getenv("REDISADDR")
+	if len(redisaddr) == 0 {
+		redisaddr = "127.0.0.1:6379"
+	}
+	client := redis.NewClient(&redis.Options{Addr: redisaddr})
+	defer client.Close()
+	if err := client.Eval("return 1", nil).Err(); err != nil {
+		t.Skipf("no redis running scripts at %s: %v", redisaddr, err)
+	}
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	server.RegisterScript(TakeScript, takeStandIn)
+	standIn := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer standIn.Close()
+
+	key := "ratelimit:test:takescript"
+	client.Del(key)
+	defer client.Del(key)
+	//2 tokens a second with a burst of 3, at times in milliseconds
+	rate, burst, start := "0.002", 3, time.Now().UnixNano()/int64(time.Millisecond)
+	for i, at := range []int64{0, 0, 0, 0, 499, 500, 500, 1250, 60000, 60000} {
+		var replies [2][]interface{}
+		for j, c := range []*redis.Client{client, standIn} {
+			reply, err := takeScript.Run(c, []string{key}, rate, burst, start+at).Result()
+			if err != nil {
+				t.Fatalf("take %d: unexpected error: %v", i, err)
+			}
+			replies[j] = reply.([]interface{})
+		}
+		script, stood := replies[0], replies[1]
+		scriptTokens, _ := strconv.ParseFloat(script[1].(string), 64)
+		standInTokens, _ := strconv.ParseFloat(stood[1].(string), 64)
+		if script[0] != stood[0] || math.Abs(scriptTokens-standInTokens) > 1e-9 {
+			t.Errorf("take %d at %dms: script returned %v but the stand-in %v", i, at, script, stood)
+		}
+		scriptTTL, standInTTL := client.PTTL(key).Val(), standIn.PTTL(key).Val()
+		if diff := scriptTTL - standInTTL; diff < -time.Second || diff > time.Second {
+			t.Errorf("take %d at %dms: script expires the bucket in %v but the stand-in in %v", i, at, scriptTTL, standInTTL)
+		}
+	}
+}
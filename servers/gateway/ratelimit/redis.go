@@ -0,0 +1,78 @@
+package ratelimit
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+//TakeScript atomically takes a token from the bucket hash at KEYS[1], holding
+//its tokens and the unix time in milliseconds they were counted at. ARGV is the
+//rate in tokens per millisecond, the burst, and the current unix time in
+//milliseconds. It returns whether a token was taken and the tokens left. Buckets
+//expire once they would be full again, since a missing bucket counts as full.
+const TakeScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+if now > ts then
+	tokens = math.min(burst, tokens + (now - ts) * rate)
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - tokens) / rate) + 1000)
+return {allowed, tostring(tokens)}
+`
+
+//takeScript is TakeScript, run by its SHA1 digest once redis has it cached
+var takeScript = redis.NewScript(TakeScript)
+
+//RedisBackend keeps token buckets in redis, so every gateway instance
+//shares the same budget. Buckets are updated by TakeScript, which redis
+//runs atomically. The current time comes from the gateway instances, so
+//their clocks should agree to well within the shortest time it takes a
+//bucket to get back a token.
+type RedisBackend struct {
+	Client *redis.Client
+	//Prefix is added to the key of each bucket
+	Prefix string
+}
+
+//NewRedisBackend constructs a new RedisBackend, keeping buckets under the prefix
+func NewRedisBackend(client *redis.Client, prefix string) *RedisBackend {
+	return &RedisBackend{Client: client, Prefix: prefix}
+}
+
+//Take takes a token from the bucket with the key
+func (rb *RedisBackend) Take(key string, limit Limit) (*Result, error) {
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	reply, err := takeScript.Run(rb.Client, []string{rb.Prefix + key},
+		strconv.FormatFloat(limit.Rate/1000, 'g', -1, 64), limit.Burst, now).Result()
+	if err != nil {
+		return nil, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return nil, fmt.Errorf("unexpected reply from rate limit script: %v", reply)
+	}
+	allowed, _ := values[0].(int64)
+	remaining, _ := values[1].(string)
+	tokens, err := strconv.ParseFloat(remaining, 64)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected reply from rate limit script: %v", reply)
+	}
+	return newResult(limit, tokens, allowed == 1), nil
+}
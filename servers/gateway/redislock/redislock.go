@@ -0,0 +1,39 @@
+//Package redislock holds locks in redis that every gateway instance respects,
+//each taken with a random token so that only its holder releases it.
+package redislock
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+//ReleaseScript deletes the lock at KEYS[1] if it still holds the token ARGV[1],
+//in one step, so a lock that expired and was taken by another holder in the
+//meantime is left alone
+const ReleaseScript = `if redis.call('get',KEYS[1])==ARGV[1] then return redis.call('del',KEYS[1]) end return 0`
+
+//releaseScript is ReleaseScript, run by its SHA1 digest once redis has it cached
+var releaseScript = redis.NewScript(ReleaseScript)
+
+//NewToken returns a random token identifying the holder of a lock
+func NewToken() (string, error) {
+	randBytes := make([]byte, 16)
+	if _, err := rand.Read(randBytes); err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(randBytes), nil
+}
+
+//TryAcquire takes the lock at `key` with the token for up to the ttl,
+//reporting false if another holder has it
+func TryAcquire(client *redis.Client, key string, token string, ttl time.Duration) (bool, error) {
+	return client.SetNX(key, token, ttl).Result()
+}
+
+//Release releases the lock at `key` if it is still held with the token
+func Release(client *redis.Client, key string, token string) error {
+	return releaseScript.Run(client, []string{key}, token).Err()
+}
@@ -0,0 +1,1054 @@
+// Package redistest provides a small in-process stand-in for a redis server.
+// It speaks enough of the RESP protocol for the gateway's tests to exercise
+// stores and middleware that are backed by redis without needing a real
+// redis server, and it can be stopped and restarted on the same address to
+// simulate outages.
+package redistest
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/my/repo/servers/gateway/redislock"
+)
+
+// entry is a single value held by the server
+type entry struct {
+	str     string
+	set     map[string]bool
+	zset    map[string]float64
+	hash    map[string]string
+	expires time.Time
+}
+
+// Server is a minimal redis server listening on a local TCP port
+type Server struct {
+	mu      sync.Mutex
+	addr    string
+	ln      net.Listener
+	data    map[string]*entry
+	conns   map[*conn]bool
+	subs    map[string]map[*conn]bool
+	hang    bool
+	running bool
+	wg      sync.WaitGroup
+	scripts map[string]Script
+}
+
+// conn is a single client connection
+type conn struct {
+	nc       net.Conn
+	w        *bufio.Writer
+	wmu      sync.Mutex
+	channels map[string]bool
+	multi    [][]string
+	inMulti  bool
+}
+
+// NewServer starts a new Server listening on a random local port
+func NewServer() (*Server, error) {
+	s := &Server{
+		data:    map[string]*entry{},
+		conns:   map[*conn]bool{},
+		subs:    map[string]map[*conn]bool{},
+		scripts: map[string]Script{},
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s.addr = ln.Addr().String()
+	// every lock the gateway takes is released with the same script
+	s.scripts[scriptSHA(redislock.ReleaseScript)] = releaseStandIn
+	s.serve(ln)
+	return s, nil
+}
+
+// releaseStandIn does what redislock.ReleaseScript does
+func releaseStandIn(call func(args ...string) interface{}, keys []string, args []string) interface{} {
+	if held, ok := call("get", keys[0]).(string); ok && held == args[0] {
+		return call("del", keys[0])
+	}
+	return int64(0)
+}
+
+// Script is a Go stand-in for a Lua script, since the server cannot run Lua.
+// EVAL and EVALSHA run it atomically, as redis runs scripts, with `call`
+// running redis commands the way redis.call does.
+type Script func(call func(args ...string) interface{}, keys []string, args []string) interface{}
+
+// RegisterScript makes EVAL of the Lua source `src`, or EVALSHA of its
+// SHA1 digest, run `script` instead
+func (s *Server) RegisterScript(src string, script Script) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[scriptSHA(src)] = script
+}
+
+// Addr returns the address the server listens on
+func (s *Server) Addr() string {
+	return s.addr
+}
+
+// Close stops the server and drops every open connection.
+// Stored data is kept so a later Restart behaves like a redis
+// instance coming back after a network partition.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if !s.running {
+		s.mu.Unlock()
+		return
+	}
+	s.running = false
+	s.ln.Close()
+	for c := range s.conns {
+		c.nc.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Restart starts listening again on the same address after Close
+func (s *Server) Restart() error {
+	var ln net.Listener
+	var err error
+	// the port may take a moment to become available again
+	for i := 0; i < 50; i++ {
+		ln, err = net.Listen("tcp", s.addr)
+		if err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		return err
+	}
+	s.serve(ln)
+	return nil
+}
+
+// SetHang makes the server stop answering commands (while still
+// accepting connections) when true, simulating a hung redis
+func (s *Server) SetHang(hang bool) {
+	s.mu.Lock()
+	s.hang = hang
+	s.mu.Unlock()
+}
+
+// FlushAll removes every key from the server
+func (s *Server) FlushAll() {
+	s.mu.Lock()
+	s.data = map[string]*entry{}
+	s.mu.Unlock()
+}
+
+// Keys returns all live keys, sorted
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []string{}
+	for k := range s.data {
+		if s.lookup(k) != nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Get returns the string value stored at `key`
+func (s *Server) Get(key string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.lookup(key)
+	if e == nil {
+		return "", false
+	}
+	return e.str, true
+}
+
+// TTL returns the remaining time to live of `key`,
+// or zero if the key does not exist or has no expiry
+func (s *Server) TTL(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.lookup(key)
+	if e == nil || e.expires.IsZero() {
+		return 0
+	}
+	return time.Until(e.expires)
+}
+
+func (s *Server) serve(ln net.Listener) {
+	s.mu.Lock()
+	s.ln = ln
+	s.running = true
+	s.mu.Unlock()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			nc, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c := &conn{nc: nc, w: bufio.NewWriter(nc), channels: map[string]bool{}}
+			s.mu.Lock()
+			s.conns[c] = true
+			s.mu.Unlock()
+			s.wg.Add(1)
+			go s.handle(c)
+		}
+	}()
+}
+
+func (s *Server) handle(c *conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		for ch := range c.channels {
+			delete(s.subs[ch], c)
+		}
+		s.mu.Unlock()
+		c.nc.Close()
+	}()
+	r := bufio.NewReader(c.nc)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		hang := s.hang
+		s.mu.Unlock()
+		if hang {
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		reply := s.dispatch(c, args)
+		c.wmu.Lock()
+		writeReply(c.w, reply)
+		err = c.w.Flush()
+		c.wmu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// status is a RESP simple string reply
+type status string
+
+// replyError is a RESP error reply
+type replyError string
+
+var ok = status("OK")
+
+func errWrongArgs(cmd string) replyError {
+	return replyError("ERR wrong number of arguments for '" + cmd + "' command")
+}
+
+const errWrongType = replyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+func (s *Server) dispatch(c *conn, args []string) interface{} {
+	cmd := strings.ToLower(args[0])
+	if c.inMulti && cmd != "exec" && cmd != "discard" && cmd != "multi" {
+		c.multi = append(c.multi, args)
+		return status("QUEUED")
+	}
+	switch cmd {
+	case "multi":
+		c.inMulti = true
+		c.multi = nil
+		return ok
+	case "discard":
+		c.inMulti = false
+		c.multi = nil
+		return ok
+	case "exec":
+		c.inMulti = false
+		replies := []interface{}{}
+		for _, queued := range c.multi {
+			replies = append(replies, s.dispatch(c, queued))
+		}
+		c.multi = nil
+		return replies
+	case "subscribe", "psubscribe":
+		return s.subscribe(c, args[1:])
+	case "unsubscribe", "punsubscribe":
+		return s.unsubscribe(c, args[1:])
+	case "ping":
+		if len(c.channels) > 0 {
+			payload := ""
+			if len(args) > 1 {
+				payload = args[1]
+			}
+			return []interface{}{"pong", payload}
+		}
+		if len(args) > 1 {
+			return args[1]
+		}
+		return status("PONG")
+	case "publish":
+		if len(args) != 3 {
+			return errWrongArgs(cmd)
+		}
+		return s.publish(args[1], args[2])
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch cmd {
+	case "eval", "evalsha":
+		return s.eval(cmd, args[1:])
+	case "script":
+		return s.scriptCommand(args[1:])
+	}
+	return s.command(cmd, args[1:])
+}
+
+// eval runs a registered script; the caller holds s.mu
+func (s *Server) eval(cmd string, args []string) interface{} {
+	if len(args) < 2 {
+		return errWrongArgs(cmd)
+	}
+	sha := args[0]
+	if cmd == "eval" {
+		sha = scriptSHA(args[0])
+	}
+	script, found := s.scripts[strings.ToLower(sha)]
+	if !found {
+		if cmd == "eval" {
+			return replyError("ERR redistest cannot run Lua; register a stand-in with RegisterScript")
+		}
+		return replyError("NOSCRIPT No matching script. Please use EVAL.")
+	}
+	numKeys, err := strconv.Atoi(args[1])
+	if err != nil || numKeys < 0 || numKeys > len(args)-2 {
+		return replyError("ERR Number of keys can't be greater than number of args")
+	}
+	call := func(callArgs ...string) interface{} {
+		return s.command(strings.ToLower(callArgs[0]), callArgs[1:])
+	}
+	return script(call, args[2:2+numKeys], args[2+numKeys:])
+}
+
+// scriptCommand answers SCRIPT LOAD and SCRIPT EXISTS; the caller holds s.mu
+func (s *Server) scriptCommand(args []string) interface{} {
+	if len(args) < 1 {
+		return errWrongArgs("script")
+	}
+	switch strings.ToLower(args[0]) {
+	case "load":
+		if len(args) != 2 {
+			return errWrongArgs("script|load")
+		}
+		sha := scriptSHA(args[1])
+		if _, found := s.scripts[sha]; !found {
+			return replyError("ERR redistest cannot run Lua; register a stand-in with RegisterScript")
+		}
+		return sha
+	case "exists":
+		exists := []interface{}{}
+		for _, sha := range args[1:] {
+			if _, found := s.scripts[strings.ToLower(sha)]; found {
+				exists = append(exists, int64(1))
+			} else {
+				exists = append(exists, int64(0))
+			}
+		}
+		return exists
+	}
+	return replyError("ERR unknown SCRIPT subcommand")
+}
+
+// scriptSHA returns the hex SHA1 digest scripts are known by
+func scriptSHA(src string) string {
+	sum := sha1.Sum([]byte(src))
+	return hex.EncodeToString(sum[:])
+}
+
+// command runs a data command; the caller holds s.mu
+func (s *Server) command(cmd string, args []string) interface{} {
+	switch cmd {
+	case "echo":
+		if len(args) != 1 {
+			return errWrongArgs(cmd)
+		}
+		return args[0]
+	case "select", "quit":
+		return ok
+	case "flushall", "flushdb":
+		s.data = map[string]*entry{}
+		return ok
+	case "get":
+		if len(args) != 1 {
+			return errWrongArgs(cmd)
+		}
+		e := s.lookup(args[0])
+		if e == nil {
+			return nil
+		}
+		if e.set != nil || e.zset != nil || e.hash != nil {
+			return errWrongType
+		}
+		return e.str
+	case "mget":
+		values := []interface{}{}
+		for _, k := range args {
+			if e := s.lookup(k); e != nil && e.set == nil && e.zset == nil && e.hash == nil {
+				values = append(values, e.str)
+			} else {
+				values = append(values, nil)
+			}
+		}
+		return values
+	case "set":
+		return s.set(args)
+	case "setnx":
+		if len(args) != 2 {
+			return errWrongArgs(cmd)
+		}
+		if s.lookup(args[0]) != nil {
+			return int64(0)
+		}
+		s.data[args[0]] = &entry{str: args[1]}
+		return int64(1)
+	case "del", "unlink":
+		var n int64
+		for _, k := range args {
+			if s.lookup(k) != nil {
+				delete(s.data, k)
+				n++
+			}
+		}
+		return n
+	case "exists":
+		var n int64
+		for _, k := range args {
+			if s.lookup(k) != nil {
+				n++
+			}
+		}
+		return n
+	case "keys":
+		if len(args) != 1 {
+			return errWrongArgs(cmd)
+		}
+		keys := []interface{}{}
+		for k := range s.data {
+			if matched, _ := path.Match(args[0], k); matched && s.lookup(k) != nil {
+				keys = append(keys, k)
+			}
+		}
+		return keys
+	case "scan":
+		// every key is returned in one pass, with the cursor that ends the scan
+		if len(args) < 1 || len(args)%2 != 1 {
+			return errWrongArgs(cmd)
+		}
+		pattern := "*"
+		for i := 1; i < len(args); i += 2 {
+			if strings.ToLower(args[i]) == "match" {
+				pattern = args[i+1]
+			}
+		}
+		keys := []interface{}{}
+		for k := range s.data {
+			if matched, _ := path.Match(pattern, k); matched && s.lookup(k) != nil {
+				keys = append(keys, k)
+			}
+		}
+		return []interface{}{"0", keys}
+	case "expire", "pexpire":
+		if len(args) != 2 {
+			return errWrongArgs(cmd)
+		}
+		n, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return replyError("ERR value is not an integer or out of range")
+		}
+		e := s.lookup(args[0])
+		if e == nil {
+			return int64(0)
+		}
+		unit := time.Second
+		if cmd == "pexpire" {
+			unit = time.Millisecond
+		}
+		e.expires = time.Now().Add(time.Duration(n) * unit)
+		return int64(1)
+	case "persist":
+		if len(args) != 1 {
+			return errWrongArgs(cmd)
+		}
+		e := s.lookup(args[0])
+		if e == nil || e.expires.IsZero() {
+			return int64(0)
+		}
+		e.expires = time.Time{}
+		return int64(1)
+	case "ttl", "pttl":
+		if len(args) != 1 {
+			return errWrongArgs(cmd)
+		}
+		e := s.lookup(args[0])
+		if e == nil {
+			return int64(-2)
+		}
+		if e.expires.IsZero() {
+			return int64(-1)
+		}
+		if cmd == "pttl" {
+			return int64(time.Until(e.expires) / time.Millisecond)
+		}
+		return int64(time.Until(e.expires) / time.Second)
+	case "incr", "incrby", "decr", "decrby":
+		delta := int64(1)
+		if cmd == "incrby" || cmd == "decrby" {
+			if len(args) != 2 {
+				return errWrongArgs(cmd)
+			}
+			d, err := strconv.ParseInt(args[1], 10, 64)
+			if err != nil {
+				return replyError("ERR value is not an integer or out of range")
+			}
+			delta = d
+		} else if len(args) != 1 {
+			return errWrongArgs(cmd)
+		}
+		if strings.HasPrefix(cmd, "decr") {
+			delta = -delta
+		}
+		e := s.lookup(args[0])
+		if e == nil {
+			e = &entry{str: "0"}
+			s.data[args[0]] = e
+		}
+		n, err := strconv.ParseInt(e.str, 10, 64)
+		if err != nil {
+			return replyError("ERR value is not an integer or out of range")
+		}
+		n += delta
+		e.str = strconv.FormatInt(n, 10)
+		return n
+	case "sadd", "srem", "smembers", "scard", "sismember":
+		return s.setCommand(cmd, args)
+	case "zadd", "zrem", "zrange", "zcard", "zscore", "zrangebyscore", "zremrangebyscore":
+		return s.zsetCommand(cmd, args)
+	case "hset", "hget", "hmget", "hgetall", "hdel":
+		return s.hashCommand(cmd, args)
+	}
+	return replyError("ERR unknown command '" + cmd + "'")
+}
+
+func (s *Server) set(args []string) interface{} {
+	if len(args) < 2 {
+		return errWrongArgs("set")
+	}
+	var expires time.Time
+	nx, xx := false, false
+	for i := 2; i < len(args); i++ {
+		switch strings.ToLower(args[i]) {
+		case "ex", "px":
+			if i+1 >= len(args) {
+				return replyError("ERR syntax error")
+			}
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return replyError("ERR value is not an integer or out of range")
+			}
+			unit := time.Second
+			if strings.ToLower(args[i]) == "px" {
+				unit = time.Millisecond
+			}
+			expires = time.Now().Add(time.Duration(n) * unit)
+			i++
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		default:
+			return replyError("ERR syntax error")
+		}
+	}
+	exists := s.lookup(args[0]) != nil
+	if (nx && exists) || (xx && !exists) {
+		return nil
+	}
+	s.data[args[0]] = &entry{str: args[1], expires: expires}
+	return ok
+}
+
+func (s *Server) setCommand(cmd string, args []string) interface{} {
+	if len(args) < 1 {
+		return errWrongArgs(cmd)
+	}
+	e := s.lookup(args[0])
+	if e != nil && e.set == nil {
+		return errWrongType
+	}
+	switch cmd {
+	case "sadd":
+		if e == nil {
+			e = &entry{set: map[string]bool{}}
+			s.data[args[0]] = e
+		}
+		var n int64
+		for _, m := range args[1:] {
+			if !e.set[m] {
+				e.set[m] = true
+				n++
+			}
+		}
+		return n
+	case "srem":
+		var n int64
+		if e != nil {
+			for _, m := range args[1:] {
+				if e.set[m] {
+					delete(e.set, m)
+					n++
+				}
+			}
+			if len(e.set) == 0 {
+				delete(s.data, args[0])
+			}
+		}
+		return n
+	case "smembers":
+		members := []interface{}{}
+		if e != nil {
+			sorted := []string{}
+			for m := range e.set {
+				sorted = append(sorted, m)
+			}
+			sort.Strings(sorted)
+			for _, m := range sorted {
+				members = append(members, m)
+			}
+		}
+		return members
+	case "scard":
+		if e == nil {
+			return int64(0)
+		}
+		return int64(len(e.set))
+	default: // sismember
+		if len(args) != 2 {
+			return errWrongArgs(cmd)
+		}
+		if e != nil && e.set[args[1]] {
+			return int64(1)
+		}
+		return int64(0)
+	}
+}
+
+func (s *Server) zsetCommand(cmd string, args []string) interface{} {
+	if len(args) < 1 {
+		return errWrongArgs(cmd)
+	}
+	e := s.lookup(args[0])
+	if e != nil && e.zset == nil {
+		return errWrongType
+	}
+	switch cmd {
+	case "zadd":
+		key := args[0]
+		var nx, xx bool
+		for len(args) > 1 {
+			if flag := strings.ToLower(args[1]); flag == "nx" {
+				nx = true
+			} else if flag == "xx" {
+				xx = true
+			} else {
+				break
+			}
+			args = args[1:]
+		}
+		if len(args) < 3 || len(args)%2 != 1 {
+			return errWrongArgs(cmd)
+		}
+		if e == nil {
+			e = &entry{zset: map[string]float64{}}
+			s.data[key] = e
+		}
+		var n int64
+		for i := 1; i < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				return replyError("ERR value is not a valid float")
+			}
+			_, found := e.zset[args[i+1]]
+			if found && nx || !found && xx {
+				continue
+			}
+			if !found {
+				n++
+			}
+			e.zset[args[i+1]] = score
+		}
+		if len(e.zset) == 0 {
+			delete(s.data, key)
+		}
+		return n
+	case "zrem":
+		var n int64
+		if e != nil {
+			for _, m := range args[1:] {
+				if _, found := e.zset[m]; found {
+					delete(e.zset, m)
+					n++
+				}
+			}
+			if len(e.zset) == 0 {
+				delete(s.data, args[0])
+			}
+		}
+		return n
+	case "zcard":
+		if e == nil {
+			return int64(0)
+		}
+		return int64(len(e.zset))
+	case "zscore":
+		if len(args) != 2 {
+			return errWrongArgs(cmd)
+		}
+		if e == nil {
+			return nil
+		}
+		score, found := e.zset[args[1]]
+		if !found {
+			return nil
+		}
+		return strconv.FormatFloat(score, 'f', -1, 64)
+	case "zrangebyscore", "zremrangebyscore":
+		if len(args) < 3 {
+			return errWrongArgs(cmd)
+		}
+		min, errMin := parseScore(args[1])
+		max, errMax := parseScore(args[2])
+		if errMin != nil || errMax != nil {
+			return replyError("ERR min or max is not a float")
+		}
+		members := []string{}
+		if e != nil {
+			for m, score := range e.zset {
+				if score >= min && score <= max {
+					members = append(members, m)
+				}
+			}
+		}
+		sort.Strings(members)
+		if cmd == "zremrangebyscore" {
+			for _, m := range members {
+				delete(e.zset, m)
+			}
+			if e != nil && len(e.zset) == 0 {
+				delete(s.data, args[0])
+			}
+			return int64(len(members))
+		}
+		withScores := len(args) > 3 && strings.ToLower(args[3]) == "withscores"
+		result := []interface{}{}
+		for _, m := range members {
+			result = append(result, m)
+			if withScores {
+				result = append(result, strconv.FormatFloat(e.zset[m], 'f', -1, 64))
+			}
+		}
+		return result
+	default: // zrange
+		if len(args) < 3 {
+			return errWrongArgs(cmd)
+		}
+		withScores := len(args) > 3 && strings.ToLower(args[3]) == "withscores"
+		members := []string{}
+		if e != nil {
+			for m := range e.zset {
+				members = append(members, m)
+			}
+		}
+		sort.Slice(members, func(i, j int) bool {
+			if e.zset[members[i]] == e.zset[members[j]] {
+				return members[i] < members[j]
+			}
+			return e.zset[members[i]] < e.zset[members[j]]
+		})
+		start, _ := strconv.Atoi(args[1])
+		stop, _ := strconv.Atoi(args[2])
+		n := len(members)
+		if start < 0 {
+			start += n
+		}
+		if stop < 0 {
+			stop += n
+		}
+		if start < 0 {
+			start = 0
+		}
+		if stop >= n {
+			stop = n - 1
+		}
+		result := []interface{}{}
+		for i := start; i <= stop; i++ {
+			result = append(result, members[i])
+			if withScores {
+				result = append(result, strconv.FormatFloat(e.zset[members[i]], 'f', -1, 64))
+			}
+		}
+		return result
+	}
+}
+
+// parseScore parses a sorted set score bound such as "1.5", "-inf" or "+inf"
+func parseScore(bound string) (float64, error) {
+	switch bound {
+	case "-inf":
+		return math.Inf(-1), nil
+	case "+inf", "inf":
+		return math.Inf(1), nil
+	}
+	return strconv.ParseFloat(strings.TrimPrefix(bound, "("), 64)
+}
+
+func (s *Server) hashCommand(cmd string, args []string) interface{} {
+	if len(args) < 1 {
+		return errWrongArgs(cmd)
+	}
+	e := s.lookup(args[0])
+	if e != nil && e.hash == nil {
+		return errWrongType
+	}
+	switch cmd {
+	case "hset":
+		if len(args) < 3 || len(args)%2 != 1 {
+			return errWrongArgs(cmd)
+		}
+		if e == nil {
+			e = &entry{hash: map[string]string{}}
+			s.data[args[0]] = e
+		}
+		var n int64
+		for i := 1; i < len(args); i += 2 {
+			if _, found := e.hash[args[i]]; !found {
+				n++
+			}
+			e.hash[args[i]] = args[i+1]
+		}
+		return n
+	case "hget":
+		if len(args) != 2 {
+			return errWrongArgs(cmd)
+		}
+		if e == nil {
+			return nil
+		}
+		v, found := e.hash[args[1]]
+		if !found {
+			return nil
+		}
+		return v
+	case "hmget":
+		if len(args) < 2 {
+			return errWrongArgs(cmd)
+		}
+		values := []interface{}{}
+		for _, f := range args[1:] {
+			if v, found := e.hashValue(f); found {
+				values = append(values, v)
+			} else {
+				values = append(values, nil)
+			}
+		}
+		return values
+	case "hdel":
+		var n int64
+		if e != nil {
+			for _, f := range args[1:] {
+				if _, found := e.hash[f]; found {
+					delete(e.hash, f)
+					n++
+				}
+			}
+			if len(e.hash) == 0 {
+				delete(s.data, args[0])
+			}
+		}
+		return n
+	default: // hgetall
+		fields := []string{}
+		if e != nil {
+			for f := range e.hash {
+				fields = append(fields, f)
+			}
+		}
+		sort.Strings(fields)
+		result := []interface{}{}
+		for _, f := range fields {
+			result = append(result, f, e.hash[f])
+		}
+		return result
+	}
+}
+
+// hashValue returns the field of a hash entry, which may be nil
+func (e *entry) hashValue(field string) (string, bool) {
+	if e == nil {
+		return "", false
+	}
+	v, found := e.hash[field]
+	return v, found
+}
+
+// lookup returns the live entry at `key`, evicting it if it
+// has expired; the caller holds s.mu
+func (s *Server) lookup(key string) *entry {
+	e, found := s.data[key]
+	if !found {
+		return nil
+	}
+	if !e.expires.IsZero() && !time.Now().Before(e.expires) {
+		delete(s.data, key)
+		return nil
+	}
+	return e
+}
+
+func (s *Server) subscribe(c *conn, channels []string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	replies := []interface{}{}
+	for _, ch := range channels {
+		c.channels[ch] = true
+		if s.subs[ch] == nil {
+			s.subs[ch] = map[*conn]bool{}
+		}
+		s.subs[ch][c] = true
+		replies = append(replies, []interface{}{"subscribe", ch, int64(len(c.channels))})
+	}
+	return multiReply(replies)
+}
+
+func (s *Server) unsubscribe(c *conn, channels []string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(channels) == 0 {
+		for ch := range c.channels {
+			channels = append(channels, ch)
+		}
+	}
+	replies := []interface{}{}
+	for _, ch := range channels {
+		delete(c.channels, ch)
+		delete(s.subs[ch], c)
+		replies = append(replies, []interface{}{"unsubscribe", ch, int64(len(c.channels))})
+	}
+	return multiReply(replies)
+}
+
+func (s *Server) publish(channel, payload string) interface{} {
+	s.mu.Lock()
+	receivers := []*conn{}
+	for c := range s.subs[channel] {
+		receivers = append(receivers, c)
+	}
+	s.mu.Unlock()
+	for _, c := range receivers {
+		c.wmu.Lock()
+		writeReply(c.w, []interface{}{"message", channel, payload})
+		c.w.Flush()
+		c.wmu.Unlock()
+	}
+	return int64(len(receivers))
+}
+
+// multiReply is a sequence of replies sent back to back, as
+// (un)subscribe does for each channel named in the command
+type multiReply []interface{}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		// inline command
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		header, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(header) == 0 || header[0] != '$' {
+			return nil, errors.New("redistest: expected bulk string")
+		}
+		size, err := strconv.Atoi(header[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case status:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case replyError:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case multiReply:
+		for _, r := range v {
+			writeReply(w, r)
+		}
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, r := range v {
+			writeReply(w, r)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+
+	"github.com/go-redis/redis"
+	"github.com/my/repo/servers/gateway/cache"
+	"github.com/my/repo/servers/gateway/metrics"
+)
+
+// newResponseCache builds the cache of the responses of cached routes selected by the environment:
+//   - CACHEBACKEND is "memory" (the default) to keep responses in each gateway instance,
+//     or "redis" to share them between instances through `client`
+//   - CACHEMAXBYTES is roughly how many bytes of responses are kept in memory; 64MiB if not set
+func newResponseCache(client *redis.Client) (*cache.Cache, error) {
+	switch os.Getenv("CACHEBACKEND") {
+	case "", "memory":
+	case "redis":
+		return cache.New(cache.NewRedisBackend(client, "cache:")), nil
+	default:
+		return nil, errors.New("CACHEBACKEND must be \"memory\" or \"redis\"")
+	}
+	maxBytes := cache.DefaultMaxBytes
+	if env := os.Getenv("CACHEMAXBYTES"); len(env) != 0 {
+		n, err := strconv.Atoi(env)
+		if err != nil || n <= 0 {
+			return nil, errors.New("CACHEMAXBYTES must be a positive number of bytes")
+		}
+		maxBytes = n
+	}
+	backend := cache.NewMemoryBackend(maxBytes)
+	metrics.Default.NewGaugeFunc("gateway_cache_bytes", "Bytes of responses held in the in-memory cache.", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(backend.Bytes())}}
+	})
+	metrics.Default.NewGaugeFunc("gateway_cache_entries", "Responses held in the in-memory cache.", nil, func() []metrics.Sample {
+		return []metrics.Sample{{Value: float64(backend.Len())}}
+	})
+	return cache.New(backend), nil
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/my/repo/servers/gateway/cache"
+	"github.com/my/repo/servers/gateway/handlers"
+	"github.com/my/repo/servers/gateway/identity"
+	"github.com/my/repo/servers/gateway/live"
+	"github.com/my/repo/servers/gateway/openapi"
+	"github.com/my/repo/servers/gateway/routing"
+	"github.com/my/repo/servers/gateway/security"
+	"github.com/my/repo/servers/gateway/upstream"
+)
+
+// builtinTargets are the gateway's own handlers, by the names route configurations use for them
+func builtinTargets(ctx *handlers.HandlerContext, cspReports *security.Reports) map[string]http.Handler {
+	return map[string]http.Handler{
+		"users":       http.HandlerFunc(ctx.UsersHandler),
+		"user":        http.HandlerFunc(ctx.SpecificUserHandler),
+		"sessions":    http.HandlerFunc(ctx.SessionsHandler),
+		"session":     http.HandlerFunc(ctx.SpecificSessionHandler),
+		"csp-reports": http.HandlerFunc(cspReports.Collect),
+	}
+}
+
+// rate limits of the default routes: sign ups and sign ins from each address, which are
+// costly to check and attractive to abuse, and the large /v1/data payload for each user
+var (
+	signUpLimit = &routing.RateLimitConfig{Requests: 10, Per: routing.Duration(time.Hour), Burst: 5}
+	signInLimit = &routing.RateLimitConfig{Requests: 10, Per: routing.Duration(time.Minute)}
+	dataLimit   = &routing.RateLimitConfig{Requests: 30, Per: routing.Duration(time.Minute), By: routing.RateLimitByUser}
+	reportLimit = &routing.RateLimitConfig{Requests: 60, Per: routing.Duration(time.Minute)}
+	liveLimit   = &routing.RateLimitConfig{Requests: 10, Per: routing.Duration(time.Minute), By: routing.RateLimitByUser}
+)
+
+// dataCache caches the /v1/data payload, which is the same for every user and
+// rarely changes, serving it for a day while the dashboards upstream is down
+var dataCache = &routing.CacheConfig{TTL: routing.Duration(10 * time.Minute), StaleIfError: routing.Duration(24 * time.Hour)}
+
+// defaultSecurity are the security headers of the default routes, which only serve
+// JSON: nothing in a response may be loaded or run, or framed by another page, and
+// browsers are to reach the gateway only over HTTPS for a year
+var defaultSecurity = &routing.SecurityConfig{
+	HSTS:      routing.Duration(365 * 24 * time.Hour),
+	CSP:       "default-src 'none'",
+	ReportURI: "/v1/csp-reports",
+}
+
+// defaultCORS is the CORS policy of the default routes, allowing requests from the
+// comma-separated CORSORIGINS list of origins, with credentials if CORSCREDENTIALS is
+// "true". Without CORSORIGINS pages on other origins cannot use the API.
+func defaultCORS() *routing.CORSConfig {
+	origins := os.Getenv("CORSORIGINS")
+	if len(origins) == 0 {
+		return nil
+	}
+	cfg := &routing.CORSConfig{Credentials: os.Getenv("CORSCREDENTIALS") == "true"}
+	for _, origin := range strings.Split(origins, ",") {
+		cfg.Origins = append(cfg.Origins, strings.TrimSpace(origin))
+	}
+	return cfg
+}
+
+// defaultRoutes are the routes used when no route configuration file is given,
+// sending dashboard requests to the comma-separated DASHBOARDADDR list
+func defaultRoutes() *routing.Config {
+	return &routing.Config{
+		CORS:     defaultCORS(),
+		Security: defaultSecurity,
+		Upstreams: map[string]*routing.UpstreamConfig{
+			"dashboards": {Targets: strings.Split(os.Getenv("DASHBOARDADDR"), ",")},
+		},
+		Routes: []*routing.RouteConfig{
+			{Prefix: "/v1/users", Target: "users", RateLimit: signUpLimit},
+			{Prefix: "/v1/users/", Target: "user"},
+			{Prefix: "/v1/sessions", Target: "sessions", RateLimit: signInLimit},
+			{Prefix: "/v1/sessions/", Target: "session"},
+			{Prefix: "/v1/dashboards", Upstream: "dashboards"},
+			{Prefix: "/v1/data", Upstream: "dashboards", RateLimit: dataLimit, Cache: dataCache},
+			{Prefix: "/v1/csp-reports", Target: "csp-reports", Methods: []string{"POST"}, RateLimit: reportLimit},
+			{Prefix: "/v1/live", Target: "live", Methods: []string{"GET"}, RateLimit: liveLimit},
+			{Prefix: "/v1/openapi.json", Target: "openapi", Methods: []string{"GET"}},
+		},
+	}
+}
+
+// newRouter builds the router from the route configuration file named by ROUTESCONFIG,
+// reloading it on SIGHUP or when the file changes, or from the default routes if it is not set.
+// The pool of every upstream is added to the registry, and requests to upstreams
+// carry identity assertions signed by `signer`. Reports of violations of the
+// Content-Security-Policy are collected into `cspReports`, and the responses of
+// cached routes are kept in `responses`, live updates are subscribed to through `hub`,
+// and `spec` is served as the description of the API.
+func newRouter(ctx *handlers.HandlerContext, registry *upstream.Registry, signer *identity.Signer,
+	cspReports *security.Reports, responses *cache.Cache, hub *live.Hub, spec *openapi.Document) (*routing.Router, error) {
+	newUpstream := func(name string, cfg *routing.UpstreamConfig) (http.Handler, error) {
+		pool, err := newPool(name, cfg)
+		if err != nil {
+			return nil, err
+		}
+		registry.Add(pool)
+		return DashHandler(newProxy(pool, cfg), ctx, signer), nil
+	}
+	router := routing.NewRouter(builtinTargets(ctx, cspReports), newUpstream, ctx.RequireSession)
+	router.Cache = func(route *routing.RouteConfig, handler http.Handler) http.Handler {
+		return handlers.NewCache(handler, route, responses)
+	}
+	// the live updates handler checks origins against the router's own CORS policies
+	router.Builtins["live"] = handlers.NewLive(ctx, hub, router)
+	router.Builtins["openapi"] = spec
+
+	path := os.Getenv("ROUTESCONFIG")
+	if len(path) == 0 {
+		return router, router.Apply(defaultRoutes())
+	}
+	if err := router.LoadFile(path); err != nil {
+		return nil, err
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := router.Reload(); err != nil {
+				log.Printf("error reloading routes from %s: %v", path, err)
+			} else {
+				log.Printf("reloaded routes from %s", path)
+			}
+		}
+	}()
+	go router.Watch(5*time.Second, nil)
+	return router, nil
+}
+
+// newPool builds the pool of servers of an upstream, starting its health checks if configured
+func newPool(name string, cfg *routing.UpstreamConfig) (*upstream.Pool, error) {
+	strategy, err := upstream.NewStrategy(cfg.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	backends := make([]*upstream.Backend, 0, len(cfg.Targets))
+	for _, target := range cfg.Targets {
+		backends = append(backends, &upstream.Backend{Addr: target, Weight: cfg.Weights[target]})
+	}
+	pool := upstream.NewPool(name, backends, strategy)
+	if cfg.TLS != nil {
+		if pool.TLSConfig, err = newUpstreamTLS(cfg.TLS); err != nil {
+			return nil, fmt.Errorf("upstream %q: %v", name, err)
+		}
+		pool.Scheme = "https"
+	}
+	if cfg.MaxFails > 0 {
+		pool.MaxFails = cfg.MaxFails
+	}
+	if cfg.EjectFor > 0 {
+		pool.EjectFor = time.Duration(cfg.EjectFor)
+	}
+	if cfg.SlowStart > 0 {
+		pool.SlowStart = time.Duration(cfg.SlowStart)
+	}
+	if breaker := cfg.Breaker; breaker != nil {
+		pool.Breaker.Threshold = breaker.Threshold
+		pool.Breaker.Cooldown = time.Duration(breaker.Cooldown)
+	}
+	if check := cfg.HealthCheck; check != nil {
+		pool.StartHealthChecks(upstream.HealthCheck{
+			Path:               check.Path,
+			Interval:           time.Duration(check.Interval),
+			Timeout:            time.Duration(check.Timeout),
+			HealthyThreshold:   check.HealthyThreshold,
+			UnhealthyThreshold: check.UnhealthyThreshold,
+		})
+	}
+	return pool, nil
+}
+
+// newProxy builds the reverse proxy to the pool of an upstream, with its configured retries and timeouts
+func newProxy(pool *upstream.Pool, cfg *routing.UpstreamConfig) *upstream.Proxy {
+	proxy := upstream.NewProxy(pool)
+	if cfg.Retries != nil {
+		proxy.Retries = *cfg.Retries
+	}
+	if cfg.ConnectTimeout > 0 {
+		proxy.Transport.DialContext = (&net.Dialer{
+			Timeout:   time.Duration(cfg.ConnectTimeout),
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+	if cfg.ResponseTimeout > 0 {
+		proxy.Transport.ResponseHeaderTimeout = time.Duration(cfg.ResponseTimeout)
+	}
+	return proxy
+}
+
+// newUpstreamTLS builds the TLS configuration used to reach the targets of an upstream
+func newUpstreamTLS(cfg *routing.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{ServerName: cfg.ServerName, MinVersion: tls.VersionTLS12}
+	if len(cfg.CA) != 0 {
+		pem, err := ioutil.ReadFile(cfg.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.CA)
+		}
+	}
+	if len(cfg.Cert) != 0 {
+		cert, err := tls.LoadX509KeyPair(cfg.Cert, cfg.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
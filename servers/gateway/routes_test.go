@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/my/repo/servers/gateway/handlers"
+	"github.com/my/repo/servers/gateway/routing"
+	"github.com/my/repo/servers/gateway/security"
+)
+
+// TestAPISpecCoversRoutes fails when a route or method of the default configuration or of
+// routes.json is missing from the API description, or the description documents a path no route serves
+func TestAPISpecCoversRoutes(t *testing.T) {
+	spec, err := newAPISpec()
+	if err != nil {
+		t.Fatalf("error parsing the API description: %v", err)
+	}
+	os.Setenv("DASHBOARDADDR", "dashboards:80")
+	defer os.Unsetenv("DASHBOARDADDR")
+	fileRoutes, err := routing.LoadConfig("routes.json")
+	if err != nil {
+		t.Fatalf("error loading routes.json: %v", err)
+	}
+
+	for name, cfg := range map[string]*routing.Config{"default routes": defaultRoutes(), "routes.json": fileRoutes} {
+		builtins := builtinTargets(&handlers.HandlerContext{}, security.NewReports())
+		builtins["live"] = http.NotFoundHandler()
+		builtins["openapi"] = spec
+		newUpstream := func(string, *routing.UpstreamConfig) (http.Handler, error) {
+			return http.NotFoundHandler(), nil
+		}
+		router := routing.NewRouter(builtins, newUpstream, nil)
+		if err := router.Apply(cfg); err != nil {
+			t.Fatalf("%s: error applying routes: %v", name, err)
+		}
+
+		// the methods documented for the paths of each route
+		documented := map[*routing.RouteConfig]map[string]bool{}
+		for template, item := range spec.Paths {
+			// any value stands in for the parameters, as routes match paths by prefix
+			path := template
+			for strings.Contains(path, "{") {
+				path = path[:strings.Index(path, "{")] + "x" + path[strings.Index(path, "}")+1:]
+			}
+			route := router.Match(path)
+			if route == nil {
+				t.Errorf("%s: %s is documented but no route serves it", name, template)
+				continue
+			}
+			if documented[route] == nil {
+				documented[route] = map[string]bool{}
+			}
+			// a configuration may allow fewer methods than are documented
+			for method := range item.Operations() {
+				documented[route][method] = true
+			}
+		}
+		for _, route := range router.Routes() {
+			if len(documented[route]) == 0 {
+				t.Errorf("%s: route %s is missing from the API description", name, route.Prefix)
+			}
+			for _, method := range route.Methods {
+				if !documented[route][method] {
+					t.Errorf("%s: %s %s is missing from the API description", name, method, route.Prefix)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package routing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/my/repo/servers/gateway/cors"
+	"github.com/my/repo/servers/gateway/security"
+)
+
+//methods are the HTTP methods a route may allow
+var methods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true,
+	"DELETE": true, "OPTIONS": true,
+}
+
+//Config is the routing table of the gateway, as read from a route configuration file
+type Config struct {
+	//Upstreams are the pools of servers routes can forward to, by name
+	Upstreams map[string]*UpstreamConfig `json:"upstreams"`
+	//Routes map path prefixes to built-in targets or upstreams
+	Routes []*RouteConfig `json:"routes"`
+	//CORS is the policy for requests from pages on other origins, which
+	//browsers block from reading any response if it is not set
+	CORS *CORSConfig `json:"cors,omitempty"`
+	//Security is the security headers sent with every response,
+	//unless the route sets its own
+	Security *SecurityConfig `json:"security,omitempty"`
+}
+
+//SecurityConfig describes the security headers sent with responses
+type SecurityConfig struct {
+	//HSTS is how long browsers should only reach the gateway's host over HTTPS; not sent if zero
+	HSTS                  Duration `json:"hsts,omitempty"`
+	HSTSIncludeSubdomains bool     `json:"hstsIncludeSubdomains,omitempty"`
+	HSTSPreload           bool     `json:"hstsPreload,omitempty"`
+	//CSP is the Content-Security-Policy, in which "{nonce}" is replaced
+	//with a fresh nonce for each response, passed on to upstreams in the
+	//X-CSP-Nonce header
+	CSP string `json:"csp,omitempty"`
+	//CSPReportOnly only reports violations of the policy rather than blocking them
+	CSPReportOnly bool `json:"cspReportOnly,omitempty"`
+	//FrameAncestors are the sources allowed to frame pages, such as "'self'";
+	//pages may not be framed if not set
+	FrameAncestors []string `json:"frameAncestors,omitempty"`
+	//ReferrerPolicy is strict-origin-when-cross-origin if not set
+	ReferrerPolicy string `json:"referrerPolicy,omitempty"`
+	//ReportURI is where browsers send reports of violations of the policy
+	ReportURI string `json:"reportUri,omitempty"`
+}
+
+//CORSConfig describes which pages on other origins may make requests to the gateway
+type CORSConfig struct {
+	//Origins allowed to make requests: exact origins such as "https://example.com",
+	//wildcards such as "https://*.example.com" for any subdomain, or "*" for any origin
+	Origins []string `json:"origins"`
+	//Credentials lets pages send cookies with requests and read the responses;
+	//it cannot be combined with the "*" origin
+	Credentials bool `json:"credentials,omitempty"`
+	//Headers pages may send; Content-Type and Authorization if not set
+	Headers []string `json:"headers,omitempty"`
+	//ExposeHeaders pages may read besides the safelisted ones; Authorization if not set
+	ExposeHeaders []string `json:"exposeHeaders,omitempty"`
+	//MaxAge is how long browsers may cache the answers to preflight requests; 10m if not set
+	MaxAge Duration `json:"maxAge,omitempty"`
+}
+
+//RouteCORSConfig narrows the CORS policy of the gateway for one route
+type RouteCORSConfig struct {
+	//Methods pages on other origins may use; the route's methods if not set
+	Methods []string `json:"methods,omitempty"`
+	//Headers pages may send, instead of those of the gateway's policy
+	Headers []string `json:"headers,omitempty"`
+	//ExposeHeaders pages may read, instead of those of the gateway's policy
+	ExposeHeaders []string `json:"exposeHeaders,omitempty"`
+	//Disabled turns away requests from every other origin
+	Disabled bool `json:"disabled,omitempty"`
+}
+
+//UpstreamConfig describes a pool of servers
+type UpstreamConfig struct {
+	//Targets are the host:port addresses of the servers
+	Targets []string `json:"targets"`
+	//Strategy spreading requests over the targets: "round-robin"
+	//(the default), "least-outstanding" or "weighted"
+	Strategy string `json:"strategy,omitempty"`
+	//Weights of the targets for the weighted strategy; 1 if not listed
+	Weights map[string]int `json:"weights,omitempty"`
+	//HealthCheck enables active health checks of the targets
+	HealthCheck *HealthCheckConfig `json:"healthCheck,omitempty"`
+	//MaxFails is the number of failed requests in a row that ejects a target
+	MaxFails int `json:"maxFails,omitempty"`
+	//EjectFor is how long an ejected target is sent no requests
+	EjectFor Duration `json:"ejectFor,omitempty"`
+	//SlowStart is how long a target coming back into service takes
+	//to ramp up to its full share of requests
+	SlowStart Duration `json:"slowStart,omitempty"`
+	//Retries is the number of other targets a request with an idempotent method
+	//is retried on when its target cannot be reached; 2 if not set
+	Retries *int `json:"retries,omitempty"`
+	//ConnectTimeout limits how long connecting to a target may take
+	ConnectTimeout Duration `json:"connectTimeout,omitempty"`
+	//ResponseTimeout limits how long a target may take to start responding
+	ResponseTimeout Duration `json:"responseTimeout,omitempty"`
+	//Breaker configures the circuit breaker over the whole upstream
+	Breaker *BreakerConfig `json:"breaker,omitempty"`
+	//TLS makes the targets be reached over https, and optionally mutual TLS
+	TLS *TLSConfig `json:"tls,omitempty"`
+}
+
+//TLSConfig describes how the targets of an upstream are reached over TLS
+type TLSConfig struct {
+	//CA is the path of the PEM bundle the targets' certificates are
+	//verified against; the system roots are used if it is empty
+	CA string `json:"ca,omitempty"`
+	//Cert and Key are the paths of the PEM client certificate and key
+	//presented to the targets for mutual TLS
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+	//ServerName the targets' certificates are verified for, if not their host names
+	ServerName string `json:"serverName,omitempty"`
+}
+
+//BreakerConfig describes the circuit breaker of an upstream
+type BreakerConfig struct {
+	//Threshold is the number of failed requests in a row that opens the breaker;
+	//the breaker never opens if zero
+	Threshold int `json:"threshold"`
+	//Cooldown is how long the breaker stays open before a trial request is let through
+	Cooldown Duration `json:"cooldown"`
+}
+
+//HealthCheckConfig describes the active health checks of an upstream
+type HealthCheckConfig struct {
+	//Path requested from each target
+	Path string `json:"path"`
+	//Interval between checks
+	Interval Duration `json:"interval"`
+	//Timeout of each check
+	Timeout Duration `json:"timeout,omitempty"`
+	//HealthyThreshold is the number of passed checks in a row that brings a target back
+	HealthyThreshold int `json:"healthyThreshold,omitempty"`
+	//UnhealthyThreshold is the number of failed checks in a row that takes a target out
+	UnhealthyThreshold int `json:"unhealthyThreshold,omitempty"`
+}
+
+//RouteConfig describes where requests for a path prefix are sent
+type RouteConfig struct {
+	//Prefix is the path the route handles. A prefix ending in "/" handles the
+	//paths beneath it; any other prefix handles itself and the paths beneath it.
+	//When routes overlap, the longest prefix wins.
+	Prefix string `json:"prefix"`
+	//Target is the name of the built-in handler serving the route
+	Target string `json:"target,omitempty"`
+	//Upstream is the name of the upstream serving the route
+	Upstream string `json:"upstream,omitempty"`
+	//Auth requires requests to carry a valid session
+	Auth bool `json:"auth,omitempty"`
+	//Methods the route allows; all if empty
+	Methods []string `json:"methods,omitempty"`
+	//Timeout is how long the route has to answer, after which the request's
+	//context is cancelled; unbounded if zero
+	Timeout Duration `json:"timeout,omitempty"`
+	//RateLimit limits how often each client can make requests to the route
+	RateLimit *RateLimitConfig `json:"rateLimit,omitempty"`
+	//CORS narrows the gateway's CORS policy for the route
+	CORS *RouteCORSConfig `json:"cors,omitempty"`
+	//Security replaces the gateway's security headers for the route
+	Security *SecurityConfig `json:"security,omitempty"`
+	//Cache caches the route's responses to GET requests
+	Cache *CacheConfig `json:"cache,omitempty"`
+	//Purges are the prefixes of the paths whose cached responses are purged
+	//when a request changing data succeeds on the route. Cached routes
+	//always purge their own responses.
+	Purges []string `json:"purges,omitempty"`
+}
+
+//CacheConfig describes how the responses of a route are cached. Responses
+//are cached by path and query alone, so only routes whose responses are the
+//same for every user should be cached.
+type CacheConfig struct {
+	//TTL is how long responses are served from the cache, unless
+	//the upstream says otherwise with max-age or s-maxage
+	TTL Duration `json:"ttl"`
+	//StaleIfError is how long after their TTL responses are still
+	//served while the upstream is failing
+	StaleIfError Duration `json:"staleIfError,omitempty"`
+}
+
+//What rate limits count requests by
+const (
+	//RateLimitByIP counts the requests from each client IP address
+	RateLimitByIP = "ip"
+	//RateLimitByUser counts the requests of each signed-in user, and those
+	//of clients that are not signed in by IP address
+	RateLimitByUser = "user"
+	//RateLimitByToken counts the requests made with each access token, and
+	//those made without one by IP address
+	RateLimitByToken = "token"
+)
+
+//RateLimitConfig describes the rate limit of a route
+type RateLimitConfig struct {
+	//Requests is the number of requests allowed each Per, on average
+	Requests int      `json:"requests"`
+	Per      Duration `json:"per"`
+	//Burst is the number of requests allowed at once; Requests if zero
+	Burst int `json:"burst,omitempty"`
+	//By is what requests are counted by: "ip" (the default), "user" or "token"
+	By string `json:"by,omitempty"`
+}
+
+//Duration is a time.Duration written in configuration files as a string such as "30s"
+type Duration time.Duration
+
+//UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations must be strings such as \"30s\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+//MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+//ParseConfig parses and validates a route configuration
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("error parsing route configuration: %v", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+//LoadConfig reads, parses and validates a route configuration file
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseConfig(data)
+}
+
+//Validate checks that the configuration is complete and consistent.
+//Built-in target names are checked when the configuration is applied to a Router.
+func (cfg *Config) Validate() error {
+	for name, upstream := range cfg.Upstreams {
+		if upstream == nil || len(upstream.Targets) == 0 {
+			return fmt.Errorf("upstream %q has no targets", name)
+		}
+		targets := map[string]bool{}
+		for _, target := range upstream.Targets {
+			if len(strings.TrimSpace(target)) == 0 {
+				return fmt.Errorf("upstream %q has an empty target", name)
+			}
+			targets[target] = true
+		}
+		for target, weight := range upstream.Weights {
+			if !targets[target] {
+				return fmt.Errorf("upstream %q has a weight for unknown target %q", name, target)
+			}
+			if weight < 1 {
+				return fmt.Errorf("upstream %q: weights must be at least 1", name)
+			}
+		}
+		if check := upstream.HealthCheck; check != nil {
+			if !strings.HasPrefix(check.Path, "/") {
+				return fmt.Errorf("upstream %q: health check path must start with /", name)
+			}
+			if check.Interval <= 0 {
+				return fmt.Errorf("upstream %q: health check interval must be positive", name)
+			}
+		}
+		if upstream.MaxFails < 0 || upstream.EjectFor < 0 || upstream.SlowStart < 0 {
+			return fmt.Errorf("upstream %q: maxFails, ejectFor and slowStart may not be negative", name)
+		}
+		if (upstream.Retries != nil && *upstream.Retries < 0) || upstream.ConnectTimeout < 0 || upstream.ResponseTimeout < 0 {
+			return fmt.Errorf("upstream %q: retries, connectTimeout and responseTimeout may not be negative", name)
+		}
+		if breaker := upstream.Breaker; breaker != nil && (breaker.Threshold < 0 || breaker.Cooldown <= 0) {
+			return fmt.Errorf("upstream %q: breaker threshold may not be negative and cooldown must be positive", name)
+		}
+		if tls := upstream.TLS; tls != nil && (len(tls.Cert) == 0) != (len(tls.Key) == 0) {
+			return fmt.Errorf("upstream %q: tls cert and key must be given together", name)
+		}
+	}
+	if len(cfg.Routes) == 0 {
+		return fmt.Errorf("no routes configured")
+	}
+	if _, err := newSecurityPolicy(cfg.Security); err != nil {
+		return fmt.Errorf("security: %v", err)
+	}
+	prefixes := map[string]bool{}
+	for i, route := range cfg.Routes {
+		if route == nil {
+			return fmt.Errorf("route %d is empty", i)
+		}
+		if !strings.HasPrefix(route.Prefix, "/") {
+			return fmt.Errorf("route %d: prefix %q must start with /", i, route.Prefix)
+		}
+		if prefixes[route.Prefix] {
+			return fmt.Errorf("route %d: prefix %q is configured more than once", i, route.Prefix)
+		}
+		prefixes[route.Prefix] = true
+		if (len(route.Target) == 0) == (len(route.Upstream) == 0) {
+			return fmt.Errorf("route %s: exactly one of target and upstream must be set", route.Prefix)
+		}
+		if len(route.Upstream) != 0 && cfg.Upstreams[route.Upstream] == nil {
+			return fmt.Errorf("route %s: upstream %q is not configured", route.Prefix, route.Upstream)
+		}
+		for _, method := range route.Methods {
+			if !methods[method] {
+				return fmt.Errorf("route %s: unknown method %q", route.Prefix, method)
+			}
+		}
+		if route.Timeout < 0 {
+			return fmt.Errorf("route %s: timeout may not be negative", route.Prefix)
+		}
+		if route.CORS != nil {
+			for _, method := range route.CORS.Methods {
+				if !methods[method] || (len(route.Methods) != 0 && !contains(route.Methods, method)) {
+					return fmt.Errorf("route %s: cors method %q is not allowed by the route", route.Prefix, method)
+				}
+			}
+		}
+		if _, err := cfg.corsPolicy(route); err != nil {
+			return fmt.Errorf("route %s: cors: %v", route.Prefix, err)
+		}
+		if _, err := newSecurityPolicy(route.Security); err != nil {
+			return fmt.Errorf("route %s: security: %v", route.Prefix, err)
+		}
+		if cache := route.Cache; cache != nil {
+			if cache.TTL <= 0 || cache.StaleIfError < 0 {
+				return fmt.Errorf("route %s: cache ttl must be positive and staleIfError may not be negative", route.Prefix)
+			}
+			if len(route.Methods) != 0 && !contains(route.Methods, "GET") {
+				return fmt.Errorf("route %s: only the responses of routes allowing GET are cached", route.Prefix)
+			}
+		}
+		for _, purge := range route.Purges {
+			if !strings.HasPrefix(purge, "/") {
+				return fmt.Errorf("route %s: purged prefix %q must start with /", route.Prefix, purge)
+			}
+		}
+		if limit := route.RateLimit; limit != nil {
+			if limit.Requests < 1 || limit.Per <= 0 || limit.Burst < 0 {
+				return fmt.Errorf("route %s: rate limits need at least 1 request per positive duration", route.Prefix)
+			}
+			switch limit.By {
+			case "", RateLimitByIP, RateLimitByUser, RateLimitByToken:
+			default:
+				return fmt.Errorf("route %s: rate limits are by %q, %q or %q, not %q", route.Prefix,
+					RateLimitByIP, RateLimitByUser, RateLimitByToken, limit.By)
+			}
+		}
+	}
+	return nil
+}
+
+//corsPolicy builds the CORS policy of the route, nil if requests
+//from other origins are not allowed
+func (cfg *Config) corsPolicy(route *RouteConfig) (*cors.Policy, error) {
+	if cfg.CORS == nil || (route.CORS != nil && route.CORS.Disabled) {
+		return nil, nil
+	}
+	opts := cors.Options{
+		Origins:       cfg.CORS.Origins,
+		Credentials:   cfg.CORS.Credentials,
+		Headers:       cfg.CORS.Headers,
+		ExposeHeaders: cfg.CORS.ExposeHeaders,
+		MaxAge:        time.Duration(cfg.CORS.MaxAge),
+	}
+	//preflight requests are answered by the gateway, so the route's own OPTIONS is not offered
+	for _, method := range route.Methods {
+		if method != "OPTIONS" {
+			opts.Methods = append(opts.Methods, method)
+		}
+	}
+	if len(route.Methods) != 0 && len(opts.Methods) == 0 {
+		return nil, nil
+	}
+	if route.CORS != nil {
+		if len(route.CORS.Methods) != 0 {
+			opts.Methods = route.CORS.Methods
+		}
+		if route.CORS.Headers != nil {
+			opts.Headers = route.CORS.Headers
+		}
+		if route.CORS.ExposeHeaders != nil {
+			opts.ExposeHeaders = route.CORS.ExposeHeaders
+		}
+	}
+	return cors.NewPolicy(opts)
+}
+
+//newSecurityPolicy builds the policy setting the security headers, nil if none are set
+func newSecurityPolicy(cfg *SecurityConfig) (*security.Policy, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	return security.NewPolicy(security.Options{
+		HSTSMaxAge:            time.Duration(cfg.HSTS),
+		HSTSIncludeSubdomains: cfg.HSTSIncludeSubdomains,
+		HSTSPreload:           cfg.HSTSPreload,
+		CSP:                   cfg.CSP,
+		CSPReportOnly:         cfg.CSPReportOnly,
+		FrameAncestors:        cfg.FrameAncestors,
+		ReferrerPolicy:        cfg.ReferrerPolicy,
+		ReportURI:             cfg.ReportURI,
+	})
+}
+
+//contains reports whether the list contains the string
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,321 @@
+package routing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/my/repo/servers/gateway/cors"
+	"github.com/my/repo/servers/gateway/logging"
+	"github.com/my/repo/servers/gateway/problem"
+	"github.com/my/repo/servers/gateway/security"
+	"github.com/my/repo/servers/gateway/tracing"
+)
+
+//UpstreamFactory builds the handler forwarding requests to an upstream
+type UpstreamFactory func(name string, upstream *UpstreamConfig) (http.Handler, error)
+
+//route is a RouteConfig ready to serve requests
+type route struct {
+	config  *RouteConfig
+	handler http.Handler
+	allow   string
+	//cors is the CORS policy of the route, nil if it allows no requests from other origins
+	cors *cors.Policy
+	//security sets the security headers of the route's responses, if any are set
+	security *security.Policy
+}
+
+//table is an applied Config. Tables are never modified once
+//built, so requests keep the table they started with.
+type table struct {
+	//routes sorted longest prefix first
+	routes []*route
+	//security sets the security headers of the responses of routes without their own
+	security *security.Policy
+}
+
+//upstream is a handler built for an UpstreamConfig, kept
+//across reloads for as long as its configuration is unchanged
+type upstream struct {
+	config  *UpstreamConfig
+	handler http.Handler
+}
+
+//Router is an http.Handler sending requests to built-in handlers or upstreams
+//according to a route configuration, which can be replaced at any time without
+//disturbing requests already in flight.
+type Router struct {
+	//Builtins are the handlers routes may name as their target
+	Builtins map[string]http.Handler
+	//NewUpstream builds the handler for each upstream
+	NewUpstream UpstreamFactory
+	//RequireAuth wraps the handlers of routes requiring a session
+	RequireAuth func(http.Handler) http.Handler
+	//Cache wraps the handlers of routes caching their responses or purging
+	//those of other routes, inside RequireAuth; routes are not cached if nil
+	Cache func(route *RouteConfig, handler http.Handler) http.Handler
+
+	current atomic.Value
+
+	//mu serializes changes to the configuration
+	mu        sync.Mutex
+	upstreams map[string]*upstream
+	path      string
+	modTime   time.Time
+}
+
+//NewRouter constructs a new Router with no routes
+func NewRouter(builtins map[string]http.Handler, newUpstream UpstreamFactory, requireAuth func(http.Handler) http.Handler) *Router {
+	rt := &Router{
+		Builtins:    builtins,
+		NewUpstream: newUpstream,
+		RequireAuth: requireAuth,
+		upstreams:   map[string]*upstream{},
+	}
+	rt.current.Store(&table{})
+	return rt
+}
+
+//Apply validates the configuration and starts routing requests by it.
+//If it is not valid the current configuration is kept.
+func (rt *Router) Apply(cfg *Config) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.apply(cfg)
+}
+
+//LoadFile applies the configuration in the file, which
+//Reload and Watch read again when asked to
+func (rt *Router) LoadFile(path string) error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	return rt.loadFile(path)
+}
+
+//Reload applies the configuration file again
+func (rt *Router) Reload() error {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	if len(rt.path) == 0 {
+		return fmt.Errorf("no route configuration file loaded")
+	}
+	return rt.loadFile(rt.path)
+}
+
+//Watch reloads the configuration file whenever it changes, checking
+//every `interval` until `done` is closed. Invalid changes are logged
+//and ignored, leaving the current configuration in place.
+func (rt *Router) Watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rt.mu.Lock()
+			if info, err := os.Stat(rt.path); err == nil && !info.ModTime().Equal(rt.modTime) {
+				if err := rt.loadFile(rt.path); err != nil {
+					log.Printf("error reloading routes from %s: %v", rt.path, err)
+					//do not retry until the file changes again
+					rt.modTime = info.ModTime()
+				} else {
+					log.Printf("reloaded routes from %s", rt.path)
+				}
+			}
+			rt.mu.Unlock()
+		case <-done:
+			return
+		}
+	}
+}
+
+//Routes returns the route configurations currently applied, longest prefix first
+func (rt *Router) Routes() []*RouteConfig {
+	t := rt.current.Load().(*table)
+	configs := make([]*RouteConfig, len(t.routes))
+	for i, r := range t.routes {
+		configs[i] = r.config
+	}
+	return configs
+}
+
+//Match returns the configuration of the route currently handling the path, if any
+func (rt *Router) Match(path string) *RouteConfig {
+	if matched := rt.current.Load().(*table).match(path); matched != nil {
+		return matched.config
+	}
+	return nil
+}
+
+//loadFile reads and applies the configuration file; the caller holds rt.mu
+func (rt *Router) loadFile(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return err
+	}
+	if err := rt.apply(cfg); err != nil {
+		return err
+	}
+	rt.path = path
+	rt.modTime = info.ModTime()
+	return nil
+}
+
+//apply builds a table for the configuration and swaps it in; the caller holds rt.mu
+func (rt *Router) apply(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	upstreams := map[string]*upstream{}
+	for name, upstreamConfig := range cfg.Upstreams {
+		if existing, found := rt.upstreams[name]; found && reflect.DeepEqual(existing.config, upstreamConfig) {
+			upstreams[name] = existing
+			continue
+		}
+		handler, err := rt.NewUpstream(name, upstreamConfig)
+		if err != nil {
+			closeUpstreams(upstreams, rt.upstreams)
+			return fmt.Errorf("upstream %q: %v", name, err)
+		}
+		upstreams[name] = &upstream{upstreamConfig, handler}
+	}
+
+	t := &table{}
+	//the policies were checked as the configuration was validated
+	t.security, _ = newSecurityPolicy(cfg.Security)
+	for _, routeConfig := range cfg.Routes {
+		var handler http.Handler
+		if len(routeConfig.Target) != 0 {
+			handler = rt.Builtins[routeConfig.Target]
+			if handler == nil {
+				closeUpstreams(upstreams, rt.upstreams)
+				return fmt.Errorf("route %s: unknown target %q", routeConfig.Prefix, routeConfig.Target)
+			}
+		} else {
+			handler = upstreams[routeConfig.Upstream].handler
+		}
+		if rt.Cache != nil && (routeConfig.Cache != nil || len(routeConfig.Purges) != 0) {
+			handler = rt.Cache(routeConfig, handler)
+		}
+		if routeConfig.Auth {
+			handler = rt.RequireAuth(handler)
+		}
+		allow := ""
+		if len(routeConfig.Methods) != 0 {
+			allow = strings.Join(routeConfig.Methods, ", ")
+		}
+		policy, err := cfg.corsPolicy(routeConfig)
+		if err != nil {
+			closeUpstreams(upstreams, rt.upstreams)
+			return fmt.Errorf("route %s: cors: %v", routeConfig.Prefix, err)
+		}
+		r := &route{config: routeConfig, handler: handler, allow: allow, cors: policy, security: t.security}
+		if routeConfig.Security != nil {
+			r.security, _ = newSecurityPolicy(routeConfig.Security)
+		}
+		t.routes = append(t.routes, r)
+	}
+	sort.SliceStable(t.routes, func(i, j int) bool {
+		return len(t.routes[i].config.Prefix) > len(t.routes[j].config.Prefix)
+	})
+
+	rt.current.Store(t)
+	//upstreams no longer configured stop their background work; requests
+	//still using them through the previous table can finish
+	closeUpstreams(rt.upstreams, upstreams)
+	rt.upstreams = upstreams
+	return nil
+}
+
+//closeUpstreams closes the upstreams in `from` that are not in `keep`
+func closeUpstreams(from map[string]*upstream, keep map[string]*upstream) {
+	for name, u := range from {
+		if kept, found := keep[name]; found && kept == u {
+			continue
+		}
+		if closer, ok := u.handler.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+//CORS returns the CORS policy of the route currently handling the path, nil if the
+//route allows no requests from other origins, and whether there is such a route
+func (rt *Router) CORS(path string) (*cors.Policy, bool) {
+	if matched := rt.current.Load().(*table).match(path); matched != nil {
+		return matched.cors, true
+	}
+	return nil, false
+}
+
+//Security returns the policy setting the security headers of the responses
+//of the route currently handling the path, nil if none are set
+func (rt *Router) Security(path string) *security.Policy {
+	t := rt.current.Load().(*table)
+	if matched := t.match(path); matched != nil {
+		return matched.security
+	}
+	return t.security
+}
+
+//match returns the route for the path
+func (t *table) match(path string) *route {
+	for _, r := range t.routes {
+		prefix := r.config.Prefix
+		if strings.HasSuffix(prefix, "/") {
+			if strings.HasPrefix(path, prefix) {
+				return r
+			}
+		} else if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return r
+		}
+	}
+	return nil
+}
+
+//allows reports whether the route accepts the method
+func (r *route) allows(method string) bool {
+	if len(r.config.Methods) == 0 {
+		return true
+	}
+	//preflight requests never get here, as the CORS handler in front of the router answers them
+	return contains(r.config.Methods, method)
+}
+
+//ServeHTTP sends the request to the handler of its route
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t := rt.current.Load().(*table)
+	matched := t.match(r.URL.Path)
+	if matched == nil {
+		problem.Error(w, r, http.StatusNotFound, problem.CodeNotFound, "no route serves "+r.URL.Path)
+		return
+	}
+	logging.Annotate(r.Context(), "route", matched.config.Prefix)
+	if !matched.allows(r.Method) {
+		w.Header().Set("Allow", matched.allow)
+		problem.Error(w, r, http.StatusMethodNotAllowed, problem.CodeMethodNotAllowed, r.Method+" is not allowed")
+		return
+	}
+	if matched.config.Timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), time.Duration(matched.config.Timeout))
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	ctx, span := tracing.Start(r.Context(), "handler "+matched.config.Target)
+	defer span.End()
+	span.SetAttribute("http.route", matched.config.Prefix)
+	matched.handler.ServeHTTP(w, r.WithContext(ctx))
+}
@@ -0,0 +1,282 @@
+package routing
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+//namedHandler answers every request with its name
+type namedHandler string
+
+func (name namedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte(name))
+}
+
+//closingHandler records whether it was closed
+type closingHandler struct {
+	namedHandler
+	closed bool
+}
+
+func (ch *closingHandler) Close() error {
+	ch.closed = true
+	return nil
+}
+
+//newTestRouter builds a router whose upstreams answer with their name
+//and first target, and whose auth check requires an Authorization header
+func newTestRouter(built map[string]*closingHandler) *Router {
+	builtins := map[string]http.Handler{
+		"users": namedHandler("users"),
+		"user":  namedHandler("user"),
+	}
+	newUpstream := func(name string, upstream *UpstreamConfig) (http.Handler, error) {
+		handler := &closingHandler{namedHandler: namedHandler(name + " " + upstream.Targets[0])}
+		if built != nil {
+			built[name] = handler
+		}
+		return handler, nil
+	}
+	requireAuth := func(handler http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(r.Header.Get("Authorization")) == 0 {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		})
+	}
+	return NewRouter(builtins, newUpstream, requireAuth)
+}
+
+const testConfig = `{
+	"upstreams": {"dash": {"targets": ["dash1:80", "dash2:80"]}},
+	"routes": [
+		{"prefix": "/v1/users", "target": "users", "methods": ["POST"]},
+		{"prefix": "/v1/users/", "target": "user"},
+		{"prefix": "/v1/dashboards", "upstream": "dash", "auth": true, "timeout": "5s"}
+	]
+}`
+
+func TestParseConfig(t *testing.T) {
+	cases := []struct {
+		name        string
+		config      string
+		expectError string
+	}{
+		{"valid configuration", testConfig, ""},
+		{"not JSON", `routes:`, "error parsing"},
+		{"unknown field", `{"routes": [{"prefix": "/a", "target": "users", "auth": true, "tiemout": "5s"}]}`, "tiemout"},
+		{"no routes", `{"routes": []}`, "no routes"},
+		{"relative prefix", `{"routes": [{"prefix": "a", "target": "users"}]}`, "must start with /"},
+		{"duplicate prefix", `{"routes": [{"prefix": "/a", "target": "users"}, {"prefix": "/a", "target": "user"}]}`, "more than once"},
+		{"target and upstream", `{"upstreams": {"u": {"targets": ["h:80"]}}, "routes": [{"prefix": "/a", "target": "users", "upstream": "u"}]}`, "exactly one"},
+		{"neither target nor upstream", `{"routes": [{"prefix": "/a"}]}`, "exactly one"},
+		{"undefined upstream", `{"routes": [{"prefix": "/a", "upstream": "u"}]}`, "not configured"},
+		{"upstream without targets", `{"upstreams": {"u": {"targets": []}}, "routes": [{"prefix": "/a", "upstream": "u"}]}`, "no targets"},
+		{"unknown method", `{"routes": [{"prefix": "/a", "target": "users", "methods": ["FETCH"]}]}`, "unknown method"},
+		{"bad timeout", `{"routes": [{"prefix": "/a", "target": "users", "timeout": "soon"}]}`, "soon"},
+		{"negative timeout", `{"routes": [{"prefix": "/a", "target": "users", "timeout": "-5s"}]}`, "negative"},
+		{"weight for unknown target", `{"upstreams": {"u": {"targets": ["h:80"], "weights": {"g:80": 2}}}, "routes": [{"prefix": "/a", "upstream": "u"}]}`, "unknown target"},
+		{"zero weight", `{"upstreams": {"u": {"targets": ["h:80"], "weights": {"h:80": 0}}}, "routes": [{"prefix": "/a", "upstream": "u"}]}`, "at least 1"},
+		{"relative health check path", `{"upstreams": {"u": {"targets": ["h:80"], "healthCheck": {"path": "health", "interval": "5s"}}}, "routes": [{"prefix": "/a", "upstream": "u"}]}`, "must start with /"},
+		{"health check without interval", `{"upstreams": {"u": {"targets": ["h:80"], "healthCheck": {"path": "/health"}}}, "routes": [{"prefix": "/a", "upstream": "u"}]}`, "interval must be positive"},
+		{"negative retries", `{"upstreams": {"u": {"targets": ["h:80"], "retries": -1}}, "routes": [{"prefix": "/a", "upstream": "u"}]}`, "may not be negative"},
+		{"breaker without cooldown", `{"upstreams": {"u": {"targets": ["h:80"], "breaker": {"threshold": 5}}}, "routes": [{"prefix": "/a", "upstream": "u"}]}`, "cooldown must be positive"},
+		{"client cert without key", `{"upstreams": {"u": {"targets": ["h:443"], "tls": {"cert": "client.pem"}}}, "routes": [{"prefix": "/a", "upstream": "u"}]}`, "cert and key"},
+		{"rate limit without duration", `{"routes": [{"prefix": "/a", "target": "users", "rateLimit": {"requests": 5}}]}`, "positive duration"},
+		{"rate limit by unknown key", `{"routes": [{"prefix": "/a", "target": "users", "rateLimit": {"requests": 5, "per": "1m", "by": "cookie"}}]}`, "not \"cookie\""},
+		{"negative slow start", `{"upstreams": {"u": {"targets": ["h:80"], "slowStart": "-1s"}}, "routes": [{"prefix": "/a", "upstream": "u"}]}`, "may not be negative"},
+		{"cors with any origin and credentials", `{"cors": {"origins": ["*"], "credentials": true}, "routes": [{"prefix": "/a", "target": "users"}]}`, "credentials"},
+		{"cors origin with path", `{"cors": {"origins": ["https://example.com/app"]}, "routes": [{"prefix": "/a", "target": "users"}]}`, "scheme and host"},
+		{"cors wildcard within label", `{"cors": {"origins": ["https://app*.example.com"]}, "routes": [{"prefix": "/a", "target": "users"}]}`, "whole leading label"},
+		{"cors method not allowed by route", `{"cors": {"origins": ["https://example.com"]}, "routes": [{"prefix": "/a", "target": "users", "methods": ["GET"], "cors": {"methods": ["DELETE"]}}]}`, "not allowed by the route"},
+		{"hsts preload too short", `{"security": {"hsts": "24h", "hstsIncludeSubdomains": true, "hstsPreload": true}, "routes": [{"prefix": "/a", "target": "users"}]}`, "preload"},
+		{"frame-ancestors in route csp", `{"routes": [{"prefix": "/a", "target": "users", "security": {"csp": "frame-ancestors *"}}]}`, "own option"},
+		{"cache without ttl", `{"routes": [{"prefix": "/a", "target": "users", "cache": {"staleIfError": "1h"}}]}`, "ttl must be positive"},
+		{"cache on route without GET", `{"routes": [{"prefix": "/a", "target": "users", "methods": ["POST"], "cache": {"ttl": "1m"}}]}`, "allowing GET"},
+		{"relative purge", `{"routes": [{"prefix": "/a", "target": "users", "purges": ["a"]}]}`, "must start with /"},
+	}
+	for _, c := range cases {
+		_, err := ParseConfig([]byte(c.config))
+		if len(c.expectError) == 0 && err != nil {
+			t.Errorf("case %s: unexpected error: %v", c.name, err)
+		}
+		if len(c.expectError) != 0 && (err == nil || !strings.Contains(err.Error(), c.expectError)) {
+			t.Errorf("case %s: expected error containing %q but got %v", c.name, c.expectError, err)
+		}
+	}
+}
+
+func TestShippedConfig(t *testing.T) {
+	if _, err := LoadConfig("../routes.json"); err != nil {
+		t.Errorf("error loading the route configuration shipped with the gateway: %v", err)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	router := newTestRouter(nil)
+	cfg, _ := ParseConfig([]byte(testConfig))
+	if err := router.Apply(cfg); err != nil {
+		t.Fatalf("unexpected error applying configuration: %v", err)
+	}
+
+	cases := []struct {
+		name           string
+		method         string
+		path           string
+		authorized     bool
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"exact prefix", "POST", "/v1/users", false, http.StatusOK, "users"},
+		{"method not allowed", "GET", "/v1/users", false, http.StatusMethodNotAllowed, ""},
+		{"longest prefix wins", "GET", "/v1/users/me", false, http.StatusOK, "user"},
+		{"prefix with trailing slash does not match itself", "GET", "/v1/users/", false, http.StatusOK, "user"},
+		{"upstream beneath prefix", "GET", "/v1/dashboards/12", true, http.StatusOK, "dash dash1:80"},
+		{"auth required", "GET", "/v1/dashboards", false, http.StatusUnauthorized, ""},
+		{"prefix is matched on whole segments", "GET", "/v1/dashboardsx", true, http.StatusNotFound, ""},
+		{"no route", "GET", "/v2/users", false, http.StatusNotFound, ""},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		if c.authorized {
+			req.Header.Set("Authorization", "Bearer x")
+		}
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d", c.name, c.expectedStatus, rr.Code)
+		}
+		if len(c.expectedBody) != 0 && rr.Body.String() != c.expectedBody {
+			t.Errorf("case %s: expected %q but got %q", c.name, c.expectedBody, rr.Body.String())
+		}
+		if rr.Code == http.StatusMethodNotAllowed && rr.Header().Get("Allow") != "POST" {
+			t.Errorf("case %s: incorrect Allow header %q", c.name, rr.Header().Get("Allow"))
+		}
+		if matched := router.Match(c.path); (matched == nil) != (c.expectedStatus == http.StatusNotFound) {
+			t.Errorf("case %s: Match returned %+v", c.name, matched)
+		}
+	}
+}
+
+func TestRouterTimeout(t *testing.T) {
+	router := newTestRouter(nil)
+	router.Builtins["slow"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			http.Error(w, "timed out", http.StatusGatewayTimeout)
+		case <-time.After(time.Second):
+			w.Write([]byte("too late"))
+		}
+	})
+	cfg, _ := ParseConfig([]byte(`{"routes": [{"prefix": "/slow", "target": "slow", "timeout": "10ms"}]}`))
+	if err := router.Apply(cfg); err != nil {
+		t.Fatalf("unexpected error applying configuration: %v", err)
+	}
+	rr := httptest.NewRecorder()
+	router.ServeHTTP(rr, httptest.NewRequest("GET", "/slow", nil))
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("expected the request context to be cancelled after the route timeout, got %d %q", rr.Code, rr.Body.String())
+	}
+}
+
+func TestRouterReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "routes")
+	if err != nil {
+		t.Fatalf("error creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "routes.json")
+	if err := ioutil.WriteFile(path, []byte(testConfig), 0644); err != nil {
+		t.Fatalf("error writing config: %v", err)
+	}
+
+	built := map[string]*closingHandler{}
+	router := newTestRouter(built)
+	if err := router.LoadFile(path); err != nil {
+		t.Fatalf("unexpected error loading configuration: %v", err)
+	}
+	dash := built["dash"]
+
+	//a request in flight keeps the routes it started with
+	started := make(chan struct{})
+	release := make(chan struct{})
+	router.Builtins["blocking"] = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("finished"))
+	})
+	ioutil.WriteFile(path, []byte(`{"routes": [{"prefix": "/v1/users", "target": "blocking"}]}`), 0644)
+	if err := router.Reload(); err != nil {
+		t.Fatalf("unexpected error reloading configuration: %v", err)
+	}
+	inFlight := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		router.ServeHTTP(inFlight, httptest.NewRequest("POST", "/v1/users", nil))
+		close(done)
+	}()
+	<-started
+	if !dash.closed {
+		t.Error("upstream removed from the configuration was not closed")
+	}
+
+	//invalid changes are rejected, keeping the current routes
+	ioutil.WriteFile(path, []byte(`{"routes": [{"prefix": "/v1/users", "target": "unknown"}]}`), 0644)
+	if err := router.Reload(); err == nil {
+		t.Error("expected error reloading configuration with an unknown target")
+	}
+	if routes := router.Routes(); len(routes) != 1 || routes[0].Target != "blocking" {
+		t.Errorf("invalid configuration replaced the current routes: %+v", routes)
+	}
+
+	//the file is watched for changes
+	watchDone := make(chan struct{})
+	defer close(watchDone)
+	go router.Watch(5*time.Millisecond, watchDone)
+	later := time.Now().Add(time.Second)
+	ioutil.WriteFile(path, []byte(testConfig), 0644)
+	os.Chtimes(path, later, later)
+	deadline := time.Now().Add(2 * time.Second)
+	for len(router.Routes()) != 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("changed configuration file was never reloaded")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	close(release)
+	<-done
+	if inFlight.Body.String() != "finished" {
+		t.Errorf("request in flight during reloads was disturbed: %q", inFlight.Body.String())
+	}
+}
+
+func TestRouterKeepsUnchangedUpstreams(t *testing.T) {
+	built := map[string]*closingHandler{}
+	router := newTestRouter(built)
+	cfg, _ := ParseConfig([]byte(testConfig))
+	router.Apply(cfg)
+	first := built["dash"]
+
+	cfg, _ = ParseConfig([]byte(testConfig))
+	cfg.Routes[0].Methods = nil
+	router.Apply(cfg)
+	if built["dash"] != first || first.closed {
+		t.Error("unchanged upstream was rebuilt")
+	}
+
+	cfg, _ = ParseConfig([]byte(testConfig))
+	cfg.Upstreams["dash"].Targets = []string{"dash3:80"}
+	router.Apply(cfg)
+	if built["dash"] == first || !first.closed {
+		t.Error("changed upstream was not rebuilt")
+	}
+}
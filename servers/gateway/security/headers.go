@@ -0,0 +1,188 @@
+//Package security builds the security headers the gateway sends with its
+//responses, including a Content-Security-Policy that may carry a fresh nonce
+//for each response, and collects the reports of pages violating the policy.
+package security
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Security headers
+const (
+	HSTSHeader               = "Strict-Transport-Security"
+	CSPHeader                = "Content-Security-Policy"
+	CSPReportOnlyHeader      = "Content-Security-Policy-Report-Only"
+	ContentTypeOptionsHeader = "X-Content-Type-Options"
+	FrameOptionsHeader       = "X-Frame-Options"
+	ReferrerPolicyHeader     = "Referrer-Policy"
+	ReportingEndpointsHeader = "Reporting-Endpoints"
+	//NonceHeader passes the nonce of the response's policy on to the upstream
+	//rendering the page, to be put on the scripts and styles it allows
+	NonceHeader = "X-CSP-Nonce"
+)
+
+//NoncePlaceholder is replaced in policies with the nonce of each response, as a
+//'nonce-...' source, so "script-src {nonce}" allows the scripts carrying it
+const NoncePlaceholder = "{nonce}"
+
+//reportingGroup is the name of the Reporting API endpoint violations are reported to
+const reportingGroup = "csp"
+
+//DefaultReferrerPolicy is the Referrer-Policy sent unless another is configured
+const DefaultReferrerPolicy = "strict-origin-when-cross-origin"
+
+//referrerPolicies are the values of the Referrer-Policy header
+var referrerPolicies = map[string]bool{
+	"no-referrer": true, "no-referrer-when-downgrade": true, "origin": true,
+	"origin-when-cross-origin": true, "same-origin": true, "strict-origin": true,
+	"strict-origin-when-cross-origin": true, "unsafe-url": true,
+}
+
+//Options describe a Policy
+type Options struct {
+	//HSTSMaxAge is how long browsers should only reach the host over HTTPS;
+	//no Strict-Transport-Security header is sent if zero
+	HSTSMaxAge            time.Duration
+	HSTSIncludeSubdomains bool
+	HSTSPreload           bool
+	//CSP is the Content-Security-Policy, in which NoncePlaceholder
+	//is replaced with a fresh nonce for each response
+	CSP string
+	//CSPReportOnly sends the policy as Content-Security-Policy-Report-Only,
+	//so browsers report violations without blocking anything
+	CSPReportOnly bool
+	//FrameAncestors are the sources allowed to frame pages, such as "'self'";
+	//pages may not be framed at all if empty
+	FrameAncestors []string
+	//ReferrerPolicy is DefaultReferrerPolicy if empty
+	ReferrerPolicy string
+	//ReportURI is where browsers send reports of violations of the policy
+	ReportURI string
+}
+
+//Policy sets the security headers of responses
+type Policy struct {
+	hsts           string
+	cspHeader      string
+	csp            string
+	frameOptions   string
+	referrerPolicy string
+	reporting      string
+}
+
+//NewPolicy constructs a new Policy, checking the options are valid
+func NewPolicy(opts Options) (*Policy, error) {
+	p := &Policy{referrerPolicy: DefaultReferrerPolicy}
+	if opts.HSTSMaxAge < 0 {
+		return nil, fmt.Errorf("hsts max age may not be negative")
+	}
+	if opts.HSTSMaxAge > 0 {
+		p.hsts = "max-age=" + strconv.Itoa(int(opts.HSTSMaxAge/time.Second))
+		if opts.HSTSIncludeSubdomains {
+			p.hsts += "; includeSubDomains"
+		}
+		if opts.HSTSPreload {
+			//browsers' preload lists only take hosts asking for a year over every subdomain
+			if opts.HSTSMaxAge < 365*24*time.Hour || !opts.HSTSIncludeSubdomains {
+				return nil, fmt.Errorf("hsts preload needs a max age of a year and includeSubdomains")
+			}
+			p.hsts += "; preload"
+		}
+	} else if opts.HSTSIncludeSubdomains || opts.HSTSPreload {
+		return nil, fmt.Errorf("hsts options need a max age")
+	}
+
+	if len(opts.ReferrerPolicy) != 0 {
+		if !referrerPolicies[opts.ReferrerPolicy] {
+			return nil, fmt.Errorf("unknown referrer policy %q", opts.ReferrerPolicy)
+		}
+		p.referrerPolicy = opts.ReferrerPolicy
+	}
+
+	directives := []string{}
+	for _, directive := range strings.Split(opts.CSP, ";") {
+		directive = strings.TrimSpace(directive)
+		if len(directive) == 0 {
+			continue
+		}
+		name := strings.ToLower(strings.Fields(directive)[0])
+		if name == "frame-ancestors" || name == "report-uri" || name == "report-to" {
+			return nil, fmt.Errorf("csp: set %s with its own option", name)
+		}
+		if strings.ContainsAny(directive, "\r\n") {
+			return nil, fmt.Errorf("csp: directives may not contain line breaks")
+		}
+		directives = append(directives, directive)
+	}
+	ancestors := "'none'"
+	if len(opts.FrameAncestors) != 0 {
+		ancestors = strings.Join(opts.FrameAncestors, " ")
+	}
+	directives = append(directives, "frame-ancestors "+ancestors)
+	if len(opts.ReportURI) != 0 {
+		if strings.ContainsAny(opts.ReportURI, " ;,\"\r\n") {
+			return nil, fmt.Errorf("report uri %q is not a valid URI", opts.ReportURI)
+		}
+		//report-uri is for browsers without the Reporting API, which ignore report-to
+		directives = append(directives, "report-uri "+opts.ReportURI, "report-to "+reportingGroup)
+		p.reporting = reportingGroup + `="` + opts.ReportURI + `"`
+	}
+	p.csp = strings.Join(directives, "; ")
+	p.cspHeader = CSPHeader
+	if opts.CSPReportOnly {
+		p.cspHeader = CSPReportOnlyHeader
+	} else {
+		//for browsers predating frame-ancestors, which only know these two
+		switch ancestors {
+		case "'none'":
+			p.frameOptions = "DENY"
+		case "'self'":
+			p.frameOptions = "SAMEORIGIN"
+		}
+	}
+	return p, nil
+}
+
+//UsesNonce reports whether the policy needs a nonce for each response
+func (p *Policy) UsesNonce() bool {
+	return strings.Contains(p.csp, NoncePlaceholder)
+}
+
+//Apply sets the security headers, replacing any the response already had,
+//with `nonce` as the nonce of the response if the policy uses one
+func (p *Policy) Apply(header http.Header, nonce string) {
+	if len(p.hsts) != 0 {
+		header.Set(HSTSHeader, p.hsts)
+	}
+	csp := p.csp
+	if len(nonce) != 0 {
+		csp = strings.Replace(csp, NoncePlaceholder, "'nonce-"+nonce+"'", -1)
+	}
+	//a policy left by the upstream in the other header would be enforced as well
+	header.Del(CSPHeader)
+	header.Del(CSPReportOnlyHeader)
+	header.Set(p.cspHeader, csp)
+	header.Set(ContentTypeOptionsHeader, "nosniff")
+	if len(p.frameOptions) != 0 {
+		header.Set(FrameOptionsHeader, p.frameOptions)
+	} else {
+		header.Del(FrameOptionsHeader)
+	}
+	header.Set(ReferrerPolicyHeader, p.referrerPolicy)
+	if len(p.reporting) != 0 {
+		header.Set(ReportingEndpointsHeader, p.reporting)
+	}
+}
+
+//NewNonce returns a new random nonce for a response
+func NewNonce() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return base64.StdEncoding.EncodeToString(nonce)
+}
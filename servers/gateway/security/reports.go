@@ -0,0 +1,246 @@
+package security
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/my/repo/servers/gateway/metrics"
+)
+
+//maxReportBody is the largest body of violation reports read
+const maxReportBody = 64 << 10
+
+//maxURILength is the longest URI kept in a report summary
+const maxURILength = 256
+
+//DefaultMaxSummaries is how many different violations are kept unless configured otherwise
+const DefaultMaxSummaries = 1000
+
+//directives are the CSP directives violations are counted under in the metrics;
+//others are counted as "other", as reports can say anything
+var directives = map[string]bool{
+	"default-src": true, "script-src": true, "script-src-elem": true, "script-src-attr": true,
+	"style-src": true, "style-src-elem": true, "style-src-attr": true, "img-src": true,
+	"font-src": true, "connect-src": true, "media-src": true, "object-src": true,
+	"frame-src": true, "child-src": true, "worker-src": true, "manifest-src": true,
+	"form-action": true, "frame-ancestors": true, "base-uri": true, "require-trusted-types-for": true,
+	"trusted-types": true,
+}
+
+var violationsTotal = metrics.Default.NewCounterVec("gateway_csp_violations_total",
+	"Content-Security-Policy violations reported by browsers.", "directive", "disposition")
+
+//Violation is a page's violation of its Content-Security-Policy, as reported by a browser
+type Violation struct {
+	//Directive is the directive violated, such as script-src
+	Directive string
+	//BlockedURI is what the page tried to load, or "inline" or "eval"
+	BlockedURI string
+	//DocumentURI is the page that violated the policy
+	DocumentURI string
+	//Disposition is "enforce", or "report" when the policy was report-only
+	Disposition string
+}
+
+//Summary is the count of the reports of a violation of a directive by a URI
+type Summary struct {
+	Directive   string `json:"directive"`
+	BlockedURI  string `json:"blockedUri"`
+	Disposition string `json:"disposition"`
+	Count       int    `json:"count"`
+	//LastDocumentURI is the page that last reported the violation
+	LastDocumentURI string    `json:"lastDocumentUri"`
+	FirstSeen       time.Time `json:"firstSeen"`
+	LastSeen        time.Time `json:"lastSeen"`
+}
+
+//summaryKey identifies the violations summarized together
+type summaryKey struct {
+	directive   string
+	blockedURI  string
+	disposition string
+}
+
+//Reports aggregates violation reports by directive and blocked URI.
+//Once MaxSummaries different violations have been seen, new ones are
+//only counted in the metrics.
+type Reports struct {
+	MaxSummaries int
+
+	mu        sync.Mutex
+	summaries map[summaryKey]*Summary
+	dropped   int
+}
+
+//NewReports constructs a new Reports keeping up to DefaultMaxSummaries violations
+func NewReports() *Reports {
+	return &Reports{MaxSummaries: DefaultMaxSummaries, summaries: map[summaryKey]*Summary{}}
+}
+
+//Add counts the violation
+func (rs *Reports) Add(v Violation) {
+	v.Directive = strings.ToLower(v.Directive)
+	v.BlockedURI = trimURI(v.BlockedURI)
+	v.DocumentURI = trimURI(v.DocumentURI)
+	if v.Disposition != "report" {
+		v.Disposition = "enforce"
+	}
+	label := v.Directive
+	if !directives[label] {
+		label = "other"
+	}
+	violationsTotal.With(label, v.Disposition).Inc()
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	key := summaryKey{v.Directive, v.BlockedURI, v.Disposition}
+	summary, found := rs.summaries[key]
+	if !found {
+		if len(rs.summaries) >= rs.MaxSummaries {
+			rs.dropped++
+			return
+		}
+		summary = &Summary{Directive: v.Directive, BlockedURI: v.BlockedURI, Disposition: v.Disposition, FirstSeen: time.Now()}
+		rs.summaries[key] = summary
+	}
+	summary.Count++
+	summary.LastDocumentURI = v.DocumentURI
+	summary.LastSeen = time.Now()
+}
+
+//Summaries returns the violations seen, most reported first
+func (rs *Reports) Summaries() []Summary {
+	rs.mu.Lock()
+	summaries := make([]Summary, 0, len(rs.summaries))
+	for _, summary := range rs.summaries {
+		summaries = append(summaries, *summary)
+	}
+	rs.mu.Unlock()
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Count != summaries[j].Count {
+			return summaries[i].Count > summaries[j].Count
+		}
+		if summaries[i].Directive != summaries[j].Directive {
+			return summaries[i].Directive < summaries[j].Directive
+		}
+		return summaries[i].BlockedURI < summaries[j].BlockedURI
+	})
+	return summaries
+}
+
+//trimURI drops the query and fragment of a URI, which may hold
+//secrets and would keep reports of the same violation apart
+func trimURI(uri string) string {
+	if u, err := url.Parse(uri); err == nil && len(u.Scheme) != 0 {
+		u.RawQuery, u.Fragment, u.User = "", "", nil
+		uri = u.String()
+	}
+	if len(uri) > maxURILength {
+		uri = uri[:maxURILength]
+	}
+	return uri
+}
+
+//legacyReport is the body of reports sent to report-uri
+type legacyReport struct {
+	Report struct {
+		DocumentURI        string `json:"document-uri"`
+		BlockedURI         string `json:"blocked-uri"`
+		ViolatedDirective  string `json:"violated-directive"`
+		EffectiveDirective string `json:"effective-directive"`
+		Disposition        string `json:"disposition"`
+	} `json:"csp-report"`
+}
+
+//reportingAPIReport is a report sent through the Reporting API to report-to
+type reportingAPIReport struct {
+	Type string `json:"type"`
+	Body struct {
+		DocumentURL        string `json:"documentURL"`
+		BlockedURL         string `json:"blockedURL"`
+		EffectiveDirective string `json:"effectiveDirective"`
+		Disposition        string `json:"disposition"`
+	} `json:"body"`
+}
+
+//Collect is the handler browsers send violation reports to, in either the
+//application/csp-report format of report-uri or the application/reports+json
+//format of the Reporting API
+func (rs *Reports) Collect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "reports must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxReportBody+1))
+	if err != nil {
+		http.Error(w, "error reading reports", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxReportBody {
+		http.Error(w, "reports too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	violations := []Violation{}
+	switch mediaType {
+	case "application/csp-report", "application/json":
+		report := &legacyReport{}
+		if err := json.Unmarshal(body, report); err != nil {
+			http.Error(w, "invalid report", http.StatusBadRequest)
+			return
+		}
+		directive := report.Report.EffectiveDirective
+		if len(directive) == 0 {
+			//older browsers send the whole directive rather than its name
+			if fields := strings.Fields(report.Report.ViolatedDirective); len(fields) != 0 {
+				directive = fields[0]
+			}
+		}
+		violations = append(violations, Violation{directive, report.Report.BlockedURI,
+			report.Report.DocumentURI, report.Report.Disposition})
+	case "application/reports+json":
+		reports := []reportingAPIReport{}
+		if err := json.Unmarshal(body, &reports); err != nil {
+			http.Error(w, "invalid reports", http.StatusBadRequest)
+			return
+		}
+		for _, report := range reports {
+			//the same endpoint may be sent other kinds of reports, which are not collected
+			if report.Type == "csp-violation" {
+				violations = append(violations, Violation{report.Body.EffectiveDirective, report.Body.BlockedURL,
+					report.Body.DocumentURL, report.Body.Disposition})
+			}
+		}
+	default:
+		http.Error(w, "reports must be application/csp-report or application/reports+json", http.StatusUnsupportedMediaType)
+		return
+	}
+	for _, v := range violations {
+		if len(v.Directive) != 0 {
+			rs.Add(v)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//ServeHTTP responds with the summaries of the violations seen, as JSON
+func (rs *Reports) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rs.mu.Lock()
+	dropped := rs.dropped
+	rs.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Violations []Summary `json:"violations"`
+		//Dropped is the number of reports of violations not summarized, as too many were seen
+		Dropped int `json:"dropped"`
+	}{rs.Summaries(), dropped})
+}
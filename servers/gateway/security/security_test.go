@@ -0,0 +1,183 @@
+package security
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewPolicy(t *testing.T) {
+	year := 365 * 24 * time.Hour
+	cases := []struct {
+		name  string
+		opts  Options
+		valid bool
+	}{
+		{"defaults", Options{}, true},
+		{"everything", Options{HSTSMaxAge: year, HSTSIncludeSubdomains: true, HSTSPreload: true, CSP: "default-src 'self'; script-src {nonce}",
+			FrameAncestors: []string{"'self'"}, ReferrerPolicy: "no-referrer", ReportURI: "/v1/csp-reports"}, true},
+		{"negative hsts", Options{HSTSMaxAge: -time.Second}, false},
+		{"hsts options without max age", Options{HSTSIncludeSubdomains: true}, false},
+		{"preload too short", Options{HSTSMaxAge: time.Hour, HSTSIncludeSubdomains: true, HSTSPreload: true}, false},
+		{"preload without subdomains", Options{HSTSMaxAge: year, HSTSPreload: true}, false},
+		{"unknown referrer policy", Options{ReferrerPolicy: "never"}, false},
+		{"frame-ancestors in csp", Options{CSP: "default-src 'self'; frame-ancestors 'none'"}, false},
+		{"report-uri in csp", Options{CSP: "default-src 'self'; Report-URI /reports"}, false},
+		{"line break in csp", Options{CSP: "default-src 'self'\r\nX-Injected: 1"}, false},
+		{"report uri with separator", Options{ReportURI: "/reports; script-src *"}, false},
+	}
+	for _, c := range cases {
+		_, err := NewPolicy(c.opts)
+		if (err == nil) != c.valid {
+			t.Errorf("case %s: expected valid %v but got error %v", c.name, c.valid, err)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	cases := []struct {
+		name     string
+		opts     Options
+		nonce    string
+		expected map[string]string
+	}{
+		{"defaults", Options{}, "", map[string]string{
+			HSTSHeader:               "",
+			CSPHeader:                "frame-ancestors 'none'",
+			CSPReportOnlyHeader:      "",
+			ContentTypeOptionsHeader: "nosniff",
+			FrameOptionsHeader:       "DENY",
+			ReferrerPolicyHeader:     "strict-origin-when-cross-origin",
+			ReportingEndpointsHeader: "",
+		}},
+		{"enforced with nonce", Options{
+			HSTSMaxAge: 365 * 24 * time.Hour, HSTSIncludeSubdomains: true, HSTSPreload: true,
+			CSP:            "default-src 'self'; script-src 'self' {nonce}; style-src {nonce}",
+			FrameAncestors: []string{"'self'"}, ReferrerPolicy: "same-origin", ReportURI: "/v1/csp-reports",
+		}, "abc123", map[string]string{
+			HSTSHeader: "max-age=31536000; includeSubDomains; preload",
+			CSPHeader: "default-src 'self'; script-src 'self' 'nonce-abc123'; style-src 'nonce-abc123'; " +
+				"frame-ancestors 'self'; report-uri /v1/csp-reports; report-to csp",
+			CSPReportOnlyHeader:      "",
+			FrameOptionsHeader:       "SAMEORIGIN",
+			ReferrerPolicyHeader:     "same-origin",
+			ReportingEndpointsHeader: `csp="/v1/csp-reports"`,
+		}},
+		{"report only", Options{
+			CSP: "default-src 'none'", CSPReportOnly: true, FrameAncestors: []string{"https://example.com"}, ReportURI: "https://reports.example.com/csp",
+		}, "", map[string]string{
+			CSPHeader:           "",
+			CSPReportOnlyHeader: "default-src 'none'; frame-ancestors https://example.com; report-uri https://reports.example.com/csp; report-to csp",
+			// the frame options would be enforced, so none are sent with a report-only policy
+			FrameOptionsHeader: "",
+		}},
+	}
+	for _, c := range cases {
+		policy, err := NewPolicy(c.opts)
+		if err != nil {
+			t.Fatalf("case %s: unexpected error: %v", c.name, err)
+		}
+		// the headers the upstream sent are replaced
+		header := http.Header{}
+		header.Set(CSPHeader, "script-src *")
+		header.Set(CSPReportOnlyHeader, "script-src *")
+		header.Set(FrameOptionsHeader, "ALLOWALL")
+		header.Set(ContentTypeOptionsHeader, "sniff")
+		policy.Apply(header, c.nonce)
+		for name, value := range c.expected {
+			if values := header.Values(name); (len(value) == 0 && len(values) != 0) || (len(value) != 0 && (len(values) != 1 || values[0] != value)) {
+				t.Errorf("case %s: expected %s %q but got %q", c.name, name, value, values)
+			}
+		}
+		if policy.UsesNonce() != (len(c.nonce) != 0) {
+			t.Errorf("case %s: unexpected UsesNonce %v", c.name, policy.UsesNonce())
+		}
+	}
+
+	if nonce := NewNonce(); len(nonce) != 24 || nonce == NewNonce() {
+		t.Errorf("expected new random nonces but got %q", nonce)
+	}
+}
+
+//post sends the body to the collector
+func post(rs *Reports, contentType string, body string) int {
+	r := httptest.NewRequest("POST", "/v1/csp-reports", strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	rr := httptest.NewRecorder()
+	rs.Collect(rr, r)
+	return rr.Code
+}
+
+func TestReports(t *testing.T) {
+	rs := NewReports()
+	legacy := `{"csp-report": {"document-uri": "https://example.com/dash?id=1", "blocked-uri": "https://evil.com/x.js?token=secret",
+		"violated-directive": "script-src-elem 'self'", "effective-directive": "script-src-elem", "disposition": "enforce"}}`
+	older := `{"csp-report": {"document-uri": "https://example.com/", "blocked-uri": "https://evil.com/x.js",
+		"violated-directive": "script-src-elem 'self'"}}`
+	reportingAPI := `[
+		{"type": "csp-violation", "url": "https://example.com/", "body": {"documentURL": "https://example.com/other",
+			"blockedURL": "inline", "effectiveDirective": "style-src-elem", "disposition": "report"}},
+		{"type": "deprecation", "body": {"id": "old-api"}},
+		{"type": "csp-violation", "body": {"documentURL": "https://example.com/", "blockedURL": "https://evil.com/x.js#frag",
+			"effectiveDirective": "script-src-elem", "disposition": "enforce"}}
+	]`
+	cases := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"report-uri format", "application/csp-report", legacy, http.StatusNoContent},
+		{"older browsers", "application/csp-report; charset=utf-8", older, http.StatusNoContent},
+		{"Reporting API format", "application/reports+json", reportingAPI, http.StatusNoContent},
+		{"other content type", "text/plain", legacy, http.StatusUnsupportedMediaType},
+		{"invalid JSON", "application/csp-report", `{"csp-report":`, http.StatusBadRequest},
+		{"too large", "application/csp-report", `{"csp-report": {"blocked-uri": "` + strings.Repeat("a", maxReportBody) + `"}}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		if status := post(rs, c.contentType, c.body); status != c.status {
+			t.Errorf("case %s: expected status %d but got %d", c.name, c.status, status)
+		}
+	}
+	rr := httptest.NewRecorder()
+	rs.Collect(rr, httptest.NewRequest("GET", "/v1/csp-reports", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected reports to only be posted but got %d", rr.Code)
+	}
+
+	summaries := rs.Summaries()
+	if len(summaries) != 2 {
+		t.Fatalf("expected 2 violations but got %+v", summaries)
+	}
+	script, style := summaries[0], summaries[1]
+	if script.Directive != "script-src-elem" || script.BlockedURI != "https://evil.com/x.js" || script.Disposition != "enforce" ||
+		script.Count != 3 || script.LastDocumentURI != "https://example.com/" || script.LastSeen.Before(script.FirstSeen) {
+		t.Errorf("unexpected script violations %+v", script)
+	}
+	if style.Directive != "style-src-elem" || style.BlockedURI != "inline" || style.Disposition != "report" || style.Count != 1 {
+		t.Errorf("unexpected style violations %+v", style)
+	}
+	if before := violationsTotal.With("script-src-elem", "enforce").Value(); before < 3 {
+		t.Errorf("expected the violations to be counted but got %v", before)
+	}
+
+	// once full, new violations are only counted
+	rs.MaxSummaries = 2
+	rs.Add(Violation{Directive: "img-src", BlockedURI: "https://tracker.example.com/pixel.gif"})
+	rs.Add(Violation{Directive: "script-src-elem", BlockedURI: "https://evil.com/x.js", DocumentURI: "https://example.com/"})
+	rr = httptest.NewRecorder()
+	rs.ServeHTTP(rr, httptest.NewRequest("GET", "/csp-reports", nil))
+	summary := struct {
+		Violations []Summary
+		Dropped    int
+	}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &summary); err != nil {
+		t.Fatalf("error decoding summary: %v", err)
+	}
+	if len(summary.Violations) != 2 || summary.Violations[0].Count != 4 || summary.Dropped != 1 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/my/repo/servers/gateway/handlers"
+	"github.com/my/repo/servers/gateway/health"
+	"github.com/my/repo/servers/gateway/introspect"
+	"github.com/my/repo/servers/gateway/logging"
+	"github.com/my/repo/servers/gateway/tlsconfig"
+)
+
+// defaultShutdownTimeout is how long requests in flight are given to finish
+// on shutdown, unless SHUTDOWNTIMEOUT is set
+const defaultShutdownTimeout = 30 * time.Second
+
+// certCheckInterval is how often the certificate files are checked for changes
+const certCheckInterval = 30 * time.Second
+
+// newServerTLS builds the TLS configuration clients are served with:
+//   - the certificate in `certPath` and key in `keyPath`, read again when
+//     either file changes or on SIGHUP
+//   - TLSMINVERSION is the oldest TLS version accepted, 1.2 unless set
+//   - TLSCIPHERS is a comma-separated list of the cipher suites accepted for
+//     connections before TLS 1.3, by their standard names; Go's defaults unless set
+func newServerTLS(certPath string, keyPath string) (*tls.Config, error) {
+	certs, err := tlsconfig.NewCertReloader(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("error loading TLS certificate: %v", err)
+	}
+	var minVersion uint16 = tlsconfig.DefaultMinVersion
+	if env := os.Getenv("TLSMINVERSION"); len(env) != 0 {
+		if minVersion, err = tlsconfig.ParseVersion(env); err != nil {
+			return nil, err
+		}
+	}
+	var cipherSuites []uint16
+	if env := os.Getenv("TLSCIPHERS"); len(env) != 0 {
+		if cipherSuites, err = tlsconfig.ParseCipherSuites(env); err != nil {
+			return nil, err
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := certs.Reload(); err != nil {
+				log.Printf("error reloading TLS certificate from %s: %v", certPath, err)
+			} else {
+				log.Printf("reloaded TLS certificate from %s", certPath)
+			}
+		}
+	}()
+	go certs.Watch(certCheckInterval, nil)
+	return tlsconfig.NewServerConfig(certs, minVersion, cipherSuites), nil
+}
+
+// shutdownTimeout returns how long requests in flight are given to finish on shutdown,
+// from SHUTDOWNTIMEOUT, such as "30s"
+func shutdownTimeout() (time.Duration, error) {
+	return durationEnv("SHUTDOWNTIMEOUT", defaultShutdownTimeout)
+}
+
+// drainDelay returns how long the gateway keeps serving once it is told to stop, failing
+// its readiness check so load balancers stop sending it requests before its servers
+// stop accepting connections, from DRAINDELAY, such as "5s"; no time at all unless set
+func drainDelay() (time.Duration, error) {
+	return durationEnv("DRAINDELAY", 0)
+}
+
+// readyTimeout returns how long each readiness check is given, from READYTIMEOUT, such as "2s"
+func readyTimeout() (time.Duration, error) {
+	return durationEnv("READYTIMEOUT", health.DefaultTimeout)
+}
+
+// durationEnv reads the duration in the environment variable `name`, or `def` if it is not set
+func durationEnv(name string, def time.Duration) (time.Duration, error) {
+	env := os.Getenv(name)
+	if len(env) == 0 {
+		return def, nil
+	}
+	d, err := time.ParseDuration(env)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s must be a duration such as 30s", name)
+	}
+	return d, nil
+}
+
+// newRedirectServer builds the plain-HTTP server at `addr`, which redirects requests
+// to HTTPS at `httpsAddr` and serves the liveness and readiness checks at /healthz
+// and /readyz, without the errors of the checks
+func newRedirectServer(addr string, httpsAddr string, checks *health.Checker) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", checks.Live)
+	mux.HandleFunc("/readyz", checks.ReadySummary)
+	mux.Handle("/", handlers.NewHTTPSRedirect(httpsAddr))
+	return &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+}
+
+// newIntrospectionServer builds the server at `addr` that answers the services behind
+// the gateway about the sessions of the tokens they are sent, at introspect.Path, and
+// takes the live events they publish, at /live/publish. It is kept apart from the
+// internal address so that it can be exposed to those services alone.
+func newIntrospectionServer(addr string, introspection http.Handler, publish http.Handler, ctx *handlers.HandlerContext) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle(introspect.Path, introspection)
+	mux.Handle("/live/publish", publish)
+	handler := handlers.NewAccessLogger(mux, ctx, logging.Default)
+	return &http.Server{Addr: addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+}
+
+// parseServiceCredentials parses a comma-separated list of name:secret service credentials
+func parseServiceCredentials(list string) (map[string]string, error) {
+	credentials := map[string]string{}
+	for _, pair := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			return nil, errors.New("service credentials must be in the form name:secret")
+		}
+		credentials[parts[0]] = parts[1]
+	}
+	return credentials, nil
+}
+
+// parseTrustedProxies parses a comma-separated list of the addresses or CIDR networks of proxies
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	networks := []*net.IPNet{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("trusted proxy %q is not an IP address or CIDR network", entry)
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an IP address or CIDR network", entry)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// listener is one of the servers the gateway runs
+type listener struct {
+	server *http.Server
+	// tls is whether the server serves HTTPS, with the server's TLSConfig
+	tls bool
+}
+
+func (l *listener) serve() error {
+	if l.tls {
+		log.Printf("Listening at https://%s", l.server.Addr)
+		return l.server.ListenAndServeTLS("", "")
+	}
+	log.Printf("Listening at http://%s", l.server.Addr)
+	return l.server.ListenAndServe()
+}
+
+// serve runs the servers until one of them fails or the process is sent SIGTERM
+// or SIGINT. On a signal the readiness check begins failing, the servers keep
+// serving for `delay` so load balancers notice, then stop accepting connections,
+// and the requests in flight are given up to `timeout` to finish before their
+// connections are closed.
+func serve(listeners []*listener, checks *health.Checker, delay time.Duration, timeout time.Duration) error {
+	failed := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *listener) {
+			if err := l.serve(); err != http.ErrServerClosed {
+				failed <- fmt.Errorf("error serving at %s: %v", l.server.Addr, err)
+			}
+		}(l)
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(stop)
+	var err error
+	select {
+	case err = <-failed:
+		log.Printf("shutting down: %v", err)
+	case sig := <-stop:
+		log.Printf("received %v, finishing requests in flight for up to %v", sig, timeout)
+	}
+	checks.Drain()
+	if err == nil && delay > 0 {
+		log.Printf("draining for %v", delay)
+		time.Sleep(delay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	wg := sync.WaitGroup{}
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(server *http.Server) {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				log.Printf("requests at %s did not finish in time, closing their connections", server.Addr)
+				server.Close()
+			}
+		}(l.server)
+	}
+	wg.Wait()
+	log.Printf("shut down")
+	return err
+}
@@ -0,0 +1,271 @@
+package sessions
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+//cacheInvalidationChannel is the redis pub/sub channel CachedStores
+//use to tell each other which sessions have changed
+const cacheInvalidationChannel = "sessions:invalidate"
+
+//cacheEntry is a session held in a CachedStore
+type cacheEntry struct {
+	sid SessionID
+	//data is the encoded session state, as saved in redis
+	data []byte
+	//expires is when the entry must next be reloaded from redis
+	expires time.Time
+	//fetched is when the entry was loaded from redis
+	fetched time.Time
+}
+
+//CachedStore represents a session.Store that keeps a bounded in-process LRU
+//cache in front of a RedisStore, so most reads do not need a round trip.
+//
+//Cached entries expire after SessionDuration without use, like the sessions
+//in redis, and after MaxAge since they were loaded. Saves and deletes are
+//broadcast over redis pub/sub so every other server evicts its copy. Instead
+//of resetting the expiry of a session in redis on every read, the sessions
+//read from the cache are collected and their expiry is reset in one pipelined
+//batch every FlushInterval.
+type CachedStore struct {
+	//Redis is the store the cache is in front of.
+	Redis *RedisStore
+	//MaxAge bounds how long an entry is trusted without reloading it from
+	//redis, in case an invalidation message was missed.
+	MaxAge time.Duration
+	//FlushInterval is how often the expiry of sessions read from the cache
+	//is reset in redis.
+	FlushInterval time.Duration
+
+	capacity int
+	origin   string
+
+	mu      sync.Mutex
+	entries map[SessionID]*list.Element
+	lru     *list.List
+	touched map[SessionID]bool
+	//evictions counts invalidations, so a load that raced with
+	//one is not cached
+	evictions uint64
+
+	pubsub *redis.PubSub
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+//NewCachedStore constructs a new CachedStore holding up to `capacity` sessions
+//in front of `store`, and starts listening for invalidations from other servers.
+//Close must be called to stop it.
+func NewCachedStore(store *RedisStore, capacity int, flushInterval time.Duration) (*CachedStore, error) {
+	randBytes := make([]byte, 12)
+	if _, err := rand.Read(randBytes); err != nil {
+		return nil, err
+	}
+	cs := &CachedStore{
+		Redis:         store,
+		MaxAge:        store.SessionDuration,
+		FlushInterval: flushInterval,
+		capacity:      capacity,
+		origin:        base64.RawURLEncoding.EncodeToString(randBytes),
+		entries:       map[SessionID]*list.Element{},
+		lru:           list.New(),
+		touched:       map[SessionID]bool{},
+		done:          make(chan struct{}),
+	}
+	cs.pubsub = store.Client.Subscribe(cacheInvalidationChannel)
+	//wait for the subscription to be confirmed so no invalidation is missed
+	if _, err := cs.pubsub.Receive(); err != nil {
+		cs.pubsub.Close()
+		return nil, err
+	}
+	cs.wg.Add(2)
+	go cs.listen()
+	go cs.flushLoop()
+	return cs, nil
+}
+
+//Save saves the provided `sessionState` and associated SessionID to redis and
+//the cache, and tells the other servers to evict their copies
+func (cs *CachedStore) Save(sid SessionID, sessionState interface{}) error {
+	data, err := codecOrDefault(cs.Redis.Codec).Marshal(sessionState)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = cs.Redis.Client.Set(sid.getRedisKey(), data, cs.Redis.SessionDuration).Err()
+	measure("redis", "save", start, err)
+	if err != nil {
+		cs.evict(sid)
+		return err
+	}
+	cs.mu.Lock()
+	cs.evictions++
+	cs.put(sid, data, time.Now())
+	cs.mu.Unlock()
+	return cs.publish(sid)
+}
+
+//Get populates `sessionState` with the data previously saved
+//for the given SessionID, from the cache if it holds it
+func (cs *CachedStore) Get(sid SessionID, sessionState interface{}) error {
+	now := time.Now()
+	cs.mu.Lock()
+	if elem, found := cs.entries[sid]; found {
+		entry := elem.Value.(*cacheEntry)
+		if now.Before(entry.expires) && now.Sub(entry.fetched) < cs.MaxAge {
+			cs.lru.MoveToFront(elem)
+			entry.expires = now.Add(cs.Redis.SessionDuration)
+			cs.touched[sid] = true
+			data := entry.data
+			cs.mu.Unlock()
+			return codecOrDefault(cs.Redis.Codec).Unmarshal(data, sessionState)
+		}
+		cs.remove(elem)
+	}
+	evictions := cs.evictions
+	cs.mu.Unlock()
+
+	data, err := cs.Redis.getRaw(sid)
+	if err != nil {
+		return err
+	}
+	cs.mu.Lock()
+	//only cache what was loaded if nothing was invalidated meanwhile
+	if cs.evictions == evictions {
+		cs.put(sid, data, now)
+	}
+	cs.mu.Unlock()
+	return codecOrDefault(cs.Redis.Codec).Unmarshal(data, sessionState)
+}
+
+//Delete deletes all state data associated with the SessionID from redis and
+//the cache, and tells the other servers to evict their copies
+func (cs *CachedStore) Delete(sid SessionID) error {
+	cs.evict(sid)
+	err := cs.Redis.Delete(sid)
+	//evict again, as a Get may have loaded the session from redis and cached it
+	//before it was deleted, and this server ignores its own invalidations
+	cs.evict(sid)
+	if err != nil {
+		return err
+	}
+	return cs.publish(sid)
+}
+
+//Exists reports whether state is saved for the SessionID in redis, without
+//resetting its expiry time
+func (cs *CachedStore) Exists(sid SessionID) (bool, error) {
+	return cs.Redis.Exists(sid)
+}
+
+//Len returns the number of sessions in the cache
+func (cs *CachedStore) Len() int {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	return cs.lru.Len()
+}
+
+//Flush resets the expiry in redis of every session read
+//from the cache since the last flush
+func (cs *CachedStore) Flush() error {
+	cs.mu.Lock()
+	touched := cs.touched
+	cs.touched = map[SessionID]bool{}
+	cs.mu.Unlock()
+	if len(touched) == 0 {
+		return nil
+	}
+	pipe := cs.Redis.Client.Pipeline()
+	for sid := range touched {
+		pipe.Expire(sid.getRedisKey(), cs.Redis.SessionDuration)
+	}
+	_, err := pipe.Exec()
+	return err
+}
+
+//Close stops listening for invalidations and flushes pending expiry resets
+func (cs *CachedStore) Close() error {
+	close(cs.done)
+	err := cs.pubsub.Close()
+	cs.wg.Wait()
+	cs.Flush()
+	return err
+}
+
+//put adds or replaces the entry for `sid`, evicting the least
+//recently used entry if the cache is full; the caller holds cs.mu
+func (cs *CachedStore) put(sid SessionID, data []byte, now time.Time) {
+	if elem, found := cs.entries[sid]; found {
+		cs.remove(elem)
+	}
+	for cs.lru.Len() >= cs.capacity && cs.lru.Len() > 0 {
+		cs.remove(cs.lru.Back())
+	}
+	if cs.capacity <= 0 {
+		return
+	}
+	cs.entries[sid] = cs.lru.PushFront(&cacheEntry{
+		sid:     sid,
+		data:    data,
+		expires: now.Add(cs.Redis.SessionDuration),
+		fetched: now,
+	})
+}
+
+//remove drops the entry from the cache; the caller holds cs.mu
+func (cs *CachedStore) remove(elem *list.Element) {
+	entry := cs.lru.Remove(elem).(*cacheEntry)
+	delete(cs.entries, entry.sid)
+}
+
+//evict drops the session from the cache, if it holds it
+func (cs *CachedStore) evict(sid SessionID) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.evictions++
+	if elem, found := cs.entries[sid]; found {
+		cs.remove(elem)
+	}
+	delete(cs.touched, sid)
+}
+
+//publish tells the other servers that the session has changed.
+//Messages are laid out as "<origin> <SessionID>".
+func (cs *CachedStore) publish(sid SessionID) error {
+	return cs.Redis.Client.Publish(cacheInvalidationChannel, cs.origin+" "+sid.String()).Err()
+}
+
+//listen evicts the sessions other servers have changed
+func (cs *CachedStore) listen() {
+	defer cs.wg.Done()
+	for msg := range cs.pubsub.Channel() {
+		parts := strings.SplitN(msg.Payload, " ", 2)
+		if len(parts) != 2 || parts[0] == cs.origin {
+			continue
+		}
+		cs.evict(SessionID(parts[1]))
+	}
+}
+
+//flushLoop periodically resets the expiry of sessions read from the cache
+func (cs *CachedStore) flushLoop() {
+	defer cs.wg.Done()
+	ticker := time.NewTicker(cs.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			cs.Flush()
+		case <-cs.done:
+			return
+		}
+	}
+}
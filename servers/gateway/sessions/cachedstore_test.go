@@ -0,0 +1,237 @@
+package sessions
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/my/repo/servers/gateway/redistest"
+)
+
+//newTestCachedStore starts a CachedStore against the redis stand-in
+func newTestCachedStore(t testing.TB, server *redistest.Server, capacity int) *CachedStore {
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	store, err := NewCachedStore(NewRedisStore(client, time.Hour), capacity, time.Hour)
+	if err != nil {
+		t.Fatalf("error creating cached store: %v", err)
+	}
+	return store
+}
+
+func TestCachedStore(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	store := newTestCachedStore(t, server, 10)
+	defer store.Close()
+
+	sid, _ := NewSessionID("test key")
+	if err := store.Get(sid, &codecState{}); err != ErrStateNotFound {
+		t.Errorf("expected ErrStateNotFound before saving but got %v", err)
+	}
+	state := &codecState{User: &codecUser{ID: 1, UserName: "username"}}
+	if err := store.Save(sid, state); err != nil {
+		t.Fatalf("unexpected error saving state: %v", err)
+	}
+	if _, found := server.Get(sid.getRedisKey()); !found {
+		t.Error("state not written through to redis")
+	}
+
+	//reads are served from the cache without going to redis
+	server.FlushAll()
+	stateRet := &codecState{}
+	if err := store.Get(sid, stateRet); err != nil {
+		t.Fatalf("unexpected error getting cached state: %v", err)
+	}
+	if !reflect.DeepEqual(state, stateRet) {
+		t.Errorf("incorrect state retrieved:\nEXPECTED\n%+v\nACTUAL\n%+v", state, stateRet)
+	}
+
+	//entries are reloaded once they are older than MaxAge
+	store.MaxAge = 0
+	if err := store.Get(sid, stateRet); err != ErrStateNotFound {
+		t.Errorf("expected ErrStateNotFound after MaxAge but got %v", err)
+	}
+	store.MaxAge = time.Hour
+
+	store.Save(sid, state)
+	if err := store.Delete(sid); err != nil {
+		t.Errorf("unexpected error deleting state: %v", err)
+	}
+	if err := store.Get(sid, stateRet); err != ErrStateNotFound {
+		t.Errorf("expected ErrStateNotFound after deleting but got %v", err)
+	}
+}
+
+func TestCachedStoreInvalidation(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	storeA := newTestCachedStore(t, server, 10)
+	defer storeA.Close()
+	storeB := newTestCachedStore(t, server, 10)
+	defer storeB.Close()
+
+	sid, _ := NewSessionID("test key")
+	storeA.Save(sid, &codecState{User: &codecUser{ID: 1, UserName: "before"}})
+	stateRet := &codecState{}
+	if err := storeB.Get(sid, stateRet); err != nil {
+		t.Fatalf("unexpected error getting state: %v", err)
+	}
+
+	//an update on one server is seen by the other
+	storeA.Save(sid, &codecState{User: &codecUser{ID: 1, UserName: "after"}})
+	deadline := time.Now().Add(2 * time.Second)
+	for storeB.Get(sid, stateRet); stateRet.User.UserName != "after"; storeB.Get(sid, stateRet) {
+		if time.Now().After(deadline) {
+			t.Fatal("update on one store was never seen by the other")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	//and so is a delete
+	storeB.Delete(sid)
+	deadline = time.Now().Add(2 * time.Second)
+	for storeA.Get(sid, stateRet) != ErrStateNotFound {
+		if time.Now().After(deadline) {
+			t.Fatal("delete on one store was never seen by the other")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCachedStoreDeleteDuringGet(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	store := newTestCachedStore(t, server, 10)
+	defer store.Close()
+
+	sid, _ := NewSessionID("test key")
+	store.Save(sid, &codecState{User: &codecUser{ID: 1}})
+	//run a Get just before the session is deleted from redis, once the
+	//cache has been evicted, so it loads the session that is being deleted
+	once := sync.Once{}
+	store.Redis.Client.WrapProcess(func(process func(redis.Cmder) error) func(redis.Cmder) error {
+		return func(cmd redis.Cmder) error {
+			if cmd.Name() == "del" {
+				once.Do(func() {
+					if err := store.Get(sid, &codecState{}); err != nil {
+						t.Errorf("unexpected error getting state before it is deleted: %v", err)
+					}
+				})
+			}
+			return process(cmd)
+		}
+	})
+	if err := store.Delete(sid); err != nil {
+		t.Fatalf("unexpected error deleting state: %v", err)
+	}
+	//this server ignores its own invalidations, so it would serve the session until MaxAge
+	if err := store.Get(sid, &codecState{}); err != ErrStateNotFound {
+		t.Errorf("expected ErrStateNotFound after deleting during a Get but got %v", err)
+	}
+}
+
+func TestCachedStoreLRU(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	store := newTestCachedStore(t, server, 2)
+	defer store.Close()
+
+	sids := make([]SessionID, 3)
+	for i := range sids {
+		sids[i], _ = NewSessionID("test key")
+	}
+	store.Save(sids[0], &codecState{})
+	store.Save(sids[1], &codecState{})
+	//using the first session makes the second the least recently used
+	store.Get(sids[0], &codecState{})
+	store.Save(sids[2], &codecState{})
+	if store.Len() != 2 {
+		t.Errorf("cache holds %d sessions but should be bounded to 2", store.Len())
+	}
+
+	server.FlushAll()
+	if err := store.Get(sids[0], &codecState{}); err != nil {
+		t.Errorf("recently used session was evicted: %v", err)
+	}
+	if err := store.Get(sids[1], &codecState{}); err != ErrStateNotFound {
+		t.Errorf("least recently used session was not evicted: %v", err)
+	}
+}
+
+func TestCachedStoreFlush(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	store := newTestCachedStore(t, server, 10)
+	defer store.Close()
+
+	sid, _ := NewSessionID("test key")
+	store.Save(sid, &codecState{})
+	store.Redis.Client.Expire(sid.getRedisKey(), time.Minute)
+
+	//reading from the cache does not reset the expiry in redis...
+	store.Get(sid, &codecState{})
+	if ttl := server.TTL(sid.getRedisKey()); ttl > time.Minute {
+		t.Errorf("expiry reset on a cached read: %v", ttl)
+	}
+	//...until the batch is flushed
+	if err := store.Flush(); err != nil {
+		t.Fatalf("unexpected error flushing: %v", err)
+	}
+	if ttl := server.TTL(sid.getRedisKey()); ttl <= time.Minute {
+		t.Errorf("expiry not reset by flush: %v", ttl)
+	}
+}
+
+func BenchmarkRedisStoreGet(b *testing.B) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		b.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	store := NewRedisStore(redis.NewClient(&redis.Options{Addr: server.Addr()}), time.Hour)
+	sid, _ := NewSessionID("test key")
+	store.Save(sid, &codecState{User: &codecUser{ID: 1, UserName: "username"}})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := store.Get(sid, &codecState{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCachedStoreGet(b *testing.B) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		b.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	store := newTestCachedStore(b, server, 1000)
+	defer store.Close()
+	sid, _ := NewSessionID("test key")
+	store.Save(sid, &codecState{User: &codecUser{ID: 1, UserName: "username"}})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := store.Get(sid, &codecState{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
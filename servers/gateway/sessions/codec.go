@@ -0,0 +1,439 @@
+package sessions
+
+import (
+	"encoding"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+//Codec converts session state to and from the bytes kept in a store
+type Codec interface {
+	//Marshal returns the encoding of `v`
+	Marshal(v interface{}) ([]byte, error)
+	//Unmarshal decodes `data` into the value pointed to by `v`
+	Unmarshal(data []byte, v interface{}) error
+}
+
+//JSONCodec encodes session state as JSON. It is the
+//codec used by the stores when none is configured.
+var JSONCodec Codec = jsonCodec{}
+
+//BinaryCodec encodes session state in a compact binary form. Values are
+//written without field names, in the order struct fields are declared,
+//and are prefixed with a fingerprint of their type's layout so that state
+//written by a build with a different layout is rejected rather than misread.
+//Fields tagged `json:"-"` are skipped, just as they are by the JSONCodec.
+//Interface values are not supported.
+var BinaryCodec Codec = binaryCodec{}
+
+//ErrCodecMismatch is returned by BinaryCodec when the data
+//was encoded from a value of a different type
+var ErrCodecMismatch = errors.New("session state was encoded from a different type")
+
+//errShortData is returned by BinaryCodec when the data ends early
+var errShortData = errors.New("session state data is truncated")
+
+//codecOrDefault returns `codec`, or the JSONCodec if it is nil
+func codecOrDefault(codec Codec) Codec {
+	if codec == nil {
+		return JSONCodec
+	}
+	return codec
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+//discardState accepts and ignores any saved session state. It is
+//used to check that a session exists without decoding its state.
+type discardState struct{}
+
+func (discardState) UnmarshalJSON([]byte) error   { return nil }
+func (discardState) UnmarshalBinary([]byte) error { return nil }
+
+var binaryMarshalerType = reflect.TypeOf((*encoding.BinaryMarshaler)(nil)).Elem()
+var binaryUnmarshalerType = reflect.TypeOf((*encoding.BinaryUnmarshaler)(nil)).Elem()
+
+//fingerprintSize is the number of bytes of type fingerprint
+//at the start of each value encoded by the BinaryCodec
+const fingerprintSize = 4
+
+type binaryCodec struct{}
+
+func (binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	//like encoding/json, pointers at the top level are transparent
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, errors.New("cannot encode a nil session state")
+		}
+		rv = rv.Elem()
+	}
+	if !rv.IsValid() {
+		return nil, errors.New("cannot encode a nil session state")
+	}
+	if usesBinaryMarshaler(rv.Type()) {
+		return rv.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+	}
+	buf := make([]byte, fingerprintSize, 64)
+	binary.BigEndian.PutUint32(buf, fingerprint(rv.Type()))
+	return encodeValue(buf, rv)
+}
+
+func (binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("session state must be decoded into a non-nil pointer")
+	}
+	if u, ok := v.(encoding.BinaryUnmarshaler); ok {
+		return u.UnmarshalBinary(data)
+	}
+	rv = rv.Elem()
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			rv.Set(reflect.New(rv.Type().Elem()))
+		}
+		rv = rv.Elem()
+	}
+	if usesBinaryMarshaler(rv.Type()) {
+		return rv.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(data)
+	}
+	if len(data) < fingerprintSize {
+		return errShortData
+	}
+	if binary.BigEndian.Uint32(data) != fingerprint(rv.Type()) {
+		return ErrCodecMismatch
+	}
+	rest, err := decodeValue(data[fingerprintSize:], rv)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return ErrCodecMismatch
+	}
+	return nil
+}
+
+//usesBinaryMarshaler reports whether values of type `t` are encoded
+//by the BinaryCodec using their own MarshalBinary and UnmarshalBinary
+func usesBinaryMarshaler(t reflect.Type) bool {
+	return t.Kind() != reflect.Ptr && t.Implements(binaryMarshalerType) &&
+		reflect.PtrTo(t).Implements(binaryUnmarshalerType)
+}
+
+//encodedFields returns the indexes of the struct fields the BinaryCodec encodes
+func encodedFields(t reflect.Type) []int {
+	fields := []int{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" || strings.Split(f.Tag.Get("json"), ",")[0] == "-" {
+			continue
+		}
+		fields = append(fields, i)
+	}
+	return fields
+}
+
+var fingerprints sync.Map
+
+//fingerprint returns a hash of the layout of `t` as encoded by the BinaryCodec
+func fingerprint(t reflect.Type) uint32 {
+	if fp, found := fingerprints.Load(t); found {
+		return fp.(uint32)
+	}
+	h := fnv.New32a()
+	describeType(h, t, map[reflect.Type]bool{})
+	fp := h.Sum32()
+	fingerprints.Store(t, fp)
+	return fp
+}
+
+//describeType writes a description of the layout of `t` to `w`
+func describeType(w interface{ Write([]byte) (int, error) }, t reflect.Type, seen map[reflect.Type]bool) {
+	fmt.Fprintf(w, "%s(", t.Kind())
+	defer w.Write([]byte(")"))
+	if usesBinaryMarshaler(t) {
+		fmt.Fprintf(w, "%s", t.String())
+		return
+	}
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice:
+		describeType(w, t.Elem(), seen)
+	case reflect.Array:
+		fmt.Fprintf(w, "%d", t.Len())
+		describeType(w, t.Elem(), seen)
+	case reflect.Map:
+		describeType(w, t.Key(), seen)
+		describeType(w, t.Elem(), seen)
+	case reflect.Struct:
+		if seen[t] {
+			fmt.Fprintf(w, "%s", t.String())
+			return
+		}
+		seen[t] = true
+		for _, i := range encodedFields(t) {
+			fmt.Fprintf(w, "%s:", t.Field(i).Name)
+			describeType(w, t.Field(i).Type, seen)
+		}
+	}
+}
+
+func encodeValue(buf []byte, v reflect.Value) ([]byte, error) {
+	if usesBinaryMarshaler(v.Type()) {
+		data, err := v.Interface().(encoding.BinaryMarshaler).MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		buf = appendUvarint(buf, uint64(len(data)))
+		return append(buf, data...), nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			return append(buf, 1), nil
+		}
+		return append(buf, 0), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return appendVarint(buf, v.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return appendUvarint(buf, v.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		return appendUint64(buf, math.Float64bits(v.Float())), nil
+	case reflect.String:
+		buf = appendUvarint(buf, uint64(v.Len()))
+		return append(buf, v.String()...), nil
+	case reflect.Ptr:
+		if v.IsNil() {
+			return append(buf, 0), nil
+		}
+		return encodeValue(append(buf, 1), v.Elem())
+	case reflect.Slice:
+		//lengths are offset by one so that nil and empty slices are told apart
+		if v.IsNil() {
+			return append(buf, 0), nil
+		}
+		buf = appendUvarint(buf, uint64(v.Len())+1)
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return append(buf, v.Bytes()...), nil
+		}
+		return encodeElements(buf, v)
+	case reflect.Array:
+		return encodeElements(buf, v)
+	case reflect.Map:
+		if v.IsNil() {
+			return append(buf, 0), nil
+		}
+		buf = appendUvarint(buf, uint64(v.Len())+1)
+		iter := v.MapRange()
+		for iter.Next() {
+			var err error
+			if buf, err = encodeValue(buf, iter.Key()); err != nil {
+				return nil, err
+			}
+			if buf, err = encodeValue(buf, iter.Value()); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	case reflect.Struct:
+		for _, i := range encodedFields(v.Type()) {
+			var err error
+			if buf, err = encodeValue(buf, v.Field(i)); err != nil {
+				return nil, err
+			}
+		}
+		return buf, nil
+	}
+	return nil, fmt.Errorf("cannot encode session state of type %s", v.Type())
+}
+
+func appendUvarint(buf []byte, n uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(buf, scratch[:binary.PutUvarint(scratch[:], n)]...)
+}
+
+func appendVarint(buf []byte, n int64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(buf, scratch[:binary.PutVarint(scratch[:], n)]...)
+}
+
+func appendUint64(buf []byte, n uint64) []byte {
+	var scratch [8]byte
+	binary.BigEndian.PutUint64(scratch[:], n)
+	return append(buf, scratch[:]...)
+}
+
+func encodeElements(buf []byte, v reflect.Value) ([]byte, error) {
+	for i := 0; i < v.Len(); i++ {
+		var err error
+		if buf, err = encodeValue(buf, v.Index(i)); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func decodeValue(data []byte, v reflect.Value) ([]byte, error) {
+	if usesBinaryMarshaler(v.Type()) {
+		size, rest, err := readLength(data)
+		if err != nil {
+			return nil, err
+		}
+		if err := v.Addr().Interface().(encoding.BinaryUnmarshaler).UnmarshalBinary(rest[:size]); err != nil {
+			return nil, err
+		}
+		return rest[size:], nil
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if len(data) < 1 {
+			return nil, errShortData
+		}
+		v.SetBool(data[0] == 1)
+		return data[1:], nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, size := binary.Varint(data)
+		if size <= 0 {
+			return nil, errShortData
+		}
+		v.SetInt(n)
+		return data[size:], nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, size := binary.Uvarint(data)
+		if size <= 0 {
+			return nil, errShortData
+		}
+		v.SetUint(n)
+		return data[size:], nil
+	case reflect.Float32, reflect.Float64:
+		if len(data) < 8 {
+			return nil, errShortData
+		}
+		v.SetFloat(math.Float64frombits(binary.BigEndian.Uint64(data)))
+		return data[8:], nil
+	case reflect.String:
+		size, rest, err := readLength(data)
+		if err != nil {
+			return nil, err
+		}
+		v.SetString(string(rest[:size]))
+		return rest[size:], nil
+	case reflect.Ptr:
+		if len(data) < 1 {
+			return nil, errShortData
+		}
+		if data[0] == 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return data[1:], nil
+		}
+		elem := reflect.New(v.Type().Elem())
+		rest, err := decodeValue(data[1:], elem.Elem())
+		if err != nil {
+			return nil, err
+		}
+		v.Set(elem)
+		return rest, nil
+	case reflect.Slice:
+		n, rest, err := readCount(data)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return rest, nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			if len(rest) < n {
+				return nil, errShortData
+			}
+			v.SetBytes(append([]byte{}, rest[:n]...))
+			return rest[n:], nil
+		}
+		//each element takes at least one byte, which bounds the allocation
+		if len(rest) < n {
+			return nil, errShortData
+		}
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+		return decodeElements(rest, v)
+	case reflect.Array:
+		return decodeElements(data, v)
+	case reflect.Map:
+		n, rest, err := readCount(data)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			v.Set(reflect.Zero(v.Type()))
+			return rest, nil
+		}
+		if len(rest) < n {
+			return nil, errShortData
+		}
+		m := reflect.MakeMapWithSize(v.Type(), n)
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if rest, err = decodeValue(rest, key); err != nil {
+				return nil, err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if rest, err = decodeValue(rest, value); err != nil {
+				return nil, err
+			}
+			m.SetMapIndex(key, value)
+		}
+		v.Set(m)
+		return rest, nil
+	case reflect.Struct:
+		for _, i := range encodedFields(v.Type()) {
+			var err error
+			if data, err = decodeValue(data, v.Field(i)); err != nil {
+				return nil, err
+			}
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("cannot decode session state of type %s", v.Type())
+}
+
+func decodeElements(data []byte, v reflect.Value) ([]byte, error) {
+	for i := 0; i < v.Len(); i++ {
+		var err error
+		if data, err = decodeValue(data, v.Index(i)); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+//readLength reads a length prefix, checking that that many bytes follow it
+func readLength(data []byte) (int, []byte, error) {
+	n, size := binary.Uvarint(data)
+	if size <= 0 || n > uint64(len(data)-size) {
+		return 0, nil, errShortData
+	}
+	return int(n), data[size:], nil
+}
+
+//readCount reads an element count that is offset by one,
+//returning -1 for a nil slice or map
+func readCount(data []byte) (int, []byte, error) {
+	n, size := binary.Uvarint(data)
+	if size <= 0 || n > uint64(len(data)) {
+		return 0, nil, errShortData
+	}
+	return int(n) - 1, data[size:], nil
+}
@@ -0,0 +1,116 @@
+package sessions
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+//codecUser mirrors the shape of users.User, including fields
+//that must never be written to the store
+type codecUser struct {
+	ID        int64  `json:"id"`
+	Email     string `json:"-"`
+	PassHash  []byte `json:"-"`
+	UserName  string `json:"userName"`
+	FirstName string `json:"firstName"`
+}
+
+type codecState struct {
+	BeginTime time.Time
+	User      *codecUser
+	Roles     []string
+	Flags     map[string]bool
+	Score     float64
+	Count     uint16
+	Active    bool
+	Empty     []int
+	Nil       []int
+}
+
+func TestBinaryCodecRoundTrip(t *testing.T) {
+	state := &codecState{
+		BeginTime: time.Date(2020, 11, 3, 10, 30, 0, 12345, time.UTC),
+		User:      &codecUser{ID: 1234567890, UserName: "username", FirstName: "First"},
+		Roles:     []string{"viewer", "editor"},
+		Flags:     map[string]bool{"beta": true},
+		Score:     -1.5,
+		Count:     65535,
+		Active:    true,
+		Empty:     []int{},
+	}
+	data, err := BinaryCodec.Marshal(state)
+	if err != nil {
+		t.Fatalf("unexpected error encoding state: %v", err)
+	}
+	jsonData, _ := json.Marshal(state)
+	if len(data) >= len(jsonData) {
+		t.Errorf("binary encoding (%d bytes) is not smaller than JSON (%d bytes)", len(data), len(jsonData))
+	}
+
+	//decoding works through any number of pointers, like encoding/json
+	stateRet := &codecState{}
+	if err := BinaryCodec.Unmarshal(data, &stateRet); err != nil {
+		t.Fatalf("unexpected error decoding state: %v", err)
+	}
+	if !reflect.DeepEqual(state, stateRet) {
+		t.Errorf("incorrect state decoded:\nEXPECTED\n%+v\nACTUAL\n%+v", state, stateRet)
+	}
+	if stateRet.Empty == nil || stateRet.Nil != nil {
+		t.Error("nil and empty slices should be told apart")
+	}
+
+	//fields excluded from JSON are not stored either
+	withSecrets := &codecState{User: &codecUser{ID: 1, Email: "test@test.com", PassHash: []byte("hash")}}
+	data, _ = BinaryCodec.Marshal(withSecrets)
+	stateRet = &codecState{}
+	BinaryCodec.Unmarshal(data, stateRet)
+	if len(stateRet.User.Email) != 0 || len(stateRet.User.PassHash) != 0 {
+		t.Error("fields tagged json:\"-\" should not be encoded")
+	}
+}
+
+func TestBinaryCodecErrors(t *testing.T) {
+	data, _ := BinaryCodec.Marshal(&codecState{User: &codecUser{UserName: "username"}})
+	type otherState struct {
+		BeginTime time.Time
+		User      *codecUser
+	}
+	if err := BinaryCodec.Unmarshal(data, &otherState{}); err != ErrCodecMismatch {
+		t.Errorf("expected ErrCodecMismatch decoding into a different type but got %v", err)
+	}
+	if err := BinaryCodec.Unmarshal(data[:len(data)-3], &codecState{}); err == nil {
+		t.Error("expected error decoding truncated data")
+	}
+	if err := BinaryCodec.Unmarshal(data, codecState{}); err == nil {
+		t.Error("expected error decoding into a non-pointer")
+	}
+	if _, err := BinaryCodec.Marshal(func() {}); err == nil {
+		t.Error("expected error encoding a function")
+	}
+	var state interface{} = 1
+	if _, err := BinaryCodec.Marshal(struct{ Any interface{} }{state}); err == nil {
+		t.Error("expected error encoding an interface value")
+	}
+	if err := BinaryCodec.Unmarshal(data, &discardState{}); err != nil {
+		t.Errorf("unexpected error discarding state: %v", err)
+	}
+}
+
+func TestStoresWithBinaryCodec(t *testing.T) {
+	memstore := NewMemStore(time.Hour, time.Minute)
+	memstore.Codec = BinaryCodec
+	sid, _ := NewSessionID("test key")
+	state := &codecState{User: &codecUser{ID: 7, UserName: "username"}, Roles: []string{"viewer"}}
+	if err := memstore.Save(sid, state); err != nil {
+		t.Fatalf("unexpected error saving state: %v", err)
+	}
+	stateRet := &codecState{}
+	if err := memstore.Get(sid, stateRet); err != nil {
+		t.Fatalf("unexpected error getting state: %v", err)
+	}
+	if !reflect.DeepEqual(state, stateRet) {
+		t.Errorf("incorrect state retrieved:\nEXPECTED\n%+v\nACTUAL\n%+v", state, stateRet)
+	}
+}
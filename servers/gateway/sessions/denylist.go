@@ -0,0 +1,136 @@
+package sessions
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/patrickmn/go-cache"
+)
+
+//Denylist records sessions that have been ended before
+//the tokens issued for them expire
+type Denylist interface {
+	//Revoke adds the session `id` to the denylist until `until`
+	Revoke(id string, until time.Time) error
+	//IsRevoked reports whether the session `id` has been revoked
+	IsRevoked(id string) (bool, error)
+}
+
+//MemDenylist represents an in-process memory Denylist.
+//Like the MemStore, this should be used only for testing and
+//prototyping, since revocations are not shared between servers.
+type MemDenylist struct {
+	entries *cache.Cache
+}
+
+//NewMemDenylist constructs and returns a new MemDenylist
+func NewMemDenylist(purgeInterval time.Duration) *MemDenylist {
+	return &MemDenylist{
+		entries: cache.New(cache.NoExpiration, purgeInterval),
+	}
+}
+
+//Revoke adds the session `id` to the denylist until `until`
+func (md *MemDenylist) Revoke(id string, until time.Time) error {
+	ttl := time.Until(until)
+	if ttl <= 0 {
+		//nothing issued for the session is still valid
+		return nil
+	}
+	md.entries.Set(id, true, ttl)
+	return nil
+}
+
+//IsRevoked reports whether the session `id` has been revoked
+func (md *MemDenylist) IsRevoked(id string) (bool, error) {
+	_, found := md.entries.Get(id)
+	return found, nil
+}
+
+//redisDenylistKey is the sorted set holding revoked sessions,
+//scored by the unix time their revocation can be forgotten
+const redisDenylistKey = "sessions:denylist"
+
+//RedisDenylist represents a Denylist shared through redis. To keep
+//lookups off the network, each server holds a local copy of the
+//denylist that is reloaded from redis at most once per SyncInterval,
+//so a session ended on another server is rejected here within
+//SyncInterval. Revocations made through this server apply immediately.
+//A zero SyncInterval checks redis on every lookup.
+type RedisDenylist struct {
+	//Redis client used to talk to redis server.
+	Client *redis.Client
+	//How stale the local copy of the denylist may become.
+	SyncInterval time.Duration
+
+	mu       sync.Mutex
+	revoked  map[string]time.Time
+	lastSync time.Time
+}
+
+//NewRedisDenylist constructs a new RedisDenylist
+func NewRedisDenylist(client *redis.Client, syncInterval time.Duration) *RedisDenylist {
+	return &RedisDenylist{
+		Client:       client,
+		SyncInterval: syncInterval,
+		revoked:      map[string]time.Time{},
+	}
+}
+
+//Revoke adds the session `id` to the denylist until `until`
+func (rd *RedisDenylist) Revoke(id string, until time.Time) error {
+	pipe := rd.Client.Pipeline()
+	pipe.ZAdd(redisDenylistKey, redis.Z{Score: float64(until.Unix()), Member: id})
+	//forget revocations whose tokens have all expired
+	pipe.ZRemRangeByScore(redisDenylistKey, "-inf", strconv.FormatInt(time.Now().Unix(), 10))
+	if _, err := pipe.Exec(); err != nil {
+		return err
+	}
+	rd.mu.Lock()
+	rd.revoked[id] = until
+	rd.mu.Unlock()
+	return nil
+}
+
+//IsRevoked reports whether the session `id` has been revoked
+func (rd *RedisDenylist) IsRevoked(id string) (bool, error) {
+	if rd.SyncInterval <= 0 {
+		err := rd.Client.ZScore(redisDenylistKey, id).Err()
+		if err == redis.Nil {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	now := time.Now()
+	if now.Sub(rd.lastSync) >= rd.SyncInterval {
+		if err := rd.sync(now); err != nil {
+			return false, err
+		}
+	}
+	until, found := rd.revoked[id]
+	return found && now.Before(until), nil
+}
+
+//sync reloads the local copy of the denylist; the caller holds rd.mu
+func (rd *RedisDenylist) sync(now time.Time) error {
+	members, err := rd.Client.ZRangeByScoreWithScores(redisDenylistKey, redis.ZRangeBy{
+		Min: strconv.FormatInt(now.Unix(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return err
+	}
+	revoked := make(map[string]time.Time, len(members))
+	for _, m := range members {
+		if id, ok := m.Member.(string); ok {
+			revoked[id] = time.Unix(int64(m.Score), 0)
+		}
+	}
+	rd.revoked = revoked
+	rd.lastSync = now
+	return nil
+}
@@ -0,0 +1,68 @@
+package sessions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/my/repo/servers/gateway/redistest"
+)
+
+func TestMemDenylist(t *testing.T) {
+	denylist := NewMemDenylist(time.Minute)
+	if revoked, _ := denylist.IsRevoked("session"); revoked {
+		t.Error("session reported revoked before it was revoked")
+	}
+	denylist.Revoke("session", time.Now().Add(time.Hour))
+	if revoked, _ := denylist.IsRevoked("session"); !revoked {
+		t.Error("session not reported revoked after it was revoked")
+	}
+	denylist.Revoke("expired", time.Now().Add(-time.Second))
+	if revoked, _ := denylist.IsRevoked("expired"); revoked {
+		t.Error("revocation should be forgotten after it expires")
+	}
+}
+
+func TestRedisDenylist(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	newClient := func() *redis.Client {
+		return redis.NewClient(&redis.Options{Addr: server.Addr()})
+	}
+
+	//two gateway instances, one checking redis on every lookup
+	//and one that syncs its local copy once per minute
+	local := NewRedisDenylist(newClient(), time.Minute)
+	strict := NewRedisDenylist(newClient(), 0)
+	synced := NewRedisDenylist(newClient(), time.Minute)
+
+	if revoked, err := synced.IsRevoked("session"); err != nil || revoked {
+		t.Fatalf("session reported revoked before it was revoked: %v", err)
+	}
+	if err := local.Revoke("session", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("unexpected error revoking session: %v", err)
+	}
+	if revoked, err := local.IsRevoked("session"); err != nil || !revoked {
+		t.Errorf("revocation should apply immediately on the revoking server: %v", err)
+	}
+	if revoked, err := strict.IsRevoked("session"); err != nil || !revoked {
+		t.Errorf("revocation should apply immediately when checking redis directly: %v", err)
+	}
+	if revoked, _ := synced.IsRevoked("session"); revoked {
+		t.Error("revocation applied before the local copy was due to sync")
+	}
+	synced.lastSync = time.Time{}
+	if revoked, err := synced.IsRevoked("session"); err != nil || !revoked {
+		t.Errorf("revocation not applied after the local copy synced: %v", err)
+	}
+
+	//lookups must fail closed when redis is unreachable
+	server.Close()
+	synced.lastSync = time.Time{}
+	if _, err := synced.IsRevoked("session"); err == nil {
+		t.Error("expected error syncing denylist while redis is down")
+	}
+}
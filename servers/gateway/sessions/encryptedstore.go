@@ -0,0 +1,160 @@
+package sessions
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+)
+
+//encryptedVersion is the first byte of every record
+//written by an EncryptedStore
+const encryptedVersion byte = 1
+
+//ErrDecryptFailed is returned when a saved record cannot be decrypted, either
+//because it was tampered with, was saved under a different SessionID,
+//or was encrypted with a key the store no longer has
+var ErrDecryptFailed = errors.New("session state could not be decrypted")
+
+//StoreKey is an encryption key used by an EncryptedStore
+type StoreKey struct {
+	//ID identifies the key in each record it encrypts,
+	//so records can still be read after rotating keys
+	ID byte
+	//Secret the AES-256 key is derived from
+	Secret string
+}
+
+//EncryptedStore represents a session.Store that encrypts session state before
+//saving it to another Store, so the state cannot be read by anyone with access
+//to the underlying store. Each record is sealed with AES-GCM using a fresh nonce
+//and the SessionID as associated data, so records cannot be moved between keys.
+//
+//Records are always encrypted with the first key. The others are only used to
+//decrypt records saved before the keys were rotated; such records are
+//re-encrypted with the first key the next time they are read.
+type EncryptedStore struct {
+	//Store the encrypted records are saved to.
+	Store Store
+	//Codec used to encode session state before it is encrypted; the JSONCodec if nil.
+	Codec Codec
+	keys  []StoreKey
+	aeads map[byte]cipher.AEAD
+}
+
+//NewEncryptedStore constructs a new EncryptedStore around `store`, encrypting
+//with the first of the `keys` and decrypting with any of them
+func NewEncryptedStore(store Store, codec Codec, keys ...StoreKey) (*EncryptedStore, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one encryption key is required")
+	}
+	aeads := map[byte]cipher.AEAD{}
+	for _, key := range keys {
+		if len(key.Secret) == 0 {
+			return nil, errors.New("encryption key secrets may not be empty")
+		}
+		if _, found := aeads[key.ID]; found {
+			return nil, errors.New("encryption key IDs must be unique")
+		}
+		secret := sha256.Sum256([]byte(key.Secret))
+		block, err := aes.NewCipher(secret[:])
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		aeads[key.ID] = aead
+	}
+	return &EncryptedStore{
+		Store: store,
+		Codec: codec,
+		keys:  keys,
+		aeads: aeads,
+	}, nil
+}
+
+//Save encrypts the provided `sessionState` and saves it
+//to the underlying store under the SessionID
+func (es *EncryptedStore) Save(sid SessionID, sessionState interface{}) error {
+	plaintext, err := codecOrDefault(es.Codec).Marshal(sessionState)
+	if err != nil {
+		return err
+	}
+	record, err := es.seal(sid, plaintext)
+	if err != nil {
+		return err
+	}
+	return es.Store.Save(sid, record)
+}
+
+//Get decrypts the state saved for the SessionID into `sessionState`
+func (es *EncryptedStore) Get(sid SessionID, sessionState interface{}) error {
+	var record []byte
+	if err := es.Store.Get(sid, &record); err != nil {
+		return err
+	}
+	plaintext, keyID, err := es.open(sid, record)
+	if err != nil {
+		return err
+	}
+	if keyID != es.keys[0].ID {
+		//rotate the record onto the current key
+		if rotated, err := es.seal(sid, plaintext); err == nil {
+			es.Store.Save(sid, rotated)
+		}
+	}
+	return codecOrDefault(es.Codec).Unmarshal(plaintext, sessionState)
+}
+
+//Delete deletes all state data associated with the SessionID from the store.
+func (es *EncryptedStore) Delete(sid SessionID) error {
+	return es.Store.Delete(sid)
+}
+
+//Exists reports whether state is saved for the SessionID, without
+//resetting its expiry time if the wrapped store is a Checker
+func (es *EncryptedStore) Exists(sid SessionID) (bool, error) {
+	return exists(es.Store, sid)
+}
+
+//seal encrypts `plaintext` with the current key. Records are laid out as:
+//+---------------------------------------------------+
+//|version|key ID|...nonce...|...sealed plaintext...|
+//+---------------------------------------------------+
+func (es *EncryptedStore) seal(sid SessionID, plaintext []byte) ([]byte, error) {
+	key := es.keys[0]
+	aead := es.aeads[key.ID]
+	record := make([]byte, 2+aead.NonceSize(), 2+aead.NonceSize()+len(plaintext)+aead.Overhead())
+	record[0] = encryptedVersion
+	record[1] = key.ID
+	nonce := record[2:]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(record, nonce, plaintext, additionalData(sid, key.ID)), nil
+}
+
+//open decrypts a record, returning the plaintext and the ID of the key it was encrypted with
+func (es *EncryptedStore) open(sid SessionID, record []byte) ([]byte, byte, error) {
+	if len(record) < 2 || record[0] != encryptedVersion {
+		return nil, 0, ErrDecryptFailed
+	}
+	aead, found := es.aeads[record[1]]
+	if !found || len(record) < 2+aead.NonceSize() {
+		return nil, 0, ErrDecryptFailed
+	}
+	nonce := record[2 : 2+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, record[2+aead.NonceSize():], additionalData(sid, record[1]))
+	if err != nil {
+		return nil, 0, ErrDecryptFailed
+	}
+	return plaintext, record[1], nil
+}
+
+//additionalData binds a record to its SessionID and the version and key it was encrypted with
+func additionalData(sid SessionID, keyID byte) []byte {
+	return append([]byte{encryptedVersion, keyID}, sid...)
+}
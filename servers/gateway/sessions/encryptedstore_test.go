@@ -0,0 +1,131 @@
+package sessions
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/my/repo/servers/gateway/redistest"
+)
+
+/*
+TestEncryptedStore runs the EncryptedStore through a full CRUD cycle over
+the MemStore and the RedisStore (using a local redis stand-in), with both
+codecs, and checks that nothing readable ends up in redis.
+*/
+func TestEncryptedStore(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+
+	cases := []struct {
+		name  string
+		store Store
+		codec Codec
+	}{
+		{"MemStore JSON", NewMemStore(time.Hour, time.Minute), JSONCodec},
+		{"MemStore Binary", NewMemStore(time.Hour, time.Minute), BinaryCodec},
+		{"RedisStore JSON", NewRedisStore(client, time.Hour), JSONCodec},
+		{"RedisStore Binary", &RedisStore{Client: client, SessionDuration: time.Hour, Codec: BinaryCodec}, BinaryCodec},
+	}
+	for _, c := range cases {
+		store, err := NewEncryptedStore(c.store, c.codec, StoreKey{1, "secret"})
+		if err != nil {
+			t.Fatalf("case %s: unexpected error creating store: %v", c.name, err)
+		}
+		state := &codecState{User: &codecUser{ID: 1, UserName: "secret-username"}}
+		sid, _ := NewSessionID("test key")
+		if err := store.Get(sid, &codecState{}); err != ErrStateNotFound {
+			t.Errorf("case %s: expected ErrStateNotFound before saving but got %v", c.name, err)
+		}
+		if err := store.Save(sid, state); err != nil {
+			t.Fatalf("case %s: unexpected error saving state: %v", c.name, err)
+		}
+		stateRet := &codecState{}
+		if err := store.Get(sid, stateRet); err != nil {
+			t.Fatalf("case %s: unexpected error getting state: %v", c.name, err)
+		}
+		if !reflect.DeepEqual(state, stateRet) {
+			t.Errorf("case %s: incorrect state retrieved:\nEXPECTED\n%+v\nACTUAL\n%+v", c.name, state, stateRet)
+		}
+		for _, key := range server.Keys() {
+			if value, _ := server.Get(key); strings.Contains(value, "secret-username") {
+				t.Errorf("case %s: session state readable in redis key %s", c.name, key)
+			}
+		}
+		if err := store.Delete(sid); err != nil {
+			t.Errorf("case %s: unexpected error deleting state: %v", c.name, err)
+		}
+		if err := store.Get(sid, stateRet); err != ErrStateNotFound {
+			t.Errorf("case %s: expected ErrStateNotFound after deleting but got %v", c.name, err)
+		}
+	}
+}
+
+func TestEncryptedStoreSwappedRecords(t *testing.T) {
+	inner := NewMemStore(time.Hour, time.Minute)
+	store, _ := NewEncryptedStore(inner, nil, StoreKey{1, "secret"})
+	victim, _ := NewSessionID("test key")
+	attacker, _ := NewSessionID("test key")
+	store.Save(victim, &codecState{User: &codecUser{ID: 1}})
+	store.Save(attacker, &codecState{User: &codecUser{ID: 2}})
+
+	//copy the victim's record over the attacker's session
+	var record []byte
+	inner.Get(victim, &record)
+	inner.Save(attacker, record)
+	if err := store.Get(attacker, &codecState{}); err != ErrDecryptFailed {
+		t.Errorf("expected ErrDecryptFailed for record moved between sessions but got %v", err)
+	}
+
+	//and tamper with the victim's record
+	record[len(record)-1] ^= 1
+	inner.Save(victim, record)
+	if err := store.Get(victim, &codecState{}); err != ErrDecryptFailed {
+		t.Errorf("expected ErrDecryptFailed for tampered record but got %v", err)
+	}
+}
+
+func TestEncryptedStoreKeyRotation(t *testing.T) {
+	inner := NewMemStore(time.Hour, time.Minute)
+	oldStore, _ := NewEncryptedStore(inner, nil, StoreKey{1, "old secret"})
+	sid, _ := NewSessionID("test key")
+	state := &codecState{User: &codecUser{ID: 1, UserName: "username"}}
+	oldStore.Save(sid, state)
+
+	rotated, err := NewEncryptedStore(inner, nil, StoreKey{2, "new secret"}, StoreKey{1, "old secret"})
+	if err != nil {
+		t.Fatalf("unexpected error creating store: %v", err)
+	}
+	stateRet := &codecState{}
+	if err := rotated.Get(sid, stateRet); err != nil || !reflect.DeepEqual(state, stateRet) {
+		t.Fatalf("could not read record encrypted with the previous key: %v", err)
+	}
+	//reading the record re-encrypted it with the new key
+	var record []byte
+	inner.Get(sid, &record)
+	if record[1] != 2 {
+		t.Errorf("record not re-encrypted with the current key: key ID %d", record[1])
+	}
+
+	//so the old key can then be retired
+	newOnly, _ := NewEncryptedStore(inner, nil, StoreKey{2, "new secret"})
+	if err := newOnly.Get(sid, stateRet); err != nil {
+		t.Errorf("unexpected error reading rotated record: %v", err)
+	}
+	if err := oldStore.Get(sid, stateRet); err != ErrDecryptFailed {
+		t.Errorf("expected ErrDecryptFailed reading with a retired key but got %v", err)
+	}
+
+	if _, err := NewEncryptedStore(inner, nil); err == nil {
+		t.Error("expected error creating store without keys")
+	}
+	if _, err := NewEncryptedStore(inner, nil, StoreKey{1, "a"}, StoreKey{1, "b"}); err == nil {
+		t.Error("expected error creating store with duplicate key IDs")
+	}
+}
@@ -1,7 +1,6 @@
 package sessions
 
 import (
-	"encoding/json"
 	"time"
 
 	"github.com/patrickmn/go-cache"
@@ -12,6 +11,8 @@ import (
 // Production systems should use a shared server store like redis
 type MemStore struct {
 	entries *cache.Cache
+	//Codec used to encode session state; the JSONCodec if nil.
+	Codec Codec
 }
 
 //NewMemStore constructs and returns a new MemStore
@@ -24,8 +25,10 @@ func NewMemStore(sessionDuration time.Duration, purgeInterval time.Duration) *Me
 //Save saves the provided `sessionState` and associated SessionID to the store.
 //The `sessionState` parameter is typically a pointer to a struct containing
 //all the data you want to associated with the given SessionID.
-func (ms *MemStore) Save(sid SessionID, state interface{}) error {
-	j, err := json.Marshal(state)
+func (ms *MemStore) Save(sid SessionID, state interface{}) (err error) {
+	start := time.Now()
+	defer func() { measure("memory", "save", start, err) }()
+	j, err := codecOrDefault(ms.Codec).Marshal(state)
 	if nil != err {
 		return err
 	}
@@ -35,18 +38,34 @@ func (ms *MemStore) Save(sid SessionID, state interface{}) error {
 
 //Get populates `sessionState` with the data previously saved
 //for the given SessionID
-func (ms *MemStore) Get(sid SessionID, state interface{}) error {
+func (ms *MemStore) Get(sid SessionID, state interface{}) (err error) {
+	start := time.Now()
+	defer func() { measure("memory", "get", start, err) }()
 	j, found := ms.entries.Get(sid.String())
 	if !found {
 		return ErrStateNotFound
 	}
 	//reset TTL
 	ms.entries.Set(sid.String(), j, 0)
-	return json.Unmarshal(j.([]byte), state)
+	return codecOrDefault(ms.Codec).Unmarshal(j.([]byte), state)
 }
 
 //Delete deletes all state data associated with the SessionID from the store.
 func (ms *MemStore) Delete(sid SessionID) error {
+	start := time.Now()
 	ms.entries.Delete(sid.String())
+	measure("memory", "delete", start, nil)
 	return nil
 }
+
+//Exists reports whether state is saved for the SessionID, without resetting its expiry time
+func (ms *MemStore) Exists(sid SessionID) (bool, error) {
+	_, found := ms.entries.Get(sid.String())
+	return found, nil
+}
+
+//Count returns the number of live sessions, including any
+//that have expired but not yet been purged
+func (ms *MemStore) Count() (int, error) {
+	return ms.entries.ItemCount(), nil
+}
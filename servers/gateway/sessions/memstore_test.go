@@ -52,10 +52,18 @@ func TestMemStore(t *testing.T) {
 		t.Errorf("incorrect state retrieved:\nEXPECTED\n%s\nACTUAL\n%s", string(jexp), string(jact))
 	}
 
+	if found, err := store.Exists(sid); !found || err != nil {
+		t.Errorf("expected saved state to exist but got %v, %v", found, err)
+	}
+
 	if err := store.Delete(sid); err != nil {
 		t.Errorf("error deleting state: %v", err)
 	}
 
+	if found, err := store.Exists(sid); found || err != nil {
+		t.Errorf("expected deleted state not to exist but got %v, %v", found, err)
+	}
+
 	if err := store.Get(sid, &stateRet); err != ErrStateNotFound {
 		t.Fatalf("incorrect error when getting state that was deleted: expected %v but got %v", ErrStateNotFound, err)
 	}
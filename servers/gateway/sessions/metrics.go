@@ -0,0 +1,29 @@
+package sessions
+
+import (
+	"time"
+
+	"github.com/my/repo/servers/gateway/metrics"
+)
+
+var (
+	storeDuration = metrics.Default.NewHistogramVec("gateway_session_store_duration_seconds",
+		"Time taken by session store operations, by store and operation.",
+		metrics.DefaultBuckets, "store", "op")
+	storeErrors = metrics.Default.NewCounterVec("gateway_session_store_errors_total",
+		"Session store operations that failed, by store and operation.", "store", "op")
+)
+
+//measure records the duration of the store operation begun at `start`, and
+//whether it failed. Sessions that are not found are not counted as failures.
+func measure(store, op string, start time.Time, err error) {
+	storeDuration.With(store, op).Observe(time.Since(start).Seconds())
+	if err != nil && err != ErrStateNotFound {
+		storeErrors.With(store, op).Inc()
+	}
+}
+
+//Counter is implemented by stores that can count their live sessions
+type Counter interface {
+	Count() (int, error)
+}
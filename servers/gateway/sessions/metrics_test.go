@@ -0,0 +1,57 @@
+package sessions
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/my/repo/servers/gateway/redistest"
+)
+
+func TestStoreMetrics(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	stores := map[string]interface {
+		Store
+		Counter
+	}{
+		"redis":  NewRedisStore(client, time.Hour),
+		"memory": NewMemStore(time.Hour, time.Minute),
+	}
+	client.Set("other", "not a session", 0)
+
+	for name, store := range stores {
+		gets := storeDuration.With(name, "get").Count()
+		errors := storeErrors.With(name, "get").Value()
+		for i := 0; i < 3; i++ {
+			sid, _ := NewSessionID("test key")
+			if err := store.Save(sid, &codecState{}); err != nil {
+				t.Fatalf("%s: unexpected error saving state: %v", name, err)
+			}
+		}
+		if count, err := store.Count(); err != nil || count != 3 {
+			t.Errorf("%s: expected 3 live sessions but got %d, %v", name, count, err)
+		}
+		//sessions that are not found are not failures
+		sid, _ := NewSessionID("test key")
+		store.Get(sid, &codecState{})
+		if storeDuration.With(name, "get").Count() != gets+1 || storeErrors.With(name, "get").Value() != errors {
+			t.Errorf("%s: expected a get to be timed but not counted as an error", name)
+		}
+	}
+
+	server.Close()
+	errors := storeErrors.With("redis", "get").Value()
+	sid, _ := NewSessionID("test key")
+	if err := stores["redis"].Get(sid, &codecState{}); err == nil {
+		t.Fatal("expected an error with redis down")
+	}
+	if storeErrors.With("redis", "get").Value() != errors+1 {
+		t.Error("expected the failed get to be counted")
+	}
+}
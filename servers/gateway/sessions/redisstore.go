@@ -1,7 +1,6 @@
 package sessions
 
 import (
-	"encoding/json"
 	"time"
 
 	"github.com/go-redis/redis"
@@ -15,6 +14,8 @@ type RedisStore struct {
 	Client *redis.Client
 	//Used for key expiry time on redis.
 	SessionDuration time.Duration
+	//Codec used to encode session state; the JSONCodec if nil.
+	Codec Codec
 }
 
 //NewRedisStore constructs a new RedisStore
@@ -22,8 +23,8 @@ func NewRedisStore(client *redis.Client, sessionDuration time.Duration) *RedisSt
 	// Client: client
 	// TODO: use param
 	return &RedisStore{
-		client,
-		sessionDuration,
+		Client:          client,
+		SessionDuration: sessionDuration,
 	}
 }
 
@@ -32,11 +33,13 @@ func NewRedisStore(client *redis.Client, sessionDuration time.Duration) *RedisSt
 //Save saves the provided `sessionState` and associated SessionID to the store.
 //The `sessionState` parameter is typically a pointer to a struct containing
 //all the data you want to associated with the given SessionID.
-func (rs *RedisStore) Save(sid SessionID, sessionState interface{}) error {
+func (rs *RedisStore) Save(sid SessionID, sessionState interface{}) (err error) {
+	start := time.Now()
+	defer func() { measure("redis", "save", start, err) }()
 	//marshal the `sessionState` to JSON and save it in the redis database,
 	//using `sid.getRedisKey()` for the key.
 	//return any errors that occur along the way.
-	data, err := json.Marshal(sessionState)
+	data, err := codecOrDefault(rs.Codec).Marshal(sessionState)
 	if err != nil {
 		return err
 	}
@@ -51,7 +54,18 @@ func (rs *RedisStore) Save(sid SessionID, sessionState interface{}) error {
 func (rs *RedisStore) Get(sid SessionID, sessionState interface{}) error {
 	//get the previously-saved session state data from redis,
 	//unmarshal it back into the `sessionState` parameter
+	data, err := rs.getRaw(sid)
+	if err != nil {
+		return err
+	}
+	return codecOrDefault(rs.Codec).Unmarshal(data, sessionState)
+}
 
+//getRaw returns the encoded session state saved for the SessionID,
+//resetting its expiry time
+func (rs *RedisStore) getRaw(sid SessionID) (data []byte, err error) {
+	start := time.Now()
+	defer func() { measure("redis", "get", start, err) }()
 	//for extra-credit using the Pipeline feature of the redis
 	//package to do both the get and the reset of the expiry time
 	//in just one network round trip!
@@ -61,24 +75,56 @@ func (rs *RedisStore) Get(sid SessionID, sessionState interface{}) error {
 	pipe.Exec()
 
 	data, getErr := get.Bytes()
+	if getErr == redis.Nil {
+		return nil, ErrStateNotFound
+	}
 	if getErr != nil {
-		return ErrStateNotFound
+		//the store could not be reached, which
+		//is not the same as the session having ended
+		return nil, getErr
 	}
 
 	if expire.Err() != nil {
-		return expire.Err()
+		return nil, expire.Err()
 	}
-
-	return json.Unmarshal(data, sessionState)
-
+	return data, nil
 }
 
 //Delete deletes all state data associated with the SessionID from the store.
-func (rs *RedisStore) Delete(sid SessionID) error {
+func (rs *RedisStore) Delete(sid SessionID) (err error) {
+	start := time.Now()
+	defer func() { measure("redis", "delete", start, err) }()
 	//delete the data stored in redis for the provided SessionID
 	return rs.Client.Del(sid.getRedisKey()).Err()
 }
 
+//Exists reports whether state is saved for the SessionID, without resetting its expiry time
+func (rs *RedisStore) Exists(sid SessionID) (found bool, err error) {
+	start := time.Now()
+	defer func() { measure("redis", "exists", start, err) }()
+	n, err := rs.Client.Exists(sid.getRedisKey()).Result()
+	return n == 1, err
+}
+
+//Count returns the number of live sessions. The keys are scanned
+//in batches, so it takes time in proportion to the size of the
+//database and should only be called every so often.
+func (rs *RedisStore) Count() (int, error) {
+	count := 0
+	var cursor uint64
+	for {
+		keys, next, err := rs.Client.Scan(cursor, "sid:*", 1000).Result()
+		if err != nil {
+			return 0, err
+		}
+		count += len(keys)
+		if next == 0 {
+			return count, nil
+		}
+		cursor = next
+	}
+}
+
 //getRedisKey() returns the redis key to use for the SessionID
 func (sid SessionID) getRedisKey() string {
 	//convert the SessionID to a string and add the prefix "sid:" to keep
@@ -0,0 +1,350 @@
+package sessions
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+//ErrStoreUnavailable is returned from a ResilientStore when the underlying
+//store cannot be reached and the session cannot be served any other way
+var ErrStoreUnavailable = errors.New("session store is unavailable")
+
+//FallbackPolicy decides what a ResilientStore does
+//while the underlying store is unavailable
+type FallbackPolicy int
+
+const (
+	//FailClosed rejects every request with ErrStoreUnavailable
+	FailClosed FallbackPolicy = iota
+	//ServeCached serves sessions read or saved shortly before the outage
+	//from a local copy, and rejects the rest with ErrStoreUnavailable
+	ServeCached
+)
+
+//BreakerState is the state of the circuit breaker of a ResilientStore
+type BreakerState int32
+
+const (
+	//BreakerClosed sends every call to the underlying store
+	BreakerClosed BreakerState = iota
+	//BreakerOpen sends no calls to the underlying store
+	BreakerOpen
+	//BreakerHalfOpen lets a single trial call through to the underlying store
+	BreakerHalfOpen
+)
+
+func (bs BreakerState) String() string {
+	switch bs {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+//ResilienceStats counts the paths taken by the calls to a ResilientStore
+type ResilienceStats struct {
+	//Primary is the number of calls answered by the underlying store
+	Primary uint64
+	//Fallback is the number of reads served from the local copy
+	Fallback uint64
+	//Rejected is the number of calls failed with ErrStoreUnavailable
+	Rejected uint64
+	//Failures is the number of calls to the underlying store that failed
+	//because it could not be reached
+	Failures uint64
+	//BreakerOpens is the number of times the circuit breaker opened
+	BreakerOpens uint64
+}
+
+//ResilientStore represents a session.Store that keeps working in a defined way
+//when the store it wraps cannot be reached. Calls that fail because the store is
+//unreachable count towards a circuit breaker; once FailureThreshold of them fail
+//in a row the breaker opens and calls stop going to the store, failing fast
+//according to the Policy instead of each waiting out a timeout. After Cooldown a
+//single trial call is let through, closing the breaker again if it succeeds.
+//If a Probe is given it is also run every ProbeInterval, so the breaker opens
+//and closes without waiting for requests.
+type ResilientStore struct {
+	//Store the calls are sent to while it is available.
+	Store Store
+	//Policy used while the store is unavailable.
+	Policy FallbackPolicy
+	//MaxStale bounds how long after it was last read from or saved to the store
+	//a local copy may be served under the ServeCached policy.
+	MaxStale time.Duration
+	//FailureThreshold is the number of failures in a row that opens the breaker.
+	FailureThreshold int
+	//Cooldown is how long the breaker stays open before a trial call is let through.
+	Cooldown time.Duration
+	//Codec used to encode the local copies; the JSONCodec if nil.
+	Codec Codec
+	//IsFailure reports whether an error returned by the store means it could
+	//not be reached; IsUnavailable if nil.
+	IsFailure func(error) bool
+	//OnStateChange, if set, is called whenever the breaker changes state.
+	OnStateChange func(from, to BreakerState)
+
+	probe         func() error
+	probeInterval time.Duration
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	trial    bool
+
+	local *cache.Cache
+	stats ResilienceStats
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+//NewResilientStore constructs a new ResilientStore around `store`. If `probe` is not nil,
+//it is run every `probeInterval` to check the health of the store, until Close is called.
+func NewResilientStore(store Store, policy FallbackPolicy, maxStale time.Duration, probe func() error, probeInterval time.Duration) *ResilientStore {
+	rs := &ResilientStore{
+		Store:            store,
+		Policy:           policy,
+		MaxStale:         maxStale,
+		FailureThreshold: 3,
+		Cooldown:         5 * time.Second,
+		probe:            probe,
+		probeInterval:    probeInterval,
+		local:            cache.New(maxStale, time.Minute),
+		done:             make(chan struct{}),
+	}
+	if probe != nil {
+		rs.wg.Add(1)
+		go rs.probeLoop()
+	}
+	return rs
+}
+
+//IsUnavailable reports whether the error means the
+//session store could not be reached
+func IsUnavailable(err error) bool {
+	if err == ErrStoreUnavailable || err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	_, isNetErr := err.(net.Error)
+	return isNetErr
+}
+
+//Save saves the provided `sessionState` and associated SessionID to the store.
+//Sessions cannot be saved while the store is unavailable.
+func (rs *ResilientStore) Save(sid SessionID, sessionState interface{}) error {
+	if !rs.allow() {
+		atomic.AddUint64(&rs.stats.Rejected, 1)
+		return ErrStoreUnavailable
+	}
+	err := rs.Store.Save(sid, sessionState)
+	if rs.record(err) {
+		atomic.AddUint64(&rs.stats.Rejected, 1)
+		return ErrStoreUnavailable
+	}
+	if err == nil {
+		rs.remember(sid, sessionState)
+	}
+	return err
+}
+
+//Get populates `sessionState` with the data previously saved for the
+//given SessionID, falling back to the Policy if the store is unavailable
+func (rs *ResilientStore) Get(sid SessionID, sessionState interface{}) error {
+	if !rs.allow() {
+		return rs.fallback(sid, sessionState)
+	}
+	err := rs.Store.Get(sid, sessionState)
+	if rs.record(err) {
+		return rs.fallback(sid, sessionState)
+	}
+	switch err {
+	case nil:
+		rs.remember(sid, sessionState)
+	case ErrStateNotFound:
+		rs.local.Delete(sid.String())
+	}
+	return err
+}
+
+//Delete deletes all state data associated with the SessionID from the store.
+//The local copy is always dropped, so an ended session is never served from it.
+func (rs *ResilientStore) Delete(sid SessionID) error {
+	rs.local.Delete(sid.String())
+	if !rs.allow() {
+		atomic.AddUint64(&rs.stats.Rejected, 1)
+		return ErrStoreUnavailable
+	}
+	err := rs.Store.Delete(sid)
+	if rs.record(err) {
+		atomic.AddUint64(&rs.stats.Rejected, 1)
+		return ErrStoreUnavailable
+	}
+	return err
+}
+
+//Exists reports whether state is saved for the SessionID, without
+//resetting its expiry time if the wrapped store is a Checker.
+//Whether a session exists cannot be told while the store is unavailable.
+func (rs *ResilientStore) Exists(sid SessionID) (bool, error) {
+	if !rs.allow() {
+		return false, ErrStoreUnavailable
+	}
+	found, err := exists(rs.Store, sid)
+	if rs.record(err) {
+		return false, ErrStoreUnavailable
+	}
+	return found, err
+}
+
+//State returns the current state of the circuit breaker
+func (rs *ResilientStore) State() BreakerState {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	return rs.state
+}
+
+//Stats returns a snapshot of the paths taken by calls so far
+func (rs *ResilientStore) Stats() ResilienceStats {
+	return ResilienceStats{
+		Primary:      atomic.LoadUint64(&rs.stats.Primary),
+		Fallback:     atomic.LoadUint64(&rs.stats.Fallback),
+		Rejected:     atomic.LoadUint64(&rs.stats.Rejected),
+		Failures:     atomic.LoadUint64(&rs.stats.Failures),
+		BreakerOpens: atomic.LoadUint64(&rs.stats.BreakerOpens),
+	}
+}
+
+//Close stops probing the store
+func (rs *ResilientStore) Close() error {
+	close(rs.done)
+	rs.wg.Wait()
+	return nil
+}
+
+//allow reports whether a call may be sent to the store
+func (rs *ResilientStore) allow() bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	switch rs.state {
+	case BreakerClosed:
+		return true
+	case BreakerOpen:
+		if time.Since(rs.openedAt) < rs.Cooldown {
+			return false
+		}
+		rs.setState(BreakerHalfOpen)
+	}
+	//only one trial call at a time while half-open
+	if rs.trial {
+		return false
+	}
+	rs.trial = true
+	return true
+}
+
+//record updates the breaker with the outcome of a call to the store,
+//returning true if the call failed because the store is unavailable
+func (rs *ResilientStore) record(err error) bool {
+	isFailure := IsUnavailable
+	if rs.IsFailure != nil {
+		isFailure = rs.IsFailure
+	}
+	failed := err != nil && isFailure(err)
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.trial = false
+	if !failed {
+		atomic.AddUint64(&rs.stats.Primary, 1)
+		rs.failures = 0
+		rs.setState(BreakerClosed)
+		return false
+	}
+	atomic.AddUint64(&rs.stats.Failures, 1)
+	rs.failures++
+	if rs.state == BreakerHalfOpen || rs.failures >= rs.FailureThreshold {
+		rs.open()
+	}
+	return true
+}
+
+//open opens the breaker; the caller holds rs.mu
+func (rs *ResilientStore) open() {
+	rs.openedAt = time.Now()
+	if rs.state != BreakerOpen {
+		atomic.AddUint64(&rs.stats.BreakerOpens, 1)
+	}
+	rs.setState(BreakerOpen)
+}
+
+//setState changes the state of the breaker; the caller holds rs.mu
+func (rs *ResilientStore) setState(state BreakerState) {
+	if rs.state == state {
+		return
+	}
+	from := rs.state
+	rs.state = state
+	if rs.OnStateChange != nil {
+		rs.OnStateChange(from, state)
+	}
+}
+
+//fallback answers a read the store could not, according to the Policy
+func (rs *ResilientStore) fallback(sid SessionID, sessionState interface{}) error {
+	if rs.Policy == ServeCached {
+		if data, found := rs.local.Get(sid.String()); found {
+			atomic.AddUint64(&rs.stats.Fallback, 1)
+			return codecOrDefault(rs.Codec).Unmarshal(data.([]byte), sessionState)
+		}
+	}
+	atomic.AddUint64(&rs.stats.Rejected, 1)
+	return ErrStoreUnavailable
+}
+
+//remember keeps a local copy of the session state to serve if the store becomes unavailable.
+//Copies are not extended when they are served, so none outlives MaxStale.
+func (rs *ResilientStore) remember(sid SessionID, sessionState interface{}) {
+	if rs.Policy != ServeCached {
+		return
+	}
+	if _, discarded := sessionState.(*discardState); discarded {
+		return
+	}
+	if data, err := codecOrDefault(rs.Codec).Marshal(sessionState); err == nil {
+		rs.local.Set(sid.String(), data, cache.DefaultExpiration)
+	}
+}
+
+//probeLoop checks the health of the store every probeInterval,
+//opening the breaker when it fails and closing it when it recovers
+func (rs *ResilientStore) probeLoop() {
+	defer rs.wg.Done()
+	ticker := time.NewTicker(rs.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := rs.probe()
+			rs.mu.Lock()
+			if err != nil {
+				rs.open()
+			} else {
+				rs.failures = 0
+				rs.setState(BreakerClosed)
+			}
+			rs.mu.Unlock()
+		case <-rs.done:
+			return
+		}
+	}
+}
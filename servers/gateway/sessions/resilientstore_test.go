@@ -0,0 +1,156 @@
+package sessions
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/my/repo/servers/gateway/redistest"
+)
+
+/*
+TestResilientStore simulates redis outages by stopping and restarting
+a local redis stand-in behind a RedisStore, and checks each fallback policy.
+*/
+func TestResilientStore(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy FallbackPolicy
+		//whether a session read before the outage can still be read during it
+		servesCached bool
+	}{
+		{"FailClosed", FailClosed, false},
+		{"ServeCached", ServeCached, true},
+	}
+	for _, c := range cases {
+		server, err := redistest.NewServer()
+		if err != nil {
+			t.Fatalf("error starting redis stand-in: %v", err)
+		}
+		client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+		store := NewResilientStore(NewRedisStore(client, time.Hour), c.policy, time.Hour, nil, 0)
+		store.Cooldown = time.Hour
+
+		known, _ := NewSessionID("test key")
+		unknown, _ := NewSessionID("test key")
+		state := &codecState{User: &codecUser{ID: 1, UserName: "username"}}
+		if err := store.Save(known, state); err != nil {
+			t.Fatalf("case %s: unexpected error saving state: %v", c.name, err)
+		}
+		if err := store.Get(unknown, &codecState{}); err != ErrStateNotFound {
+			t.Errorf("case %s: expected ErrStateNotFound while redis is up but got %v", c.name, err)
+		}
+		if found, err := store.Exists(known); !found || err != nil {
+			t.Errorf("case %s: expected the saved session to exist but got %v, %v", c.name, found, err)
+		}
+
+		server.Close()
+		for i := 0; i < store.FailureThreshold; i++ {
+			store.Get(unknown, &codecState{})
+		}
+		if store.State() != BreakerOpen {
+			t.Errorf("case %s: breaker %s after %d failures but should be open", c.name, store.State(), store.FailureThreshold)
+		}
+		stateRet := &codecState{}
+		err = store.Get(known, stateRet)
+		if c.servesCached {
+			if err != nil || !reflect.DeepEqual(state, stateRet) {
+				t.Errorf("case %s: expected the local copy to be served but got %v", c.name, err)
+			}
+		} else if err != ErrStoreUnavailable {
+			t.Errorf("case %s: expected ErrStoreUnavailable but got %v", c.name, err)
+		}
+		if err := store.Get(unknown, &codecState{}); err != ErrStoreUnavailable {
+			t.Errorf("case %s: expected ErrStoreUnavailable for a session without a local copy but got %v", c.name, err)
+		}
+		if err := store.Save(unknown, state); err != ErrStoreUnavailable {
+			t.Errorf("case %s: expected ErrStoreUnavailable saving during the outage but got %v", c.name, err)
+		}
+		if _, err := store.Exists(known); err != ErrStoreUnavailable {
+			t.Errorf("case %s: expected ErrStoreUnavailable checking a session during the outage but got %v", c.name, err)
+		}
+
+		//once the cooldown passes, a successful trial call closes the breaker
+		if err := server.Restart(); err != nil {
+			t.Fatalf("case %s: error restarting redis stand-in: %v", c.name, err)
+		}
+		store.Cooldown = 0
+		if err := store.Get(known, stateRet); err != nil {
+			t.Errorf("case %s: unexpected error after redis recovered: %v", c.name, err)
+		}
+		if store.State() != BreakerClosed {
+			t.Errorf("case %s: breaker %s after recovering but should be closed", c.name, store.State())
+		}
+
+		stats := store.Stats()
+		if stats.BreakerOpens != 1 || stats.Failures != uint64(store.FailureThreshold) {
+			t.Errorf("case %s: incorrect stats %+v", c.name, stats)
+		}
+		if c.servesCached && stats.Fallback != 1 || !c.servesCached && stats.Fallback != 0 {
+			t.Errorf("case %s: incorrect fallback count %d", c.name, stats.Fallback)
+		}
+		store.Close()
+		server.Close()
+	}
+}
+
+func TestResilientStoreMaxStale(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	store := NewResilientStore(NewRedisStore(client, time.Hour), ServeCached, 50*time.Millisecond, nil, 0)
+	defer store.Close()
+	store.FailureThreshold = 1
+	store.Cooldown = time.Hour
+
+	sid, _ := NewSessionID("test key")
+	store.Save(sid, &codecState{})
+	server.Close()
+	if err := store.Get(sid, &codecState{}); err != nil {
+		t.Errorf("expected the local copy to be served but got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := store.Get(sid, &codecState{}); err != ErrStoreUnavailable {
+		t.Errorf("expected ErrStoreUnavailable once the local copy is older than MaxStale but got %v", err)
+	}
+}
+
+func TestResilientStoreProbe(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	probe := func() error { return client.Ping().Err() }
+	store := NewResilientStore(NewRedisStore(client, time.Hour), FailClosed, time.Hour, probe, 10*time.Millisecond)
+	defer store.Close()
+	store.Cooldown = time.Hour
+
+	waitForState := func(state BreakerState) {
+		deadline := time.Now().Add(2 * time.Second)
+		for store.State() != state {
+			if time.Now().After(deadline) {
+				t.Fatalf("breaker never became %s", state)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	//the probe opens the breaker without any calls failing...
+	server.Close()
+	waitForState(BreakerOpen)
+	sid, _ := NewSessionID("test key")
+	if err := store.Get(sid, &codecState{}); err != ErrStoreUnavailable {
+		t.Errorf("expected ErrStoreUnavailable but got %v", err)
+	}
+	//...and closes it again without waiting out the cooldown
+	server.Restart()
+	waitForState(BreakerClosed)
+	if err := store.Get(sid, &codecState{}); err != ErrStateNotFound {
+		t.Errorf("expected ErrStateNotFound after recovering but got %v", err)
+	}
+}
@@ -1,10 +1,13 @@
 package sessions
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
 	"strings"
+
+	"github.com/my/repo/servers/gateway/tracing"
 )
 
 const headerAuthorization = "Authorization"
@@ -20,14 +23,34 @@ var ErrInvalidScheme = errors.New("authorization scheme not supported")
 //BeginSession creates a new SessionID, saves the `sessionState` to the store, adds an
 //Authorization header to the response with the SessionID, and returns the new SessionID
 func BeginSession(signingKey string, store Store, sessionState interface{}, w http.ResponseWriter) (SessionID, error) {
-	//- create a new SessionID
-	sessID, err := NewSessionID(signingKey)
-	if err != nil {
-		return InvalidSessionID, err
-	}
-	//- save the sessionState to the store
-	if err := store.Save(sessID, sessionState); err != nil {
-		return InvalidSessionID, err
+	return BeginSessionContext(context.Background(), signingKey, store, sessionState, w)
+}
+
+//BeginSessionContext begins a session as BeginSession does, tracing
+//the call to the store as part of the request the context belongs to
+func BeginSessionContext(ctx context.Context, signingKey string, store Store, sessionState interface{}, w http.ResponseWriter) (SessionID, error) {
+	//- create a new SessionID, letting stores that carry
+	//  the state in the SessionID itself issue it instead
+	var sessID SessionID
+	if issuer, ok := store.(TokenIssuer); ok {
+		_, span := tracing.Start(ctx, "sessions.Store.Issue")
+		id, err := issuer.Issue(signingKey, sessionState)
+		span.SetError(err)
+		span.End()
+		if err != nil {
+			return InvalidSessionID, err
+		}
+		sessID = id
+	} else {
+		id, err := NewSessionID(signingKey)
+		if err != nil {
+			return InvalidSessionID, err
+		}
+		//- save the sessionState to the store
+		if err := traceStore(ctx, store).Save(id, sessionState); err != nil {
+			return InvalidSessionID, err
+		}
+		sessID = id
 	}
 
 	//- add a header to the ResponseWriter that looks like this:
@@ -72,7 +95,7 @@ func GetState(r *http.Request, signingKey string, store Store, sessionState inte
 		return InvalidSessionID, err
 	}
 
-	if err := store.Get(id, sessionState); err != nil {
+	if err := traceStore(r.Context(), store).Get(id, sessionState); err != nil {
 		return InvalidSessionID, err
 	}
 
@@ -90,9 +113,60 @@ func EndSession(r *http.Request, signingKey string, store Store) (SessionID, err
 		return InvalidSessionID, err
 	}
 
-	if err := store.Delete(id); err != nil {
+	if err := traceStore(r.Context(), store).Delete(id); err != nil {
 		return InvalidSessionID, err
 	}
 
 	return id, nil
 }
+
+//RefreshSession extracts the SessionID from the request and, if the store
+//reissues expiring SessionIDs, replaces it with a fresh one when it is due,
+//adding the new SessionID to the Authorization header of the response.
+//It returns the SessionID the client should use from now on.
+func RefreshSession(r *http.Request, signingKey string, store Store, w http.ResponseWriter) (SessionID, error) {
+	id, err := GetSessionID(r, signingKey)
+	if err != nil {
+		return InvalidSessionID, err
+	}
+	refresher, ok := store.(Refresher)
+	if !ok {
+		return id, nil
+	}
+	_, span := tracing.Start(r.Context(), "sessions.Store.Refresh")
+	newID, err := refresher.Refresh(signingKey, id)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		return InvalidSessionID, err
+	}
+	if newID != id {
+		w.Header().Set(headerAuthorization, schemeBearer+newID.String())
+	}
+	return newID, nil
+}
+
+//ReissueSession extracts the SessionID from the request and, if the store
+//carries session state in the SessionID, replaces it with one carrying
+//`sessionState`, adding the new SessionID to the Authorization header of
+//the response. Other stores are left unchanged. It returns the SessionID
+//the client should use from now on.
+func ReissueSession(r *http.Request, signingKey string, store Store, sessionState interface{}, w http.ResponseWriter) (SessionID, error) {
+	id, err := GetSessionID(r, signingKey)
+	if err != nil {
+		return InvalidSessionID, err
+	}
+	reissuer, ok := store.(Reissuer)
+	if !ok {
+		return id, nil
+	}
+	_, span := tracing.Start(r.Context(), "sessions.Store.Reissue")
+	newID, err := reissuer.Reissue(signingKey, id, sessionState)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		return InvalidSessionID, err
+	}
+	w.Header().Set(headerAuthorization, schemeBearer+newID.String())
+	return newID, nil
+}
@@ -75,10 +75,18 @@ func ValidateID(id string, signingKey string) (SessionID, error) {
 	//HMAC hash stored in the remaining bytes. If they match,
 	//return the entire `id` parameter as a SessionID type.
 	//If not, return InvalidSessionID and ErrInvalidID.
+	//session tokens issued by a TokenStore carry their own signature
+	if isToken(id) {
+		return validateToken(id, signingKey)
+	}
 	decodedID, err := base64.URLEncoding.DecodeString(id)
 	if err != nil {
 		return InvalidSessionID, err
 	}
+	//IDs of any other length were not made by NewSessionID
+	if len(decodedID) != signedLength {
+		return InvalidSessionID, ErrInvalidID
+	}
 	idPortion := decodedID[0:idLength]
 	compare := decodedID[idLength:]
 	remaining := hmac.New(sha256.New, []byte(signingKey))
@@ -96,3 +104,11 @@ func ValidateID(id string, signingKey string) (SessionID, error) {
 func (sid SessionID) String() string {
 	return string(sid)
 }
+
+//Fingerprint returns a hash identifying the session in logs and to
+//other services, which unlike the SessionID itself cannot be used to
+//act as the session's user
+func (sid SessionID) Fingerprint() string {
+	sum := sha256.Sum256([]byte(sid))
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
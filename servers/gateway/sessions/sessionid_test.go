@@ -128,6 +128,16 @@ func TestValidateID(t *testing.T) {
 			},
 			true,
 		},
+		{
+			"Shorter Than ID Portion",
+			"If the decoded ID is too short to hold an ID and its signature, it should return an error",
+			"test key",
+			"test key",
+			func(sid SessionID) SessionID {
+				return SessionID("nope")
+			},
+			true,
+		},
 	}
 
 	for _, c := range cases {
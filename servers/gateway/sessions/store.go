@@ -26,3 +26,23 @@ type Store interface {
 	//Delete deletes all state data associated with the SessionID from the store.
 	Delete(sid SessionID) error
 }
+
+//Checker is implemented by stores that can tell whether a session is live
+//without resetting its expiry time, as getting its state does
+type Checker interface {
+	//Exists reports whether state is saved for the SessionID
+	Exists(sid SessionID) (bool, error)
+}
+
+//exists reports whether state is saved for the SessionID in the store,
+//leaving its expiry time alone if the store is a Checker
+func exists(store Store, sid SessionID) (bool, error) {
+	if checker, ok := store.(Checker); ok {
+		return checker.Exists(sid)
+	}
+	err := store.Get(sid, &discardState{})
+	if err == ErrStateNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
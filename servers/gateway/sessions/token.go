@@ -0,0 +1,326 @@
+package sessions
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+//tokenPrefix marks a signed session token, and tokenPrefixEncrypted
+//marks one whose claims are also encrypted. Neither contains characters
+//from the base64 URL alphabet's padding or a ".", so tokens can never be
+//mistaken for the opaque SessionIDs created by NewSessionID
+const tokenPrefix = "v1"
+const tokenPrefixEncrypted = "v1e"
+
+//ErrStatelessSave is returned from TokenStore.Save, since the state of a
+//token-based session is fixed when the token is issued
+var ErrStatelessSave = errors.New("session state is carried in the token and cannot be saved separately")
+
+//ErrRefreshExpired is returned when a token can no longer be refreshed
+//because its session has reached the store's maximum age
+var ErrRefreshExpired = errors.New("session has reached its maximum age and cannot be refreshed")
+
+//TokenIssuer is implemented by stores that carry the session state
+//inside the SessionID itself. BeginSession uses Issue instead of
+//NewSessionID and Save when the store is a TokenIssuer.
+type TokenIssuer interface {
+	//Issue returns a new SessionID signed with `signingKey`
+	//that carries the provided `sessionState`
+	Issue(signingKey string, sessionState interface{}) (SessionID, error)
+}
+
+//Refresher is implemented by stores whose SessionIDs expire on their
+//own and have to be periodically reissued to the client
+type Refresher interface {
+	//Refresh returns a replacement for `sid` if it is due to be
+	//reissued, or `sid` itself if it is not
+	Refresh(signingKey string, sid SessionID) (SessionID, error)
+}
+
+//Reissuer is implemented by stores whose session state is carried in the
+//SessionID, so that changing the state means issuing a new SessionID
+type Reissuer interface {
+	//Reissue returns a new SessionID for the same session as `sid`,
+	//carrying the provided `sessionState` instead of its own
+	Reissue(signingKey string, sid SessionID, sessionState interface{}) (SessionID, error)
+}
+
+//Expirer is implemented by stores whose sessions expire at a time fixed when their
+//SessionID was issued, rather than once they have been left idle for a while
+type Expirer interface {
+	//Expiry returns when the session expires
+	Expiry(sid SessionID) (time.Time, error)
+}
+
+//tokenClaims is the payload of a session token
+type tokenClaims struct {
+	//Session identifies the session, and stays the same
+	//when the token is refreshed so that revoking it ends
+	//every token issued for the session
+	Session string `json:"sid"`
+	//IssuedAt and Expires are the unix times the token
+	//was issued and stops being valid
+	IssuedAt int64 `json:"iat"`
+	Expires  int64 `json:"exp"`
+	//AuthTime is the unix time the session began
+	AuthTime int64 `json:"sat"`
+	//State is the JSON encoded session state
+	State json.RawMessage `json:"st"`
+}
+
+//TokenStore represents a session.Store that keeps no server-side
+//state. The session state is carried in a compact signed (and
+//optionally encrypted) token that is used as the SessionID, so
+//loading it costs no round trip. Tokens are short lived and are
+//reissued by Refresh; ending a session adds it to a Denylist
+//until every token issued for it has expired. Since the store cannot
+//find the sessions of a user, a token's state only changes when the
+//client holding it is given a new one by Reissue; other tokens keep
+//the state they were issued with until their session ends.
+type TokenStore struct {
+	//Lifetime is how long each token is valid for
+	Lifetime time.Duration
+	//MaxAge bounds how long a session can be kept alive by refreshing
+	MaxAge time.Duration
+	//Denylist holds the sessions that have ended before their tokens expired
+	Denylist Denylist
+	aead     cipher.AEAD
+}
+
+//NewTokenStore constructs a new TokenStore. If `encryptionKey` is
+//non-empty the token claims are also encrypted with AES-GCM, using
+//a key derived from it, so the session state cannot be read by the client.
+func NewTokenStore(encryptionKey string, lifetime time.Duration, maxAge time.Duration, denylist Denylist) (*TokenStore, error) {
+	ts := &TokenStore{
+		Lifetime: lifetime,
+		MaxAge:   maxAge,
+		Denylist: denylist,
+	}
+	if len(encryptionKey) != 0 {
+		key := sha256.Sum256([]byte(encryptionKey))
+		block, err := aes.NewCipher(key[:])
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		ts.aead = aead
+	}
+	return ts, nil
+}
+
+//Issue returns a new token signed with `signingKey` that carries the
+//provided `sessionState`
+func (ts *TokenStore) Issue(signingKey string, sessionState interface{}) (SessionID, error) {
+	if len(signingKey) == 0 {
+		return InvalidSessionID, errors.New("Signing key may not be empty")
+	}
+	state, err := json.Marshal(sessionState)
+	if err != nil {
+		return InvalidSessionID, err
+	}
+	randBytes := make([]byte, 16)
+	if _, err := rand.Read(randBytes); err != nil {
+		return InvalidSessionID, err
+	}
+	now := time.Now()
+	return ts.sign(signingKey, &tokenClaims{
+		Session:  base64.RawURLEncoding.EncodeToString(randBytes),
+		IssuedAt: now.Unix(),
+		Expires:  now.Add(ts.Lifetime).Unix(),
+		AuthTime: now.Unix(),
+		State:    state,
+	})
+}
+
+//Save always returns ErrStatelessSave, since a token's state
+//cannot be changed after it has been issued
+func (ts *TokenStore) Save(sid SessionID, sessionState interface{}) error {
+	return ErrStatelessSave
+}
+
+//Get populates `sessionState` with the state carried in the token. It
+//returns ErrStateNotFound if the token has expired or its session has ended.
+func (ts *TokenStore) Get(sid SessionID, sessionState interface{}) error {
+	claims, err := ts.claims(sid)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(claims.State, sessionState)
+}
+
+//Delete ends the session the token was issued for, so that neither it
+//nor any other token issued for the same session is accepted again
+func (ts *TokenStore) Delete(sid SessionID) error {
+	claims, err := ts.decode(sid)
+	if err != nil {
+		return err
+	}
+	return ts.Denylist.Revoke(claims.Session, time.Now().Add(ts.Lifetime))
+}
+
+//Expiry returns when the token expires, unless it is refreshed first. It
+//returns ErrStateNotFound if the token has expired or its session has ended.
+func (ts *TokenStore) Expiry(sid SessionID) (time.Time, error) {
+	claims, err := ts.claims(sid)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(claims.Expires, 0), nil
+}
+
+//Refresh returns a new token for the same session once more than half of
+//the lifetime of `sid` has elapsed, or `sid` itself if it is not yet due.
+//Sessions older than MaxAge are not refreshed.
+func (ts *TokenStore) Refresh(signingKey string, sid SessionID) (SessionID, error) {
+	claims, err := ts.claims(sid)
+	if err != nil {
+		return InvalidSessionID, err
+	}
+	now := time.Now()
+	if now.Before(time.Unix(claims.IssuedAt, 0).Add(ts.Lifetime / 2)) {
+		return sid, nil
+	}
+	maxExpiry := time.Unix(claims.AuthTime, 0).Add(ts.MaxAge)
+	if !now.Before(maxExpiry) {
+		return InvalidSessionID, ErrRefreshExpired
+	}
+	expires := now.Add(ts.Lifetime)
+	if expires.After(maxExpiry) {
+		expires = maxExpiry
+	}
+	claims.IssuedAt = now.Unix()
+	claims.Expires = expires.Unix()
+	return ts.sign(signingKey, claims)
+}
+
+//Reissue returns a new token for the same session as `sid` that carries
+//`sessionState`. The session keeps its start time, so reissuing it does not
+//extend it past MaxAge. Tokens issued for the session before stay valid
+//until they expire.
+func (ts *TokenStore) Reissue(signingKey string, sid SessionID, sessionState interface{}) (SessionID, error) {
+	claims, err := ts.claims(sid)
+	if err != nil {
+		return InvalidSessionID, err
+	}
+	state, err := json.Marshal(sessionState)
+	if err != nil {
+		return InvalidSessionID, err
+	}
+	now := time.Now()
+	maxExpiry := time.Unix(claims.AuthTime, 0).Add(ts.MaxAge)
+	if !now.Before(maxExpiry) {
+		return InvalidSessionID, ErrRefreshExpired
+	}
+	expires := now.Add(ts.Lifetime)
+	if expires.After(maxExpiry) {
+		expires = maxExpiry
+	}
+	claims.IssuedAt = now.Unix()
+	claims.Expires = expires.Unix()
+	claims.State = state
+	return ts.sign(signingKey, claims)
+}
+
+//claims decodes `sid` and checks that it is still valid
+func (ts *TokenStore) claims(sid SessionID) (*tokenClaims, error) {
+	claims, err := ts.decode(sid)
+	if err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return nil, ErrStateNotFound
+	}
+	revoked, err := ts.Denylist.IsRevoked(claims.Session)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrStateNotFound
+	}
+	return claims, nil
+}
+
+//sign encodes and signs the claims, encrypting them first
+//if the store has an encryption key
+func (ts *TokenStore) sign(signingKey string, claims *tokenClaims) (SessionID, error) {
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return InvalidSessionID, err
+	}
+	prefix := tokenPrefix
+	if ts.aead != nil {
+		prefix = tokenPrefixEncrypted
+		nonce := make([]byte, ts.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return InvalidSessionID, err
+		}
+		payload = ts.aead.Seal(nonce, nonce, payload, []byte(prefix))
+	}
+	unsigned := prefix + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return SessionID(unsigned + "." + tokenSignature(unsigned, signingKey)), nil
+}
+
+//decode returns the claims carried in `sid`. The signature is
+//expected to have already been checked by ValidateID.
+func (ts *TokenStore) decode(sid SessionID) (*tokenClaims, error) {
+	parts := strings.Split(string(sid), ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidID
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidID
+	}
+	switch parts[0] {
+	case tokenPrefix:
+	case tokenPrefixEncrypted:
+		if ts.aead == nil || len(payload) < ts.aead.NonceSize() {
+			return nil, ErrInvalidID
+		}
+		nonceSize := ts.aead.NonceSize()
+		payload, err = ts.aead.Open(nil, payload[:nonceSize], payload[nonceSize:], []byte(parts[0]))
+		if err != nil {
+			return nil, ErrInvalidID
+		}
+	default:
+		return nil, ErrInvalidID
+	}
+	claims := &tokenClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, ErrInvalidID
+	}
+	return claims, nil
+}
+
+//isToken reports whether `id` has the shape of a session token
+//rather than an opaque SessionID
+func isToken(id string) bool {
+	return strings.Count(id, ".") == 2
+}
+
+//validateToken checks the signature of the session token in `id`
+func validateToken(id string, signingKey string) (SessionID, error) {
+	sep := strings.LastIndex(id, ".")
+	if hmac.Equal([]byte(id[sep+1:]), []byte(tokenSignature(id[:sep], signingKey))) {
+		return SessionID(id), nil
+	}
+	return InvalidSessionID, ErrInvalidID
+}
+
+//tokenSignature returns the encoded HMAC of `unsigned` using `signingKey`
+func tokenSignature(unsigned string, signingKey string) string {
+	mac := hmac.New(sha256.New, []byte(signingKey))
+	mac.Write([]byte(unsigned))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,270 @@
+package sessions
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+TestTokenStoreCycle runs through the full cycle of session methods
+(BeginSession, GetState, EndSession) using a TokenStore, with and
+without encryption, to ensure the handlers see the same behavior
+they get from the MemStore and RedisStore.
+*/
+func TestTokenStoreCycle(t *testing.T) {
+	type sessionState struct {
+		Sval string
+		Ival int
+	}
+	key := "test key"
+	cases := []struct {
+		name          string
+		encryptionKey string
+	}{
+		{"Signed Tokens", ""},
+		{"Encrypted Tokens", "encryption key"},
+	}
+	for _, c := range cases {
+		store, err := NewTokenStore(c.encryptionKey, time.Minute, time.Hour, NewMemDenylist(time.Minute))
+		if err != nil {
+			t.Fatalf("case %s: error creating token store: %v", c.name, err)
+		}
+		state := sessionState{"secret-value", 99}
+		respRec := httptest.NewRecorder()
+		sid, err := BeginSession(key, store, state, respRec)
+		if err != nil {
+			t.Fatalf("case %s: error beginning session: %v", c.name, err)
+		}
+		token := respRec.Header().Get(headerAuthorization)
+		if token != schemeBearer+sid.String() {
+			t.Errorf("case %s: incorrect Authorization header: %s", c.name, token)
+		}
+
+		//the claims should only be readable when not encrypted
+		payload, _ := base64.RawURLEncoding.DecodeString(strings.Split(sid.String(), ".")[1])
+		readable := strings.Contains(string(payload), "secret-value")
+		if readable != (len(c.encryptionKey) == 0) {
+			t.Errorf("case %s: session state readable in token = %v", c.name, readable)
+		}
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Add(headerAuthorization, token)
+		stateRet := sessionState{}
+		sid2, err := GetState(req, key, store, &stateRet)
+		if err != nil {
+			t.Fatalf("case %s: unexpected error getting session state: %v", c.name, err)
+		}
+		if sid2 != sid || stateRet != state {
+			t.Errorf("case %s: incorrect session state: expected %v but got %v", c.name, state, stateRet)
+		}
+
+		//a token signed with a different key must be rejected
+		if _, err := GetState(req, "different key", store, &stateRet); err == nil {
+			t.Errorf("case %s: expected error getting state with a different signing key", c.name)
+		}
+
+		if _, err := EndSession(req, key, store); err != nil {
+			t.Errorf("case %s: unexpected error ending session: %v", c.name, err)
+		}
+		if _, err := GetState(req, key, store, &stateRet); err != ErrStateNotFound {
+			t.Errorf("case %s: expected ErrStateNotFound after ending session but got %v", c.name, err)
+		}
+	}
+}
+
+func TestTokenStoreTampering(t *testing.T) {
+	key := "test key"
+	store, _ := NewTokenStore("", time.Minute, time.Hour, NewMemDenylist(time.Minute))
+	sid, err := store.Issue(key, map[string]string{"user": "alice"})
+	if err != nil {
+		t.Fatalf("error issuing token: %v", err)
+	}
+	//swap in a different payload but keep the original signature
+	forged, _ := store.Issue(key, map[string]string{"user": "mallory"})
+	parts := strings.Split(sid.String(), ".")
+	forgedParts := strings.Split(forged.String(), ".")
+	tampered := parts[0] + "." + forgedParts[1] + "." + parts[2]
+	if _, err := ValidateID(tampered, key); err != ErrInvalidID {
+		t.Errorf("expected ErrInvalidID for tampered token but got %v", err)
+	}
+	if _, err := ValidateID(sid.String(), key); err != nil {
+		t.Errorf("unexpected error validating token: %v", err)
+	}
+
+	//an encrypted token cannot be read by a store without the key
+	encrypted, _ := NewTokenStore("encryption key", time.Minute, time.Hour, NewMemDenylist(time.Minute))
+	esid, _ := encrypted.Issue(key, map[string]string{"user": "alice"})
+	state := map[string]string{}
+	if err := store.Get(esid, &state); err != ErrInvalidID {
+		t.Errorf("expected ErrInvalidID reading encrypted token without key but got %v", err)
+	}
+	other, _ := NewTokenStore("other key", time.Minute, time.Hour, NewMemDenylist(time.Minute))
+	if err := other.Get(esid, &state); err != ErrInvalidID {
+		t.Errorf("expected ErrInvalidID reading encrypted token with the wrong key but got %v", err)
+	}
+}
+
+func TestTokenStoreExpiryAndRefresh(t *testing.T) {
+	key := "test key"
+	denylist := NewMemDenylist(time.Minute)
+	store, _ := NewTokenStore("", 10*time.Minute, time.Hour, denylist)
+	now := time.Now()
+	issue := func(issuedAgo time.Duration, authAgo time.Duration) SessionID {
+		sid, err := store.sign(key, &tokenClaims{
+			Session:  "session",
+			IssuedAt: now.Add(-issuedAgo).Unix(),
+			Expires:  now.Add(-issuedAgo).Add(store.Lifetime).Unix(),
+			AuthTime: now.Add(-authAgo).Unix(),
+			State:    []byte(`"state"`),
+		})
+		if err != nil {
+			t.Fatalf("error signing token: %v", err)
+		}
+		return sid
+	}
+
+	var state string
+	if err := store.Get(issue(11*time.Minute, 11*time.Minute), &state); err != ErrStateNotFound {
+		t.Errorf("expected ErrStateNotFound for expired token but got %v", err)
+	}
+
+	fresh := issue(time.Minute, time.Minute)
+	if sid, err := store.Refresh(key, fresh); err != nil || sid != fresh {
+		t.Errorf("token should not be refreshed before half its lifetime: %v", err)
+	}
+
+	due := issue(6*time.Minute, 30*time.Minute)
+	refreshed, err := store.Refresh(key, due)
+	if err != nil {
+		t.Fatalf("unexpected error refreshing token: %v", err)
+	}
+	if refreshed == due {
+		t.Error("token past half its lifetime was not refreshed")
+	}
+	if _, err := ValidateID(refreshed.String(), key); err != nil {
+		t.Errorf("refreshed token failed validation: %v", err)
+	}
+	claims, _ := store.decode(refreshed)
+	if claims.Session != "session" || claims.AuthTime != now.Add(-30*time.Minute).Unix() {
+		t.Error("refreshed token should keep the session and its begin time")
+	}
+	if err := store.Get(refreshed, &state); err != nil || state != "state" {
+		t.Errorf("unexpected error getting refreshed state: %v", err)
+	}
+	if expiry, err := store.Expiry(refreshed); err != nil || expiry.Unix() != claims.Expires {
+		t.Errorf("expected the refreshed token to expire at %d but got %v, %v", claims.Expires, expiry, err)
+	}
+
+	if _, err := store.Refresh(key, issue(6*time.Minute, 2*time.Hour)); err != ErrRefreshExpired {
+		t.Errorf("expected ErrRefreshExpired for session past its maximum age but got %v", err)
+	}
+
+	//ending the session must revoke the old and the refreshed token alike
+	if err := store.Delete(refreshed); err != nil {
+		t.Fatalf("unexpected error deleting session: %v", err)
+	}
+	if err := store.Get(due, &state); err != ErrStateNotFound {
+		t.Errorf("expected ErrStateNotFound for token of ended session but got %v", err)
+	}
+	if _, err := store.Refresh(key, due); err != ErrStateNotFound {
+		t.Errorf("expected ErrStateNotFound refreshing token of ended session but got %v", err)
+	}
+	if _, err := store.Expiry(due); err != ErrStateNotFound {
+		t.Errorf("expected ErrStateNotFound for the expiry of an ended session but got %v", err)
+	}
+	if err := store.Save(refreshed, "state"); err != ErrStatelessSave {
+		t.Errorf("expected ErrStatelessSave but got %v", err)
+	}
+}
+
+func TestRefreshSession(t *testing.T) {
+	key := "test key"
+	store, _ := NewTokenStore("", 10*time.Minute, time.Hour, NewMemDenylist(time.Minute))
+	due, _ := store.sign(key, &tokenClaims{
+		Session:  "session",
+		IssuedAt: time.Now().Add(-6 * time.Minute).Unix(),
+		Expires:  time.Now().Add(4 * time.Minute).Unix(),
+		AuthTime: time.Now().Add(-6 * time.Minute).Unix(),
+		State:    []byte(`1`),
+	})
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Add(headerAuthorization, schemeBearer+due.String())
+	respRec := httptest.NewRecorder()
+	sid, err := RefreshSession(req, key, store, respRec)
+	if err != nil {
+		t.Fatalf("unexpected error refreshing session: %v", err)
+	}
+	if sid == due || respRec.Header().Get(headerAuthorization) != schemeBearer+sid.String() {
+		t.Error("refreshed token was not returned in the Authorization header")
+	}
+
+	//stores with server-side state are left alone
+	memstore := NewMemStore(time.Hour, time.Minute)
+	respRec = httptest.NewRecorder()
+	sessID, _ := BeginSession(key, memstore, 1, respRec)
+	req.Header.Set(headerAuthorization, schemeBearer+sessID.String())
+	respRec = httptest.NewRecorder()
+	if sid, err := RefreshSession(req, key, memstore, respRec); err != nil || sid != sessID {
+		t.Errorf("unexpected refresh of MemStore session: %v", err)
+	}
+	if len(respRec.Header().Get(headerAuthorization)) != 0 {
+		t.Error("no Authorization header should be set for MemStore sessions")
+	}
+}
+
+func TestReissueSession(t *testing.T) {
+	key := "test key"
+	store, _ := NewTokenStore("", 10*time.Minute, time.Hour, NewMemDenylist(time.Minute))
+	authTime := time.Now().Add(-58 * time.Minute).Unix()
+	old, _ := store.sign(key, &tokenClaims{
+		Session:  "session",
+		IssuedAt: time.Now().Unix(),
+		Expires:  time.Now().Add(2 * time.Minute).Unix(),
+		AuthTime: authTime,
+		State:    []byte(`1`),
+	})
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Add(headerAuthorization, schemeBearer+old.String())
+	respRec := httptest.NewRecorder()
+	sid, err := ReissueSession(req, key, store, 2, respRec)
+	if err != nil {
+		t.Fatalf("unexpected error reissuing session: %v", err)
+	}
+	if sid == old || respRec.Header().Get(headerAuthorization) != schemeBearer+sid.String() {
+		t.Error("reissued token was not returned in the Authorization header")
+	}
+	state := 0
+	if err := store.Get(sid, &state); err != nil || state != 2 {
+		t.Errorf("reissued token carries state %d (error %v), expected 2", state, err)
+	}
+	//the reissued token belongs to the same session, and cannot outlive it
+	claims, _ := store.decode(sid)
+	if claims.Session != "session" || claims.AuthTime != authTime {
+		t.Errorf("reissued token began a new session: %+v", claims)
+	}
+	if expiry, _ := store.Expiry(sid); expiry.After(time.Unix(authTime, 0).Add(time.Hour)) {
+		t.Errorf("reissued token expires at %v, after the session's maximum age", expiry)
+	}
+	//ending the session revokes the reissued token too
+	store.Delete(old)
+	if err := store.Get(sid, &state); err != ErrStateNotFound {
+		t.Errorf("expected ErrStateNotFound for token of ended session but got %v", err)
+	}
+
+	//stores with server-side state are left alone
+	memstore := NewMemStore(time.Hour, time.Minute)
+	respRec = httptest.NewRecorder()
+	sessID, _ := BeginSession(key, memstore, 1, respRec)
+	req.Header.Set(headerAuthorization, schemeBearer+sessID.String())
+	respRec = httptest.NewRecorder()
+	if sid, err := ReissueSession(req, key, memstore, 2, respRec); err != nil || sid != sessID {
+		t.Errorf("unexpected reissue of MemStore session: %v", err)
+	}
+	if len(respRec.Header().Get(headerAuthorization)) != 0 {
+		t.Error("no Authorization header should be set for MemStore sessions")
+	}
+}
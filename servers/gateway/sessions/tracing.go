@@ -0,0 +1,86 @@
+package sessions
+
+import (
+	"context"
+
+	"github.com/my/repo/servers/gateway/tracing"
+)
+
+//tracedStore traces the calls made to a store as part of a request
+type tracedStore struct {
+	ctx   context.Context
+	store Store
+}
+
+//traceStore returns the store, with its calls traced as part of
+//the request the context belongs to
+func traceStore(ctx context.Context, store Store) Store {
+	if tracing.FromContext(ctx) == nil {
+		return store
+	}
+	return &tracedStore{ctx: ctx, store: store}
+}
+
+//trace begins the span of a call to the store
+func (ts *tracedStore) trace(op string) *tracing.Span {
+	_, span := tracing.StartClient(ts.ctx, "sessions.Store."+op)
+	return span
+}
+
+//end ends the span of a call, which failed if it returned an error other than ErrStateNotFound
+func end(span *tracing.Span, err error) {
+	if err != ErrStateNotFound {
+		span.SetError(err)
+	}
+	span.End()
+}
+
+func (ts *tracedStore) Save(sid SessionID, sessionState interface{}) error {
+	span := ts.trace("Save")
+	err := ts.store.Save(sid, sessionState)
+	end(span, err)
+	return err
+}
+
+func (ts *tracedStore) Get(sid SessionID, sessionState interface{}) error {
+	span := ts.trace("Get")
+	err := ts.store.Get(sid, sessionState)
+	end(span, err)
+	return err
+}
+
+func (ts *tracedStore) Delete(sid SessionID) error {
+	span := ts.trace("Delete")
+	err := ts.store.Delete(sid)
+	end(span, err)
+	return err
+}
+
+//tracedUserSessions traces the calls made to a UserSessions store as part of a request
+type tracedUserSessions struct {
+	tracedStore
+	userSessions UserSessions
+}
+
+//TraceUserSessions returns the store, with its calls traced as
+//part of the request the context belongs to
+func TraceUserSessions(ctx context.Context, userSessions UserSessions) UserSessions {
+	if tracing.FromContext(ctx) == nil {
+		return userSessions
+	}
+	return &tracedUserSessions{tracedStore{ctx, userSessions}, userSessions}
+}
+
+func (tus *tracedUserSessions) Sessions(userID int64) ([]SessionID, error) {
+	span := tus.trace("Sessions")
+	sids, err := tus.userSessions.Sessions(userID)
+	end(span, err)
+	return sids, err
+}
+
+func (tus *tracedUserSessions) LockUser(userID int64) (func(), error) {
+	span := tus.trace("LockUser")
+	unlock, err := tus.userSessions.LockUser(userID)
+	end(span, err)
+	return unlock, err
+}
@@ -0,0 +1,299 @@
+package sessions
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/my/repo/servers/gateway/redislock"
+)
+
+//ErrLockTimeout is returned from UserIndex.Lock when the lock
+//could not be acquired in time
+var ErrLockTimeout = errors.New("timed out waiting for user session lock")
+
+//Owner is implemented by session states that belong to a user, so that
+//an IndexedStore can record which sessions each user has
+type Owner interface {
+	//SessionOwner returns the ID of the user the session belongs to
+	SessionOwner() int64
+}
+
+//UserSessions is implemented by stores that can find every session
+//belonging to a user, so they can be rewritten or ended together
+type UserSessions interface {
+	Store
+	//Sessions returns the IDs of the sessions belonging to the user
+	Sessions(userID int64) ([]SessionID, error)
+	//LockUser serializes changes to the sessions of the user
+	//across every server sharing the store
+	LockUser(userID int64) (unlock func(), err error)
+}
+
+//UserIndex records the sessions belonging to each user
+type UserIndex interface {
+	//Add records that the session belongs to the user, returning
+	//false if it was already recorded
+	Add(userID int64, sid SessionID) (bool, error)
+	//Remove forgets the session of the user
+	Remove(userID int64, sid SessionID) error
+	//Sessions returns the sessions recorded for the user, oldest first.
+	//Sessions that have since expired from the store may still be included.
+	Sessions(userID int64) ([]SessionID, error)
+	//Lock acquires an exclusive lock for the user
+	Lock(userID int64) (unlock func(), err error)
+}
+
+//IndexedStore represents a session.Store that keeps an index of
+//the sessions belonging to each user. Sessions are indexed when
+//their state, saved through the IndexedStore, implements Owner.
+type IndexedStore struct {
+	Store
+	Index UserIndex
+	//MaxSessions, if positive, is the most live sessions a user may have.
+	//When a new session takes a user over the limit, the user's oldest
+	//sessions are ended.
+	MaxSessions int
+}
+
+//NewIndexedStore constructs a new IndexedStore around `store`
+func NewIndexedStore(store Store, index UserIndex) *IndexedStore {
+	return &IndexedStore{Store: store, Index: index}
+}
+
+//Save saves the provided `sessionState` and associated SessionID to the
+//store, and records the session under its owner if it has one
+func (is *IndexedStore) Save(sid SessionID, sessionState interface{}) error {
+	if err := is.Store.Save(sid, sessionState); err != nil {
+		return err
+	}
+	owner, ok := sessionState.(Owner)
+	if !ok {
+		return nil
+	}
+	added, err := is.Index.Add(owner.SessionOwner(), sid)
+	if err != nil || !added {
+		return err
+	}
+	//the index does not expire, as the sessions in it are kept alive by being used,
+	//so the sessions that have ended are dropped from it as each new one begins
+	live, err := is.Sessions(owner.SessionOwner())
+	if err != nil {
+		return err
+	}
+	return is.enforceLimit(owner.SessionOwner(), live)
+}
+
+//enforceLimit ends the oldest of the user's `live` sessions
+//until the user has no more than MaxSessions
+func (is *IndexedStore) enforceLimit(userID int64, live []SessionID) error {
+	if is.MaxSessions <= 0 {
+		return nil
+	}
+	for len(live) > is.MaxSessions {
+		if err := is.Store.Delete(live[0]); err != nil {
+			return err
+		}
+		if err := is.Index.Remove(userID, live[0]); err != nil {
+			return err
+		}
+		live = live[1:]
+	}
+	return nil
+}
+
+//Sessions returns the IDs of the live sessions belonging to the user, oldest
+//first, dropping sessions that have expired from the store from the index.
+//Checking the sessions does not keep them alive if the store is a Checker.
+func (is *IndexedStore) Sessions(userID int64) ([]SessionID, error) {
+	indexed, err := is.Index.Sessions(userID)
+	if err != nil {
+		return nil, err
+	}
+	live := []SessionID{}
+	for _, sid := range indexed {
+		found, err := exists(is.Store, sid)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			if err := is.Index.Remove(userID, sid); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		live = append(live, sid)
+	}
+	return live, nil
+}
+
+//LockUser serializes changes to the sessions of the user
+func (is *IndexedStore) LockUser(userID int64) (func(), error) {
+	return is.Index.Lock(userID)
+}
+
+//MemIndex represents an in-process memory UserIndex.
+//This should be used only for testing and prototyping,
+//alongside the MemStore.
+type MemIndex struct {
+	mu sync.Mutex
+	//sessions maps each session of a user to the order it was added in
+	sessions map[int64]map[SessionID]uint64
+	added    uint64
+	locks    map[int64]*sync.Mutex
+}
+
+//NewMemIndex constructs and returns a new MemIndex
+func NewMemIndex() *MemIndex {
+	return &MemIndex{
+		sessions: map[int64]map[SessionID]uint64{},
+		locks:    map[int64]*sync.Mutex{},
+	}
+}
+
+//Add records that the session belongs to the user
+func (mi *MemIndex) Add(userID int64, sid SessionID) (bool, error) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	if mi.sessions[userID] == nil {
+		mi.sessions[userID] = map[SessionID]uint64{}
+	}
+	if _, found := mi.sessions[userID][sid]; found {
+		return false, nil
+	}
+	mi.added++
+	mi.sessions[userID][sid] = mi.added
+	return true, nil
+}
+
+//Remove forgets the session of the user
+func (mi *MemIndex) Remove(userID int64, sid SessionID) error {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	delete(mi.sessions[userID], sid)
+	if len(mi.sessions[userID]) == 0 {
+		delete(mi.sessions, userID)
+	}
+	return nil
+}
+
+//Sessions returns the sessions recorded for the user, oldest first
+func (mi *MemIndex) Sessions(userID int64) ([]SessionID, error) {
+	mi.mu.Lock()
+	defer mi.mu.Unlock()
+	sids := []SessionID{}
+	for sid := range mi.sessions[userID] {
+		sids = append(sids, sid)
+	}
+	added := mi.sessions[userID]
+	sort.Slice(sids, func(i, j int) bool {
+		return added[sids[i]] < added[sids[j]]
+	})
+	return sids, nil
+}
+
+//Lock acquires an exclusive lock for the user
+func (mi *MemIndex) Lock(userID int64) (func(), error) {
+	mi.mu.Lock()
+	lock, found := mi.locks[userID]
+	if !found {
+		lock = &sync.Mutex{}
+		mi.locks[userID] = lock
+	}
+	mi.mu.Unlock()
+	lock.Lock()
+	return lock.Unlock, nil
+}
+
+//RedisIndex represents a UserIndex shared through redis, so that
+//every server sharing a RedisStore sees the same sessions per user.
+//The index of a user does not expire, as each session in it lives on for
+//as long as it is used; an IndexedStore drops the sessions that have ended.
+type RedisIndex struct {
+	//Redis client used to talk to redis server.
+	Client *redis.Client
+	//How long a user lock is held before it is considered abandoned,
+	//and how long Lock waits to acquire it.
+	LockTimeout time.Duration
+}
+
+//NewRedisIndex constructs a new RedisIndex
+func NewRedisIndex(client *redis.Client) *RedisIndex {
+	return &RedisIndex{
+		Client:      client,
+		LockTimeout: 5 * time.Second,
+	}
+}
+
+//Add records that the session belongs to the user,
+//scored by the time it was added
+func (ri *RedisIndex) Add(userID int64, sid SessionID) (bool, error) {
+	added, err := ri.Client.ZAddNX(userSessionsKey(userID), redis.Z{
+		Score:  float64(time.Now().UnixNano()),
+		Member: sid.String(),
+	}).Result()
+	if err != nil {
+		return false, err
+	}
+	return added == 1, nil
+}
+
+//Remove forgets the session of the user
+func (ri *RedisIndex) Remove(userID int64, sid SessionID) error {
+	return ri.Client.ZRem(userSessionsKey(userID), sid.String()).Err()
+}
+
+//Sessions returns the sessions recorded for the user, oldest first
+func (ri *RedisIndex) Sessions(userID int64) ([]SessionID, error) {
+	members, err := ri.Client.ZRange(userSessionsKey(userID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	sids := make([]SessionID, len(members))
+	for i, m := range members {
+		sids[i] = SessionID(m)
+	}
+	return sids, nil
+}
+
+//Lock acquires an exclusive lock for the user, shared by every server
+func (ri *RedisIndex) Lock(userID int64) (func(), error) {
+	token, err := redislock.NewToken()
+	if err != nil {
+		return nil, err
+	}
+	key := userLockKey(userID)
+	deadline := time.Now().Add(ri.LockTimeout)
+	for {
+		acquired, err := redislock.TryAcquire(ri.Client, key, token, ri.LockTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if acquired {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, ErrLockTimeout
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return func() {
+		//only release the lock if it has not expired and been taken by another server
+		redislock.Release(ri.Client, key, token)
+	}, nil
+}
+
+//userSessionsKey returns the redis key for the sorted set of sessions of the user.
+//The sets once held under usersessions:<id> were plain sets, which the sorted set
+//commands refuse, so the sorted sets are kept under keys of their own.
+func userSessionsKey(userID int64) string {
+	return "usersessions:z:" + strconv.FormatInt(userID, 10)
+}
+
+//userLockKey returns the redis key for the lock of the user
+func userLockKey(userID int64) string {
+	return "userlock:" + strconv.FormatInt(userID, 10)
+}
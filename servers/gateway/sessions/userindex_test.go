@@ -0,0 +1,260 @@
+package sessions
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/my/repo/servers/gateway/redistest"
+)
+
+//ownedState is a session state belonging to a user
+type ownedState struct {
+	UserID int64
+	Name   string
+}
+
+func (state ownedState) SessionOwner() int64 {
+	return state.UserID
+}
+
+/*
+TestIndexedStore runs the IndexedStore over both the MemStore
+and the RedisStore (against a local redis stand-in), ensuring
+sessions are indexed by their owner and that sessions which
+have ended are dropped from the index.
+*/
+func TestIndexedStore(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+
+	cases := []struct {
+		name  string
+		store *IndexedStore
+	}{
+		{"MemStore", NewIndexedStore(NewMemStore(time.Hour, time.Minute), NewMemIndex())},
+		{"RedisStore", NewIndexedStore(NewRedisStore(client, time.Hour), NewRedisIndex(client))},
+	}
+	for _, c := range cases {
+		sids := []SessionID{}
+		for i := 0; i < 3; i++ {
+			sid, _ := NewSessionID("test key")
+			if err := c.store.Save(sid, ownedState{1, "first"}); err != nil {
+				t.Fatalf("case %s: unexpected error saving state: %v", c.name, err)
+			}
+			sids = append(sids, sid)
+		}
+		other, _ := NewSessionID("test key")
+		c.store.Save(other, ownedState{2, "other"})
+		//states without an owner are saved but not indexed
+		anonymous, _ := NewSessionID("test key")
+		if err := c.store.Save(anonymous, 100); err != nil {
+			t.Fatalf("case %s: unexpected error saving unowned state: %v", c.name, err)
+		}
+
+		found, err := c.store.Sessions(1)
+		if err != nil {
+			t.Fatalf("case %s: unexpected error listing sessions: %v", c.name, err)
+		}
+		if !sameSessions(found, sids) {
+			t.Errorf("case %s: incorrect sessions: expected %v but got %v", c.name, sids, found)
+		}
+
+		c.store.Delete(sids[0])
+		found, _ = c.store.Sessions(1)
+		if !sameSessions(found, sids[1:]) {
+			t.Errorf("case %s: ended session still listed: %v", c.name, found)
+		}
+		indexed, _ := c.store.Index.Sessions(1)
+		if len(indexed) != 2 {
+			t.Errorf("case %s: ended session not dropped from the index: %v", c.name, indexed)
+		}
+	}
+}
+
+func TestRedisIndexOldSets(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	//the plain sets the index was once kept in are left alone
+	client.SAdd("usersessions:1", "old-session")
+	store := NewIndexedStore(NewRedisStore(client, time.Hour), NewRedisIndex(client))
+	sid, _ := NewSessionID("test key")
+	if err := store.Save(sid, ownedState{1, "first"}); err != nil {
+		t.Fatalf("unexpected error saving state of a user with an old set: %v", err)
+	}
+	found, err := store.Sessions(1)
+	if err != nil {
+		t.Fatalf("unexpected error listing sessions of a user with an old set: %v", err)
+	}
+	if !sameSessions(found, []SessionID{sid}) {
+		t.Errorf("incorrect sessions: expected %v but got %v", sid, found)
+	}
+}
+
+func sameSessions(a []SessionID, b []SessionID) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	as := make([]string, len(a))
+	bs := make([]string, len(b))
+	for i := range a {
+		as[i] = a[i].String()
+		bs[i] = b[i].String()
+	}
+	sort.Strings(as)
+	sort.Strings(bs)
+	for i := range as {
+		if as[i] != bs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRedisIndexLock(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	//two servers sharing the same redis
+	first := NewRedisIndex(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	second := NewRedisIndex(redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	second.LockTimeout = 50 * time.Millisecond
+
+	unlock, err := first.Lock(1)
+	if err != nil {
+		t.Fatalf("unexpected error acquiring lock: %v", err)
+	}
+	if _, err := second.Lock(1); err != ErrLockTimeout {
+		t.Errorf("expected ErrLockTimeout while lock is held but got %v", err)
+	}
+	if unlockOther, err := second.Lock(2); err != nil {
+		t.Errorf("locks of different users should not conflict: %v", err)
+	} else {
+		unlockOther()
+	}
+	unlock()
+	unlock, err = second.Lock(1)
+	if err != nil {
+		t.Fatalf("unexpected error acquiring released lock: %v", err)
+	}
+	unlock()
+
+	//a lock that expired and was taken by another server is not released by its first holder
+	stale, err := first.Lock(1)
+	if err != nil {
+		t.Fatalf("unexpected error acquiring lock: %v", err)
+	}
+	first.Client.Del(userLockKey(1))
+	unlock, err = second.Lock(1)
+	if err != nil {
+		t.Fatalf("unexpected error acquiring expired lock: %v", err)
+	}
+	stale()
+	if n := first.Client.Exists(userLockKey(1)).Val(); n != 1 {
+		t.Errorf("expected the lock to still be held after the stale unlock")
+	}
+	unlock()
+	if n := first.Client.Exists(userLockKey(1)).Val(); n != 0 {
+		t.Errorf("expected the lock to be released by its holder")
+	}
+}
+
+func TestIndexedStoreMaxSessions(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+
+	cases := []struct {
+		name  string
+		store *IndexedStore
+	}{
+		{"MemStore", NewIndexedStore(NewMemStore(time.Hour, time.Minute), NewMemIndex())},
+		{"RedisStore", NewIndexedStore(NewRedisStore(client, time.Hour), NewRedisIndex(client))},
+	}
+	for _, c := range cases {
+		c.store.MaxSessions = 2
+		sids := []SessionID{}
+		for i := 0; i < 4; i++ {
+			sid, _ := NewSessionID("test key")
+			if err := c.store.Save(sid, ownedState{1, "first"}); err != nil {
+				t.Fatalf("case %s: unexpected error saving state: %v", c.name, err)
+			}
+			sids = append(sids, sid)
+		}
+		//saving an existing session again does not count against the limit
+		if err := c.store.Save(sids[2], ownedState{1, "updated"}); err != nil {
+			t.Fatalf("case %s: unexpected error saving state: %v", c.name, err)
+		}
+
+		found, _ := c.store.Sessions(1)
+		if !reflect.DeepEqual(found, sids[2:]) {
+			t.Errorf("case %s: expected the newest sessions %v but got %v", c.name, sids[2:], found)
+		}
+		for _, sid := range sids[:2] {
+			if err := c.store.Get(sid, &ownedState{}); err != ErrStateNotFound {
+				t.Errorf("case %s: expected oldest session to be ended but got %v", c.name, err)
+			}
+		}
+	}
+}
+
+func TestIndexedStoreSessionsExpiry(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	store := NewIndexedStore(NewRedisStore(client, time.Hour), NewRedisIndex(client))
+
+	//listing the sessions of a user does not keep them alive
+	sid, _ := NewSessionID("test key")
+	store.Save(sid, ownedState{1, "first"})
+	client.Expire(sid.getRedisKey(), time.Minute)
+	if found, err := store.Sessions(1); err != nil || !sameSessions(found, []SessionID{sid}) {
+		t.Fatalf("expected the session to be listed but got %v, %v", found, err)
+	}
+	if ttl := client.TTL(sid.getRedisKey()).Val(); ttl > time.Minute {
+		t.Errorf("expected listing the sessions to leave their expiry alone but it was reset to %v", ttl)
+	}
+}
+
+func TestRedisIndexExpiry(t *testing.T) {
+	server, err := redistest.NewServer()
+	if err != nil {
+		t.Fatalf("error starting redis stand-in: %v", err)
+	}
+	defer server.Close()
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	store := NewIndexedStore(NewRedisStore(client, time.Hour), NewRedisIndex(client))
+
+	first, _ := NewSessionID("test key")
+	store.Save(first, ownedState{1, "first"})
+	//the index outlives the sessions in it, which are kept alive by being used
+	if ttl := client.TTL(userSessionsKey(1)).Val(); ttl >= 0 {
+		t.Errorf("expected the index not to expire but it expires in %v", ttl)
+	}
+
+	//sessions that have ended are dropped from the index as new ones begin
+	client.Del(first.getRedisKey())
+	second, _ := NewSessionID("test key")
+	store.Save(second, ownedState{1, "second"})
+	if indexed, _ := store.Index.Sessions(1); !sameSessions(indexed, []SessionID{second}) {
+		t.Errorf("expected only the new session to be indexed but got %v", indexed)
+	}
+}
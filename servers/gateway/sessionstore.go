@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/my/repo/servers/gateway/sessions"
+)
+
+// sessionDuration is how long an idle session lasts
+const sessionDuration = time.Hour
+
+// newSessionStore builds the session store selected by the environment:
+//   - SESSIONMODE=token carries session state in signed tokens instead of redis,
+//     encrypted when SESSIONTOKENKEY is set. Token sessions cannot be found by user, so a profile
+//     change only reaches the session that made it, and deleting a user leaves its other
+//     sessions valid until they reach their maximum age
+//   - SESSIONCODEC=binary stores session state in the compact binary encoding instead of JSON
+//   - SESSIONENCKEYS encrypts session state at rest, as a comma-separated list of id:secret
+//     pairs where the first is used to encrypt and the rest only to decrypt older records
+//   - SESSIONCACHESIZE keeps up to that many sessions in an in-process cache in front of redis
+//   - SESSIONFALLBACK=cached keeps serving sessions read in the last SESSIONMAXSTALE (default 5m)
+//     while redis is down; otherwise requests needing a session fail with 503 until it recovers
+//   - SESSIONLIMIT caps the live sessions of each user, ending the oldest when a new one begins
+func newSessionStore(redisClient *redis.Client) (sessions.Store, error) {
+	if os.Getenv("SESSIONMODE") == "token" {
+		return sessions.NewTokenStore(os.Getenv("SESSIONTOKENKEY"), 15*time.Minute, sessionDuration,
+			sessions.NewRedisDenylist(redisClient, 5*time.Second))
+	}
+
+	codec := sessions.JSONCodec
+	if os.Getenv("SESSIONCODEC") == "binary" {
+		codec = sessions.BinaryCodec
+	}
+	redisStore := sessions.NewRedisStore(redisClient, sessionDuration)
+	redisStore.Codec = codec
+	registerSessionMetrics(redisStore)
+	var stateStore sessions.Store = redisStore
+	if cacheSize := os.Getenv("SESSIONCACHESIZE"); len(cacheSize) != 0 {
+		size, err := strconv.Atoi(cacheSize)
+		if err != nil {
+			return nil, errors.New("SESSIONCACHESIZE must be a number of sessions")
+		}
+		cachedStore, err := sessions.NewCachedStore(redisStore, size, 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		stateStore = cachedStore
+	}
+	if encKeys := os.Getenv("SESSIONENCKEYS"); len(encKeys) != 0 {
+		keys, err := parseStoreKeys(encKeys)
+		if err != nil {
+			return nil, err
+		}
+		encryptedStore, err := sessions.NewEncryptedStore(stateStore, codec, keys...)
+		if err != nil {
+			return nil, err
+		}
+		// the encrypted records are opaque bytes, which the binary codec stores without re-encoding
+		redisStore.Codec = sessions.BinaryCodec
+		stateStore = encryptedStore
+	}
+
+	resilientStore, err := newResilientStore(stateStore, redisClient)
+	if err != nil {
+		return nil, err
+	}
+	// index sessions by user so profile changes can be applied to every live session
+	indexedStore := sessions.NewIndexedStore(resilientStore, sessions.NewRedisIndex(redisClient))
+	if limit := os.Getenv("SESSIONLIMIT"); len(limit) != 0 {
+		maxSessions, err := strconv.Atoi(limit)
+		if err != nil {
+			return nil, errors.New("SESSIONLIMIT must be a number of sessions")
+		}
+		indexedStore.MaxSessions = maxSessions
+	}
+	return indexedStore, nil
+}
+
+// newResilientStore wraps the store so redis outages are detected and handled by the SESSIONFALLBACK policy
+func newResilientStore(store sessions.Store, redisClient *redis.Client) (*sessions.ResilientStore, error) {
+	policy := sessions.FailClosed
+	if os.Getenv("SESSIONFALLBACK") == "cached" {
+		policy = sessions.ServeCached
+	}
+	maxStale := 5 * time.Minute
+	if env := os.Getenv("SESSIONMAXSTALE"); len(env) != 0 {
+		d, err := time.ParseDuration(env)
+		if err != nil {
+			return nil, errors.New("SESSIONMAXSTALE must be a duration such as 5m")
+		}
+		maxStale = d
+	}
+	probe := func() error { return redisClient.Ping().Err() }
+	resilientStore := sessions.NewResilientStore(store, policy, maxStale, probe, time.Second)
+	resilientStore.OnStateChange = func(from, to sessions.BreakerState) {
+		log.Printf("session store circuit breaker %s -> %s: %+v", from, to, resilientStore.Stats())
+	}
+	return resilientStore, nil
+}
+
+// parseStoreKeys parses a comma-separated list of id:secret encryption keys
+func parseStoreKeys(list string) ([]sessions.StoreKey, error) {
+	keys := []sessions.StoreKey{}
+	for _, pair := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return nil, errors.New("session encryption keys must be in the form id:secret")
+		}
+		id, err := strconv.ParseUint(parts[0], 10, 8)
+		if err != nil {
+			return nil, errors.New("session encryption key IDs must be between 0 and 255")
+		}
+		keys = append(keys, sessions.StoreKey{ID: byte(id), Secret: parts[1]})
+	}
+	return keys, nil
+}
@@ -3,5 +3,6 @@ export SESSIONKEY="a key"
 export TLSKEY="privkey.pem"
 export TLSCERT="fullchain.pem"
 export DSN="root:qazwsx@tcp(127.0.0.1:3306)/demo"
+export IDENTITYKEYS="identity-keys.json"
 gateway
 
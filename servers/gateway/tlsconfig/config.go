@@ -0,0 +1,76 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+//versions are the TLS versions that may be required, by the names they are configured with
+var versions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+//DefaultMinVersion is the oldest TLS version accepted unless configured otherwise
+const DefaultMinVersion = tls.VersionTLS12
+
+//ParseVersion parses a TLS version, such as "1.2"
+func ParseVersion(name string) (uint16, error) {
+	version, ok := versions[strings.TrimSpace(name)]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, must be 1.0, 1.1, 1.2 or 1.3", name)
+	}
+	return version, nil
+}
+
+//ParseCipherSuites parses a comma-separated list of cipher suites by their
+//standard names, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Suites with
+//known security problems are rejected. The suites of TLS 1.3 cannot be chosen,
+//so the list only applies to connections made with older versions.
+func ParseCipherSuites(list string) ([]uint16, error) {
+	secure := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite.ID
+	}
+	insecure := map[string]bool{}
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = true
+	}
+	ids := []uint16{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		if insecure[name] {
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		}
+		id, ok := secure[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no cipher suites given")
+	}
+	return ids, nil
+}
+
+//NewServerConfig builds the TLS configuration of a server serving the certificates
+//of `certs`, accepting TLS versions from `minVersion` up and, for connections made
+//with versions before TLS 1.3, only `cipherSuites` if any are given
+func NewServerConfig(certs *CertReloader, minVersion uint16, cipherSuites []uint16) *tls.Config {
+	cfg := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     minVersion,
+	}
+	if len(cipherSuites) != 0 {
+		cfg.CipherSuites = cipherSuites
+		cfg.PreferServerCipherSuites = true
+	}
+	return cfg
+}
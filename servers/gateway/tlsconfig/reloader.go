@@ -0,0 +1,110 @@
+//Package tlsconfig builds the TLS configuration the gateway serves clients with,
+//reloading its certificate when the files change so that renewed certificates
+//are picked up without a restart.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//CertReloader serves a certificate and key read from files, reading them
+//again when asked to or when they change. A certificate that fails to load
+//leaves the current one in place.
+type CertReloader struct {
+	certPath string
+	keyPath  string
+	//cert is the *tls.Certificate currently served
+	cert atomic.Value
+
+	mu      sync.Mutex
+	certMod time.Time
+	keyMod  time.Time
+}
+
+//NewCertReloader constructs a new CertReloader serving the certificate in
+//`certPath` with the private key in `keyPath`, which must load
+func NewCertReloader(certPath string, keyPath string) (*CertReloader, error) {
+	cr := &CertReloader{certPath: certPath, keyPath: keyPath}
+	if err := cr.Reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+//GetCertificate returns the current certificate, for tls.Config.GetCertificate
+func (cr *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return cr.cert.Load().(*tls.Certificate), nil
+}
+
+//Reload reads the certificate and key files again
+func (cr *CertReloader) Reload() error {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	//the files are stat'd first, so changes made while loading are seen next time
+	certMod, keyMod := modTime(cr.certPath), modTime(cr.keyPath)
+	//the modification times are recorded whether or not the files load,
+	//so broken files are not read again until they change
+	cr.certMod, cr.keyMod = certMod, keyMod
+	cert, err := tls.LoadX509KeyPair(cr.certPath, cr.keyPath)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	cr.cert.Store(&cert)
+	return nil
+}
+
+//NotAfter returns when the current certificate expires
+func (cr *CertReloader) NotAfter() time.Time {
+	return cr.cert.Load().(*tls.Certificate).Leaf.NotAfter
+}
+
+//Watch reloads the certificate whenever its files change, checking
+//every `interval` until `done` is closed. Certificates that fail to
+//load are logged and ignored, leaving the current one in place.
+//A certificate and key replaced one after the other may fail to load
+//in between, but load once the second of them has changed.
+func (cr *CertReloader) Watch(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if !cr.changed() {
+				continue
+			}
+			if err := cr.Reload(); err != nil {
+				log.Printf("error reloading TLS certificate from %s: %v", cr.certPath, err)
+			} else {
+				log.Printf("reloaded TLS certificate from %s, valid until %s", cr.certPath, cr.NotAfter().Format(time.RFC3339))
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+//changed reports whether either file has changed since it was last loaded
+func (cr *CertReloader) changed() bool {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	return !modTime(cr.certPath).Equal(cr.certMod) || !modTime(cr.keyPath).Equal(cr.keyMod)
+}
+
+//modTime returns when the file was last modified, following symlinks
+//as certificate managers swap them, or the zero time if it cannot be read
+func modTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,168 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//writeCert writes a new self-signed certificate for `name` and its key to the files
+func writeCert(t *testing.T, certPath string, keyPath string, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("error encoding key: %v", err)
+	}
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatalf("error writing certificate: %v", err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatalf("error writing key: %v", err)
+	}
+}
+
+//served returns the name of the certificate the reloader is serving
+func served(t *testing.T, cr *CertReloader) string {
+	cert, err := cr.GetCertificate(&tls.ClientHelloInfo{})
+	if err != nil {
+		t.Fatalf("error getting certificate: %v", err)
+	}
+	return cert.Leaf.Subject.CommonName
+}
+
+//touch moves the modification time of the file on, as file systems may not
+//record a change made within the same tick as the last
+func touch(t *testing.T, path string, by time.Duration) {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("error reading %s: %v", path, err)
+	}
+	mod := info.ModTime().Add(by)
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatalf("error touching %s: %v", path, err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tlsconfig")
+	if err != nil {
+		t.Fatalf("error creating directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	if _, err := NewCertReloader(certPath, keyPath); err == nil {
+		t.Error("expected an error loading missing files")
+	}
+	writeCert(t, certPath, keyPath, "first.example.com")
+	cr, err := NewCertReloader(certPath, keyPath)
+	if err != nil {
+		t.Fatalf("error loading certificate: %v", err)
+	}
+	if name := served(t, cr); name != "first.example.com" {
+		t.Errorf("expected the first certificate but got %s", name)
+	}
+	if cr.NotAfter().Before(time.Now()) {
+		t.Errorf("expected the certificate to expire later but got %v", cr.NotAfter())
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go cr.Watch(10*time.Millisecond, done)
+	waitFor := func(name string) {
+		deadline := time.Now().Add(2 * time.Second)
+		for served(t, cr) != name && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := served(t, cr); got != name {
+			t.Fatalf("expected %s to be served but got %s", name, got)
+		}
+	}
+
+	// a renewed certificate is picked up once its files change
+	writeCert(t, certPath, keyPath, "second.example.com")
+	touch(t, certPath, time.Second)
+	touch(t, keyPath, time.Second)
+	waitFor("second.example.com")
+
+	// a certificate replaced before its key fails to load, keeping the current
+	// one, until the key is replaced too
+	writeCert(t, filepath.Join(dir, "third.pem"), filepath.Join(dir, "third-key.pem"), "third.example.com")
+	third, _ := ioutil.ReadFile(filepath.Join(dir, "third.pem"))
+	thirdKey, _ := ioutil.ReadFile(filepath.Join(dir, "third-key.pem"))
+	ioutil.WriteFile(certPath, third, 0600)
+	touch(t, certPath, 2*time.Second)
+	if err := cr.Reload(); err == nil {
+		t.Error("expected an error loading a certificate with the wrong key")
+	}
+	if name := served(t, cr); name != "second.example.com" {
+		t.Errorf("expected the second certificate to be kept but got %s", name)
+	}
+	ioutil.WriteFile(keyPath, thirdKey, 0600)
+	touch(t, keyPath, 2*time.Second)
+	waitFor("third.example.com")
+}
+
+func TestParseVersion(t *testing.T) {
+	if version, err := ParseVersion("1.3"); err != nil || version != tls.VersionTLS13 {
+		t.Errorf("expected TLS 1.3 but got %x, %v", version, err)
+	}
+	if _, err := ParseVersion("1.4"); err == nil {
+		t.Error("expected an error for an unknown version")
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	cases := []struct {
+		name  string
+		list  string
+		valid bool
+		ids   []uint16
+	}{
+		{"secure suites", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+			true, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256}},
+		{"insecure suite", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_RSA_WITH_RC4_128_SHA", false, nil},
+		{"unknown suite", "TLS_MADE_UP", false, nil},
+		{"empty list", " , ", false, nil},
+	}
+	for _, c := range cases {
+		ids, err := ParseCipherSuites(c.list)
+		if (err == nil) != c.valid {
+			t.Errorf("case %s: expected valid %v but got error %v", c.name, c.valid, err)
+			continue
+		}
+		if len(ids) != len(c.ids) {
+			t.Errorf("case %s: expected %v but got %v", c.name, c.ids, ids)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != c.ids[i] {
+				t.Errorf("case %s: expected %v but got %v", c.name, c.ids, ids)
+			}
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Package tracetest provides a small in-process stand-in for a trace collector.
+// It accepts spans exported as OTLP/HTTP JSON, so the gateway's tests can check
+// the spans it records without needing a real collector.
+package tracetest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+)
+
+// Span is a span received by the collector
+type Span struct {
+	Service      string
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	TraceState   string
+	Name         string
+	Kind         int
+	Start        int64
+	End          int64
+	Attributes   map[string]interface{}
+	// Error is the status message of a failed span, empty if the span did not fail
+	Error string
+}
+
+// Collector is a trace collector listening on a local port
+type Collector struct {
+	server *httptest.Server
+	mu     sync.Mutex
+	spans  []Span
+	// status is the status the collector responds with, to simulate a failing collector
+	status int
+}
+
+// NewCollector starts a new Collector listening on a random local port
+func NewCollector() *Collector {
+	c := &Collector{status: http.StatusOK}
+	c.server = httptest.NewServer(http.HandlerFunc(c.serveTraces))
+	return c
+}
+
+// URL returns the base URL of the collector, to which /v1/traces is added by exporters
+func (c *Collector) URL() string {
+	return c.server.URL
+}
+
+// Close stops the collector
+func (c *Collector) Close() {
+	c.server.Close()
+}
+
+// SetStatus makes the collector respond to exports with the status
+func (c *Collector) SetStatus(status int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status = status
+}
+
+// Spans returns the spans received so far, in the order they arrived
+func (c *Collector) Spans() []Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Span{}, c.spans...)
+}
+
+// Reset forgets the spans received so far
+func (c *Collector) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.spans = nil
+}
+
+// exportRequest is the part of an OTLP/HTTP JSON export request the collector reads
+type exportRequest struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []keyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Spans []struct {
+				TraceID           string     `json:"traceId"`
+				SpanID            string     `json:"spanId"`
+				ParentSpanID      string     `json:"parentSpanId"`
+				TraceState        string     `json:"traceState"`
+				Name              string     `json:"name"`
+				Kind              int        `json:"kind"`
+				StartTimeUnixNano string     `json:"startTimeUnixNano"`
+				EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+				Attributes        []keyValue `json:"attributes"`
+				Status            struct {
+					Code    int    `json:"code"`
+					Message string `json:"message"`
+				} `json:"status"`
+			} `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+// keyValue is an attribute of a span or resource
+type keyValue struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue *string  `json:"stringValue"`
+		BoolValue   *bool    `json:"boolValue"`
+		IntValue    *string  `json:"intValue"`
+		DoubleValue *float64 `json:"doubleValue"`
+	} `json:"value"`
+}
+
+// attributes decodes the attributes into a map, with integers as int64
+func attributes(kvs []keyValue) map[string]interface{} {
+	attrs := map[string]interface{}{}
+	for _, kv := range kvs {
+		switch v := kv.Value; {
+		case v.StringValue != nil:
+			attrs[kv.Key] = *v.StringValue
+		case v.BoolValue != nil:
+			attrs[kv.Key] = *v.BoolValue
+		case v.IntValue != nil:
+			attrs[kv.Key], _ = strconv.ParseInt(*v.IntValue, 10, 64)
+		case v.DoubleValue != nil:
+			attrs[kv.Key] = *v.DoubleValue
+		}
+	}
+	return attrs
+}
+
+// serveTraces receives an export request
+func (c *Collector) serveTraces(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" || r.Method != "POST" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "only JSON is supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	c.mu.Lock()
+	status := c.status
+	c.mu.Unlock()
+	if status != http.StatusOK {
+		http.Error(w, "collector unavailable", status)
+		return
+	}
+	req := &exportRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	received := []Span{}
+	for _, rs := range req.ResourceSpans {
+		service, _ := attributes(rs.Resource.Attributes)["service.name"].(string)
+		for _, ss := range rs.ScopeSpans {
+			for _, s := range ss.Spans {
+				span := Span{
+					Service:      service,
+					TraceID:      s.TraceID,
+					SpanID:       s.SpanID,
+					ParentSpanID: s.ParentSpanID,
+					TraceState:   s.TraceState,
+					Name:         s.Name,
+					Kind:         s.Kind,
+					Attributes:   attributes(s.Attributes),
+				}
+				span.Start, _ = strconv.ParseInt(s.StartTimeUnixNano, 10, 64)
+				span.End, _ = strconv.ParseInt(s.EndTimeUnixNano, 10, 64)
+				if s.Status.Code == 2 {
+					span.Error = s.Status.Message
+				}
+				received = append(received, span)
+			}
+		}
+	}
+	c.mu.Lock()
+	c.spans = append(c.spans, received...)
+	c.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{}"))
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/my/repo/servers/gateway/tracing"
+)
+
+// defaultSampleRate is the share of traces begun by the gateway that are recorded, unless TRACESAMPLERATE is set
+const defaultSampleRate = 0.1
+
+// newTracer builds the tracer selected by the environment:
+//   - TRACEENDPOINT is the base URL of the OTLP/HTTP collector spans are exported to, such as
+//     http://localhost:4318; without it traces are still passed on to upstreams but not recorded
+//   - TRACESAMPLERATE is the share of the traces begun by the gateway that are recorded, from 0 to 1.
+//     Traces begun by clients are recorded if the client is recording them.
+//
+// The returned exporter, if any, should be closed on shutdown to send the last spans.
+func newTracer() (*tracing.Tracer, *tracing.OTLPExporter, error) {
+	sampleRate := defaultSampleRate
+	if env := os.Getenv("TRACESAMPLERATE"); len(env) != 0 {
+		rate, err := strconv.ParseFloat(env, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, nil, errors.New("TRACESAMPLERATE must be a number from 0 to 1")
+		}
+		sampleRate = rate
+	}
+	endpoint := os.Getenv("TRACEENDPOINT")
+	if len(endpoint) == 0 {
+		return tracing.NewTracer(nil, sampleRate), nil, nil
+	}
+	exporter := tracing.NewOTLPExporter(endpoint, "gateway", 5*time.Second)
+	return tracing.NewTracer(exporter, sampleRate), exporter, nil
+}
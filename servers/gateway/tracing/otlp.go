@@ -0,0 +1,260 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//OTLPExporter sends spans in batches to a collector, as OTLP/HTTP JSON.
+//Spans are dropped rather than held up when the collector falls behind.
+type OTLPExporter struct {
+	//URL is the collector's traces endpoint
+	URL string
+	//Service is the service.name the spans are reported under
+	Service string
+	Client  *http.Client
+	//BatchSize is how many spans are sent at once, and MaxQueue how many
+	//are kept waiting to be sent before new ones are dropped
+	BatchSize int
+	MaxQueue  int
+
+	mu      sync.Mutex
+	queue   []*Span
+	dropped int
+	send    chan struct{}
+	closed  chan struct{}
+	done    chan struct{}
+	flushMu sync.Mutex
+}
+
+//NewOTLPExporter constructs a new OTLPExporter sending the spans of `service` to the collector
+//at `endpoint`, such as http://localhost:4318, every `interval` or once a batch has built up
+func NewOTLPExporter(endpoint string, service string, interval time.Duration) *OTLPExporter {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	oe := &OTLPExporter{
+		URL:       url,
+		Service:   service,
+		Client:    &http.Client{Timeout: 10 * time.Second},
+		BatchSize: 512,
+		MaxQueue:  2048,
+		send:      make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go oe.loop(interval)
+	return oe
+}
+
+//ExportSpan queues the span to be sent with the next batch
+func (oe *OTLPExporter) ExportSpan(span *Span) {
+	oe.mu.Lock()
+	defer oe.mu.Unlock()
+	if len(oe.queue) >= oe.MaxQueue {
+		oe.dropped++
+		return
+	}
+	oe.queue = append(oe.queue, span)
+	if len(oe.queue) >= oe.BatchSize {
+		select {
+		case oe.send <- struct{}{}:
+		default:
+		}
+	}
+}
+
+//Flush sends every queued span to the collector
+func (oe *OTLPExporter) Flush() error {
+	//batches are sent one at a time, so spans arrive in order
+	oe.flushMu.Lock()
+	defer oe.flushMu.Unlock()
+	for {
+		oe.mu.Lock()
+		batch := oe.queue
+		if len(batch) > oe.BatchSize {
+			batch = batch[:oe.BatchSize]
+		}
+		oe.queue = oe.queue[len(batch):]
+		dropped := oe.dropped
+		oe.dropped = 0
+		oe.mu.Unlock()
+		if dropped != 0 {
+			log.Printf("tracing: dropped %d spans the collector could not keep up with", dropped)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := oe.post(batch); err != nil {
+			return err
+		}
+	}
+}
+
+//Close sends the queued spans and stops sending any more
+func (oe *OTLPExporter) Close() error {
+	close(oe.closed)
+	<-oe.done
+	return oe.Flush()
+}
+
+//loop sends the queued spans every interval, and whenever a batch builds up
+func (oe *OTLPExporter) loop(interval time.Duration) {
+	defer close(oe.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-oe.closed:
+			return
+		case <-ticker.C:
+		case <-oe.send:
+		}
+		if err := oe.Flush(); err != nil {
+			log.Printf("tracing: error exporting spans: %v", err)
+		}
+	}
+}
+
+//post sends the batch of spans to the collector
+func (oe *OTLPExporter) post(batch []*Span) error {
+	body, err := json.Marshal(oe.encode(batch))
+	if err != nil {
+		return err
+	}
+	resp, err := oe.Client.Post(oe.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+//The OTLP/HTTP JSON encoding of spans, see
+//https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+//statusError is the status code of failed spans
+const statusError = 2
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+//encode encodes the batch of spans as an OTLP export request
+func (oe *OTLPExporter) encode(batch []*Span) *otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           s.context.TraceID.String(),
+			SpanID:            s.context.SpanID.String(),
+			TraceState:        s.context.TraceState,
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        encodeAttributes(s.attributes),
+		}
+		if s.parentID.IsValid() {
+			span.ParentSpanID = s.parentID.String()
+		}
+		if len(s.err) != 0 {
+			span.Status = otlpStatus{Code: statusError, Message: s.err}
+		}
+		s.mu.Unlock()
+		spans = append(spans, span)
+	}
+	return &otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: encodeAttributes(map[string]interface{}{"service.name": oe.Service})},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: "gateway/tracing"}, Spans: spans}},
+	}}}
+}
+
+//encodeAttributes encodes the attributes, sorted by key
+func encodeAttributes(attributes map[string]interface{}) []otlpKeyValue {
+	encoded := []otlpKeyValue{}
+	for key, value := range attributes {
+		var v otlpAnyValue
+		switch value := value.(type) {
+		case string:
+			v.StringValue = &value
+		case bool:
+			v.BoolValue = &value
+		case int:
+			s := strconv.Itoa(value)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(value, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &value
+		default:
+			s := fmt.Sprint(value)
+			v.StringValue = &s
+		}
+		encoded = append(encoded, otlpKeyValue{Key: key, Value: v})
+	}
+	sort.Slice(encoded, func(i, j int) bool {
+		return encoded[i].Key < encoded[j].Key
+	})
+	return encoded
+}
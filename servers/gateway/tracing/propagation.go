@@ -0,0 +1,161 @@
+//Package tracing records spans of the work done to serve each request, continuing
+//traces begun by clients and passing them on to upstreams with the W3C Trace Context
+//headers, and exports the spans to a collector over OTLP/HTTP.
+package tracing
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+//Trace Context headers, see https://www.w3.org/TR/trace-context/
+const (
+	TraceparentHeader = "traceparent"
+	TracestateHeader  = "tracestate"
+)
+
+//maxTracestate is the longest tracestate header passed on
+const maxTracestate = 512
+
+//flagSampled is the trace flag of traces being recorded
+const flagSampled = 0x01
+
+//TraceID identifies a trace, the spans of every service taking part in a request
+type TraceID [16]byte
+
+//SpanID identifies a span within a trace
+type SpanID [8]byte
+
+//String returns the ID in lowercase hex
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+//IsValid reports whether the ID is set, as IDs of all zeros are invalid
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+//String returns the ID in lowercase hex
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+//IsValid reports whether the ID is set, as IDs of all zeros are invalid
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+//newTraceID returns a random trace ID
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+//newSpanID returns a random span ID
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+//SpanContext is the part of a span passed on to other services
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	//Sampled is whether the trace is being recorded
+	Sampled bool
+	//TraceState is the vendor-specific state of the trace, passed on as is
+	TraceState string
+}
+
+//IsValid reports whether the span context identifies a span
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+//Traceparent returns the value of the traceparent header for the span context
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+//Extract returns the span context carried by the traceparent and tracestate
+//headers, reporting whether there was a valid one
+func Extract(header http.Header) (SpanContext, bool) {
+	sc, ok := ParseTraceparent(header.Get(TraceparentHeader))
+	if !ok {
+		return SpanContext{}, false
+	}
+	//the tracestate means nothing without the traceparent it belongs to
+	if state := strings.Join(header.Values(TracestateHeader), ","); len(state) <= maxTracestate {
+		sc.TraceState = state
+	}
+	return sc, true
+}
+
+//Inject sets the traceparent and tracestate headers to pass the span context on
+func Inject(sc SpanContext, header http.Header) {
+	if !sc.IsValid() {
+		return
+	}
+	header.Set(TraceparentHeader, sc.Traceparent())
+	if len(sc.TraceState) != 0 {
+		header.Set(TracestateHeader, sc.TraceState)
+	} else {
+		header.Del(TracestateHeader)
+	}
+}
+
+//ParseTraceparent parses the value of a traceparent header,
+//reporting whether it was valid
+func ParseTraceparent(value string) (SpanContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || !isLowerHex(parts[0]) || parts[0] == "ff" {
+		return SpanContext{}, false
+	}
+	//later versions may add fields, which are ignored
+	if parts[0] == "00" && len(parts) != 4 {
+		return SpanContext{}, false
+	}
+	var sc SpanContext
+	var flags [1]byte
+	if !decodeHex(sc.TraceID[:], parts[1]) || !decodeHex(sc.SpanID[:], parts[2]) || !decodeHex(flags[:], parts[3]) {
+		return SpanContext{}, false
+	}
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+	sc.Sampled = flags[0]&flagSampled != 0
+	return sc, true
+}
+
+//decodeHex decodes the lowercase hex string into dst, reporting
+//whether it was exactly the right length
+func decodeHex(dst []byte, s string) bool {
+	if len(s) != hex.EncodedLen(len(dst)) || !isLowerHex(s) {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+//isLowerHex reports whether the string is made of lowercase hex digits
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,179 @@
+package tracing
+
+import (
+	"context"
+	"encoding/binary"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//SpanKind is the role of a span in a request between services
+type SpanKind int
+
+const (
+	//KindInternal spans are work done within the gateway
+	KindInternal SpanKind = 1
+	//KindServer spans are requests the gateway serves
+	KindServer SpanKind = 2
+	//KindClient spans are requests the gateway makes to other services
+	KindClient SpanKind = 3
+)
+
+//Exporter sends the spans that have ended to a collector
+type Exporter interface {
+	ExportSpan(span *Span)
+}
+
+//Tracer begins the traces of the requests the gateway serves
+type Tracer struct {
+	//Exporter is sent the spans of traces being recorded; none are if nil
+	Exporter Exporter
+	//SampleRate is the share of the traces begun by the gateway that are
+	//recorded, from 0 to 1. Traces continued from a client are recorded
+	//if the client is recording them.
+	SampleRate float64
+}
+
+//NewTracer constructs a new Tracer recording a share of the traces to `exporter`
+func NewTracer(exporter Exporter, sampleRate float64) *Tracer {
+	return &Tracer{Exporter: exporter, SampleRate: sampleRate}
+}
+
+//Span is a timed piece of the work done as part of a trace. The methods of a nil
+//Span do nothing, so work can be traced whether or not it is part of a trace.
+type Span struct {
+	tracer   *Tracer
+	context  SpanContext
+	parentID SpanID
+	name     string
+	kind     SpanKind
+	start    time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	attributes map[string]interface{}
+	err        string
+}
+
+//spanKey is the context key of the current span
+type spanKey struct{}
+
+//FromContext returns the current span of the context, or nil if there is none
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+//StartRequest begins the server span of the request, continuing the trace the
+//request carries in its traceparent header or else beginning a new one
+func (t *Tracer) StartRequest(r *http.Request, name string) (context.Context, *Span) {
+	parent, ok := Extract(r.Header)
+	span := &Span{tracer: t, name: name, kind: KindServer, start: time.Now()}
+	if ok {
+		span.context = SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled, TraceState: parent.TraceState}
+		span.parentID = parent.SpanID
+	} else {
+		span.context.TraceID = newTraceID()
+		span.context.Sampled = t.sample(span.context.TraceID)
+	}
+	span.context.SpanID = newSpanID()
+	return context.WithValue(r.Context(), spanKey{}, span), span
+}
+
+//sample decides whether a trace begun by the gateway is recorded. The decision
+//is made from the random part of the trace ID, so it is the same for every
+//gateway that sees the trace.
+func (t *Tracer) sample(id TraceID) bool {
+	if t.SampleRate >= 1 {
+		return true
+	}
+	if t.SampleRate <= 0 {
+		return false
+	}
+	return binary.BigEndian.Uint64(id[8:]) < uint64(t.SampleRate*math.MaxUint64)
+}
+
+//Start begins a span of work within the gateway as part of the
+//current span of the context, returning a context with the new span
+//as its current span. If the context has no span, the work is not traced.
+func Start(ctx context.Context, name string) (context.Context, *Span) {
+	return start(ctx, name, KindInternal)
+}
+
+//StartClient begins a span of a request to another service, as Start does
+func StartClient(ctx context.Context, name string) (context.Context, *Span) {
+	return start(ctx, name, KindClient)
+}
+
+func start(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	parent := FromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := &Span{
+		tracer:   parent.tracer,
+		context:  parent.context,
+		parentID: parent.context.SpanID,
+		name:     name,
+		kind:     kind,
+		start:    time.Now(),
+	}
+	span.context.SpanID = newSpanID()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+//Context returns the span context to pass on to other services
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+//IsRecording reports whether the span will be exported once it ends
+func (s *Span) IsRecording() bool {
+	return s != nil && s.context.Sampled && s.tracer.Exporter != nil
+}
+
+//SetAttribute adds an attribute describing the work, which may be a
+//string, bool, integer or float
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.attributes == nil {
+		s.attributes = map[string]interface{}{}
+	}
+	s.attributes[key] = value
+}
+
+//SetError marks the span as failed with the error, if it is not nil
+func (s *Span) SetError(err error) {
+	if err == nil || !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err.Error()
+}
+
+//End ends the span, exporting it if the trace is being recorded.
+//Only the first call has any effect.
+func (s *Span) End() {
+	if !s.IsRecording() {
+		return
+	}
+	s.mu.Lock()
+	ended := !s.end.IsZero()
+	if !ended {
+		s.end = time.Now()
+	}
+	s.mu.Unlock()
+	if !ended {
+		s.tracer.Exporter.ExportSpan(s)
+	}
+}
@@ -0,0 +1,191 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/my/repo/servers/gateway/tracetest"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	cases := []struct {
+		name     string
+		value    string
+		valid    bool
+		sampled  bool
+		traceID  string
+		parentID string
+	}{
+		{"sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true, true, "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"},
+		{"not sampled", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00", true, false, "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"},
+		{"other flags", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-03", true, true, "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"},
+		{"later version with more fields", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", true, true, "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"},
+		{"version 00 with more fields", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", false, false, "", ""},
+		{"invalid version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false, false, "", ""},
+		{"uppercase", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false, false, "", ""},
+		{"zero trace ID", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false, false, "", ""},
+		{"zero parent ID", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false, false, "", ""},
+		{"short trace ID", "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01", false, false, "", ""},
+		{"empty", "", false, false, "", ""},
+	}
+	for _, c := range cases {
+		sc, ok := ParseTraceparent(c.value)
+		if ok != c.valid {
+			t.Errorf("case %s: expected valid %v but got %v", c.name, c.valid, ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if sc.Sampled != c.sampled || sc.TraceID.String() != c.traceID || sc.SpanID.String() != c.parentID {
+			t.Errorf("case %s: unexpected span context %+v", c.name, sc)
+		}
+	}
+}
+
+func TestPropagation(t *testing.T) {
+	header := http.Header{}
+	header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	header.Add(TracestateHeader, "vendor=a")
+	header.Add(TracestateHeader, "other=b")
+	sc, ok := Extract(header)
+	if !ok || sc.TraceState != "vendor=a,other=b" {
+		t.Fatalf("unexpected span context %+v", sc)
+	}
+
+	out := http.Header{}
+	out.Set(TracestateHeader, "stale=1")
+	Inject(sc, out)
+	if out.Get(TraceparentHeader) != header.Get(TraceparentHeader) || out.Get(TracestateHeader) != "vendor=a,other=b" {
+		t.Errorf("unexpected headers %v", out)
+	}
+	sc.TraceState = ""
+	Inject(sc, out)
+	if len(out.Values(TracestateHeader)) != 0 {
+		t.Errorf("expected the tracestate of another trace to be removed but got %v", out)
+	}
+	// nothing is injected outside of a trace
+	empty := http.Header{}
+	Inject(SpanContext{}, empty)
+	if len(empty) != 0 {
+		t.Errorf("expected no headers but got %v", empty)
+	}
+}
+
+func TestSampling(t *testing.T) {
+	for _, rate := range []float64{0, 0.25, 1} {
+		tracer := NewTracer(nil, rate)
+		sampled := 0
+		for i := 0; i < 4000; i++ {
+			_, span := tracer.StartRequest(httptest.NewRequest("GET", "/", nil), "request")
+			if span.Context().Sampled {
+				sampled++
+			}
+		}
+		if share := float64(sampled) / 4000; share < rate-0.05 || share > rate+0.05 {
+			t.Errorf("rate %v: sampled %v of traces", rate, share)
+		}
+	}
+
+	// the client's decision is followed, whatever the rate
+	tracer := NewTracer(nil, 0)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if _, span := tracer.StartRequest(r, "request"); !span.Context().Sampled {
+		t.Error("expected the trace sampled by the client to be recorded")
+	}
+}
+
+func TestExport(t *testing.T) {
+	collector := tracetest.NewCollector()
+	defer collector.Close()
+	exporter := NewOTLPExporter(collector.URL(), "gateway", time.Hour)
+	defer exporter.Close()
+	tracer := NewTracer(exporter, 1)
+
+	r := httptest.NewRequest("GET", "/v1/users", nil)
+	r.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.Header.Set(TracestateHeader, "vendor=a")
+	ctx, server := tracer.StartRequest(r, "GET /v1/users")
+	server.SetAttribute("http.response.status_code", 200)
+	_, child := StartClient(ctx, "users.Store.GetByID")
+	child.SetAttribute("db.system", "mysql")
+	child.SetAttribute("cached", false)
+	child.SetAttribute("ratio", 0.5)
+	child.SetError(errors.New("connection refused"))
+	child.End()
+	child.End()
+	server.End()
+
+	// work outside of a request is not traced
+	if ctx, span := Start(context.Background(), "background"); span != nil || FromContext(ctx) != nil {
+		t.Error("expected no span outside of a trace")
+	}
+
+	if err := exporter.Flush(); err != nil {
+		t.Fatalf("unexpected error flushing: %v", err)
+	}
+	spans := collector.Spans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans but got %+v", spans)
+	}
+	c, s := spans[0], spans[1]
+	if s.Name != "GET /v1/users" || s.Kind != int(KindServer) || s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		s.ParentSpanID != "00f067aa0ba902b7" || s.TraceState != "vendor=a" || s.Service != "gateway" ||
+		s.Attributes["http.response.status_code"] != int64(200) || len(s.Error) != 0 || s.End < s.Start {
+		t.Errorf("unexpected server span %+v", s)
+	}
+	if c.Name != "users.Store.GetByID" || c.Kind != int(KindClient) || c.TraceID != s.TraceID || c.ParentSpanID != s.SpanID ||
+		c.Attributes["db.system"] != "mysql" || c.Attributes["cached"] != false || c.Attributes["ratio"] != 0.5 ||
+		c.Error != "connection refused" {
+		t.Errorf("unexpected child span %+v", c)
+	}
+
+	// unsampled traces are passed on but not exported
+	r = httptest.NewRequest("GET", "/v1/users", nil)
+	r.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	ctx, server = tracer.StartRequest(r, "GET /v1/users")
+	_, child = Start(ctx, "handler")
+	if child.Context().TraceID != server.Context().TraceID || child.IsRecording() {
+		t.Errorf("unexpected unsampled span %+v", child.Context())
+	}
+	child.End()
+	server.End()
+	exporter.Flush()
+	if len(collector.Spans()) != 2 {
+		t.Errorf("expected unsampled spans not to be exported but got %+v", collector.Spans()[2:])
+	}
+}
+
+func TestExportFailures(t *testing.T) {
+	collector := tracetest.NewCollector()
+	defer collector.Close()
+	exporter := NewOTLPExporter(collector.URL()+"/v1/traces", "gateway", time.Hour)
+	defer exporter.Close()
+	exporter.MaxQueue = 2
+	tracer := NewTracer(exporter, 1)
+
+	collector.SetStatus(http.StatusServiceUnavailable)
+	for i := 0; i < 3; i++ {
+		_, span := tracer.StartRequest(httptest.NewRequest("GET", "/", nil), "request")
+		span.End()
+	}
+	if err := exporter.Flush(); err == nil {
+		t.Error("expected an error from the failing collector")
+	}
+
+	// the spans that failed to send are not sent again, and those over the queue limit were dropped
+	collector.SetStatus(http.StatusOK)
+	_, span := tracer.StartRequest(httptest.NewRequest("GET", "/", nil), "later")
+	span.End()
+	if err := exporter.Flush(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if spans := collector.Spans(); len(spans) != 1 || spans[0].Name != "later" {
+		t.Errorf("unexpected spans %+v", spans)
+	}
+}
@@ -0,0 +1,131 @@
+package upstream
+
+import (
+	"sync"
+	"time"
+)
+
+//BreakerState is the state of the circuit breaker of a Pool
+type BreakerState int32
+
+const (
+	//BreakerClosed lets every request through to the upstream
+	BreakerClosed BreakerState = iota
+	//BreakerOpen turns every request away without trying the upstream
+	BreakerOpen
+	//BreakerHalfOpen lets a single trial request through to the upstream
+	BreakerHalfOpen
+)
+
+func (bs BreakerState) String() string {
+	switch bs {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+//Breaker is a circuit breaker over a whole upstream. Once Threshold requests
+//in a row have failed on every backend tried, requests are turned away at once
+//for Cooldown instead of each waiting on an upstream that is down, after which
+//a single trial request is let through to decide whether to close again.
+type Breaker struct {
+	//Threshold is the number of failed requests in a row that opens the
+	//breaker; the breaker never opens if zero
+	Threshold int
+	//Cooldown is how long the breaker stays open before a trial request is let through
+	Cooldown time.Duration
+	//OnStateChange, if set, is called with the breaker locked whenever its state changes
+	OnStateChange func(from, to BreakerState)
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+//NewBreaker constructs a new closed Breaker
+func NewBreaker(threshold int, cooldown time.Duration) *Breaker {
+	return &Breaker{Threshold: threshold, Cooldown: cooldown}
+}
+
+//State returns the current state of the breaker
+func (br *Breaker) State() BreakerState {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	return br.state
+}
+
+//Allow reports whether a request may be sent to the upstream. Every
+//allowed request must be followed by a call to Record or release.
+func (br *Breaker) Allow() bool {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	switch br.state {
+	case BreakerClosed:
+		return true
+	case BreakerOpen:
+		if time.Since(br.openedAt) < br.Cooldown {
+			return false
+		}
+		br.setState(BreakerHalfOpen)
+	}
+	//only one trial request at a time while half-open
+	if br.trial {
+		return false
+	}
+	br.trial = true
+	return true
+}
+
+//RetryAfter returns how long until the open breaker lets a trial request through
+func (br *Breaker) RetryAfter() time.Duration {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if br.state != BreakerOpen {
+		return 0
+	}
+	return br.Cooldown - time.Since(br.openedAt)
+}
+
+//Record updates the breaker with the outcome of an allowed request
+func (br *Breaker) Record(failed bool) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	br.trial = false
+	if !failed {
+		br.failures = 0
+		br.setState(BreakerClosed)
+		return
+	}
+	br.failures++
+	if br.state == BreakerHalfOpen || (br.Threshold > 0 && br.failures >= br.Threshold) {
+		br.openedAt = time.Now()
+		br.setState(BreakerOpen)
+	}
+}
+
+//release gives up an allowed request that said nothing about the
+//upstream's health, such as one the client cancelled
+func (br *Breaker) release() {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	br.trial = false
+}
+
+//setState changes the state of the breaker; the caller holds br.mu
+func (br *Breaker) setState(state BreakerState) {
+	if br.state == state {
+		return
+	}
+	from := br.state
+	br.state = state
+	if br.OnStateChange != nil {
+		br.OnStateChange(from, state)
+	}
+}
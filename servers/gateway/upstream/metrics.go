@@ -0,0 +1,59 @@
+package upstream
+
+import (
+	"time"
+
+	"github.com/my/repo/servers/gateway/metrics"
+)
+
+//backendDuration measures every attempt to proxy a request to a backend
+var backendDuration = metrics.Default.NewHistogramVec("gateway_upstream_request_duration_seconds",
+	"Time taken by attempts to proxy requests to upstream backends, by upstream, backend and outcome.",
+	metrics.DefaultBuckets, "upstream", "backend", "outcome")
+
+//RegisterMetrics adds gauges of the health of the registry's pools to `m`
+func (reg *Registry) RegisterMetrics(m *metrics.Registry) {
+	m.NewGaugeFunc("gateway_upstream_backend_up",
+		"Whether the upstream backend is passing health checks and not ejected (1) or not (0).",
+		[]string{"upstream", "backend"}, func() []metrics.Sample {
+			samples := []metrics.Sample{}
+			now := time.Now()
+			for _, p := range reg.Pools() {
+				for _, b := range p.Status().Backends {
+					up := 0.0
+					if b.Healthy && (b.EjectedUntil == nil || !now.Before(*b.EjectedUntil)) {
+						up = 1
+					}
+					samples = append(samples, metrics.Sample{LabelValues: []string{p.Name, b.Addr}, Value: up})
+				}
+			}
+			return samples
+		})
+	m.NewGaugeFunc("gateway_upstream_backend_outstanding_requests",
+		"Requests being proxied to the upstream backend.",
+		[]string{"upstream", "backend"}, func() []metrics.Sample {
+			samples := []metrics.Sample{}
+			for _, p := range reg.Pools() {
+				for _, b := range p.Status().Backends {
+					samples = append(samples, metrics.Sample{LabelValues: []string{p.Name, b.Addr}, Value: float64(b.Outstanding)})
+				}
+			}
+			return samples
+		})
+	m.NewGaugeFunc("gateway_upstream_breaker_state",
+		"The state of the upstream's circuit breaker, 1 for the current state and 0 for the others.",
+		[]string{"upstream", "state"}, func() []metrics.Sample {
+			samples := []metrics.Sample{}
+			for _, p := range reg.Pools() {
+				current := p.Breaker.State()
+				for _, state := range []BreakerState{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+					value := 0.0
+					if state == current {
+						value = 1
+					}
+					samples = append(samples, metrics.Sample{LabelValues: []string{p.Name, state.String()}, Value: value})
+				}
+			}
+			return samples
+		})
+}
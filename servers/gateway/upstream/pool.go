@@ -0,0 +1,366 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//ErrNoBackends is returned from Pool.Next when no backend can take requests
+var ErrNoBackends = errors.New("no healthy upstream servers")
+
+//Backend is a server in a Pool
+type Backend struct {
+	//Addr is the host:port of the server
+	Addr string
+	//Weight is the share of requests the Weighted strategy sends the server
+	Weight int
+
+	outstanding int64
+	requests    uint64
+	failed      uint64
+
+	mu sync.Mutex
+	//healthy is false while active health checks are failing
+	healthy        bool
+	checkFailures  int
+	checkSuccesses int
+	//healthySince is when the active health checks last passed again
+	healthySince time.Time
+	//failures counts failed requests in a row
+	failures     int
+	ejectedUntil time.Time
+}
+
+//Outstanding returns the number of requests to the backend in progress
+func (b *Backend) Outstanding() int64 {
+	return atomic.LoadInt64(&b.outstanding)
+}
+
+//available reports whether the backend can take requests; the caller holds b.mu
+func (b *Backend) available(now time.Time) bool {
+	return b.healthy && !now.Before(b.ejectedUntil)
+}
+
+//warmth returns how far through its slow start the backend is, from 0
+//when it has just become available to 1 once it takes its full share
+func (b *Backend) warmth(now time.Time, slowStart time.Duration) float64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.available(now) {
+		return 0
+	}
+	up := b.healthySince
+	if b.ejectedUntil.After(up) {
+		up = b.ejectedUntil
+	}
+	if slowStart <= 0 || up.IsZero() || now.Sub(up) >= slowStart {
+		return 1
+	}
+	return float64(now.Sub(up)) / float64(slowStart)
+}
+
+//HealthCheck describes the active health checks of a Pool
+type HealthCheck struct {
+	//Path requested from each backend; healthy backends answer with a 2xx or 3xx status
+	Path string
+	//Interval between checks
+	Interval time.Duration
+	//Timeout of each check; Interval if zero
+	Timeout time.Duration
+	//HealthyThreshold is the number of checks in a row that must
+	//pass before an unhealthy backend is sent requests again
+	HealthyThreshold int
+	//UnhealthyThreshold is the number of checks in a row that must
+	//fail before a backend stops being sent requests
+	UnhealthyThreshold int
+}
+
+//Pool spreads requests over a set of backends, skipping backends that fail
+//active health checks or that are ejected after failing too many requests in
+//a row. Backends coming back into service are eased in over SlowStart.
+type Pool struct {
+	//Name of the upstream the pool serves
+	Name string
+	//Strategy choosing between available backends
+	Strategy Strategy
+	//Scheme used to reach the backends, "http" or "https"
+	Scheme string
+	//TLSConfig used to reach the backends over https, which may hold
+	//a client certificate so the backends can authenticate the gateway
+	TLSConfig *tls.Config
+	//MaxFails is the number of failed requests in a row that ejects a backend;
+	//backends are never ejected if zero
+	MaxFails int
+	//EjectFor is how long an ejected backend is sent no requests
+	EjectFor time.Duration
+	//SlowStart is how long a backend coming back into service
+	//takes to ramp up to its full share of requests
+	SlowStart time.Duration
+	//Client used for active health checks
+	Client *http.Client
+	//Breaker turns requests away while the whole upstream is failing
+	Breaker *Breaker
+
+	backends []*Backend
+	check    *HealthCheck
+	closed   int32
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+//NewPool constructs a new Pool over the backends, which all start out healthy
+func NewPool(name string, backends []*Backend, strategy Strategy) *Pool {
+	for _, b := range backends {
+		b.healthy = true
+		if b.Weight <= 0 {
+			b.Weight = 1
+		}
+	}
+	breaker := NewBreaker(10, 10*time.Second)
+	breaker.OnStateChange = func(from, to BreakerState) {
+		log.Printf("upstream %s: circuit breaker %s", name, to)
+	}
+	return &Pool{
+		Name:      name,
+		Strategy:  strategy,
+		Scheme:    "http",
+		MaxFails:  5,
+		EjectFor:  30 * time.Second,
+		SlowStart: 30 * time.Second,
+		Client:    &http.Client{},
+		Breaker:   breaker,
+		backends:  backends,
+		done:      make(chan struct{}),
+	}
+}
+
+//Backends returns the backends of the pool
+func (p *Pool) Backends() []*Backend {
+	return p.backends
+}
+
+//Next chooses the backend for a request, other than any of the backends
+//to exclude. Backends still in slow start are only offered to the Strategy
+//for their current share of requests.
+func (p *Pool) Next(exclude ...*Backend) (*Backend, error) {
+	now := time.Now()
+	candidates := make([]*Backend, 0, len(p.backends))
+	available := make([]*Backend, 0, len(p.backends))
+next:
+	for _, b := range p.backends {
+		for _, excluded := range exclude {
+			if b == excluded {
+				continue next
+			}
+		}
+		warmth := b.warmth(now, p.SlowStart)
+		if warmth <= 0 {
+			continue
+		}
+		available = append(available, b)
+		if warmth >= 1 || rand.Float64() < warmth {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		//every available backend is warming up and was passed over
+		candidates = available
+	}
+	if len(candidates) == 0 {
+		return nil, ErrNoBackends
+	}
+	return p.Strategy.Pick(candidates), nil
+}
+
+//Begin records that a request to the backend has started
+func (p *Pool) Begin(b *Backend) {
+	atomic.AddInt64(&b.outstanding, 1)
+	atomic.AddUint64(&b.requests, 1)
+}
+
+//Done records that a request to the backend has finished, ejecting
+//the backend if it has failed MaxFails requests in a row
+func (p *Pool) Done(b *Backend, failed bool) {
+	atomic.AddInt64(&b.outstanding, -1)
+	if failed {
+		atomic.AddUint64(&b.failed, 1)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if p.MaxFails > 0 && b.failures >= p.MaxFails {
+		b.failures = 0
+		b.ejectedUntil = time.Now().Add(p.EjectFor)
+		log.Printf("upstream %s: ejected %s for %v after %d failed requests", p.Name, b.Addr, p.EjectFor, p.MaxFails)
+	}
+}
+
+//StartHealthChecks checks the health of every backend as described
+//by `check` in the background, until the pool is closed
+func (p *Pool) StartHealthChecks(check HealthCheck) {
+	if check.HealthyThreshold <= 0 {
+		check.HealthyThreshold = 1
+	}
+	if check.UnhealthyThreshold <= 0 {
+		check.UnhealthyThreshold = 1
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = check.Interval
+	}
+	p.check = &check
+	if p.TLSConfig != nil && p.Client.Transport == nil {
+		p.Client = &http.Client{Transport: &http.Transport{TLSClientConfig: p.TLSConfig}}
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(check.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.checkAll()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+//checkAll checks the health of every backend at once
+func (p *Pool) checkAll() {
+	var wg sync.WaitGroup
+	for _, b := range p.backends {
+		wg.Add(1)
+		go func(b *Backend) {
+			defer wg.Done()
+			p.recordCheck(b, p.checkBackend(b))
+		}(b)
+	}
+	wg.Wait()
+}
+
+//checkBackend requests the health check path from the backend
+func (p *Pool) checkBackend(b *Backend) bool {
+	req, err := http.NewRequest("GET", p.Scheme+"://"+b.Addr+p.check.Path, nil)
+	if err != nil {
+		return false
+	}
+	client := *p.Client
+	client.Timeout = p.check.Timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 400
+}
+
+//recordCheck updates the health of the backend with the result of a check
+func (p *Pool) recordCheck(b *Backend, passed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if passed {
+		b.checkFailures = 0
+		b.checkSuccesses++
+		if !b.healthy && b.checkSuccesses >= p.check.HealthyThreshold {
+			b.healthy = true
+			b.healthySince = time.Now()
+			log.Printf("upstream %s: %s is healthy", p.Name, b.Addr)
+		}
+		return
+	}
+	b.checkSuccesses = 0
+	b.checkFailures++
+	if b.healthy && b.checkFailures >= p.check.UnhealthyThreshold {
+		b.healthy = false
+		log.Printf("upstream %s: %s is unhealthy", p.Name, b.Addr)
+	}
+}
+
+//Check reports why the pool cannot serve requests, if it cannot: its breaker is
+//open, none of its backends is available, or none of the available backends
+//answers its health check path, or accepts a connection if the pool has no
+//health checks. The available backends are tried at once, until ctx is done.
+func (p *Pool) Check(ctx context.Context) error {
+	if p.Breaker.State() == BreakerOpen {
+		return errors.New("circuit breaker is open")
+	}
+	now := time.Now()
+	available := make([]*Backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		b.mu.Lock()
+		if b.available(now) {
+			available = append(available, b)
+		}
+		b.mu.Unlock()
+	}
+	if len(available) == 0 {
+		return ErrNoBackends
+	}
+	results := make(chan error, len(available))
+	for _, b := range available {
+		go func(b *Backend) {
+			results <- p.probe(ctx, b)
+		}(b)
+	}
+	var err error
+	for range available {
+		if err = <-results; err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+//probe requests the health check path from the backend,
+//or connects to it if the pool has no health checks
+func (p *Pool) probe(ctx context.Context, b *Backend) error {
+	if p.check == nil {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", b.Addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	req, err := http.NewRequest("GET", p.Scheme+"://"+b.Addr+p.check.Path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("%s answered its health check with %d", b.Addr, resp.StatusCode)
+	}
+	return nil
+}
+
+//Close stops the health checks of the pool
+func (p *Pool) Close() error {
+	if atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		close(p.done)
+		p.wg.Wait()
+	}
+	return nil
+}
+
+//Closed reports whether the pool has been closed
+func (p *Pool) Closed() bool {
+	return atomic.LoadInt32(&p.closed) == 1
+}
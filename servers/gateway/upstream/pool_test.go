@@ -0,0 +1,278 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//testBackend is a stand-in upstream server whose health and
+//responses can be switched while the test runs
+type testBackend struct {
+	*httptest.Server
+	healthy int32
+	failing int32
+	hits    int64
+}
+
+func newTestBackend(name string) *testBackend {
+	tb := &testBackend{healthy: 1}
+	tb.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			if atomic.LoadInt32(&tb.healthy) == 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+			}
+			return
+		}
+		atomic.AddInt64(&tb.hits, 1)
+		if atomic.LoadInt32(&tb.failing) == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(name))
+	}))
+	return tb
+}
+
+func (tb *testBackend) addr() string {
+	return strings.TrimPrefix(tb.URL, "http://")
+}
+
+//newTestPool starts a backend stand-in for each name and pools them round-robin
+func newTestPool(names ...string) (*Pool, []*testBackend) {
+	servers := []*testBackend{}
+	backends := []*Backend{}
+	for _, name := range names {
+		tb := newTestBackend(name)
+		servers = append(servers, tb)
+		backends = append(backends, &Backend{Addr: tb.addr()})
+	}
+	return NewPool("test", backends, &RoundRobin{}), servers
+}
+
+func get(handler http.Handler) *httptest.ResponseRecorder {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/dashboards", nil))
+	return rr
+}
+
+func TestProxyRoundRobin(t *testing.T) {
+	pool, servers := newTestPool("a", "b")
+	defer servers[0].Close()
+	defer servers[1].Close()
+	proxy := NewProxy(pool)
+	defer proxy.Close()
+
+	for i, expected := range []string{"a", "b", "a", "b"} {
+		rr := get(proxy)
+		if rr.Code != http.StatusOK || rr.Body.String() != expected {
+			t.Errorf("request %d: expected %q but got %d %q", i, expected, rr.Code, rr.Body.String())
+		}
+	}
+	for _, b := range pool.Backends() {
+		if b.Outstanding() != 0 {
+			t.Errorf("%s has %d requests outstanding after they all finished", b.Addr, b.Outstanding())
+		}
+	}
+}
+
+func TestPassiveEjection(t *testing.T) {
+	pool, servers := newTestPool("a", "b")
+	defer servers[0].Close()
+	defer servers[1].Close()
+	pool.MaxFails = 2
+	pool.EjectFor = 50 * time.Millisecond
+	pool.SlowStart = 0
+	proxy := NewProxy(pool)
+	defer proxy.Close()
+
+	atomic.StoreInt32(&servers[0].failing, 1)
+	for i := 0; i < 4; i++ {
+		get(proxy)
+	}
+	hits := atomic.LoadInt64(&servers[0].hits)
+	if hits != 2 {
+		t.Fatalf("expected the failing backend to be hit MaxFails times but it was hit %d times", hits)
+	}
+	for i := 0; i < 4; i++ {
+		if rr := get(proxy); rr.Body.String() != "b" {
+			t.Errorf("request sent to the ejected backend: %d %q", rr.Code, rr.Body.String())
+		}
+	}
+	if status := pool.Status(); status.Backends[0].EjectedUntil == nil {
+		t.Error("ejected backend not shown as ejected in the pool status")
+	}
+
+	//the backend is sent requests again once the ejection is over
+	atomic.StoreInt32(&servers[0].failing, 0)
+	time.Sleep(60 * time.Millisecond)
+	bodies := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		bodies[get(proxy).Body.String()] = true
+	}
+	if !bodies["a"] {
+		t.Error("backend never returned to service after its ejection")
+	}
+}
+
+func TestActiveHealthChecks(t *testing.T) {
+	pool, servers := newTestPool("a", "b")
+	defer servers[0].Close()
+	defer servers[1].Close()
+	pool.SlowStart = 0
+	pool.StartHealthChecks(HealthCheck{Path: "/health", Interval: 5 * time.Millisecond, HealthyThreshold: 2, UnhealthyThreshold: 2})
+	proxy := NewProxy(pool)
+	defer proxy.Close()
+
+	waitFor := func(healthy bool) {
+		deadline := time.Now().Add(2 * time.Second)
+		for pool.Status().Backends[0].Healthy != healthy {
+			if time.Now().After(deadline) {
+				t.Fatalf("backend never marked healthy=%v", healthy)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	atomic.StoreInt32(&servers[0].healthy, 0)
+	waitFor(false)
+	for i := 0; i < 4; i++ {
+		if rr := get(proxy); rr.Body.String() != "b" {
+			t.Errorf("request sent to the unhealthy backend: %d %q", rr.Code, rr.Body.String())
+		}
+	}
+
+	atomic.StoreInt32(&servers[0].healthy, 1)
+	waitFor(true)
+
+	//with every backend down there is nothing to send requests to
+	atomic.StoreInt32(&servers[0].healthy, 0)
+	atomic.StoreInt32(&servers[1].healthy, 0)
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := pool.Next(); err == ErrNoBackends {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected ErrNoBackends with every backend failing its health checks")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if rr := get(proxy); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 with no healthy backends but got %d", rr.Code)
+	}
+
+	pool.Close()
+	if !pool.Closed() {
+		t.Error("pool not closed")
+	}
+}
+
+func TestSlowStart(t *testing.T) {
+	pool := NewPool("test", newBackends(1, 1), &RoundRobin{})
+	pool.SlowStart = time.Hour
+	recovering := pool.Backends()[0]
+	recovering.healthySince = time.Now().Add(-6 * time.Minute)
+
+	counts := map[*Backend]int{}
+	for i := 0; i < 2000; i++ {
+		b, err := pool.Next()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		counts[b]++
+	}
+	//a tenth of the way through slow start the backend is a candidate a tenth
+	//of the time, and then picked for about half of those requests
+	if n := counts[recovering]; n < 50 || n > 150 {
+		t.Errorf("expected about 100 of 2000 requests sent to the backend in slow start but got %d", n)
+	}
+	if warmth := pool.Status().Backends[0].Warmth; warmth < 0.09 || warmth > 0.11 {
+		t.Errorf("expected warmth of about 0.1 but got %v", warmth)
+	}
+
+	//a backend that is the only one available is not starved
+	pool.Backends()[1].healthy = false
+	if b, err := pool.Next(); err != nil || b != recovering {
+		t.Errorf("expected the only available backend but got %v, %v", b, err)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	reg := &Registry{}
+	first := NewPool("first", newBackends(1), &RoundRobin{})
+	second := NewPool("second", newBackends(2, 1), &Weighted{})
+	reg.Add(second)
+	reg.Add(first)
+
+	rr := httptest.NewRecorder()
+	reg.ServeHTTP(rr, httptest.NewRequest("GET", "/upstreams", nil))
+	if ctype := rr.Header().Get("Content-Type"); ctype != "application/json" {
+		t.Errorf("incorrect content type %q", ctype)
+	}
+	statuses := []PoolStatus{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &statuses); err != nil {
+		t.Fatalf("error decoding status: %v", err)
+	}
+	if len(statuses) != 2 || statuses[0].Name != "first" || statuses[1].Strategy != "weighted" ||
+		len(statuses[1].Backends) != 2 || statuses[1].Backends[0].Weight != 2 || !statuses[1].Backends[1].Healthy {
+		t.Errorf("incorrect status %+v", statuses)
+	}
+
+	first.Close()
+	if pools := reg.Pools(); len(pools) != 1 || pools[0] != second {
+		t.Errorf("closed pool still registered: %v", pools)
+	}
+}
+
+func TestPoolCheck(t *testing.T) {
+	pool, servers := newTestPool("a", "b")
+	defer servers[1].Close()
+	check := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		return pool.Check(ctx)
+	}
+	//without health checks a backend accepting connections will do
+	if err := check(); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	//with them one of the backends must pass its health check
+	pool.StartHealthChecks(HealthCheck{Path: "/health", Interval: time.Hour})
+	defer pool.Close()
+	atomic.StoreInt32(&servers[0].healthy, 0)
+	if err := check(); err != nil {
+		t.Errorf("unexpected error with one backend healthy %v", err)
+	}
+	atomic.StoreInt32(&servers[1].healthy, 0)
+	if err := check(); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("expected the failed health check but got %v", err)
+	}
+	servers[0].Close()
+	atomic.StoreInt32(&servers[1].healthy, 1)
+	if err := check(); err != nil {
+		t.Errorf("unexpected error with one backend up %v", err)
+	}
+
+	//backends that are ejected are not tried at all
+	pool.MaxFails = 1
+	for _, b := range pool.Backends() {
+		pool.Begin(b)
+		pool.Done(b, true)
+	}
+	if err := check(); err != ErrNoBackends {
+		t.Errorf("expected ErrNoBackends with every backend ejected but got %v", err)
+	}
+
+	pool.Breaker = NewBreaker(1, time.Hour)
+	pool.Breaker.Allow()
+	pool.Breaker.Record(true)
+	if err := check(); err == nil || !strings.Contains(err.Error(), "breaker") {
+		t.Errorf("expected the open breaker but got %v", err)
+	}
+}
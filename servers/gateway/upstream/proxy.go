@@ -0,0 +1,273 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"time"
+
+	"github.com/my/repo/servers/gateway/logging"
+	"github.com/my/repo/servers/gateway/problem"
+	"github.com/my/repo/servers/gateway/tracing"
+)
+
+//attemptKey is the request context key of the attempt being proxied
+type attemptKey struct{}
+
+//attempt is a request being sent to a backend
+type attempt struct {
+	backend *Backend
+	status  int
+	err     error
+}
+
+//failure describes why the attempt failed
+func (a *attempt) failure() error {
+	switch {
+	case a.err != nil:
+		return a.err
+	case a.status != 0:
+		return fmt.Errorf("backend responded with status %d", a.status)
+	}
+	return errors.New("response from backend cut off")
+}
+
+//idempotentMethods are the methods that may be retried on another backend
+var idempotentMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"PUT":     true,
+	"DELETE":  true,
+}
+
+//ProxyError is the body of the responses the Proxy
+//sends when it could not get one from the upstream
+type ProxyError struct {
+	problem.Problem
+	Upstream string `json:"upstream"`
+	//Attempts is the number of backends the request was sent to
+	Attempts int `json:"attempts"`
+}
+
+//Proxy is a reverse proxy sending each request to a backend chosen by a Pool.
+//Requests with idempotent methods whose backend cannot be reached are retried
+//on another backend, and requests are turned away at once while the breaker
+//of the pool is open.
+type Proxy struct {
+	Pool *Pool
+	//Transport used to reach the backends, which sets their connect and response timeouts
+	Transport *http.Transport
+	//Retries is the number of other backends a failed idempotent request is retried on
+	Retries int
+	//MaxRetryBody is the largest request body kept to be sent again
+	//on retries; requests with larger bodies are never retried
+	MaxRetryBody int64
+
+	proxy *httputil.ReverseProxy
+}
+
+//NewProxy constructs a new Proxy over the pool, reaching
+//the backends with the pool's Scheme and TLSConfig
+func NewProxy(pool *Pool) *Proxy {
+	p := &Proxy{
+		Pool: pool,
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   5 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConnsPerHost:   32,
+			IdleConnTimeout:       90 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+			TLSClientConfig:       pool.TLSConfig,
+		},
+		Retries:      2,
+		MaxRetryBody: 1 << 20,
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Director:       p.direct,
+		Transport:      p.Transport,
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler:   p.handleError,
+	}
+	return p
+}
+
+//ServeHTTP forwards the request to the next backend of the pool, retrying
+//idempotent requests on other backends when a backend cannot be reached
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	breaker := p.Pool.Breaker
+	if !breaker.Allow() {
+		w.Header().Set("Retry-After", strconv.Itoa(int(breaker.RetryAfter()/time.Second)+1))
+		p.writeError(w, r, http.StatusServiceUnavailable, problem.CodeUnavailable, "upstream is unavailable", 0)
+		return
+	}
+	//the breaker hears about every request, even one that panics on an aborted response
+	failed, cancelled := true, false
+	defer func() {
+		if cancelled {
+			breaker.release()
+		} else {
+			breaker.Record(failed)
+		}
+	}()
+
+	body, replayable, err := p.bufferBody(r)
+	if err != nil {
+		cancelled = true
+		p.writeError(w, r, http.StatusBadRequest, problem.CodeInvalidRequest, "error reading request body", 0)
+		return
+	}
+	tried := []*Backend{}
+	var last *attempt
+	for {
+		backend, err := p.Pool.Next(tried...)
+		if err != nil {
+			if last == nil {
+				logging.FromContext(r.Context()).Printf("upstream %s: %v", p.Pool.Name, err)
+				p.writeError(w, r, http.StatusServiceUnavailable, problem.CodeUnavailable, "upstream is unavailable", 0)
+				return
+			}
+			break
+		}
+		tried = append(tried, backend)
+		logging.Annotate(r.Context(), "upstream", p.Pool.Name)
+		logging.Annotate(r.Context(), "backend", backend.Addr)
+		logging.Annotate(r.Context(), "attempts", len(tried))
+		if replayable {
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		last = p.try(w, r, backend)
+		if last.err == nil {
+			failed = last.status >= 500
+			return
+		}
+		if r.Context().Err() != nil {
+			break
+		}
+		if !replayable || !idempotentMethods[r.Method] || len(tried) > p.Retries {
+			break
+		}
+		logging.FromContext(r.Context()).Printf("upstream %s: retrying %s %s after error from %s: %v", p.Pool.Name, r.Method, r.URL.Path, backend.Addr, last.err)
+	}
+
+	switch {
+	case r.Context().Err() == context.Canceled:
+		//the client has gone away, and there is no one to tell
+		cancelled = true
+	case r.Context().Err() == context.DeadlineExceeded || isTimeout(last.err):
+		p.writeError(w, r, http.StatusGatewayTimeout, problem.CodeUpstreamTimeout, "upstream timed out", len(tried))
+	default:
+		p.writeError(w, r, http.StatusBadGateway, problem.CodeUpstreamUnreachable, "upstream could not be reached", len(tried))
+	}
+}
+
+//try sends the request to the backend
+func (p *Proxy) try(w http.ResponseWriter, r *http.Request, backend *Backend) *attempt {
+	a := &attempt{backend: backend}
+	ctx, span := tracing.StartClient(r.Context(), "proxy "+p.Pool.Name)
+	span.SetAttribute("server.address", backend.Addr)
+	start := time.Now()
+	p.Pool.Begin(backend)
+	//the backend is blamed unless the attempt returns normally, as it does not
+	//when the response is aborted because the backend went away part way through
+	returned := false
+	defer func() {
+		failed := !returned || (a.err != nil && r.Context().Err() != context.Canceled) || a.status >= 500
+		p.Pool.Done(backend, failed)
+		outcome := "success"
+		if failed {
+			outcome = "failure"
+		}
+		backendDuration.With(p.Pool.Name, backend.Addr, outcome).Observe(time.Since(start).Seconds())
+		if a.status != 0 {
+			span.SetAttribute("http.response.status_code", a.status)
+		}
+		if failed {
+			span.SetError(a.failure())
+		}
+		span.End()
+	}()
+	p.proxy.ServeHTTP(w, r.WithContext(context.WithValue(ctx, attemptKey{}, a)))
+	returned = true
+	return a
+}
+
+//bufferBody reads the body of an idempotent request so it can be sent again on
+//retries, reporting whether it could be. Bodies larger than MaxRetryBody are
+//left to be streamed to the one backend.
+func (p *Proxy) bufferBody(r *http.Request) ([]byte, bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if !idempotentMethods[r.Method] || r.ContentLength > p.MaxRetryBody {
+		return nil, false, nil
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, p.MaxRetryBody+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > p.MaxRetryBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		return nil, false, nil
+	}
+	r.Body.Close()
+	return body, true, nil
+}
+
+//Close stops the health checks of the pool
+func (p *Proxy) Close() error {
+	p.Transport.CloseIdleConnections()
+	return p.Pool.Close()
+}
+
+//direct points the outgoing request at the chosen backend
+func (p *Proxy) direct(r *http.Request) {
+	a := r.Context().Value(attemptKey{}).(*attempt)
+	r.Host = a.backend.Addr
+	r.URL.Host = a.backend.Addr
+	r.URL.Scheme = p.Pool.Scheme
+	//the upstream's spans are children of the attempt's, or of the client's if the request is not traced
+	tracing.Inject(tracing.FromContext(r.Context()).Context(), r.Header)
+}
+
+//modifyResponse records the status the backend responded with
+func (p *Proxy) modifyResponse(resp *http.Response) error {
+	resp.Request.Context().Value(attemptKey{}).(*attempt).status = resp.StatusCode
+	return nil
+}
+
+//handleError records the failure to get a response from the backend,
+//leaving the response to be written once every retry has failed
+func (p *Proxy) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	a := r.Context().Value(attemptKey{}).(*attempt)
+	a.err = err
+	if r.Context().Err() != context.Canceled {
+		logging.FromContext(r.Context()).Errorf("upstream %s: error proxying to %s: %v", p.Pool.Name, a.backend.Addr, err)
+	}
+}
+
+//writeError responds with a ProxyError
+func (p *Proxy) writeError(w http.ResponseWriter, r *http.Request, status int, code string, detail string, attempts int) {
+	proxyErr := &ProxyError{Problem: *problem.New(status, code, detail), Upstream: p.Pool.Name, Attempts: attempts}
+	problem.WriteExtended(w, r, &proxyErr.Problem, proxyErr)
+}
+
+//isTimeout reports whether the error is a timeout reaching a backend
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
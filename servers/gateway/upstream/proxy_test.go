@@ -0,0 +1,232 @@
+package upstream
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/my/repo/servers/gateway/logging"
+	"github.com/my/repo/servers/gateway/problem"
+)
+
+//resettingBackend accepts connections and resets them straight away
+type resettingBackend struct {
+	net.Listener
+}
+
+func newResettingBackend(t *testing.T) *resettingBackend {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("error listening: %v", err)
+	}
+	rb := &resettingBackend{Listener: l}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	}()
+	return rb
+}
+
+//newHangingBackend starts a backend that never responds to requests
+func newHangingBackend() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+}
+
+//newEchoBackend starts a backend that responds with its name and the request body
+func newEchoBackend(name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write([]byte(name + string(body)))
+	}))
+}
+
+func newProxyOver(addrs ...string) *Proxy {
+	backends := []*Backend{}
+	for _, addr := range addrs {
+		backends = append(backends, &Backend{Addr: strings.TrimPrefix(addr, "http://")})
+	}
+	pool := NewPool("test", backends, &RoundRobin{})
+	pool.MaxFails = 0
+	pool.SlowStart = 0
+	return NewProxy(pool)
+}
+
+//serve sends a request through the handler, decoding the body as a ProxyError if it is a problem
+func serve(handler http.Handler, method string, body string) (*httptest.ResponseRecorder, *ProxyError) {
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(method, "/v1/dashboards", strings.NewReader(body)))
+	if rr.Header().Get("Content-Type") != problem.ContentType {
+		return rr, nil
+	}
+	proxyErr := &ProxyError{}
+	json.Unmarshal(rr.Body.Bytes(), proxyErr)
+	return rr, proxyErr
+}
+
+func TestProxyRetries(t *testing.T) {
+	reset := newResettingBackend(t)
+	defer reset.Close()
+	echo := newEchoBackend("echo")
+	defer echo.Close()
+
+	cases := []struct {
+		name             string
+		method           string
+		body             string
+		maxRetryBody     int64
+		expectedStatus   int
+		expectedBody     string
+		expectedAttempts int
+	}{
+		{"GET retried on another backend", "GET", "", 1024, http.StatusOK, "echo", 0},
+		{"PUT retried with its body", "PUT", "body", 1024, http.StatusOK, "echobody", 0},
+		{"POST not retried", "POST", "body", 1024, http.StatusBadGateway, "", 1},
+		{"PUT with a body too large to keep not retried", "PUT", "body", 2, http.StatusBadGateway, "", 1},
+	}
+	for _, c := range cases {
+		//the resetting backend is always tried first
+		proxy := newProxyOver(reset.Addr().String(), echo.URL)
+		proxy.MaxRetryBody = c.maxRetryBody
+		rr, proxyErr := serve(proxy, c.method, c.body)
+		if rr.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d", c.name, c.expectedStatus, rr.Code)
+		}
+		if len(c.expectedBody) != 0 && rr.Body.String() != c.expectedBody {
+			t.Errorf("case %s: expected %q but got %q", c.name, c.expectedBody, rr.Body.String())
+		}
+		if c.expectedAttempts != 0 && (proxyErr == nil || proxyErr.Attempts != c.expectedAttempts || proxyErr.Upstream != "test") {
+			t.Errorf("case %s: expected JSON error after %d attempts but got %q", c.name, c.expectedAttempts, rr.Body.String())
+		}
+		proxy.Close()
+	}
+
+	//every backend failing is reported once retries run out
+	reset2 := newResettingBackend(t)
+	defer reset2.Close()
+	proxy := newProxyOver(reset.Addr().String(), reset2.Addr().String())
+	defer proxy.Close()
+	rr, proxyErr := serve(proxy, "GET", "")
+	if rr.Code != http.StatusBadGateway || proxyErr == nil || proxyErr.Attempts != 2 || len(proxyErr.Detail) == 0 {
+		t.Errorf("expected JSON 502 after trying both backends but got %d %q", rr.Code, rr.Body.String())
+	}
+
+	//the backend that finally served the request goes in the access log
+	retried := newProxyOver(reset.Addr().String(), echo.URL)
+	defer retried.Close()
+	ctx, annotations := logging.WithAnnotations(context.Background())
+	retried.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/v1/dashboards", nil).WithContext(ctx))
+	fields := annotations()
+	if fields["upstream"] != "test" || fields["backend"] != strings.TrimPrefix(echo.URL, "http://") || fields["attempts"] != 2 {
+		t.Errorf("unexpected annotations %v", fields)
+	}
+}
+
+func TestProxyTimeouts(t *testing.T) {
+	hanging := newHangingBackend()
+	defer hanging.Close()
+	echo := newEchoBackend("echo")
+	defer echo.Close()
+
+	//a backend that hangs before responding times out, and the request is tried elsewhere
+	proxy := newProxyOver(hanging.URL, echo.URL)
+	proxy.Transport.ResponseHeaderTimeout = 20 * time.Millisecond
+	if rr, _ := serve(proxy, "GET", ""); rr.Code != http.StatusOK || rr.Body.String() != "echo" {
+		t.Errorf("expected the request retried after the response timeout but got %d %q", rr.Code, rr.Body.String())
+	}
+	proxy.Close()
+
+	proxy = newProxyOver(hanging.URL, echo.URL)
+	proxy.Transport.ResponseHeaderTimeout = 20 * time.Millisecond
+	if rr, proxyErr := serve(proxy, "POST", ""); rr.Code != http.StatusGatewayTimeout || proxyErr == nil || proxyErr.Attempts != 1 {
+		t.Errorf("expected JSON 504 without retrying but got %d %q", rr.Code, rr.Body.String())
+	}
+	proxy.Close()
+
+	//the route timeout bounds the whole request, retries included
+	proxy = newProxyOver(hanging.URL, hanging.URL)
+	defer proxy.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	rr := httptest.NewRecorder()
+	proxy.ServeHTTP(rr, httptest.NewRequest("GET", "/v1/dashboards", nil).WithContext(ctx))
+	if rr.Code != http.StatusGatewayTimeout || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("expected 504 once the route timeout passed but got %d %q after %v", rr.Code, rr.Body.String(), time.Since(start))
+	}
+	if state := proxy.Pool.Breaker.State(); state != BreakerClosed {
+		t.Errorf("one timeout opened the breaker: %s", state)
+	}
+}
+
+func TestProxyBreaker(t *testing.T) {
+	server := newTestBackend("a")
+	defer server.Close()
+	atomic.StoreInt32(&server.failing, 1)
+	proxy := newProxyOver(server.URL)
+	defer proxy.Close()
+	proxy.Pool.Breaker.Threshold = 3
+	proxy.Pool.Breaker.Cooldown = 50 * time.Millisecond
+
+	//server errors are passed through until the breaker opens
+	for i := 0; i < 3; i++ {
+		if rr, _ := serve(proxy, "GET", ""); rr.Code != http.StatusInternalServerError {
+			t.Errorf("request %d: expected the backend's 500 but got %d", i, rr.Code)
+		}
+	}
+	rr, proxyErr := serve(proxy, "GET", "")
+	if rr.Code != http.StatusServiceUnavailable || proxyErr == nil || rr.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected JSON 503 with Retry-After once the breaker opened but got %d %q %q",
+			rr.Code, rr.Header().Get("Retry-After"), rr.Body.String())
+	}
+	if hits := atomic.LoadInt64(&server.hits); hits != 3 {
+		t.Errorf("expected no requests sent while the breaker is open but the backend was hit %d times", hits)
+	}
+	if state := proxy.Pool.Status().Breaker; state != "open" {
+		t.Errorf("expected the status to show the breaker open but got %q", state)
+	}
+
+	//a trial request after the cooldown closes the breaker again once the upstream recovers
+	atomic.StoreInt32(&server.failing, 0)
+	time.Sleep(60 * time.Millisecond)
+	if rr, _ := serve(proxy, "GET", ""); rr.Code != http.StatusOK {
+		t.Errorf("expected the trial request to succeed but got %d", rr.Code)
+	}
+	if state := proxy.Pool.Breaker.State(); state != BreakerClosed {
+		t.Errorf("expected the breaker closed after the trial succeeded but got %s", state)
+	}
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	br := NewBreaker(1, 10*time.Millisecond)
+	br.Allow()
+	br.Record(true)
+	if br.Allow() {
+		t.Error("open breaker allowed a request")
+	}
+	time.Sleep(15 * time.Millisecond)
+	if !br.Allow() || br.State() != BreakerHalfOpen {
+		t.Fatalf("expected a trial request allowed half-open but the breaker is %s", br.State())
+	}
+	if br.Allow() {
+		t.Error("half-open breaker allowed a second request during the trial")
+	}
+	br.Record(true)
+	if br.State() != BreakerOpen {
+		t.Errorf("expected a failed trial to open the breaker again but it is %s", br.State())
+	}
+}
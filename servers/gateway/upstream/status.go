@@ -0,0 +1,101 @@
+package upstream
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//BackendStatus is the state of a backend, as shown on the status endpoint
+type BackendStatus struct {
+	Addr         string     `json:"addr"`
+	Weight       int        `json:"weight"`
+	Healthy      bool       `json:"healthy"`
+	EjectedUntil *time.Time `json:"ejectedUntil,omitempty"`
+	//Warmth is the share of its requests the backend is being sent during slow start
+	Warmth      float64 `json:"warmth"`
+	Outstanding int64   `json:"outstanding"`
+	Requests    uint64  `json:"requests"`
+	Failed      uint64  `json:"failed"`
+}
+
+//PoolStatus is the state of a pool, as shown on the status endpoint
+type PoolStatus struct {
+	Name     string          `json:"name"`
+	Strategy string          `json:"strategy"`
+	Breaker  string          `json:"breaker"`
+	Backends []BackendStatus `json:"backends"`
+}
+
+//Status returns the current state of the pool and its backends
+func (p *Pool) Status() PoolStatus {
+	now := time.Now()
+	status := PoolStatus{Name: p.Name, Strategy: p.Strategy.Name(), Breaker: p.Breaker.State().String()}
+	for _, b := range p.backends {
+		warmth := b.warmth(now, p.SlowStart)
+		b.mu.Lock()
+		bs := BackendStatus{
+			Addr:        b.Addr,
+			Weight:      b.Weight,
+			Healthy:     b.healthy,
+			Warmth:      warmth,
+			Outstanding: atomic.LoadInt64(&b.outstanding),
+			Requests:    atomic.LoadUint64(&b.requests),
+			Failed:      atomic.LoadUint64(&b.failed),
+		}
+		if now.Before(b.ejectedUntil) {
+			until := b.ejectedUntil
+			bs.EjectedUntil = &until
+		}
+		b.mu.Unlock()
+		status.Backends = append(status.Backends, bs)
+	}
+	return status
+}
+
+//Registry keeps track of the pools in service, so their
+//state can be shown on an internal status endpoint
+type Registry struct {
+	mu    sync.Mutex
+	pools []*Pool
+}
+
+//Add adds the pool to the registry until it is closed
+func (reg *Registry) Add(p *Pool) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.pools = append(reg.pools, p)
+}
+
+//Pools returns the pools in service, sorted by name
+func (reg *Registry) Pools() []*Pool {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	open := reg.pools[:0]
+	for _, p := range reg.pools {
+		if !p.Closed() {
+			open = append(open, p)
+		}
+	}
+	reg.pools = open
+	pools := append([]*Pool{}, open...)
+	sort.Slice(pools, func(i, j int) bool {
+		return pools[i].Name < pools[j].Name
+	})
+	return pools
+}
+
+//ServeHTTP responds with the state of every pool in service as JSON
+func (reg *Registry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	statuses := []PoolStatus{}
+	for _, p := range reg.Pools() {
+		statuses = append(statuses, p.Status())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(statuses)
+}
@@ -0,0 +1,103 @@
+package upstream
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+//Strategy chooses the backend each request is sent to
+type Strategy interface {
+	//Name returns the name the strategy is configured by
+	Name() string
+	//Pick chooses one of the backends, of which there is at least one
+	Pick(backends []*Backend) *Backend
+}
+
+//NewStrategy returns a new instance of the named strategy:
+//"round-robin" (the default when empty), "least-outstanding" or "weighted"
+func NewStrategy(name string) (Strategy, error) {
+	switch name {
+	case "", "round-robin":
+		return &RoundRobin{}, nil
+	case "least-outstanding":
+		return &LeastOutstanding{}, nil
+	case "weighted":
+		return &Weighted{}, nil
+	}
+	return nil, fmt.Errorf("unknown load balancing strategy %q", name)
+}
+
+//RoundRobin sends requests to each backend in turn
+type RoundRobin struct {
+	//counter is unsigned so it wraps around to 0
+	//instead of going negative
+	counter uint64
+}
+
+//Name returns "round-robin"
+func (rr *RoundRobin) Name() string {
+	return "round-robin"
+}
+
+//Pick chooses the next backend in turn
+func (rr *RoundRobin) Pick(backends []*Backend) *Backend {
+	n := atomic.AddUint64(&rr.counter, 1) - 1
+	return backends[n%uint64(len(backends))]
+}
+
+//LeastOutstanding sends requests to the backend with the
+//fewest requests in progress, taking turns between ties
+type LeastOutstanding struct {
+	counter uint64
+}
+
+//Name returns "least-outstanding"
+func (lo *LeastOutstanding) Name() string {
+	return "least-outstanding"
+}
+
+//Pick chooses the backend with the fewest requests in progress
+func (lo *LeastOutstanding) Pick(backends []*Backend) *Backend {
+	start := atomic.AddUint64(&lo.counter, 1) - 1
+	var best *Backend
+	for i := range backends {
+		b := backends[(start+uint64(i))%uint64(len(backends))]
+		if best == nil || b.Outstanding() < best.Outstanding() {
+			best = b
+		}
+	}
+	return best
+}
+
+//Weighted sends requests to backends in proportion to their weights,
+//interleaving them smoothly rather than in bursts
+type Weighted struct {
+	mu      sync.Mutex
+	current map[*Backend]int
+}
+
+//Name returns "weighted"
+func (wt *Weighted) Name() string {
+	return "weighted"
+}
+
+//Pick chooses the backend furthest behind its share of requests
+func (wt *Weighted) Pick(backends []*Backend) *Backend {
+	wt.mu.Lock()
+	defer wt.mu.Unlock()
+	if wt.current == nil {
+		wt.current = map[*Backend]int{}
+	}
+	total := 0
+	var best *Backend
+	for _, b := range backends {
+		wt.current[b] += b.Weight
+		total += b.Weight
+		if best == nil || wt.current[b] > wt.current[best] {
+			best = b
+		}
+	}
+	wt.current[best] -= total
+	return best
+}
@@ -0,0 +1,93 @@
+package upstream
+
+import (
+	"math"
+	"testing"
+)
+
+func newBackends(weights ...int) []*Backend {
+	backends := []*Backend{}
+	for i, weight := range weights {
+		backends = append(backends, &Backend{Addr: string(rune('a' + i)), Weight: weight})
+	}
+	return backends
+}
+
+func TestRoundRobin(t *testing.T) {
+	backends := newBackends(1, 1, 1)
+	rr := &RoundRobin{}
+	for i := 0; i < 6; i++ {
+		if b := rr.Pick(backends); b != backends[i%3] {
+			t.Errorf("pick %d: expected %s but got %s", i, backends[i%3].Addr, b.Addr)
+		}
+	}
+
+	//the counter wraps around instead of going negative and indexing out of range
+	rr.counter = math.MaxUint64
+	rr.Pick(backends)
+	if b := rr.Pick(backends); b != backends[0] {
+		t.Errorf("expected %s after the counter wrapped but got %s", backends[0].Addr, b.Addr)
+	}
+}
+
+func TestLeastOutstanding(t *testing.T) {
+	backends := newBackends(1, 1, 1)
+	backends[0].outstanding = 3
+	backends[1].outstanding = 1
+	backends[2].outstanding = 2
+	lo := &LeastOutstanding{}
+	for i := 0; i < 3; i++ {
+		if b := lo.Pick(backends); b != backends[1] {
+			t.Errorf("expected %s, with the fewest requests in progress, but got %s", backends[1].Addr, b.Addr)
+		}
+	}
+
+	//ties are shared out
+	backends[0].outstanding = 1
+	picked := map[*Backend]bool{}
+	for i := 0; i < 3; i++ {
+		picked[lo.Pick(backends)] = true
+	}
+	if !picked[backends[0]] || !picked[backends[1]] || picked[backends[2]] {
+		t.Errorf("expected picks shared between the tied backends but got %v", picked)
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	backends := newBackends(5, 1, 1)
+	wt := &Weighted{}
+	counts := map[*Backend]int{}
+	run := 0
+	for i := 0; i < 70; i++ {
+		b := wt.Pick(backends)
+		counts[b]++
+		if b == backends[0] {
+			run++
+			if run >= 5 {
+				t.Fatalf("weighted picks are bursty: %s picked %d times in a row", b.Addr, run)
+			}
+		} else {
+			run = 0
+		}
+	}
+	for i, expected := range []int{50, 10, 10} {
+		if counts[backends[i]] != expected {
+			t.Errorf("expected %s picked %d times but got %d", backends[i].Addr, expected, counts[backends[i]])
+		}
+	}
+}
+
+func TestNewStrategy(t *testing.T) {
+	for _, name := range []string{"round-robin", "least-outstanding", "weighted"} {
+		strategy, err := NewStrategy(name)
+		if err != nil || strategy.Name() != name {
+			t.Errorf("error creating strategy %s: %v", name, err)
+		}
+	}
+	if strategy, _ := NewStrategy(""); strategy.Name() != "round-robin" {
+		t.Errorf("expected round-robin by default but got %s", strategy.Name())
+	}
+	if _, err := NewStrategy("random"); err == nil {
+		t.Error("expected error creating unknown strategy")
+	}
+}
@@ -0,0 +1,122 @@
+package upstream
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//testCA issues certificates for the mutual TLS test
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+//issue returns a certificate for the server or client named
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestProxyMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" {
+			return
+		}
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "backend", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+	server.StartTLS()
+	defer server.Close()
+	addr := strings.TrimPrefix(server.URL, "https://")
+
+	cases := []struct {
+		name           string
+		clientCert     bool
+		expectedStatus int
+	}{
+		{"client certificate", true, http.StatusOK},
+		{"no client certificate", false, http.StatusBadGateway},
+	}
+	for _, c := range cases {
+		pool := NewPool("test", []*Backend{{Addr: addr}}, &RoundRobin{})
+		pool.Scheme = "https"
+		pool.TLSConfig = &tls.Config{RootCAs: ca.pool}
+		if c.clientCert {
+			pool.TLSConfig.Certificates = []tls.Certificate{ca.issue(t, "gateway", x509.ExtKeyUsageClientAuth)}
+		}
+		pool.StartHealthChecks(HealthCheck{Path: "/health", Interval: 5 * time.Millisecond})
+		proxy := NewProxy(pool)
+		proxy.Retries = 0
+
+		rr, _ := serve(proxy, "GET", "")
+		if rr.Code != c.expectedStatus {
+			t.Errorf("case %s: expected status %d but got %d %q", c.name, c.expectedStatus, rr.Code, rr.Body.String())
+		}
+		if c.expectedStatus == http.StatusOK && rr.Body.String() != "gateway" {
+			t.Errorf("case %s: backend saw client certificate %q", c.name, rr.Body.String())
+		}
+		//health checks are made over the same mutual TLS
+		time.Sleep(30 * time.Millisecond)
+		if healthy := pool.Status().Backends[0].Healthy; healthy != c.clientCert {
+			t.Errorf("case %s: expected health checks to pass=%v", c.name, c.clientCert)
+		}
+		proxy.Close()
+	}
+}
@@ -10,14 +10,33 @@ export DSN="root:qazwsx@tcp(mysqlContainer:3306)/demo" \
 export SESSIONKEY="akey" \
 export REDDISADDR="redisServer:6379" \
 export ADDR=":443"
+export HTTPADDR=":80"
+# pages allowed to call the API from the browser
+export CORSORIGINS="https://t-mokaramanee.me"
 export DASHBOARDADDR="myDashboardServer:8080"
+# keys of the identity assertions the gateway sends the dashboard service
+export IDENTITYKEYS="/etc/gateway/identity-keys.json"
 export DASHBOARDPORT="8080"
+# the listener services behind the gateway publish live events on, reachable
+# on the private network only, and their credentials, new for each deploy
+export INTROSPECTADDR=":8082"
+export INTROSPECTCREDENTIALS="dashboards:$(openssl rand -hex 32)"
+export LIVEPUBLISHURL="http://gatewayServer:8082/live/publish"
 export MONGO_ENDPOINT="mongodb://customMongoContainer:27017/test"
 
 
 # create private network for everything to be run on
 docker network create network-441
 
+# on the first deploy, create the key the gateway signs identity assertions with,
+# which the dashboard service reads from the same file to verify them; it is kept
+# across deploys so assertions in flight stay valid
+if [ ! -f $IDENTITYKEYS ]; then
+    mkdir -p $(dirname $IDENTITYKEYS)
+    kid=$(date +%Y-%m)
+    (umask 077 && echo "{\"signing\": \"$kid\", \"keys\": [{\"kid\": \"$kid\", \"alg\": \"HS256\", \"secret\": \"$(openssl rand -base64 32)\"}]}" > $IDENTITYKEYS)
+fi
+
 # run redis
 docker rm -f redisServer
 
@@ -52,26 +71,37 @@ docker rm -f myDashboardServer
 docker pull towm1204/dashboardservice
 
 docker run -d --name myDashboardServer \
+-v /etc/gateway:/etc/gateway:ro \
 -e MONGO_ENDPOINT=$MONGO_ENDPOINT \
+-e IDENTITYKEYS=$IDENTITYKEYS \
 -e DASHBOARDPORT=$DASHBOARDPORT \
+-e LIVEPUBLISHURL=$LIVEPUBLISHURL \
+-e LIVEPUBLISHCREDENTIALS=$INTROSPECTCREDENTIALS \
 --network network-441 towm1204/dashboardservice
 
 
 
-# remove last one and pull image
+# stop last one, letting it finish requests in flight, and pull image
+docker stop --time 35 gatewayServer
 docker rm -f gatewayServer
 docker pull towm1204/mygateway
 
 # docker run, mounting cert, open port, env variables
 docker run -d \
 -v /etc/letsencrypt:/etc/letsencrypt:ro \
---name gatewayServer -p 443:443 \
+-v /etc/gateway:/etc/gateway:ro \
+--name gatewayServer -p 443:443 -p 80:80 \
 -e TLSCERT=$TLSCERT \
 -e TLSKEY=$TLSKEY \
 -e DSN=$DSN \
 -e SESSIONKEY=$SESSIONKEY \
 -e ADDR=$ADDR \
+-e HTTPADDR=$HTTPADDR \
+-e CORSORIGINS=$CORSORIGINS \
 -e DASHBOARDADDR=$DASHBOARDADDR \
 -e REDDISADDR=$REDDISADDR \
+-e IDENTITYKEYS=$IDENTITYKEYS \
+-e INTROSPECTADDR=$INTROSPECTADDR \
+-e INTROSPECTCREDENTIALS=$INTROSPECTCREDENTIALS \
 --network network-441 \
 towm1204/mygateway
\ No newline at end of file